@@ -6,9 +6,17 @@ package cmd
 import (
 	"dbackupcli/cmd/commons"
 	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/couchdb"
+	"dbackupcli/cmd/struct/manifest"
+	"dbackupcli/cmd/struct/report"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -18,58 +26,283 @@ var backupCmd = &cobra.Command{
 	Use:   "backup",
 	Short: "Operates a backup of a database on CouchDB",
 	Long:  `Operates a backup of the specified database on a certain CouchDB.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		tmpFile, err := scripts.GetEmbeddedScripts()
-		defer os.Remove(tmpFile)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
+	RunE: func(cmd *cobra.Command, args []string) error {
 		user, host, password, port := commons.GetAuthFlagValues(cmd)
 		file, _ := cmd.Flags().GetString("file")
 		if commons.CheckFlags(append([]string{}, file, user, password, host)) {
-			fmt.Println("missing on or more flags/arguments\n\nCheck using 'dbackupcli backup -h'")
-			os.Exit(1)
+			return commons.MissingFlags("backup")
+		}
+		options := getDumpOptions(cmd)
+		if err := options.validate(); err != nil {
+			slog.Error("invalid flags", "error", err)
+			return err
 		}
 
 		dbsList, err := commons.GetDBs(host, port, user, password)
 		if err != nil {
-			fmt.Println(err)
-			return
+			slog.Error("error listing the databases", "host", host, "error", err)
+			return err
 		}
 
 		var selectedDatabase string
 		if err = commons.SelectDatabase(append(dbsList, "exit"), &selectedDatabase); err != nil {
-			fmt.Println(err)
-			return
+			slog.Error("error selecting the database", "error", err)
+			return err
 		}
 
 		if selectedDatabase == "exit" {
-			os.Exit(0)
+			return nil
 		}
 
-		var cmdArgs []string = []string{"-b", "-d", selectedDatabase}
-		cmdArgs = append(cmdArgs, "-f", file)
+		_, Database, err := commons.GetDB(host, port, user, password, selectedDatabase)
+		if err != nil {
+			slog.Error("error reading the database info", "db", selectedDatabase, "host", host, "error", err)
+			return err
+		}
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			fmt.Fprintln(commons.Out, commons.DryRunBanner)
+			commons.PrintPlan("Backup plan:", []commons.PlanStep{
+				{Name: "Database", Value: selectedDatabase},
+				{Name: "Documents", Value: options.describeDocuments(Database)},
+				{Name: "Selection", Value: commons.DescribeSelection(options.selection)},
+				{Name: "Estimated size", Value: commons.FormatBytes(int64(Database.Sizes.External))},
+				{Name: "Attachments", Value: options.describeAttachments(file)},
+				{Name: "Destination", Value: commons.DescribeFile(file)},
+			})
+			return nil
+		}
+
+		tmpFile, err := scripts.GetEmbeddedScripts()
+		defer os.Remove(tmpFile)
+		if err != nil {
+			slog.Error("error preparing the backup script", "error", err)
+			return err
+		}
+
+		output, err := commons.CreateOutput(file)
+		if err != nil {
+			slog.Error("error preparing the output file", "file", file, "error", err)
+			return err
+		}
+		defer output.Close()
 
 		err = commons.OverWriteFile(file)
 		if err != nil {
-			fmt.Println(err)
-			return
+			slog.Error("error preparing the output file", "file", file, "error", err)
+			return err
 		}
 
+		var cmdArgs []string = []string{"-b", "-d", selectedDatabase}
+		cmdArgs = append(cmdArgs, "-f", output.Partial)
+
 		cmdArgs = commons.PrepareCmdAuthArgs(cmdArgs, user, password, host, port)
-		cmdExec := exec.Command("bash", append([]string{tmpFile}, cmdArgs...)...)
-		cmdExec.Stderr = os.Stderr
-		cmdExec.Stdout = os.Stdout
-		if err := cmdExec.Run(); err != nil {
-			fmt.Println("Error: ", err)
-		} else {
-			fmt.Println("Backup completed successfully!")
+		cmdArgs = append(cmdArgs, options.scriptArgs()...)
+		// The selection is read by the CLI, the progress of the script does not apply
+		progress := commons.ProgressEnabled(cmd) && !commons.SelectionActive(options.selection)
+		if progress {
+			cmdArgs = append(cmdArgs, "-q")
+		}
+		result := report.DatabaseResult{Operation: "backup", Host: host, Database: selectedDatabase, File: file, Documents: Database.DocCount,
+			Stats: commons.DatabaseStats(Database)}
+		started := time.Now()
+		slog.Info("backup started", "db", selectedDatabase, "host", host, "phase", "start", "file", file)
+
+		hooks := commons.GetHooks(cmd, "backup")
+		if err = hooks.Before(result); err == nil {
+			stopProgress := func() {}
+			if progress {
+				p := commons.NewProgress(selectedDatabase, int64(Database.DocCount), int64(Database.Sizes.External))
+				stopProgress = commons.StartProgress(p, commons.FileSampler(output.Partial))
+			}
+			if commons.SelectionActive(options.selection) {
+				slog.Info("selecting the documents", "db", selectedDatabase, "selection", commons.DescribeSelection(options.selection))
+				result.Documents, err = commons.DumpSelection(host, port, user, password, selectedDatabase, options.selection,
+					options.attachments != commons.AttachmentsSeparate, options.withConflicts, output.Partial)
+			} else {
+				err = commons.RunScript(cmd.Context(), tmpFile, cmdArgs)
+			}
+			stopProgress()
+			if err == nil {
+				err = completeDump(&result, output.Partial, host, port, user, password, options)
+			}
+			if err == nil {
+				err = verifyBackup(&result, output.Partial, options)
+			}
+			if err == nil {
+				err = commitBackup(output, host, port, user, password, Database, options)
+			}
 		}
+		err = hooks.After(result, err)
+		commons.FinishResult(&result, started, err)
+		commons.PrintResult(result, func() {
+			if err != nil {
+				fmt.Fprintln(commons.Out, "Error: ", err)
+			} else {
+				if result.Conflicts > 0 {
+					fmt.Fprintf(commons.Out, "%d conflicted documents captured with all their leaves\n", result.Conflicts)
+				}
+				if options.includeDeleted {
+					fmt.Fprintf(commons.Out, "%d of %d deleted documents captured as tombstones\n", result.Deleted, Database.DocDelCount)
+				}
+				fmt.Fprintln(commons.Out, "Backup completed successfully!")
+			}
+		})
+		return err
 	},
 }
 
+// dumpOptions are the parts of the revision tree exported besides the winning revisions.
+type dumpOptions struct {
+	withConflicts  bool
+	includeDeleted bool
+	// attachments is AttachmentsInline or AttachmentsSeparate
+	attachments string
+	// selection chooses the documents of a partial backup
+	selection manifest.Selection
+	// blobStore is the directory shared by the backups where the separate attachments
+	// are saved, empty to save them next to each dump
+	blobStore string
+}
+
+func getDumpOptions(cmd *cobra.Command) dumpOptions {
+	var options dumpOptions
+	options.withConflicts, _ = cmd.Flags().GetBool("with-conflicts")
+	options.includeDeleted, _ = cmd.Flags().GetBool("include-deleted")
+	options.attachments, _ = cmd.Flags().GetString("attachments")
+	options.blobStore, _ = cmd.Flags().GetString("blob-store")
+	if selector, _ := cmd.Flags().GetString("selector"); selector != "" {
+		options.selection.Selector = json.RawMessage(selector)
+	}
+	options.selection.IDPrefix, _ = cmd.Flags().GetString("id-prefix")
+	options.selection.Partition, _ = cmd.Flags().GetString("partition")
+	return options
+}
+
+func (o dumpOptions) validate() error {
+	if err := commons.ValidateSelection(o.selection); err != nil {
+		return err
+	}
+	if o.includeDeleted && len(o.selection.Selector) > 0 {
+		return commons.NewExitError(commons.ExitUsage, errors.New("--include-deleted cannot be combined with --selector, the deleted documents have no body to match"))
+	}
+	if o.attachments != "" && !slices.Contains(commons.AttachmentModes, o.attachments) {
+		return commons.NewExitError(commons.ExitUsage, fmt.Errorf("invalid attachments mode %q, must be one of: %s", o.attachments, strings.Join(commons.AttachmentModes, ", ")))
+	}
+	if o.blobStore != "" && o.attachments != commons.AttachmentsSeparate {
+		return commons.NewExitError(commons.ExitUsage, errors.New("--blob-store requires --attachments separate"))
+	}
+	return nil
+}
+
+// attachmentsDir is where the attachments of the dump file are saved, empty when
+// they stay inline.
+func (o dumpOptions) attachmentsDir(file string) string {
+	switch {
+	case o.attachments != commons.AttachmentsSeparate:
+		return ""
+	case o.blobStore != "":
+		return o.blobStore
+	default:
+		return commons.AttachmentsDir(file)
+	}
+}
+
+func (o dumpOptions) describeAttachments(file string) string {
+	if dir := o.attachmentsDir(file); dir != "" {
+		return "binary files in " + dir + ", the ones already there are not downloaded again"
+	}
+	return "inline, base64 encoded"
+}
+
+func (o dumpOptions) describeDocuments(Database couchdb.Database) string {
+	if o.includeDeleted {
+		return fmt.Sprintf("%d (%d deleted, exported as tombstones)", Database.DocCount, Database.DocDelCount)
+	}
+	return fmt.Sprintf("%d (%d deleted, not exported)", Database.DocCount, Database.DocDelCount)
+}
+
+func (o dumpOptions) scriptArgs() []string {
+	var args []string
+	if o.withConflicts {
+		args = append(args, "-k")
+	}
+	if o.attachments == commons.AttachmentsSeparate {
+		args = append(args, "-n")
+	}
+	return args
+}
+
+// completeDump adds to the dump written by the script what the script cannot
+// export by itself, before the dump is verified.
+func completeDump(result *report.DatabaseResult, fileName string, host string, port int, user string, password string, options dumpOptions) error {
+	if options.withConflicts {
+		conflicts, err := commons.ExpandConflicts(host, port, user, password, result.Database, fileName)
+		if err != nil {
+			return err
+		}
+		result.Conflicts = conflicts
+	}
+	if options.includeDeleted {
+		var keep func(id string) bool
+		if commons.SelectionActive(options.selection) {
+			keep = func(id string) bool { return commons.SelectsID(options.selection, id) }
+		}
+		deleted, err := commons.AppendTombstones(host, port, user, password, result.Database, fileName, keep)
+		if err != nil {
+			return err
+		}
+		result.Deleted = deleted
+	}
+	if dir := options.attachmentsDir(result.File); dir != "" {
+		stats, err := commons.SeparateAttachments(host, port, user, password, result.Database, fileName, dir)
+		if err != nil {
+			return err
+		}
+		result.Attachments = stats.Attachments
+		slog.Info("attachments saved", "db", result.Database, "phase", "attachments", "attachments", stats.Attachments,
+			"reused", stats.Reused, "bytes", stats.Bytes, "dir", dir)
+	}
+	return nil
+}
+
+// verifyBackup checks the dump just written to fileName and records the documents it really contains.
+func verifyBackup(result *report.DatabaseResult, fileName string, options dumpOptions) error {
+	count, deleted, err := commons.VerifyDump(fileName)
+	if err != nil {
+		return err
+	}
+	if count != result.Documents {
+		slog.Warn("the number of documents changed during the backup", "db", result.Database, "expected", result.Documents, "dumped", count)
+	}
+	if result.Deleted > 0 && result.Stats != nil && !commons.SelectionActive(options.selection) && deleted != result.Stats.DocDelCount {
+		slog.Warn("the number of deleted documents changed during the backup", "db", result.Database, "expected", result.Stats.DocDelCount, "dumped", deleted)
+	}
+	result.Documents = count
+	result.Deleted = deleted
+	return nil
+}
+
+// commitBackup puts the verified dump in place together with the manifest of the
+// database settings, read once the documents have been dumped, of the directory
+// of its attachments when they were saved apart and of the selection of a partial backup.
+func commitBackup(output *commons.Output, host string, port int, user string, password string, Database couchdb.Database, options dumpOptions) error {
+	settings, err := commons.FetchManifest(host, port, user, password, Database)
+	if err != nil {
+		return err
+	}
+	if dir := options.attachmentsDir(output.File); dir != "" {
+		settings.Attachments = commons.AttachmentsReference(output.File, dir)
+	}
+	if commons.SelectionActive(options.selection) {
+		settings.Selection = &options.selection
+	}
+	if err := output.Commit(); err != nil {
+		return err
+	}
+	return commons.WriteManifest(output.File, settings)
+}
+
 func init() {
 	rootCmd.AddCommand(backupCmd)
 	backupCmd.SetUsageTemplate(`
@@ -82,12 +315,31 @@ Flags:
  -p, --password		The CouchDB password for the auth
  --host			The host of the remote CouchDB, with or without 'https://'
  --port			The port of the remote CouchDB, default is 5984
+ --with-conflicts	Export all the leaves of the conflicted documents with their revision history
+ --include-deleted	Export the deleted documents as tombstones, restored as deletions
+ --attachments		How to save the attachments, default is inline:
+				inline		base64 encoded inside their documents
+				separate	as binary files in <file>.attachments, named by their digest
+ --blob-store		The directory shared by the backups where to save the separate attachments,
+				the ones already there are not downloaded again
+ --tag			A tag recorded with the backup in the catalog, can be repeated
+ --catalog		The catalog where to record the backup, default is ~/.dbackupcli-catalog.jsonl
+ --selector		Back up only the documents matching this Mango selector (e.g. '{"type":"invoice"}')
+ --id-prefix		Back up only the documents whose ID starts with this prefix
+ --partition		Back up only the documents of this partition of a partitioned database
+ --dry-run		Print what the backup would do without doing it
+ --no-progress		Show the output of the backup script instead of the progress bar
+ --pre-hook		A shell command run before the backup, a non-zero exit aborts it
+ --post-hook		A shell command run after a successful backup
+ --on-error-hook		A shell command run when the backup fails
 
 After entering the command a prompt will let you select the database to backup
 
 Examples:
  dbackupcli backup -f dump.json -u admin -p root --host 127.0.0.1 --port 9876
  dbackupcli backup --file dump.json --user admin -p root --host 127.0.0.1.
+ dbackupcli backup -f invoices.json --profile prod --selector '{"type":"invoice"}'
+ dbackupcli backup -f tenant42.json --profile prod --partition tenant42
 `)
 	backupCmd.Flags().BoolP("help", "h", false, "Help message")
 	backupCmd.Flags().String("host", "", "The remote CouchDB host, can be provided with or without 'https://'")
@@ -95,4 +347,18 @@ Examples:
 	backupCmd.Flags().StringP("file", "f", "", "The name of the file where to backup (Default: empty)")
 	backupCmd.Flags().StringP("user", "u", "", "The username to authenticate to the CouchDB (Default: empty)")
 	backupCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
+	backupCmd.Flags().Bool("with-conflicts", false, "Export the conflicting revisions with their history (Default: false)")
+	backupCmd.Flags().Bool("include-deleted", false, "Export the deleted documents from the changes feed (Default: false)")
+	backupCmd.Flags().String("attachments", commons.AttachmentsInline, "How to save the attachments: inline or separate (Default: inline)")
+	backupCmd.Flags().String("blob-store", "", "The directory shared by the backups where to save the separate attachments (Default: empty)")
+	backupCmd.Flags().StringSlice("tag", nil, "The tags to record with the backup in the catalog (Default: empty)")
+	backupCmd.Flags().String("catalog", "", "The catalog where to record the backup (Default: $DBACKUPCLI_CATALOG)")
+	backupCmd.Flags().String("selector", "", "The Mango selector of the documents to back up (Default: empty)")
+	backupCmd.Flags().String("id-prefix", "", "The prefix of the IDs of the documents to back up (Default: empty)")
+	backupCmd.Flags().String("partition", "", "The partition of the documents to back up (Default: empty)")
+	backupCmd.Flags().Bool("dry-run", false, "Print the backup plan without executing it (Default: false)")
+	backupCmd.Flags().Bool("no-progress", false, "Disable the progress bar (Default: false)")
+	backupCmd.Flags().String("pre-hook", "", "The shell command to run before the backup (Default: empty)")
+	backupCmd.Flags().String("post-hook", "", "The shell command to run after a successful backup (Default: empty)")
+	backupCmd.Flags().String("on-error-hook", "", "The shell command to run when the backup fails (Default: empty)")
 }
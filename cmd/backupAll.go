@@ -4,12 +4,15 @@ Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
 package cmd
 
 import (
+	"context"
 	"dbackupcli/cmd/commons"
 	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/couchdb"
+	"dbackupcli/cmd/struct/report"
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
-	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -19,47 +22,47 @@ var backupAllCmd = &cobra.Command{
 	Use:   "backupAll",
 	Short: "Operates a backup of the entire CouchDB istance",
 	Long:  `Operates a backup of the entire CouchDB istance that has been specified with the flags`,
-	Run: func(cmd *cobra.Command, args []string) {
-		tmpFile, err := scripts.GetEmbeddedScripts()
-		defer os.Remove(tmpFile)
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-
+	RunE: func(cmd *cobra.Command, args []string) error {
 		user, host, password, port := commons.GetAuthFlagValues(cmd)
 		dir, _ := cmd.Flags().GetString("filedir")
 		if commons.CheckFlags(append([]string{}, dir, user, password, host)) {
-			fmt.Println("missing on or more flags/arguments\n\nCheck using 'dbackupcli backup -h'")
-			os.Exit(1)
+			return commons.MissingFlags("backupAll")
+		}
+		options := getDumpOptions(cmd)
+		if err := options.validate(); err != nil {
+			slog.Error("invalid flags", "error", err)
+			return err
 		}
 
 		dbsList, err := commons.GetDBs(host, port, user, password)
 		if err != nil {
-			fmt.Println(err)
-			return
+			slog.Error("error listing the databases", "host", host, "error", err)
+			return err
 		}
 
-		var cmdArgs []string = []string{"-b"}
-		cmdArgs = commons.PrepareCmdAuthArgs(cmdArgs, user, password, host, port)
-		if err := os.Mkdir(dir, os.ModePerm); err != nil {
-			fmt.Println("error:", err)
-			return
+		var systemDbs systemBackup
+		systemDbs.include, _ = cmd.Flags().GetBool("include-system")
+		systemDbs.keepCredentials, _ = cmd.Flags().GetBool("keep-replicator-credentials")
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			planBackupAll(host, port, user, password, dir, dbsList, systemDbs, options)
+			return nil
 		}
 
-		for _, db := range dbsList {
-			if !strings.HasPrefix(db, "_") && db != "" {
-				dbArgs := append(cmdArgs, "-d", db, "-f", dir+"/"+db+".json")
-				cmdExec := exec.Command("bash", append([]string{tmpFile}, dbArgs...)...)
-				cmdExec.Stderr = os.Stderr
-				cmdExec.Stdout = os.Stdout
-				if err := cmdExec.Run(); err != nil {
-					fmt.Println("Error: ", err)
-				} else {
-					fmt.Println("Backup completed successfully!")
-				}
-			}
+		tmpFile, err := scripts.GetEmbeddedScripts()
+		defer os.Remove(tmpFile)
+		if err != nil {
+			slog.Error("error preparing the backup script", "error", err)
+			return err
 		}
+
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			slog.Error("error creating the backup directory", "dir", dir, "error", err)
+			return err
+		}
+
+		results, errs := backupInstance(cmd.Context(), tmpFile, host, port, user, password, dir, dbsList, systemDbs, options, commons.ProgressEnabled(cmd), commons.GetHooks(cmd, "backup"))
+		commons.PrintResult(results, nil)
+		return commons.RunError(results, errs)
 	},
 }
 
@@ -76,6 +79,22 @@ Flags:
  -p, --password		The CouchDB password for the auth
  --host			The host of the remote CouchDB, with or without 'https://'
  --port			The port of the remote CouchDB, default is 5984
+ --include-system	Back up also the system databases (_users, _replicator, _global_changes)
+ --keep-replicator-credentials	Keep the passwords of the replications in the dump of _replicator
+ --with-conflicts	Export all the leaves of the conflicted documents with their revision history
+ --include-deleted	Export the deleted documents as tombstones, restored as deletions
+ --attachments		How to save the attachments, default is inline:
+				inline		base64 encoded inside their documents
+				separate	as binary files in <db>.json.attachments, named by their digest
+ --blob-store		The directory shared by the backups where to save the separate attachments,
+				the ones already there are not downloaded again
+ --tag			A tag recorded with the backup in the catalog, can be repeated
+ --catalog		The catalog where to record the backup, default is ~/.dbackupcli-catalog.jsonl
+ --dry-run		Print what the backup would do without doing it
+ --no-progress		Show the output of the backup script instead of the progress bars
+ --pre-hook		A shell command run before the backup of each database, a non-zero exit skips it
+ --post-hook		A shell command run after each successful backup
+ --on-error-hook		A shell command run when the backup of a database fails
 
 After entering the command a prompt will let you select the database to backup
 
@@ -89,4 +108,166 @@ Examples:
 	backupAllCmd.Flags().StringP("filedir", "f", "", "The name of the directory where to backup (Default: empty)")
 	backupAllCmd.Flags().StringP("user", "u", "", "The username to authenticate to the CouchDB (Default: empty)")
 	backupAllCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
+	backupAllCmd.Flags().Bool("include-system", false, "Back up also the system databases (Default: false)")
+	backupAllCmd.Flags().Bool("keep-replicator-credentials", false, "Do not redact the credentials of the replications (Default: false)")
+	backupAllCmd.Flags().Bool("with-conflicts", false, "Export the conflicting revisions with their history (Default: false)")
+	backupAllCmd.Flags().Bool("include-deleted", false, "Export the deleted documents from the changes feed (Default: false)")
+	backupAllCmd.Flags().String("attachments", commons.AttachmentsInline, "How to save the attachments: inline or separate (Default: inline)")
+	backupAllCmd.Flags().String("blob-store", "", "The directory shared by the backups where to save the separate attachments (Default: empty)")
+	backupAllCmd.Flags().StringSlice("tag", nil, "The tags to record with the backup in the catalog (Default: empty)")
+	backupAllCmd.Flags().String("catalog", "", "The catalog where to record the backup (Default: $DBACKUPCLI_CATALOG)")
+	backupAllCmd.Flags().Bool("dry-run", false, "Print the backup plan without executing it (Default: false)")
+	backupAllCmd.Flags().Bool("no-progress", false, "Disable the progress bars (Default: false)")
+	backupAllCmd.Flags().String("pre-hook", "", "The shell command to run before each backup (Default: empty)")
+	backupAllCmd.Flags().String("post-hook", "", "The shell command to run after each successful backup (Default: empty)")
+	backupAllCmd.Flags().String("on-error-hook", "", "The shell command to run when a backup fails (Default: empty)")
+}
+
+// systemBackup says whether the system databases are dumped and whether the
+// credentials of the replications are kept in the dump of _replicator.
+type systemBackup struct {
+	include         bool
+	keepCredentials bool
+}
+
+func (s systemBackup) skip(dbName string) bool {
+	return dbName == "" || (commons.IsSystemDatabase(dbName) && !s.include)
+}
+
+// backupInstance dumps the databases of dbsList in dir, which must already exist.
+func backupInstance(ctx context.Context, tmpFile string, host string, port int, user string, password string, dir string, dbsList []string, systemDbs systemBackup, options dumpOptions, progress bool, hooks commons.Hooks) ([]report.DatabaseResult, []error) {
+	var cmdArgs []string = []string{"-b"}
+	cmdArgs = commons.PrepareCmdAuthArgs(cmdArgs, user, password, host, port)
+	cmdArgs = append(cmdArgs, options.scriptArgs()...)
+	var total *commons.Progress
+	infos := make(map[string]couchdb.Database)
+	var totalDocs, totalBytes int64
+	for _, db := range dbsList {
+		if !systemDbs.skip(db) {
+			if _, Database, err := commons.GetDB(host, port, user, password, db); err == nil {
+				infos[db] = Database
+				totalDocs += int64(Database.DocCount)
+				totalBytes += int64(Database.Sizes.External)
+			}
+		}
+	}
+	if progress {
+		cmdArgs = append(cmdArgs, "-q")
+		total = commons.NewProgress("instance", totalDocs, totalBytes)
+	}
+
+	var results []report.DatabaseResult
+	var errs []error
+	for _, db := range dbsList {
+		if ctx.Err() != nil {
+			break
+		}
+		if !systemDbs.skip(db) {
+			dbFile := dir + "/" + db + ".json"
+			result := report.DatabaseResult{Operation: "backup", Host: host, Database: db, File: dbFile, Documents: infos[db].DocCount}
+			if Database, ok := infos[db]; ok {
+				result.Stats = commons.DatabaseStats(Database)
+			}
+			started := time.Now()
+			slog.Info("backup started", "db", db, "host", host, "phase", "start", "file", dbFile)
+
+			var p *commons.Progress
+			output, err := commons.CreateOutput(dbFile)
+			if err == nil {
+				err = hooks.Before(result)
+			}
+			if err == nil {
+				stopProgress := func() {}
+				if progress {
+					p = total.Child(db, int64(infos[db].DocCount), int64(infos[db].Sizes.External))
+					stopProgress = commons.StartProgress(p, commons.FileSampler(output.Partial))
+				}
+				err = commons.RunScript(ctx, tmpFile, append(cmdArgs, "-d", db, "-f", output.Partial))
+				stopProgress()
+				if err == nil {
+					err = completeDump(&result, output.Partial, host, port, user, password, options)
+				}
+				if err == nil && db == commons.ReplicatorDatabase && !systemDbs.keepCredentials {
+					err = redactReplications(output.Partial)
+				}
+				if err == nil {
+					err = verifyBackup(&result, output.Partial, options)
+				}
+				if err == nil {
+					Database, ok := infos[db]
+					if !ok {
+						Database.DbName = db
+					}
+					err = commitBackup(output, host, port, user, password, Database, options)
+				}
+			}
+			err = hooks.After(result, err)
+			commons.FinishResult(&result, started, err)
+			if output != nil {
+				output.Close()
+			}
+			results = append(results, result)
+			if err != nil {
+				errs = append(errs, err)
+				fmt.Fprintln(commons.Out, "Error: ", err)
+			} else {
+				if p != nil {
+					p.Complete()
+				}
+				fmt.Fprintln(commons.Out, "Backup completed successfully!")
+			}
+		}
+	}
+	return results, errs
+}
+
+// redactReplications takes the credentials out of the dump of _replicator, the
+// replications have to be given a password again when restored.
+func redactReplications(fileName string) error {
+	redacted, err := commons.RedactReplicatorDump(fileName)
+	if err != nil {
+		return err
+	}
+	if redacted > 0 {
+		slog.Info("replication credentials redacted", "db", commons.ReplicatorDatabase, "credentials", redacted)
+	}
+	return nil
+}
+
+func planBackupAll(host string, port int, user string, password string, dir string, dbsList []string, systemDbs systemBackup, options dumpOptions) {
+	fmt.Fprintln(commons.Out, commons.DryRunBanner)
+	if _, err := os.Stat(dir); err == nil {
+		fmt.Fprintf(commons.Out, "Directory %s already exists, the backup would stop without writing anything\n", dir)
+	} else {
+		fmt.Fprintf(commons.Out, "Directory %s would be created\n", dir)
+	}
+
+	var totalDocs, totalSize int
+	for _, db := range dbsList {
+		if systemDbs.skip(db) {
+			continue
+		}
+		_, Database, err := commons.GetDB(host, port, user, password, db)
+		if err != nil {
+			slog.Error("error reading the database info", "db", db, "host", host, "error", err)
+			continue
+		}
+		totalDocs += Database.DocCount
+		totalSize += Database.Sizes.External
+		steps := []commons.PlanStep{
+			{Name: "Documents", Value: options.describeDocuments(Database)},
+			{Name: "Estimated size", Value: commons.FormatBytes(int64(Database.Sizes.External))},
+			{Name: "Attachments", Value: options.describeAttachments(dir + "/" + db + ".json")},
+			{Name: "Destination", Value: dir + "/" + db + ".json"},
+		}
+		if db == commons.ReplicatorDatabase {
+			credentials := "redacted"
+			if systemDbs.keepCredentials {
+				credentials = "kept in the dump"
+			}
+			steps = append(steps, commons.PlanStep{Name: "Credentials", Value: credentials})
+		}
+		commons.PrintPlan("Backup of "+db+":", steps)
+	}
+	fmt.Fprintf(commons.Out, "Total: %d documents, %s\n", totalDocs, commons.FormatBytes(int64(totalSize)))
 }
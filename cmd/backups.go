@@ -0,0 +1,199 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+package cmd
+
+import (
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/struct/report"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// backupsCmd represents the backups command
+var backupsCmd = &cobra.Command{
+	Use:   "backups",
+	Short: "Queries the catalog of the backups",
+	Long: `Queries the catalog where every backup run is recorded with the dumps it wrote and
+their manifests.`,
+}
+
+// backupsListCmd represents the backups list command
+var backupsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the backups of the catalog",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var filter commons.CatalogFilter
+		filter.Hosts, _ = cmd.Flags().GetStringSlice("host")
+		filter.Databases, _ = cmd.Flags().GetStringSlice("db")
+		filter.Tags, _ = cmd.Flags().GetStringSlice("tag")
+		since, _ := cmd.Flags().GetString("since")
+		until, _ := cmd.Flags().GetString("until")
+		var err error
+		if filter.Since, err = commons.ParseCatalogTime(since); err != nil {
+			slog.Error("invalid --since", "error", err)
+			return err
+		}
+		if filter.Until, err = commons.ParseCatalogTime(until); err != nil {
+			slog.Error("invalid --until", "error", err)
+			return err
+		}
+
+		catalogFile := commons.GetCatalogFile(cmd)
+		entries, err := commons.ReadCatalog(catalogFile)
+		if err != nil {
+			slog.Error("error reading the catalog", "file", catalogFile, "error", err)
+			return err
+		}
+		entries = filter.Filter(entries)
+		commons.PrintResult(entries, func() {
+			fmt.Fprintf(commons.Out, "%-16s  %-19s  %-16s  %-8s  %-20s  %5s  %10s  %s\n", "ID", "Time", "Command", "Status", "Host", "DBs", "Size", "Location")
+			for _, entry := range entries {
+				var size int64
+				for _, db := range entry.Databases {
+					size += db.Bytes
+				}
+				location := entry.Location
+				if len(entry.Tags) > 0 {
+					location += " [" + strings.Join(entry.Tags, ",") + "]"
+				}
+				fmt.Fprintf(commons.Out, "%-16s  %-19s  %-16s  %-8s  %-20s  %5d  %10s  %s\n", entry.ID, entry.StartedAt.Local().Format("2006-01-02 15:04:05"),
+					entry.Command, entry.Status, entry.Host, len(entry.Databases), commons.FormatBytes(size), location)
+			}
+			fmt.Fprintf(commons.Out, "%d backups\n", len(entries))
+		})
+		return nil
+	},
+}
+
+// backupsInspectCmd represents the backups inspect command
+var backupsInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Shows the details of a backup of the catalog",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return commons.MissingFlags("backups inspect")
+		}
+		catalogFile := commons.GetCatalogFile(cmd)
+		entries, err := commons.ReadCatalog(catalogFile)
+		if err != nil {
+			slog.Error("error reading the catalog", "file", catalogFile, "error", err)
+			return err
+		}
+		entry, err := commons.FindCatalogEntry(entries, args[0])
+		if err != nil {
+			slog.Error("error finding the backup", "id", args[0], "error", err)
+			return err
+		}
+		commons.PrintResult(entry, func() {
+			fmt.Fprintf(commons.Out, "Backup %s\n", entry.ID)
+			fmt.Fprintf(commons.Out, " Command:   dbackupcli %s\n", strings.Join(entry.Args, " "))
+			fmt.Fprintf(commons.Out, " Status:    %s\n", entry.Status)
+			fmt.Fprintf(commons.Out, " Host:      %s\n", entry.Host)
+			fmt.Fprintf(commons.Out, " Started:   %s (%.1fs)\n", entry.StartedAt.Local().Format("2006-01-02 15:04:05"), entry.Duration)
+			fmt.Fprintf(commons.Out, " Location:  %s\n", entry.Location)
+			if len(entry.Tags) > 0 {
+				fmt.Fprintf(commons.Out, " Tags:      %s\n", strings.Join(entry.Tags, ", "))
+			}
+			for _, db := range entry.Databases {
+				fmt.Fprintf(commons.Out, "\n %s\n", db.Database)
+				fmt.Fprintf(commons.Out, "  File:        %s\n", db.File)
+				fmt.Fprintf(commons.Out, "  Documents:   %d (%d deleted, %d conflicts, %d attachments)\n", db.Documents, db.Deleted, db.Conflicts, db.Attachments)
+				fmt.Fprintf(commons.Out, "  Size:        %s\n", commons.FormatBytes(db.Bytes))
+				fmt.Fprintf(commons.Out, "  SHA-256:     %s\n", db.SHA256)
+				if db.UpdateSeq != "" {
+					fmt.Fprintf(commons.Out, "  Update seq:  %s\n", db.UpdateSeq)
+				}
+				if db.Manifest != nil {
+					fmt.Fprintf(commons.Out, "  Manifest:    %d documents at start, revs_limit %d, q=%d n=%d\n", db.Manifest.DocCount, db.Manifest.RevsLimit,
+						db.Manifest.Cluster.Q, db.Manifest.Cluster.N)
+					if db.Manifest.Selection != nil {
+						fmt.Fprintf(commons.Out, "  Selection:   %s\n", commons.DescribeSelection(*db.Manifest.Selection))
+					}
+				}
+			}
+		})
+		return nil
+	},
+}
+
+// recordCatalog adds a backup run to the catalog, a failure is logged without
+// changing the outcome of the run.
+func recordCatalog(cmd *cobra.Command, run report.RunReport) {
+	catalogFile := commons.GetCatalogFile(cmd)
+	if catalogFile == "" {
+		return
+	}
+	tags, _ := cmd.Flags().GetStringSlice("tag")
+	entry, recorded, err := commons.RecordCatalog(catalogFile, run, os.Args[1:], tags)
+	if err != nil {
+		slog.Error("error recording the backup in the catalog", "file", catalogFile, "error", err)
+	} else if recorded {
+		slog.Info("backup recorded in the catalog", "file", catalogFile, "id", entry.ID)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(backupsCmd)
+	backupsCmd.AddCommand(backupsListCmd, backupsInspectCmd)
+	backupsCmd.SetUsageTemplate(`
+Usage: dbackupcli backups <command> [flags]
+
+Commands:
+ list			List the backups of the catalog
+ inspect <id>		Show the dumps of a backup with their counts, sizes, checksums and manifests
+
+Every run of backup, backupAll, instance-backup and daemon that writes a dump is recorded
+in the catalog, --catalog or $DBACKUPCLI_CATALOG or the catalog of the config file,
+default is ~/.dbackupcli-catalog.jsonl.
+
+Examples:
+ dbackupcli backups list --db users --since 7d
+ dbackupcli backups inspect 3f2a9c1e
+`)
+
+	backupsListCmd.SetUsageTemplate(`
+Usage: dbackupcli backups list [flags]
+
+Flags:
+ -h, --help		Show this help message
+ --catalog		The catalog of the backups, default is ~/.dbackupcli-catalog.jsonl
+ --host			Only the backups of these hosts (or patterns)
+ --db			Only the dumps of these databases (or patterns)
+ --since		Only the backups started from this date (2006-01-02), time (RFC 3339) or
+			duration back from now (e.g. 36h, 7d or 2w)
+ --until		Only the backups started before this date, time or duration back from now
+ --tag			Only the backups with all these tags
+
+Examples:
+ dbackupcli backups list --host prod.example.com --since 2025-06-01 --until 2025-07-01
+ dbackupcli backups list --db 'orders-*' --tag weekly --output json
+`)
+	backupsListCmd.Flags().BoolP("help", "h", false, "Help message")
+	backupsListCmd.Flags().String("catalog", "", "The catalog of the backups (Default: $DBACKUPCLI_CATALOG)")
+	backupsListCmd.Flags().StringSlice("host", nil, "The hosts of the backups to list (Default: empty)")
+	backupsListCmd.Flags().StringSlice("db", nil, "The databases of the backups to list (Default: empty)")
+	backupsListCmd.Flags().String("since", "", "List the backups started from this time (Default: empty)")
+	backupsListCmd.Flags().String("until", "", "List the backups started before this time (Default: empty)")
+	backupsListCmd.Flags().StringSlice("tag", nil, "The tags of the backups to list (Default: empty)")
+
+	backupsInspectCmd.SetUsageTemplate(`
+Usage: dbackupcli backups inspect <id> [flags]
+
+Flags:
+ -h, --help		Show this help message
+ --catalog		The catalog of the backups, default is ~/.dbackupcli-catalog.jsonl
+
+The ID can be shortened to any unique prefix.
+
+Examples:
+ dbackupcli backups inspect 3f2a9c1e
+ dbackupcli backups inspect 3f2a9c1e --output yaml
+`)
+	backupsInspectCmd.Flags().BoolP("help", "h", false, "Help message")
+	backupsInspectCmd.Flags().String("catalog", "", "The catalog of the backups (Default: $DBACKUPCLI_CATALOG)")
+}
@@ -0,0 +1,39 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeCouch starts a server answering as CouchDB with handler and returns its host and port.
+func fakeCouch(t *testing.T, handler http.HandlerFunc) (string, int) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port, _ := strings.Cut(strings.TrimPrefix(server.URL, "http://"), ":")
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, portNumber
+}
+
+// writeDump writes a dump with the documents, one per line, and returns its path.
+func writeDump(t *testing.T, docs ...string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), "dump.json")
+	content := "{\"new_edits\":false,\"docs\":[\n" + strings.Join(docs, ",\n") + "\n]}\n"
+	if err := os.WriteFile(fileName, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
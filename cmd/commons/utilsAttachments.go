@@ -0,0 +1,462 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AttachmentsInline   = "inline"
+	AttachmentsSeparate = "separate"
+
+	// AttachmentsSuffix is the directory next to a dump holding the bodies of its
+	// attachments, one file named by the MD5 digest CouchDB gives to its content.
+	AttachmentsSuffix = ".attachments"
+
+	// BlobStoreDir is the blob store shared by the backups of a repository.
+	BlobStoreDir = "blobs"
+)
+
+var AttachmentModes = []string{AttachmentsInline, AttachmentsSeparate}
+
+// attachment is an entry of _attachments as read from CouchDB or as saved in a dump
+// with separate attachments, where Blob replaces the inline data or the stub. Encoding,
+// read with att_encoding_info, is gzip for the types that CouchDB stores compressed,
+// whose Digest is then the MD5 of the compressed data.
+type attachment struct {
+	ContentType string `json:"content_type"`
+	Revpos      int    `json:"revpos,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Length      int64  `json:"length"`
+	Encoding    string `json:"encoding,omitempty"`
+	Data        string `json:"data,omitempty"`
+	Stub        bool   `json:"stub,omitempty"`
+	Follows     bool   `json:"follows,omitempty"`
+	Blob        string `json:"blob,omitempty"`
+}
+
+// AttachmentStats are the attachments moved out of a dump, Reused of them already
+// were in the blob store and Bytes were written to it.
+type AttachmentStats struct {
+	Attachments int
+	Reused      int
+	Bytes       int64
+}
+
+func AttachmentsDir(fileName string) string {
+	return fileName + AttachmentsSuffix
+}
+
+// AttachmentsLocation finds the directory with the attachments of a dump saved apart:
+// the blob store recorded in its manifest, or the directory next to it.
+func AttachmentsLocation(fileName string) (string, bool) {
+	if m, found, err := LoadManifest(fileName); err == nil && found && m.Attachments != "" {
+		if filepath.IsAbs(m.Attachments) {
+			return m.Attachments, true
+		}
+		return filepath.Join(filepath.Dir(fileName), m.Attachments), true
+	}
+	info, err := os.Stat(AttachmentsDir(fileName))
+	return AttachmentsDir(fileName), err == nil && info.IsDir()
+}
+
+// AttachmentsReference is the directory of the attachments as recorded in the manifest
+// of fileName, relative to the dump when possible so that the backups can be moved.
+func AttachmentsReference(fileName string, dir string) string {
+	absFile, err := filepath.Abs(fileName)
+	if err != nil {
+		return dir
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	if rel, err := filepath.Rel(filepath.Dir(absFile), absDir); err == nil {
+		return rel
+	}
+	return absDir
+}
+
+// SeparateAttachments moves the attachments of the dump to binary files in dir, the
+// inline ones are decoded and the stubs are downloaded, and leaves in the documents
+// a reference to their file. The attachments whose digest is already in dir are
+// not downloaded again, their blob is touched so that prune sees it in use.
+func SeparateAttachments(host string, port int, user string, password string, dbName string, fileName string, dir string) (AttachmentStats, error) {
+	var stats AttachmentStats
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return stats, fmt.Errorf("error creating the attachments directory %s: %v", dir, err)
+	}
+	tmpFile := fileName + AttachmentsSuffix + ".tmp"
+	defer os.Remove(tmpFile)
+	_, err := TransformDump(fileName, tmpFile, func(doc []byte) ([]byte, error) {
+		if !bytes.Contains(doc, []byte(`"_attachments":`)) {
+			return doc, nil
+		}
+		var ref struct {
+			ID          string                `json:"_id"`
+			Rev         string                `json:"_rev"`
+			Attachments map[string]attachment `json:"_attachments"`
+		}
+		if err := json.Unmarshal(doc, &ref); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		if len(ref.Attachments) == 0 {
+			return doc, nil
+		}
+		for name, att := range ref.Attachments {
+			if att.Blob != "" {
+				continue
+			}
+			if blob, ok := BlobName(att.Digest); ok && touchBlob(dir, blob) {
+				ref.Attachments[name] = attachment{ContentType: att.ContentType, Revpos: att.Revpos, Digest: att.Digest, Length: att.Length, Blob: blob}
+				stats.Attachments++
+				stats.Reused++
+				continue
+			}
+			var body io.ReadCloser
+			if att.Stub {
+				var err error
+				if body, err = getAttachment(host, port, user, password, dbName, ref.ID, ref.Rev, name); err != nil {
+					return nil, err
+				}
+			} else {
+				body = io.NopCloser(base64.NewDecoder(base64.StdEncoding, strings.NewReader(att.Data)))
+			}
+			blob, length, err := writeBlob(dir, att, body)
+			body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("error saving the attachment %s of %s: %v", name, ref.ID, err)
+			}
+			ref.Attachments[name] = attachment{ContentType: att.ContentType, Revpos: att.Revpos, Digest: att.Digest, Length: length, Blob: blob}
+			stats.Attachments++
+			stats.Bytes += length
+		}
+		return replaceField(doc, "_attachments", ref.Attachments)
+	})
+	if err != nil {
+		return stats, err
+	}
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		return stats, fmt.Errorf(ErrWriteDump, fileName, err)
+	}
+	return stats, nil
+}
+
+// DocumentBlobs returns the blobs referenced by a document of a dump.
+func DocumentBlobs(doc []byte) []string {
+	if !bytes.Contains(doc, []byte(`"blob":"`)) {
+		return nil
+	}
+	var blobs []string
+	for _, att := range blobAttachments(doc) {
+		blobs = append(blobs, att.Blob)
+	}
+	return blobs
+}
+
+// HasBlobs tells whether a document of a dump has attachments saved apart.
+func HasBlobs(doc []byte) bool {
+	return bytes.Contains(doc, []byte(`"blob":"`)) && len(blobAttachments(doc)) > 0
+}
+
+func blobAttachments(doc []byte) map[string]attachment {
+	var ref struct {
+		Attachments map[string]attachment `json:"_attachments"`
+	}
+	if json.Unmarshal(doc, &ref) != nil {
+		return nil
+	}
+	for _, att := range ref.Attachments {
+		if att.Blob == "" {
+			return nil
+		}
+	}
+	return ref.Attachments
+}
+
+// UploadBlobDocuments puts one by one, with new_edits false, the documents of the dump
+// whose attachments are in dir, each as a multipart/related request with the bodies
+// of its attachments. It returns the number of documents uploaded.
+func UploadBlobDocuments(host string, port int, user string, password string, dbName string, fileName string, dir string) (int, error) {
+	var count int
+	err := ReadDump(fileName, func(doc []byte) error {
+		if !HasBlobs(doc) {
+			return nil
+		}
+		var ref struct {
+			ID string `json:"_id"`
+		}
+		if err := json.Unmarshal(doc, &ref); err != nil {
+			return fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		if err := putBlobDocument(host, port, user, password, dbName, ref.ID, doc, dir, "?new_edits=false"); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// putBlobDocument puts a document with the attachments in dir, query is added to the
+// request, new_edits=false to restore the revision as it is.
+func putBlobDocument(host string, port int, user string, password string, dbName string, docID string, doc []byte, dir string, query string) error {
+	atts := blobAttachments(doc)
+	names := make([]string, 0, len(atts))
+	for name := range atts {
+		names = append(names, name)
+	}
+	// json.Marshal sorts the keys of a map, the bodies follow in the same order
+	slices.Sort(names)
+	files := make([]string, 0, len(names))
+	follows := make(map[string]attachment, len(atts))
+	for _, name := range names {
+		att := atts[name]
+		follows[name] = attachment{ContentType: att.ContentType, Revpos: att.Revpos, Length: att.Length, Follows: true}
+		files = append(files, filepath.Join(dir, att.Blob))
+	}
+	doc, err := replaceField(doc, "_attachments", follows)
+	if err != nil {
+		return err
+	}
+
+	contentType, length, open, err := multipartBody(doc, files)
+	if err != nil {
+		return err
+	}
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/" + docPath(docID) + query
+	req, err := http.NewRequest("PUT", address, body)
+	if err != nil {
+		body.Close()
+		return fmt.Errorf(ErrCreateHTTPRequest, err)
+	}
+	req.GetBody = open
+	if strings.Contains(query, "new_edits=false") {
+		// The same revision written twice is a no-op
+		req = Replayable(req)
+	}
+	req.ContentLength = length
+	req.Header.Set(headerContentType, contentType)
+	req.SetBasicAuth(user, password)
+	res, err := Do(req)
+	if err != nil {
+		return connectionError(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		resBody, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("error restoring the document %s with its attachments: %w", docID, statusError(res, resBody))
+	}
+	return nil
+}
+
+// multipartBody prepares a multipart/related body made of the document and of the
+// files, whose length is known in advance so that CouchDB does not get it chunked.
+func multipartBody(doc []byte, files []string) (string, int64, func() (io.ReadCloser, error), error) {
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	write := func(w io.Writer, part func(i int, w io.Writer) error) error {
+		mw := multipart.NewWriter(w)
+		mw.SetBoundary(boundary)
+		jsonPart, err := mw.CreatePart(textproto.MIMEHeader{headerContentType: {valueJSON}})
+		if err != nil {
+			return err
+		}
+		if _, err := jsonPart.Write(doc); err != nil {
+			return err
+		}
+		for i := range files {
+			filePart, err := mw.CreatePart(textproto.MIMEHeader{headerContentType: {"application/octet-stream"}})
+			if err != nil {
+				return err
+			}
+			if err := part(i, filePart); err != nil {
+				return err
+			}
+		}
+		return mw.Close()
+	}
+
+	// The framing is the same whatever the content, the length is the framing plus the files
+	var framing countingWriter
+	write(&framing, func(int, io.Writer) error { return nil })
+	length := int64(framing)
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", 0, nil, fmt.Errorf("error reading the attachment %s: %v", file, err)
+		}
+		length += info.Size()
+	}
+
+	open := func() (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(write(pw, func(i int, w io.Writer) error {
+				f, err := os.Open(files[i])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				_, err = io.Copy(w, f)
+				return err
+			}))
+		}()
+		return pr, nil
+	}
+	return "multipart/related; boundary=" + boundary, length, open, nil
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
+
+func getAttachment(host string, port int, user string, password string, dbName string, docID string, rev string, name string) (io.ReadCloser, error) {
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/" + docPath(docID) + "/" +
+		attachmentPath(name) + "?rev=" + url.QueryEscape(rev)
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, fmt.Errorf(ErrCreateHTTPRequest, err)
+	}
+	req.SetBasicAuth(user, password)
+	res, err := Do(req)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("error reading the attachment %s of %s: %w", name, docID, statusError(res, body))
+	}
+	return res.Body, nil
+}
+
+// attachmentPath escapes an attachment name for the URL, keeping its slashes.
+func attachmentPath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// BlobName is the file of an attachment in a blob store, named after the MD5 digest
+// that CouchDB computes on its content, ok is false for the other digests.
+func BlobName(digest string) (string, bool) {
+	sum, ok := digestMD5(digest)
+	if !ok {
+		return "", false
+	}
+	return "md5-" + hex.EncodeToString(sum), true
+}
+
+func digestMD5(digest string) ([]byte, bool) {
+	encoded, found := strings.CutPrefix(digest, "md5-")
+	if !found {
+		return nil, false
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != md5.Size {
+		return nil, false
+	}
+	return sum, true
+}
+
+// touchBlob tells whether the blob is in dir, updating its time for prune.
+func touchBlob(dir string, blob string) bool {
+	now := time.Now()
+	return os.Chtimes(filepath.Join(dir, blob), now, now) == nil
+}
+
+// writeBlob saves r, the content of att, in dir as the blob named after its CouchDB
+// digest, or after the SHA-256 of the content when there is no MD5 digest. The content
+// is checked against the digest, or only against the length when CouchDB stores it
+// compressed, as r is the content decoded. A blob already there is kept.
+func writeBlob(dir string, att attachment, r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(dir, "*"+PartialSuffix)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	sha, md := sha256.New(), md5.New()
+	length, err := io.Copy(io.MultiWriter(tmp, sha, md), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	blob := hex.EncodeToString(sha.Sum(nil))
+	if sum, ok := digestMD5(att.Digest); ok {
+		encoded := att.Encoding != "" && att.Encoding != "identity"
+		if encoded && length != att.Length {
+			return "", 0, fmt.Errorf("the content has %d bytes, the attachment %d", length, att.Length)
+		}
+		if !encoded && !bytes.Equal(md.Sum(nil), sum) {
+			return "", 0, fmt.Errorf("the content does not match the digest %s", att.Digest)
+		}
+		blob, _ = BlobName(att.Digest)
+	}
+	if _, err := os.Stat(filepath.Join(dir, blob)); err == nil {
+		return blob, length, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", 0, err
+	}
+	return blob, length, os.Rename(tmp.Name(), filepath.Join(dir, blob))
+}
+
+// replaceField sets the value of a top-level field of a compacted document, keeping
+// the order of the fields so that the document still starts with its _id.
+func replaceField(doc []byte, key string, value any) ([]byte, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf(ErrMarshalJSON, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		if token == key {
+			end := int(dec.InputOffset())
+			start := end - len(raw)
+			return slices.Concat(doc[:start], encoded, doc[end:]), nil
+		}
+	}
+	return nil, fmt.Errorf("document has no %s", key)
+}
@@ -0,0 +1,259 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"dbackupcli/cmd/struct/manifest"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func couchDigest(content string) string {
+	sum := md5.Sum([]byte(content))
+	return "md5-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// gzipDigest is the digest CouchDB gives to the compressible types, the MD5 of the
+// content as it stores it, compressed with gzip.
+func gzipDigest(t *testing.T, content string) string {
+	t.Helper()
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(content))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return couchDigest(compressed.String())
+}
+
+func TestBlobName(t *testing.T) {
+	if blob, ok := BlobName(couchDigest("hello")); !ok || blob != "md5-5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("BlobName() = %q, %t", blob, ok)
+	}
+	for _, digest := range []string{"", "sha-abc", "md5-notbase64!", "md5-" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, ok := BlobName(digest); ok {
+			t.Errorf("BlobName(%q) accepted", digest)
+		}
+	}
+}
+
+func TestWriteBlob(t *testing.T) {
+	dir := t.TempDir()
+	blob, length, err := writeBlob(dir, attachment{Digest: couchDigest("hello"), Length: 5}, strings.NewReader("hello"))
+	if err != nil || blob != "md5-5d41402abc4b2a76b9719d911017c592" || length != 5 {
+		t.Fatalf("writeBlob() = %q, %d, %v", blob, length, err)
+	}
+	if _, _, err := writeBlob(dir, attachment{Digest: couchDigest("hello"), Length: 5}, strings.NewReader("tampered")); err == nil {
+		t.Errorf("a content not matching its digest was saved")
+	}
+	// Without an MD5 digest the blob is named after the SHA-256 of the content
+	if blob, _, err := writeBlob(dir, attachment{Length: 5}, strings.NewReader("hello")); err != nil || blob != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("writeBlob() without digest = %q, %v", blob, err)
+	}
+
+	// The digest of a compressed attachment is not the one of the decoded content
+	compressed := attachment{Digest: gzipDigest(t, `{"a":1}`), Length: 7, Encoding: "gzip"}
+	blob, _, err = writeBlob(dir, compressed, strings.NewReader(`{"a":1}`))
+	if want, _ := BlobName(compressed.Digest); err != nil || blob != want {
+		t.Errorf("writeBlob() of a compressed attachment = %q, %v, want %q", blob, err, want)
+	}
+	if _, _, err := writeBlob(dir, compressed, strings.NewReader(`{"a":12}`)); err == nil {
+		t.Errorf("a compressed attachment of the wrong length was saved")
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("the blob store has %d files, want 3 and no leftovers", len(entries))
+	}
+}
+
+func TestReplaceField(t *testing.T) {
+	doc := []byte(`{"_id":"a","_attachments":{"x":{"stub":true}},"n":1}`)
+	got, err := replaceField(doc, "_attachments", map[string]string{"y": "z"})
+	if err != nil || string(got) != `{"_id":"a","_attachments":{"y":"z"},"n":1}` {
+		t.Errorf("replaceField() = %s, %v", got, err)
+	}
+	if _, err := replaceField(doc, "missing", 1); err == nil {
+		t.Errorf("a missing field was replaced")
+	}
+}
+
+func TestAttachmentPaths(t *testing.T) {
+	if got := attachmentPath("dir/a b.png"); got != "dir/a%20b.png" {
+		t.Errorf("attachmentPath() = %q", got)
+	}
+
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "backups", "db.json")
+	os.MkdirAll(filepath.Dir(fileName), 0755)
+	if location, ok := AttachmentsLocation(fileName); ok || location != AttachmentsDir(fileName) {
+		t.Errorf("AttachmentsLocation() without attachments = %q, %t", location, ok)
+	}
+	os.Mkdir(AttachmentsDir(fileName), 0755)
+	if location, ok := AttachmentsLocation(fileName); !ok || location != AttachmentsDir(fileName) {
+		t.Errorf("AttachmentsLocation() next to the dump = %q, %t", location, ok)
+	}
+
+	store := filepath.Join(dir, BlobStoreDir)
+	reference := AttachmentsReference(fileName, store)
+	if reference != filepath.Join("..", BlobStoreDir) {
+		t.Errorf("AttachmentsReference() = %q", reference)
+	}
+	if err := WriteManifest(fileName, manifest.Manifest{Version: manifest.Version, Attachments: reference}); err != nil {
+		t.Fatal(err)
+	}
+	if location, ok := AttachmentsLocation(fileName); !ok || location != store {
+		t.Errorf("AttachmentsLocation() from the manifest = %q, %t, want %q", location, ok, store)
+	}
+}
+
+func TestSeparateAndUploadAttachments(t *testing.T) {
+	var mu sync.Mutex
+	uploaded := map[string][]string{}
+	var downloads int
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "GET":
+			downloads++
+			if r.URL.EscapedPath() != "/db/b/dir/stub%20file.txt" || r.URL.Query().Get("rev") != "1-b" {
+				t.Errorf("unexpected download %s", r.URL)
+			}
+			io.WriteString(w, "downloaded")
+		case "PUT":
+			if r.URL.Query().Get("new_edits") != "false" {
+				t.Errorf("document uploaded without new_edits=false")
+			}
+			_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			body, _ := io.ReadAll(r.Body)
+			if int64(len(body)) != r.ContentLength {
+				t.Errorf("Content-Length %d, body of %d bytes", r.ContentLength, len(body))
+			}
+			reader := multipart.NewReader(strings.NewReader(string(body)), params["boundary"])
+			var parts []string
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					break
+				}
+				content, _ := io.ReadAll(part)
+				parts = append(parts, string(content))
+			}
+			uploaded[strings.TrimPrefix(r.URL.Path, "/db/")] = parts
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"ok":true}`)
+		}
+	})
+
+	inline := base64.StdEncoding.EncodeToString([]byte("inline"))
+	fileName := writeDump(t,
+		`{"_id":"a","_rev":"1-a","_attachments":{"z.txt":{"content_type":"text/plain","revpos":1,"digest":"`+couchDigest("inline")+`","length":6,"data":"`+inline+`"},"a.txt":{"content_type":"text/plain","revpos":1,"digest":"`+couchDigest("downloaded")+`","length":10,"stub":true}}}`,
+		`{"_id":"b","_rev":"1-b","_attachments":{"dir/stub file.txt":{"content_type":"text/plain","revpos":1,"digest":"`+couchDigest("downloaded")+`","length":10,"stub":true}}}`,
+		`{"_id":"plain","_rev":"1-p"}`,
+	)
+	dir := filepath.Join(t.TempDir(), BlobStoreDir)
+
+	// a.txt of the first document is already in the store, as if an earlier backup saved it
+	os.MkdirAll(dir, 0755)
+	blob, _ := BlobName(couchDigest("downloaded"))
+	os.WriteFile(filepath.Join(dir, blob), []byte("downloaded"), 0644)
+
+	stats, err := SeparateAttachments(host, port, "admin", "secret", "db", fileName, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (AttachmentStats{Attachments: 3, Reused: 2, Bytes: 6}); stats != want {
+		t.Errorf("SeparateAttachments() = %+v, want %+v", stats, want)
+	}
+	if downloads != 0 {
+		t.Errorf("%d attachments downloaded, the store had them", downloads)
+	}
+
+	var docs [][]byte
+	ReadDump(fileName, func(doc []byte) error {
+		docs = append(docs, doc)
+		return nil
+	})
+	if !HasBlobs(docs[0]) || !HasBlobs(docs[1]) || HasBlobs(docs[2]) {
+		t.Errorf("HasBlobs() is wrong for the dump %s", docs)
+	}
+	if strings.Contains(string(docs[0]), `"data"`) || !strings.HasPrefix(string(docs[0]), `{"_id":"a",`) {
+		t.Errorf("document with separated attachments = %s", docs[0])
+	}
+	blobs := DocumentBlobs(docs[0])
+	slices.Sort(blobs)
+	inlineBlob, _ := BlobName(couchDigest("inline"))
+	if want := []string{inlineBlob, blob}; !reflect.DeepEqual(blobs, want) {
+		t.Errorf("DocumentBlobs() = %v, want %v", blobs, want)
+	}
+
+	count, err := UploadBlobDocuments(host, port, "admin", "secret", "db", fileName, dir)
+	if err != nil || count != 2 {
+		t.Fatalf("UploadBlobDocuments() = %d, %v", count, err)
+	}
+	parts := uploaded["a"]
+	if len(parts) != 3 || parts[1] != "downloaded" || parts[2] != "inline" {
+		t.Fatalf("multipart parts of a = %q", parts)
+	}
+	var doc struct {
+		Attachments map[string]attachment `json:"_attachments"`
+	}
+	if err := json.Unmarshal([]byte(parts[0]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if att := doc.Attachments["z.txt"]; !att.Follows || att.Blob != "" || att.Length != 6 {
+		t.Errorf("attachment sent as %+v", att)
+	}
+}
+
+func TestSeparateCompressedAttachments(t *testing.T) {
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		// CouchDB sends the attachment decoded
+		io.WriteString(w, `{"settings":true}`)
+	})
+	stubDigest, inlineDigest := gzipDigest(t, `{"settings":true}`), gzipDigest(t, "inline text")
+	fileName := writeDump(t,
+		`{"_id":"a","_rev":"1-a","_attachments":{"s.json":{"content_type":"application/json","revpos":1,"digest":"`+stubDigest+`","length":17,"stub":true,"encoding":"gzip","encoded_length":37},`+
+			`"t.txt":{"content_type":"text/plain","revpos":1,"digest":"`+inlineDigest+`","length":11,"encoding":"gzip","encoded_length":31,"data":"`+base64.StdEncoding.EncodeToString([]byte("inline text"))+`"}}}`,
+	)
+	dir := t.TempDir()
+
+	stats, err := SeparateAttachments(host, port, "admin", "secret", "db", fileName, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Attachments != 2 || stats.Bytes != 28 {
+		t.Errorf("SeparateAttachments() = %+v", stats)
+	}
+	for digest, content := range map[string]string{stubDigest: `{"settings":true}`, inlineDigest: "inline text"} {
+		blob, _ := BlobName(digest)
+		if got, err := os.ReadFile(filepath.Join(dir, blob)); err != nil || string(got) != content {
+			t.Errorf("blob %s = %q, %v, want %q", blob, got, err, content)
+		}
+	}
+}
+
+func TestBlobAttachmentsMixed(t *testing.T) {
+	// A document with an attachment still inline is restored by the script
+	doc := []byte(`{"_id":"a","_attachments":{"x":{"blob":"md5-00"},"y":{"data":"eA=="}}}`)
+	if HasBlobs(doc) {
+		t.Errorf("a document with an inline attachment has blobs")
+	}
+}
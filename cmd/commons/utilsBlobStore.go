@@ -0,0 +1,102 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// BlobGarbage are the blobs of a store that no dump references any more.
+type BlobGarbage struct {
+	Removed int
+	Bytes   int64
+	Kept    int
+}
+
+// ReferencedBlobs collects the blobs referenced by the dumps found under root, the
+// incomplete ones of the running backups included, leaving out the paths in skip.
+func ReferencedBlobs(root string, skip ...string) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if slices.ContainsFunc(skip, func(s string) bool { return samePath(path, s) }) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if strings.HasSuffix(name, AttachmentsSuffix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !IsDumpFile(name) && !strings.HasSuffix(name, ".json"+PartialSuffix) {
+			return nil
+		}
+		return ReadDump(path, func(doc []byte) error {
+			for _, blob := range DocumentBlobs(doc) {
+				referenced[blob] = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading the backups of %s: %v", root, err)
+	}
+	return referenced, nil
+}
+
+// CollectBlobs removes from the store the blobs that are not referenced, with the
+// temporary files left by interrupted backups. The files changed within grace are
+// kept, as a running backup may have written or reused them without referencing them
+// in a dump yet. With dryRun nothing is removed.
+func CollectBlobs(store string, referenced map[string]bool, grace time.Duration, dryRun bool) (BlobGarbage, error) {
+	var garbage BlobGarbage
+	entries, err := os.ReadDir(store)
+	if err != nil {
+		return garbage, fmt.Errorf("error reading the blob store %s: %v", store, err)
+	}
+	cutoff := time.Now().Add(-grace)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return garbage, fmt.Errorf("error reading the blob %s: %v", entry.Name(), err)
+		}
+		if referenced[entry.Name()] || info.ModTime().After(cutoff) {
+			garbage.Kept++
+			continue
+		}
+		if !dryRun {
+			fileName := filepath.Join(store, entry.Name())
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return garbage, fmt.Errorf(ErrRemoveFile, fileName, err)
+			}
+			slog.Debug("blob removed", "blob", entry.Name(), "bytes", info.Size())
+		}
+		garbage.Removed++
+		garbage.Bytes += info.Size()
+	}
+	return garbage, nil
+}
+
+func samePath(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
@@ -0,0 +1,89 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeBlobDump(t *testing.T, fileName string, blobs ...string) {
+	t.Helper()
+	content := "{\"new_edits\":false,\"docs\":[\n"
+	for i, blob := range blobs {
+		if i > 0 {
+			content += ",\n"
+		}
+		content += `{"_id":"` + blob + `","_attachments":{"f":{"content_type":"text/plain","length":1,"blob":"` + blob + `"}}}`
+	}
+	content += "\n]}\n"
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReferencedBlobs(t *testing.T) {
+	root := t.TempDir()
+	writeBlobDump(t, filepath.Join(root, "run-1", "a.json"), "blob-a", "blob-shared")
+	writeBlobDump(t, filepath.Join(root, "run-2", "b.json"), "blob-b", "blob-shared")
+	// A backup still running references its blobs in the partial dump
+	writeBlobDump(t, filepath.Join(root, "run-3", "c.json"+PartialSuffix), "blob-c")
+	// The files of the blob store and of the attachments directories are not dumps
+	writeBlobDump(t, filepath.Join(root, BlobStoreDir, "x.json"), "blob-x")
+	writeBlobDump(t, filepath.Join(root, "run-1", "a.json"+AttachmentsSuffix, "y.json"), "blob-y")
+
+	referenced, err := ReferencedBlobs(root, filepath.Join(root, BlobStoreDir), filepath.Join(root, "run-2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{"blob-a": true, "blob-shared": true, "blob-c": true}
+	if !reflect.DeepEqual(referenced, want) {
+		t.Errorf("ReferencedBlobs() = %v, want %v", referenced, want)
+	}
+}
+
+func TestCollectBlobs(t *testing.T) {
+	store := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"used", "unused", "interrupted" + PartialSuffix, "recent"} {
+		fileName := filepath.Join(store, name)
+		if err := os.WriteFile(fileName, []byte("1234"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "recent" {
+			os.Chtimes(fileName, old, old)
+		}
+	}
+	referenced := map[string]bool{"used": true}
+
+	garbage, err := CollectBlobs(store, referenced, time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (BlobGarbage{Removed: 2, Bytes: 8, Kept: 2}); garbage != want {
+		t.Errorf("CollectBlobs() dry run = %+v, want %+v", garbage, want)
+	}
+	if entries, _ := os.ReadDir(store); len(entries) != 4 {
+		t.Errorf("the dry run removed %d blobs", 4-len(entries))
+	}
+
+	if _, err := CollectBlobs(store, referenced, time.Hour, false); err != nil {
+		t.Fatal(err)
+	}
+	var left []string
+	entries, _ := os.ReadDir(store)
+	for _, entry := range entries {
+		left = append(left, entry.Name())
+	}
+	if want := []string{"recent", "used"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("blobs left = %v, want %v", left, want)
+	}
+}
@@ -0,0 +1,271 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"dbackupcli/cmd/struct/catalog"
+	"dbackupcli/cmd/struct/report"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	catalogEnv         = "DBACKUPCLI_CATALOG"
+	defaultCatalogFile = ".dbackupcli-catalog.jsonl"
+)
+
+// secretFlags are the flags whose values are redacted from the catalog.
+// The webhook URLs carry the token of the channel they post to.
+var secretFlags = []string{"-p", "--password", "--smtp-password", "--replicator-password", "--notify-webhook", "--notify-slack", "--notify-teams"}
+
+// catalogDays is a duration in days (7d) or weeks (2w), which time.ParseDuration does not read.
+var catalogDays = regexp.MustCompile(`^([0-9]+)([dw])$`)
+
+// GetCatalogFile returns the catalog of the backups: --catalog, then $DBACKUPCLI_CATALOG,
+// then the catalog of the config file, then ~/.dbackupcli-catalog.jsonl.
+func GetCatalogFile(cmd *cobra.Command) string {
+	if fileName, _ := cmd.Flags().GetString("catalog"); fileName != "" {
+		return fileName
+	}
+	if fileName := os.Getenv(catalogEnv); fileName != "" {
+		return fileName
+	}
+	if config, _ := GetConfig(cmd); config.Catalog != "" {
+		return config.Catalog
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, defaultCatalogFile)
+}
+
+// RecordCatalog appends to the catalog the dumps written by a backup run. A run that
+// wrote no dump is not recorded.
+func RecordCatalog(fileName string, run report.RunReport, args []string, tags []string) (catalog.Entry, bool, error) {
+	entry := catalog.Entry{
+		ID:         randomID()[:16],
+		Command:    run.Command,
+		Status:     run.Status,
+		Tags:       tags,
+		StartedAt:  run.StartedAt,
+		FinishedAt: run.FinishedAt,
+		Duration:   run.Duration,
+		Args:       RedactArgs(args),
+		Databases:  []catalog.Database{},
+	}
+	for _, result := range run.Databases {
+		if result.Operation != "backup" || result.Status != report.StatusOK || result.File == "" {
+			continue
+		}
+		file, _ := filepath.Abs(result.File)
+		database := catalog.Database{
+			Database:    result.Database,
+			File:        file,
+			Documents:   result.Documents,
+			Deleted:     result.Deleted,
+			Conflicts:   result.Conflicts,
+			Attachments: result.Attachments,
+			Bytes:       result.Bytes,
+		}
+		checksum, err := fileChecksum(file)
+		if err != nil {
+			return entry, false, fmt.Errorf("error reading the dump %s: %v", file, err)
+		}
+		database.SHA256 = checksum
+		if settings, ok, err := LoadManifest(file); err == nil && ok {
+			database.Manifest = &settings
+			database.UpdateSeq = settings.UpdateSeq
+		}
+		entry.Host = result.Host
+		entry.Databases = append(entry.Databases, database)
+	}
+	if len(entry.Databases) == 0 {
+		return entry, false, nil
+	}
+	entry.Location = filepath.Dir(entry.Databases[0].File)
+	if len(entry.Databases) == 1 && entry.Command == "backup" {
+		entry.Location = entry.Databases[0].File
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return entry, false, fmt.Errorf(ErrMarshalJSON, err)
+	}
+	lock, err := AcquireLock(fileName + LockSuffix)
+	if err != nil {
+		return entry, false, err
+	}
+	defer lock.Release()
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return entry, false, fmt.Errorf("error writing the catalog %s: %v", fileName, err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return entry, false, fmt.Errorf("error writing the catalog %s: %v", fileName, err)
+	}
+	if err := f.Close(); err != nil {
+		return entry, false, fmt.Errorf("error writing the catalog %s: %v", fileName, err)
+	}
+	return entry, true, nil
+}
+
+// ReadCatalog returns the entries of the catalog from the oldest to the newest, none
+// when it does not exist yet.
+func ReadCatalog(fileName string) ([]catalog.Entry, error) {
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return []catalog.Entry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading the catalog %s: %v", fileName, err)
+	}
+	defer f.Close()
+	entries := []catalog.Entry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var entry catalog.Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("error reading line %d of the catalog %s: %v", line, fileName, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading the catalog %s: %v", fileName, err)
+	}
+	return entries, nil
+}
+
+// FindCatalogEntry returns the entry whose ID starts with prefix.
+func FindCatalogEntry(entries []catalog.Entry, prefix string) (catalog.Entry, error) {
+	var found []catalog.Entry
+	for _, entry := range entries {
+		if prefix != "" && strings.HasPrefix(entry.ID, prefix) {
+			found = append(found, entry)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return catalog.Entry{}, NewExitError(ExitUsage, fmt.Errorf("no backup with ID %q in the catalog", prefix))
+	case 1:
+		return found[0], nil
+	default:
+		return catalog.Entry{}, NewExitError(ExitUsage, fmt.Errorf("the ID %q matches %d backups", prefix, len(found)))
+	}
+}
+
+// CatalogFilter selects the entries of the catalog, the empty fields match everything.
+type CatalogFilter struct {
+	// Hosts and Databases are patterns, as the ones of the policy
+	Hosts     []string
+	Databases []string
+	Since     time.Time
+	Until     time.Time
+	// Tags must all be on the entry
+	Tags []string
+}
+
+// Filter returns the entries that match, with only the databases that match.
+func (f CatalogFilter) Filter(entries []catalog.Entry) []catalog.Entry {
+	matching := []catalog.Entry{}
+	for _, entry := range entries {
+		if len(f.Hosts) > 0 && !matchAny(f.Hosts, entry.Host) {
+			continue
+		}
+		if !f.Since.IsZero() && entry.StartedAt.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && !entry.StartedAt.Before(f.Until) {
+			continue
+		}
+		if slices.ContainsFunc(f.Tags, func(tag string) bool { return !slices.Contains(entry.Tags, tag) }) {
+			continue
+		}
+		if len(f.Databases) > 0 {
+			entry.Databases = slices.DeleteFunc(slices.Clone(entry.Databases), func(db catalog.Database) bool {
+				return !matchAny(f.Databases, db.Database)
+			})
+			if len(entry.Databases) == 0 {
+				continue
+			}
+		}
+		matching = append(matching, entry)
+	}
+	return matching
+}
+
+// ParseCatalogTime reads a date (2006-01-02, local time), a timestamp (RFC 3339) or a
+// duration back from now (e.g. 36h, 7d or 2w).
+func ParseCatalogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if match := catalogDays.FindStringSubmatch(value); match != nil {
+		if days, err := strconv.Atoi(match[1]); err == nil {
+			if match[2] == "w" {
+				days *= 7
+			}
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, NewExitError(ExitUsage, fmt.Errorf("invalid time %q, use 2006-01-02, RFC 3339 or a duration such as 36h, 7d or 2w", value))
+}
+
+// RedactArgs replaces the values of the password flags.
+func RedactArgs(args []string) []string {
+	redacted := slices.Clone(args)
+	for i, arg := range redacted {
+		for _, flag := range secretFlags {
+			if arg == flag && i+1 < len(redacted) {
+				redacted[i+1] = "REDACTED"
+			} else if strings.HasPrefix(arg, flag+"=") {
+				redacted[i] = flag + "=REDACTED"
+			} else if flag == "-p" && strings.HasPrefix(arg, "-p") && len(arg) > 2 {
+				redacted[i] = "-pREDACTED"
+			}
+		}
+	}
+	return redacted
+}
+
+func fileChecksum(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
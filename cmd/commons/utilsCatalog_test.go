@@ -0,0 +1,184 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/catalog"
+	"dbackupcli/cmd/struct/report"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCatalogTime(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		value string
+		want  time.Time
+		valid bool
+	}{
+		{"", time.Time{}, true},
+		{"2025-06-01", time.Date(2025, 6, 1, 0, 0, 0, 0, time.Local), true},
+		{"2025-06-01T10:30:00Z", time.Date(2025, 6, 1, 10, 30, 0, 0, time.UTC), true},
+		{"36h", now.Add(-36 * time.Hour), true},
+		{"90m", now.Add(-90 * time.Minute), true},
+		{"7d", now.AddDate(0, 0, -7), true},
+		{"0d", now, true},
+		{"2w", now.AddDate(0, 0, -14), true},
+		{"-36h", time.Time{}, false},
+		{"1.5d", time.Time{}, false},
+		{"7days", time.Time{}, false},
+		{"d", time.Time{}, false},
+		{"2025-13-01", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseCatalogTime(test.value)
+		if !test.valid {
+			if ExitCode(err) != ExitUsage {
+				t.Errorf("ParseCatalogTime(%q) = %v, %v, want a usage error", test.value, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseCatalogTime(%q) returned %v", test.value, err)
+			continue
+		}
+		// The durations are relative to the time of the call
+		if diff := got.Sub(test.want); diff < -time.Second || diff > time.Second {
+			t.Errorf("ParseCatalogTime(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			[]string{"backup", "-d", "db", "-p", "root", "--host", "h"},
+			[]string{"backup", "-d", "db", "-p", "REDACTED", "--host", "h"},
+		},
+		{
+			[]string{"backup", "-proot", "--password=root", "--port", "5984"},
+			[]string{"backup", "-pREDACTED", "--password=REDACTED", "--port", "5984"},
+		},
+		{
+			[]string{"backupAll", "--smtp-password", "s", "--replicator-password=r"},
+			[]string{"backupAll", "--smtp-password", "REDACTED", "--replicator-password=REDACTED"},
+		},
+		{
+			[]string{"daemon", "--notify-slack", "https://hooks.slack.com/services/T/B/x", "--notify-teams=https://example.webhook.office.com/x"},
+			[]string{"daemon", "--notify-slack", "REDACTED", "--notify-teams=REDACTED"},
+		},
+		{
+			[]string{"backup", "--notify-webhook=https://ops.example.com/hook?token=x", "--notify-on", "failure"},
+			[]string{"backup", "--notify-webhook=REDACTED", "--notify-on", "failure"},
+		},
+		{
+			// A secret flag at the end has no value to redact
+			[]string{"backup", "--tag", "weekly", "--password"},
+			[]string{"backup", "--tag", "weekly", "--password"},
+		},
+	}
+	for _, test := range tests {
+		args := append([]string(nil), test.args...)
+		if got := RedactArgs(args); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("RedactArgs(%q) = %q, want %q", test.args, got, test.want)
+		}
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("RedactArgs changed its argument to %q", args)
+		}
+	}
+}
+
+func TestRecordCatalog(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "catalog.jsonl")
+	dump := filepath.Join(dir, "db.json")
+	if err := os.WriteFile(dump, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Date(2025, 6, 1, 2, 0, 0, 0, time.UTC)
+	run := report.RunReport{Command: "backupAll", Status: report.StatusOK, StartedAt: started, Databases: []report.DatabaseResult{
+		{Operation: "backup", Host: "prod", Database: "db", File: dump, Status: report.StatusOK, Documents: 3},
+		{Operation: "backup", Host: "prod", Database: "failed", Status: report.StatusFailed},
+	}}
+
+	entry, recorded, err := RecordCatalog(fileName, run, []string{"backupAll", "-p", "root"}, []string{"nightly"})
+	if err != nil || !recorded {
+		t.Fatalf("RecordCatalog() = %t, %v", recorded, err)
+	}
+	if len(entry.Databases) != 1 || entry.Databases[0].SHA256 != "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a" {
+		t.Errorf("entry databases = %+v", entry.Databases)
+	}
+	if !reflect.DeepEqual(entry.Args, []string{"backupAll", "-p", "REDACTED"}) {
+		t.Errorf("entry args = %q", entry.Args)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("the catalog is readable by the others: %v", err)
+	}
+
+	// A run without dumps is not recorded
+	if _, recorded, err := RecordCatalog(fileName, report.RunReport{Command: "backup"}, nil, nil); recorded || err != nil {
+		t.Errorf("RecordCatalog() of a run without dumps = %t, %v", recorded, err)
+	}
+
+	entries, err := ReadCatalog(fileName)
+	if err != nil || len(entries) != 1 || entries[0].ID != entry.ID || entries[0].Host != "prod" {
+		t.Fatalf("ReadCatalog() = %+v, %v", entries, err)
+	}
+	if found, err := FindCatalogEntry(entries, entry.ID[:8]); err != nil || found.ID != entry.ID {
+		t.Errorf("FindCatalogEntry() = %s, %v", found.ID, err)
+	}
+	if _, err := FindCatalogEntry(entries, "zzz"); ExitCode(err) != ExitUsage {
+		t.Errorf("FindCatalogEntry() of a missing ID returned %v", err)
+	}
+	if entries, err := ReadCatalog(filepath.Join(dir, "missing.jsonl")); err != nil || len(entries) != 0 {
+		t.Errorf("ReadCatalog() of a missing catalog = %v, %v", entries, err)
+	}
+}
+
+func TestCatalogFilter(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2025, 6, d, 2, 0, 0, 0, time.UTC) }
+	entries := []catalog.Entry{
+		{ID: "a", Host: "prod", StartedAt: day(1), Tags: []string{"nightly"}, Databases: []catalog.Database{{Database: "orders-1"}, {Database: "users"}}},
+		{ID: "b", Host: "prod", StartedAt: day(2), Databases: []catalog.Database{{Database: "users"}}},
+		{ID: "c", Host: "staging", StartedAt: day(3), Tags: []string{"nightly", "weekly"}, Databases: []catalog.Database{{Database: "orders-2"}}},
+	}
+	tests := []struct {
+		name   string
+		filter CatalogFilter
+		want   []string
+	}{
+		{"everything", CatalogFilter{}, []string{"a", "b", "c"}},
+		{"host", CatalogFilter{Hosts: []string{"prod"}}, []string{"a", "b"}},
+		{"database pattern", CatalogFilter{Databases: []string{"orders-*"}}, []string{"a", "c"}},
+		{"since", CatalogFilter{Since: day(2)}, []string{"b", "c"}},
+		{"until", CatalogFilter{Until: day(2)}, []string{"a"}},
+		{"tags", CatalogFilter{Tags: []string{"nightly", "weekly"}}, []string{"c"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got []string
+			for _, entry := range test.filter.Filter(entries) {
+				got = append(got, entry.ID)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Filter() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Only the matching databases of an entry are kept
+	filtered := CatalogFilter{Databases: []string{"users"}}.Filter(entries)
+	if len(filtered[0].Databases) != 1 || len(entries[0].Databases) != 2 {
+		t.Errorf("Filter() kept %v and left %v", filtered[0].Databases, entries[0].Databases)
+	}
+}
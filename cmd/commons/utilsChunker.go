@@ -0,0 +1,63 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// Chunker splits a stream into content-defined chunks with a gear rolling hash: a
+// boundary falls where the hash of the last bytes matches the mask, so a change in
+// a dump moves the boundaries only around it and the other chunks stay the same.
+type Chunker struct {
+	r     *bufio.Reader
+	gear  [256]uint64
+	min   int
+	max   int
+	mask  uint64
+	chunk []byte
+}
+
+// NewChunker returns a chunker of r. The gear table is derived from seed, so two
+// repositories with different seeds cut the same data in different places.
+func NewChunker(r io.Reader, seed string, minSize int, avgSize int, maxSize int) *Chunker {
+	c := &Chunker{r: bufio.NewReaderSize(r, 1<<20), min: minSize, max: maxSize}
+	// The mask has as many bits as log2 of the average size, in the high half of the
+	// hash, which depends on the last 64 bytes
+	maskBits := bits.Len(uint(avgSize)) - 1
+	c.mask = (uint64(1)<<maskBits - 1) << (64 - maskBits)
+	for i := range c.gear {
+		sum := sha256.Sum256([]byte(seed + string(rune(i))))
+		c.gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+	return c
+}
+
+// Next returns the next chunk, valid until the following call, and io.EOF at the end.
+func (c *Chunker) Next() ([]byte, error) {
+	c.chunk = c.chunk[:0]
+	var hash uint64
+	for {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			if len(c.chunk) == 0 {
+				return nil, io.EOF
+			}
+			return c.chunk, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.chunk = append(c.chunk, b)
+		hash = hash<<1 + c.gear[b]
+		if len(c.chunk) >= c.max || (len(c.chunk) >= c.min && hash&c.mask == 0) {
+			return c.chunk, nil
+		}
+	}
+}
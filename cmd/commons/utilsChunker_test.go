@@ -0,0 +1,109 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand/v2"
+	"testing"
+)
+
+// randomData returns size bytes that are always the same for the same seed.
+func randomData(seed uint64, size int) []byte {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	return data
+}
+
+func chunks(t *testing.T, data []byte, seed string) [][]byte {
+	t.Helper()
+	var result [][]byte
+	chunker := NewChunker(bytes.NewReader(data), seed, 1<<10, 4<<10, 16<<10)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkerSizes(t *testing.T) {
+	data := randomData(1, 1<<20)
+	result := chunks(t, data, "seed")
+	if joined := bytes.Join(result, nil); !bytes.Equal(joined, data) {
+		t.Fatalf("the chunks do not make up the data")
+	}
+	for i, chunk := range result {
+		if len(chunk) > 16<<10 || (len(chunk) < 1<<10 && i != len(result)-1) {
+			t.Errorf("chunk %d has %d bytes, outside 1KiB-16KiB", i, len(chunk))
+		}
+	}
+	// About 1MiB / (1KiB + 4KiB) chunks
+	if len(result) < 100 || len(result) > 400 {
+		t.Errorf("%d chunks for 1MiB with an average of 4KiB", len(result))
+	}
+
+	// A chunk of the maximum size is cut even when the hash never matches
+	if result := chunks(t, make([]byte, 40<<10), "seed"); len(result) != 3 || len(result[0]) != 16<<10 {
+		t.Errorf("zeroes cut in %d chunks", len(result))
+	}
+	if result := chunks(t, nil, "seed"); len(result) != 0 {
+		t.Errorf("empty data cut in %d chunks", len(result))
+	}
+}
+
+func TestChunkerLocality(t *testing.T) {
+	data := randomData(2, 1<<20)
+	original := chunks(t, data, "seed")
+	ids := make(map[[32]byte]bool, len(original))
+	for _, chunk := range original {
+		ids[sha256.Sum256(chunk)] = true
+	}
+
+	edited := bytes.Clone(data)
+	edited[len(edited)/2] ^= 0xff
+	var changed int
+	for _, chunk := range chunks(t, edited, "seed") {
+		if !ids[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	// The chunk with the byte changes, and the next one when the edit moves a boundary
+	if changed == 0 || changed > 2 {
+		t.Errorf("a single byte edit changed %d of %d chunks", changed, len(original))
+	}
+
+	// Inserting bytes shifts the data after them without changing its chunks
+	inserted := append(append(bytes.Clone(data[:len(data)/2]), "inserted"...), data[len(data)/2:]...)
+	changed = 0
+	for _, chunk := range chunks(t, inserted, "seed") {
+		if !ids[sha256.Sum256(chunk)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("an insertion changed %d of %d chunks", changed, len(original))
+	}
+
+	// Another seed cuts in other places
+	var same int
+	for _, chunk := range chunks(t, data, "other") {
+		if ids[sha256.Sum256(chunk)] {
+			same++
+		}
+	}
+	if same > len(original)/10 {
+		t.Errorf("%d of %d chunks are the same with another seed", same, len(original))
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+const defaultConfigFile = ".dbackupcli.json"
+
+type Config struct {
+	SafetyDir     string             `json:"safety_dir"`
+	Catalog       string             `json:"catalog"`
+	Profiles      map[string]Profile `json:"profiles"`
+	Policy        Policy             `json:"policy"`
+	Notifications []Notification     `json:"notifications"`
+	SMTP          SMTPConfig         `json:"smtp"`
+	Hooks         map[string]Hooks   `json:"hooks"`
+}
+
+type Profile struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+
+	ConnectTimeout  string `json:"connect_timeout"`
+	ReadTimeout     string `json:"read_timeout"`
+	Retries         *int   `json:"retries"`
+	RetryBackoff    string `json:"retry_backoff"`
+	RetryMaxBackoff string `json:"retry_max_backoff"`
+
+	MaxBandwidth      string  `json:"max_bandwidth"`
+	MaxRequestsPerSec float64 `json:"max_requests_per_sec"`
+}
+
+var loadedConfig *Config
+
+func LoadConfig(fileName string) (Config, error) {
+	if loadedConfig != nil {
+		return *loadedConfig, nil
+	}
+
+	explicit := fileName != ""
+	if !explicit {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Config{}, nil
+		}
+		fileName = filepath.Join(home, defaultConfigFile)
+	}
+
+	var config Config
+	body, err := os.ReadFile(fileName)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			loadedConfig = &config
+			return config, nil
+		}
+		return Config{}, fmt.Errorf("error reading config file %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return Config{}, fmt.Errorf("error parsing config file %s: %v", fileName, err)
+	}
+	loadedConfig = &config
+	return config, nil
+}
+
+// GetConfig returns the config file of --config, or ~/.dbackupcli.json when it exists.
+// CheckConfig reports its errors before the commands run, so the helpers reading a
+// setting of the config can ignore them.
+func GetConfig(cmd *cobra.Command) (Config, error) {
+	fileName, _ := cmd.Flags().GetString("config")
+	config, err := LoadConfig(fileName)
+	if err != nil {
+		return Config{}, NewExitError(ExitUsage, err)
+	}
+	return config, nil
+}
+
+// GetProfile returns the profile of the config selected with --profile, if any.
+func GetProfile(cmd *cobra.Command) (string, Profile, error) {
+	name, _ := cmd.Flags().GetString("profile")
+	if name == "" {
+		return "", Profile{}, nil
+	}
+	config, err := GetConfig(cmd)
+	if err != nil {
+		return "", Profile{}, err
+	}
+	profile, ok := config.Profiles[name]
+	if !ok {
+		return "", Profile{}, NewExitError(ExitUsage, fmt.Errorf("profile %s not found in the config file", name))
+	}
+	return name, profile, nil
+}
+
+// CheckConfig loads the config file and the selected profile.
+func CheckConfig(cmd *cobra.Command) error {
+	_, _, err := GetProfile(cmd)
+	if err == nil {
+		_, err = GetConfig(cmd)
+	}
+	return err
+}
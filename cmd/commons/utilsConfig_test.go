@@ -0,0 +1,68 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Cleanup(func() { loadedConfig = nil })
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(fileName, []byte(`{
+		"safety_dir": "/var/backups/safety",
+		"profiles": {"prod": {"host": "couch.example.com", "port": 6984, "user": "admin", "password": "secret"}},
+		"policy": {"protected_databases": ["billing"]}
+	}`), 0600)
+
+	loadedConfig = nil
+	config, err := LoadConfig(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.SafetyDir != "/var/backups/safety" || config.Profiles["prod"].Port != 6984 || config.Policy.ProtectedDatabases[0] != "billing" {
+		t.Errorf("unexpected config %+v", config)
+	}
+
+	loadedConfig = nil
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("a missing explicit config file was accepted")
+	}
+
+	loadedConfig = nil
+	os.WriteFile(fileName, []byte(`{"profiles": [`), 0600)
+	if _, err := LoadConfig(fileName); err == nil {
+		t.Errorf("an invalid config file was accepted")
+	}
+}
+
+func TestGetProfileErrors(t *testing.T) {
+	t.Cleanup(func() { loadedConfig = nil })
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(fileName, []byte(`{"profiles": {"prod": {"host": "couch.example.com"}}}`), 0600)
+	newCmd := func(profile string) *cobra.Command {
+		cmd := &cobra.Command{}
+		cmd.Flags().String("config", fileName, "")
+		cmd.Flags().String("profile", profile, "")
+		return cmd
+	}
+
+	loadedConfig = nil
+	name, profile, err := GetProfile(newCmd("prod"))
+	if err != nil || name != "prod" || profile.Host != "couch.example.com" {
+		t.Errorf("GetProfile(prod) = %q, %+v, %v", name, profile, err)
+	}
+
+	err = CheckConfig(newCmd("staging"))
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != ExitUsage {
+		t.Errorf("missing profile: got %v, want a usage error", err)
+	}
+}
@@ -13,7 +13,9 @@ import (
 	"github.com/AlecAivazis/survey/v2"
 	"github.com/spf13/cobra"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -30,6 +32,7 @@ const (
 	ErrPerformHTTPRequest = "error performing the http request: %v"
 	ErrReadResponseBody   = "error reading response body: %v"
 	ErrUnmarshalJSON      = "error unmarshalling JSON: %v"
+	ErrMarshalJSON        = "error marshalling JSON: %v"
 	ErrRemoveFile         = "error removing file %s: %v"
 )
 
@@ -44,24 +47,19 @@ func CheckFlags(args []string) bool {
 	return isMissing
 }
 
+// OverWriteFile asks to confirm the replacement of an existing dump, which is
+// replaced only once the new one is complete.
 func OverWriteFile(fileName string) error {
 	if _, err := os.Stat(fileName); err == nil {
-		fmt.Printf("File %s already exists. Do you want to overwrite it? (y/n): ", fileName)
+		fmt.Fprintf(Out, "File %s already exists. Do you want to overwrite it? (y/n): ", fileName)
 		reader := bufio.NewReader(os.Stdin)
 		input, _ := reader.ReadString('\n')
 		input = strings.TrimSpace(input)
 
 		if input != "y" && input != "Y" {
-			return errors.New("operation canceled. The file will not be overwritten")
-		}
-
-		fmt.Println("Overwriting file...")
-		err := os.Remove(fileName)
-		if err != nil {
-			return fmt.Errorf(ErrRemoveFile, fileName, err)
-		} else {
-			fmt.Printf("File %s removed.\n", fileName)
+			return NewExitError(ExitUserAbort, errors.New("operation canceled. The file will not be overwritten"))
 		}
+		fmt.Fprintf(Out, "File %s will be replaced once the backup completes.\n", fileName)
 	} else if !os.IsNotExist(err) {
 		return fmt.Errorf("error checking file %s: %v", fileName, err)
 	}
@@ -70,7 +68,6 @@ func OverWriteFile(fileName string) error {
 
 func GetDBs(host string, port int, user string, password string) ([]string, error) {
 	url := urlProtocol + host + ":" + strconv.Itoa(port) + "/_all_dbs"
-	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf(ErrCreateHTTPRequest, err)
@@ -78,9 +75,9 @@ func GetDBs(host string, port int, user string, password string) ([]string, erro
 
 	req.Header.Add(headerContentType, valueJSON)
 	req.SetBasicAuth(user, password)
-	res, err := client.Do(req)
+	res, err := Do(req)
 	if err != nil {
-		return nil, fmt.Errorf(ErrPerformHTTPRequest, err)
+		return nil, connectionError(err)
 	}
 	defer res.Body.Close()
 
@@ -88,6 +85,9 @@ func GetDBs(host string, port int, user string, password string) ([]string, erro
 	if err != nil {
 		return nil, fmt.Errorf(ErrReadResponseBody, err)
 	}
+	if res.StatusCode != 200 {
+		return nil, statusError(res, body)
+	}
 	var dbNames []string
 
 	err = json.Unmarshal(body, &dbNames)
@@ -99,16 +99,15 @@ func GetDBs(host string, port int, user string, password string) ([]string, erro
 
 func GetDB(host string, port int, user string, password string, dbName string) (int, couchdb.Database, error) {
 	url := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName
-	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return 0, couchdb.Database{}, fmt.Errorf(ErrCreateHTTPRequest, err)
 	}
 	req.Header.Add(headerContentType, valueJSON)
 	req.SetBasicAuth(user, password)
-	res, err := client.Do(req)
+	res, err := Do(req)
 	if err != nil {
-		return 0, couchdb.Database{}, fmt.Errorf(ErrPerformHTTPRequest, err)
+		return 0, couchdb.Database{}, connectionError(err)
 	}
 	defer res.Body.Close()
 	body, err := io.ReadAll(res.Body)
@@ -118,7 +117,7 @@ func GetDB(host string, port int, user string, password string, dbName string) (
 
 	var db couchdb.Database
 	if res.StatusCode != 200 {
-		return res.StatusCode, couchdb.Database{}, fmt.Errorf("%s", string(body))
+		return res.StatusCode, couchdb.Database{}, statusError(res, body)
 	} else {
 		err = json.Unmarshal(body, &db)
 		if err != nil {
@@ -130,22 +129,22 @@ func GetDB(host string, port int, user string, password string, dbName string) (
 
 func DeleteDatabase(host string, port int, user string, password string, dbName string) error {
 	url := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName
-	client := &http.Client{}
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return fmt.Errorf(ErrCreateHTTPRequest, err)
 	}
 	req.Header.Add(headerContentType, valueJSON)
 	req.SetBasicAuth(user, password)
-	res, err := client.Do(req)
+	res, err := Do(req)
 	if err != nil {
-		return fmt.Errorf(ErrPerformHTTPRequest, err)
+		return connectionError(err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return fmt.Errorf("error deleting the database: %s", res.Status)
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("error deleting the database: %w", statusError(res, body))
 	}
-	fmt.Printf("Database %s deleted.\n", dbName)
+	slog.Info("database deleted", "db", dbName, "host", host)
 	return nil
 }
 
@@ -155,7 +154,7 @@ func SelectDatabase(options []string, selectedDb *string) error {
 		Options: options,
 		Default: options[0],
 	}
-	err := survey.AskOne(prompt, selectedDb)
+	err := survey.AskOne(prompt, selectedDb, survey.WithStdio(os.Stdin, outFile(), os.Stderr))
 	if err != nil {
 		return fmt.Errorf("error: %v", err)
 	}
@@ -167,6 +166,21 @@ func GetAuthFlagValues(cmd *cobra.Command) (user string, host string, password s
 	password, _ = cmd.Flags().GetString("password")
 	host, _ = cmd.Flags().GetString("host")
 	port, _ = cmd.Flags().GetInt("port")
+
+	if _, profile, _ := GetProfile(cmd); profile.Host != "" {
+		if host == "" {
+			host = profile.Host
+		}
+		if user == "" {
+			user = profile.User
+		}
+		if password == "" {
+			password = profile.Password
+		}
+		if !cmd.Flags().Changed("port") && profile.Port != 0 {
+			port = profile.Port
+		}
+	}
 	return
 }
 
@@ -174,7 +188,40 @@ func PrepareCmdAuthArgs(args []string, user string, password string, host string
 	args = append(args, "-u", user, "-p", password, "-H", host)
 
 	if port != 5984 {
-		args = append(args, "--port", strconv.Itoa(port))
+		args = append(args, "-P", strconv.Itoa(port))
+	}
+	return append(args, ScriptTransportArgs()...)
+}
+
+// docRevsPageSize is the number of rows read with each _all_docs request of GetDocRevs
+const docRevsPageSize = 10000
+
+// GetDocRevs returns the current revision of every document of the database, reading
+// _all_docs page by page so that a large database is not held in a single response.
+func GetDocRevs(host string, port int, user string, password string, dbName string) (map[string]string, error) {
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/_all_docs?limit=" + strconv.Itoa(docRevsPageSize)
+	revs := make(map[string]string)
+	var query string
+	for {
+		body, err := couchRequest("GET", address+query, user, password, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error listing the documents: %w", err)
+		}
+		var allDocs couchdb.AllDocs
+		if err := json.Unmarshal(body, &allDocs); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		for _, row := range allDocs.Rows {
+			revs[row.ID] = row.Value.Rev
+		}
+		if len(allDocs.Rows) < docRevsPageSize {
+			return revs, nil
+		}
+		// The next page starts after the last ID read
+		startKey, err := json.Marshal(allDocs.Rows[len(allDocs.Rows)-1].ID)
+		if err != nil {
+			return nil, fmt.Errorf(ErrMarshalJSON, err)
+		}
+		query = "&skip=1&startkey=" + url.QueryEscape(string(startKey))
 	}
-	return args
 }
@@ -0,0 +1,85 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestGetDocRevsPages(t *testing.T) {
+	var ids []string
+	for i := range docRevsPageSize*2 + 5 {
+		ids = append(ids, fmt.Sprintf("doc-%06d", i))
+	}
+	var requests int
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		start := 0
+		if key := r.URL.Query().Get("startkey"); key != "" {
+			var startKey string
+			if err := json.Unmarshal([]byte(key), &startKey); err != nil {
+				t.Fatalf("invalid startkey %q", key)
+			}
+			start, _ = slices.BinarySearch(ids, startKey)
+			skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+			start += skip
+		}
+		type row struct {
+			ID    string            `json:"id"`
+			Value map[string]string `json:"value"`
+		}
+		rows := []row{}
+		for _, id := range ids[start:min(start+limit, len(ids))] {
+			rows = append(rows, row{ID: id, Value: map[string]string{"rev": "1-" + id}})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"total_rows": len(ids), "rows": rows})
+	})
+
+	revs, err := GetDocRevs(host, port, "admin", "secret", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != len(ids) {
+		t.Fatalf("got %d revisions, want %d", len(revs), len(ids))
+	}
+	if revs["doc-000000"] != "1-doc-000000" || revs[ids[len(ids)-1]] != "1-"+ids[len(ids)-1] {
+		t.Fatalf("wrong revisions: %v %v", revs["doc-000000"], revs[ids[len(ids)-1]])
+	}
+	if requests != 3 {
+		t.Fatalf("got %d requests, want 3", requests)
+	}
+}
+
+func TestPutDesignDocsUsesLiveRevision(t *testing.T) {
+	var puts []map[string]any
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" || r.URL.Path != "/db/_design/views" || r.URL.RawQuery != "" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		var doc map[string]any
+		json.NewDecoder(r.Body).Decode(&doc)
+		puts = append(puts, doc)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ok":true}`))
+	})
+
+	docs := [][]byte{[]byte(`{"_id":"_design/views","_rev":"2-a","_revisions":{"start":2,"ids":["a","b"]},"views":{}}`)}
+	count, err := PutDesignDocs(host, port, "admin", "secret", "db", docs, map[string]string{"_design/views": "5-live"}, "")
+	if err != nil || count != 1 {
+		t.Fatalf("PutDesignDocs = %d, %v", count, err)
+	}
+	if puts[0]["_rev"] != "5-live" {
+		t.Errorf("_rev = %v, want the live revision", puts[0]["_rev"])
+	}
+	if _, found := puts[0]["_revisions"]; found {
+		t.Errorf("_revisions was sent")
+	}
+}
@@ -0,0 +1,197 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"bytes"
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The dump produced by the backup script is a bulk docs payload with one
+// document per line, so it can be streamed without loading it in memory.
+const (
+	dumpHeader = `{"new_edits":false,"docs":[`
+	dumpFooter = `]}`
+)
+
+const (
+	ErrOpenDump  = "error opening dump file %s: %v"
+	ErrReadDump  = "error reading dump file %s: %v"
+	ErrWriteDump = "error writing dump file %s: %v"
+)
+
+func ReadDump(fileName string, fn func(doc []byte) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf(ErrOpenDump, fileName, err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReaderSize(f, 1024*1024)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf(ErrReadDump, fileName, err)
+		}
+		doc := bytes.TrimSpace(line)
+		doc = bytes.TrimSuffix(doc, []byte(","))
+		if len(doc) != 0 && string(doc) != dumpHeader && string(doc) != dumpFooter {
+			if fnErr := fn(doc); fnErr != nil {
+				return fnErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+type DumpWriter struct {
+	w     *bufio.Writer
+	count int
+}
+
+func NewDumpWriter(w io.Writer) (*DumpWriter, error) {
+	dw := &DumpWriter{w: bufio.NewWriter(w)}
+	if _, err := dw.w.WriteString(dumpHeader); err != nil {
+		return nil, err
+	}
+	return dw, nil
+}
+
+func (dw *DumpWriter) Write(doc []byte) error {
+	sep := ",\n"
+	if dw.count == 0 {
+		sep = "\n"
+	}
+	if _, err := dw.w.WriteString(sep); err != nil {
+		return err
+	}
+	if _, err := dw.w.Write(doc); err != nil {
+		return err
+	}
+	dw.count++
+	return nil
+}
+
+func (dw *DumpWriter) Count() int {
+	return dw.count
+}
+
+func (dw *DumpWriter) Close() error {
+	if _, err := dw.w.WriteString("\n" + dumpFooter + "\n"); err != nil {
+		return err
+	}
+	return dw.w.Flush()
+}
+
+func FilterDump(src string, dst string, keep func(ref couchdb.DocRef) bool) (int, error) {
+	return TransformDump(src, dst, func(doc []byte) ([]byte, error) {
+		var ref couchdb.DocRef
+		if err := json.Unmarshal(doc, &ref); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		if !keep(ref) {
+			return nil, nil
+		}
+		return doc, nil
+	})
+}
+
+// TransformDump writes in dst the documents of src returned by fn, a nil document is left out.
+func TransformDump(src string, dst string, fn func(doc []byte) ([]byte, error)) (int, error) {
+	out, err := os.Create(dst)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, dst, err)
+	}
+	defer out.Close()
+
+	writer, err := NewDumpWriter(out)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, dst, err)
+	}
+	err = ReadDump(src, func(doc []byte) error {
+		doc, err := fn(doc)
+		if err != nil || doc == nil {
+			return err
+		}
+		if err := writer.Write(doc); err != nil {
+			return fmt.Errorf(ErrWriteDump, dst, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, dst, err)
+	}
+	return writer.Count(), nil
+}
+
+// dumpDocID returns the beginning of a document up to its _id, the leaves of a
+// conflicted document follow each other in the dump and count as one document.
+func dumpDocID(doc []byte) []byte {
+	prefix := []byte(`{"_id":"`)
+	if !bytes.HasPrefix(doc, prefix) {
+		return nil
+	}
+	for i := len(prefix); i < len(doc); i++ {
+		switch doc[i] {
+		case '\\':
+			i++
+		case '"':
+			return doc[:i+1]
+		}
+	}
+	return nil
+}
+
+// dumpCounter counts the documents of a dump once per _id. A document is counted as
+// deleted when the leaves read so far are all tombstones, and moved to the live
+// documents as soon as one of its leaves is not.
+type dumpCounter struct {
+	last        []byte
+	lastDeleted bool
+	docs        int
+	designs     int
+	deleted     int
+}
+
+func (c *dumpCounter) add(doc []byte) {
+	id := dumpDocID(doc)
+	deleted := isTombstone(doc)
+	if id != nil && bytes.Equal(id, c.last) {
+		if !c.lastDeleted || deleted {
+			return
+		}
+		c.deleted--
+	}
+	c.last, c.lastDeleted = id, deleted
+	switch {
+	case deleted:
+		c.deleted++
+	case bytes.HasPrefix(doc, []byte(`{"_id":"_design/`)):
+		c.designs++
+	default:
+		c.docs++
+	}
+}
+
+func RevGeneration(rev string) int {
+	gen, _, _ := strings.Cut(rev, "-")
+	n, err := strconv.Atoi(gen)
+	if err != nil {
+		return 0
+	}
+	return n
+}
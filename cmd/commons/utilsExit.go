@@ -0,0 +1,117 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"dbackupcli/cmd/struct/report"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Exit codes of dbackupcli, documented in the README and in the root usage.
+const (
+	ExitOK           = 0
+	ExitFailure      = 1
+	ExitUsage        = 2
+	ExitAuth         = 3
+	ExitConnection   = 4
+	ExitPartial      = 5
+	ExitVerification = 6
+	ExitUserAbort    = 7
+	ExitInterrupted  = 130
+)
+
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+func NewExitError(code int, err error) error {
+	return &ExitError{Code: code, Err: err}
+}
+
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	if errors.Is(err, context.Canceled) {
+		return ExitInterrupted
+	}
+	return ExitFailure
+}
+
+func UserAbort(message string) error {
+	slog.Warn(message)
+	return NewExitError(ExitUserAbort, errors.New(message))
+}
+
+func MissingFlags(command string) error {
+	err := fmt.Errorf("missing on or more flags/arguments, check using 'dbackupcli %s -h'", command)
+	slog.Error(err.Error())
+	return NewExitError(ExitUsage, err)
+}
+
+func connectionError(err error) error {
+	return NewExitError(ExitConnection, fmt.Errorf(ErrPerformHTTPRequest, err))
+}
+
+func statusError(res *http.Response, body []byte) error {
+	err := fmt.Errorf("couchdb returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	if res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden {
+		return NewExitError(ExitAuth, err)
+	}
+	return err
+}
+
+// RunError summarises the results of a run over many databases: a partial failure
+// when only some of them failed or were skipped, the error of the first failure when
+// all of them failed and a usage error when all of them were skipped, as the protected
+// databases without confirmation. An interruption is reported as such whatever the
+// outcome of the other databases.
+func RunError(results []report.DatabaseResult, errs []error) error {
+	for _, err := range errs {
+		if ExitCode(err) == ExitInterrupted {
+			return err
+		}
+	}
+	var failed, skipped, succeeded int
+	for _, result := range results {
+		switch result.Status {
+		case report.StatusOK:
+			succeeded++
+		case report.StatusFailed:
+			failed++
+		case report.StatusSkipped:
+			skipped++
+		}
+	}
+	switch {
+	case failed == 0 && skipped == 0:
+		return nil
+	case succeeded == 0 && len(errs) != 0:
+		return errs[0]
+	case succeeded == 0 && failed == 0:
+		return NewExitError(ExitUsage, fmt.Errorf("all the %d databases were skipped", skipped))
+	case skipped != 0:
+		return NewExitError(ExitPartial, fmt.Errorf("%d of %d databases failed, %d skipped", failed, failed+skipped+succeeded, skipped))
+	}
+	return NewExitError(ExitPartial, fmt.Errorf("%d of %d databases failed", failed, failed+succeeded))
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"dbackupcli/cmd/struct/report"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, ExitOK},
+		{errors.New("boom"), ExitFailure},
+		{NewExitError(ExitUsage, errors.New("bad flag")), ExitUsage},
+		{fmt.Errorf("wrapped: %w", NewExitError(ExitAuth, errors.New("401"))), ExitAuth},
+		{fmt.Errorf("stopped: %w", context.Canceled), ExitInterrupted},
+		{connectionError(errors.New("refused")), ExitConnection},
+	}
+	for _, test := range tests {
+		if got := ExitCode(test.err); got != test.code {
+			t.Errorf("ExitCode(%v) = %d, want %d", test.err, got, test.code)
+		}
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := map[int]int{
+		http.StatusUnauthorized:        ExitAuth,
+		http.StatusForbidden:           ExitAuth,
+		http.StatusNotFound:            ExitFailure,
+		http.StatusInternalServerError: ExitFailure,
+	}
+	for status, code := range tests {
+		err := statusError(&http.Response{StatusCode: status, Status: http.StatusText(status)}, []byte(`{"error":"x"}`))
+		if got := ExitCode(err); got != code {
+			t.Errorf("status %d: exit code %d, want %d", status, got, code)
+		}
+	}
+}
+
+func TestRunError(t *testing.T) {
+	ok := report.DatabaseResult{Status: report.StatusOK}
+	failed := report.DatabaseResult{Status: report.StatusFailed}
+	skipped := report.DatabaseResult{Status: report.StatusSkipped}
+	authErr := NewExitError(ExitAuth, errors.New("401"))
+	tests := []struct {
+		name    string
+		results []report.DatabaseResult
+		errs    []error
+		code    int
+	}{
+		{"all ok", []report.DatabaseResult{ok, ok}, nil, ExitOK},
+		{"some failed", []report.DatabaseResult{ok, failed}, []error{errors.New("boom")}, ExitPartial},
+		{"all failed", []report.DatabaseResult{failed, failed}, []error{authErr, errors.New("boom")}, ExitAuth},
+		{"interrupted", []report.DatabaseResult{ok, failed}, []error{context.Canceled}, ExitInterrupted},
+		{"some skipped", []report.DatabaseResult{ok, skipped}, nil, ExitPartial},
+		{"all skipped", []report.DatabaseResult{skipped, skipped}, nil, ExitUsage},
+		{"failed and skipped", []report.DatabaseResult{failed, skipped}, []error{authErr}, ExitAuth},
+	}
+	for _, test := range tests {
+		if got := ExitCode(RunError(test.results, test.errs)); got != test.code {
+			t.Errorf("%s: exit code %d, want %d", test.name, got, test.code)
+		}
+	}
+}
+
+func TestFinishRunReportStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status string
+	}{
+		{nil, report.RunOK},
+		{NewExitError(ExitPartial, errors.New("1 of 2 databases failed")), report.RunPartial},
+		{UserAbort("canceled"), report.RunAborted},
+		{errors.New("boom"), report.RunFailed},
+	}
+	for _, test := range tests {
+		StartRunReport("backup")
+		run := FinishRunReport(test.err)
+		if run.Status != test.status || run.ExitCode != ExitCode(test.err) {
+			t.Errorf("FinishRunReport(%v) = %s/%d, want %s", test.err, run.Status, run.ExitCode, test.status)
+		}
+	}
+}
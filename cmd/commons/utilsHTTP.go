@@ -0,0 +1,286 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// maxRetryAfter caps the wait asked by a Retry-After header.
+const maxRetryAfter = 5 * time.Minute
+
+// HTTPOptions tunes the transport shared by every request to CouchDB and the
+// retries of the requests that failed with a transient error.
+type HTTPOptions struct {
+	ConnectTimeout  time.Duration
+	ReadTimeout     time.Duration
+	MaxIdleConns    int
+	Retries         int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+}
+
+var DefaultHTTPOptions = HTTPOptions{
+	ConnectTimeout:  10 * time.Second,
+	ReadTimeout:     60 * time.Second,
+	MaxIdleConns:    16,
+	Retries:         3,
+	RetryBackoff:    500 * time.Millisecond,
+	RetryMaxBackoff: 30 * time.Second,
+}
+
+var (
+	httpOptions = DefaultHTTPOptions
+	httpClient  = newHTTPClient(DefaultHTTPOptions)
+)
+
+func newHTTPClient(options HTTPOptions) *http.Client {
+	dialer := &net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   options.ConnectTimeout,
+			ResponseHeaderTimeout: options.ReadTimeout,
+			MaxIdleConns:          options.MaxIdleConns,
+			MaxIdleConnsPerHost:   options.MaxIdleConns,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
+
+// SetupHTTP configures the shared transport from the flags, falling back to the
+// values of the profile and then to the defaults.
+func SetupHTTP(cmd *cobra.Command) error {
+	_, profile, err := GetProfile(cmd)
+	if err != nil {
+		return err
+	}
+	options := DefaultHTTPOptions
+
+	durations := []struct {
+		flag    string
+		profile string
+		value   *time.Duration
+	}{
+		{"connect-timeout", profile.ConnectTimeout, &options.ConnectTimeout},
+		{"read-timeout", profile.ReadTimeout, &options.ReadTimeout},
+		{"retry-backoff", profile.RetryBackoff, &options.RetryBackoff},
+		{"retry-max-backoff", profile.RetryMaxBackoff, &options.RetryMaxBackoff},
+	}
+	for _, d := range durations {
+		if cmd.Flags().Changed(d.flag) || d.profile == "" {
+			*d.value, _ = cmd.Flags().GetDuration(d.flag)
+			continue
+		}
+		value, err := time.ParseDuration(d.profile)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q in the profile: %v", d.flag, d.profile, err)
+		}
+		*d.value = value
+	}
+	options.Retries, _ = cmd.Flags().GetInt("retries")
+	if !cmd.Flags().Changed("retries") && profile.Retries != nil {
+		options.Retries = *profile.Retries
+	}
+
+	if options.ConnectTimeout <= 0 || options.ReadTimeout <= 0 || options.RetryBackoff <= 0 || options.RetryMaxBackoff <= 0 {
+		return errors.New("timeouts and backoffs must be positive")
+	}
+	if options.Retries < 0 {
+		return errors.New("retries cannot be negative")
+	}
+	httpOptions = options
+	httpClient = newHTTPClient(options)
+	return nil
+}
+
+// replayKey marks in the context of a request that it can be sent again.
+type replayKey struct{}
+
+// Replayable marks a request that does not change the database even though it is
+// not a GET, such as a POST to _all_docs, _find or _bulk_get, or a PUT with
+// new_edits=false, so that Do retries it as a GET.
+func Replayable(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), replayKey{}, true))
+}
+
+func replayable(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead || req.Context().Value(replayKey{}) != nil
+}
+
+// Do performs the request with the shared client, retrying on connection errors,
+// 429 and 5xx responses with exponential backoff and jitter or after the time
+// asked by the Retry-After header. The requests that change the database are
+// retried only when CouchDB cannot have received them: the connection was refused
+// or it answered 429. The response body fails when no data arrives for the read
+// timeout. The traffic is limited by the current Throttle, and requests without a
+// context of their own are canceled by SIGINT and SIGTERM.
+func Do(req *http.Request) (*http.Response, error) {
+	replay := replayable(req)
+	if req.Context().Done() == nil {
+		req = req.WithContext(runContext)
+	}
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if err := trafficLimiter.waitRequest(ctx); err != nil {
+			return nil, err
+		}
+		if req.Body != nil && CurrentThrottle().Bandwidth > 0 {
+			req.Body = throttledReader{req.Body}
+		}
+		attemptCtx, cancel := context.WithCancel(ctx)
+		res, err := httpClient.Do(req.WithContext(attemptCtx))
+		if res != nil {
+			res.Body = newIdleReader(res.Body, httpOptions.ReadTimeout, cancel)
+			if CurrentThrottle().Bandwidth > 0 {
+				res.Body = throttledReader{res.Body}
+			}
+		} else {
+			cancel()
+		}
+		if attempt >= httpOptions.Retries || ctx.Err() != nil || !retryable(res, err, replay) || (req.Body != nil && req.GetBody == nil) {
+			return res, err
+		}
+
+		wait := backoff(attempt)
+		if res != nil {
+			if retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			slog.Warn("request failed, retrying", "url", req.URL.Redacted(), "status", res.StatusCode,
+				"attempt", attempt+1, "retries", httpOptions.Retries, "wait", wait.String())
+		} else {
+			slog.Warn("request failed, retrying", "url", req.URL.Redacted(), "error", err,
+				"attempt", attempt+1, "retries", httpOptions.Retries, "wait", wait.String())
+		}
+
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// retryable tells whether a failed request can be sent again, any transient failure
+// when it can be replayed and otherwise only the ones where CouchDB did not act on it.
+func retryable(res *http.Response, err error, replay bool) bool {
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		var netErr net.Error
+		return replay && (errors.As(err, &netErr) || errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF))
+	}
+	return res.StatusCode == http.StatusTooManyRequests || (replay && res.StatusCode >= 500)
+}
+
+// idleReader fails a response body that receives no data for the read timeout, which
+// the transport only applies to the headers, by canceling its request.
+type idleReader struct {
+	r       io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired atomic.Bool
+}
+
+func newIdleReader(r io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleReader {
+	reader := &idleReader{r: r, timeout: timeout, cancel: cancel}
+	reader.timer = time.AfterFunc(timeout, func() {
+		reader.expired.Store(true)
+		cancel()
+	})
+	// Only the time spent waiting in Read counts, not the time the caller takes
+	reader.timer.Stop()
+	return reader
+}
+
+func (i *idleReader) Read(p []byte) (int, error) {
+	i.timer.Reset(i.timeout)
+	n, err := i.r.Read(p)
+	i.timer.Stop()
+	if err != nil && err != io.EOF && i.expired.Load() {
+		return n, fmt.Errorf("no data received from CouchDB for %s", i.timeout)
+	}
+	return n, err
+}
+
+func (i *idleReader) Close() error {
+	i.timer.Stop()
+	err := i.r.Close()
+	i.cancel()
+	return err
+}
+
+// backoff doubles the base wait at every attempt up to the maximum, and picks a
+// random wait in its upper half so that parallel clients do not retry together.
+func backoff(attempt int) time.Duration {
+	wait := httpOptions.RetryBackoff << attempt
+	if wait <= 0 || wait > httpOptions.RetryMaxBackoff {
+		wait = httpOptions.RetryMaxBackoff
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		wait = time.Until(date)
+	} else {
+		return 0, false
+	}
+	return min(max(wait, 0), maxRetryAfter), true
+}
+
+// ScriptTransportArgs passes the same timeouts, retries and throttle to the backup script.
+func ScriptTransportArgs() []string {
+	seconds := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+	}
+	var args []string
+	throttle := CurrentThrottle()
+	if throttle.Bandwidth > 0 {
+		args = append(args, "-L", strconv.FormatInt(throttle.Bandwidth, 10))
+	}
+	if throttle.RequestsPerSec > 0 {
+		args = append(args, "-Q", strconv.FormatFloat(throttle.RequestsPerSec, 'f', -1, 64))
+	}
+	return append(args,
+		"-a", strconv.Itoa(httpOptions.Retries+1),
+		"-C", seconds(httpOptions.ConnectTimeout),
+		"-S", strconv.Itoa(int(max(httpOptions.ReadTimeout.Seconds(), 1))),
+		"-w", seconds(httpOptions.RetryBackoff),
+		"-W", seconds(httpOptions.RetryMaxBackoff),
+	)
+}
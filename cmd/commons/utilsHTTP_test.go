@@ -0,0 +1,137 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setHTTPOptions replaces the transport options for the duration of the test.
+func setHTTPOptions(t *testing.T, options HTTPOptions) {
+	t.Helper()
+	previous := httpOptions
+	httpOptions = options
+	httpClient = newHTTPClient(options)
+	t.Cleanup(func() {
+		httpOptions = previous
+		httpClient = newHTTPClient(previous)
+	})
+}
+
+var testHTTPOptions = HTTPOptions{
+	ConnectTimeout:  time.Second,
+	ReadTimeout:     200 * time.Millisecond,
+	MaxIdleConns:    2,
+	Retries:         2,
+	RetryBackoff:    time.Millisecond,
+	RetryMaxBackoff: 2 * time.Millisecond,
+}
+
+func TestDoRetriesOnlyReplayableRequests(t *testing.T) {
+	setHTTPOptions(t, testHTTPOptions)
+	var attempts atomic.Int32
+	var status atomic.Int32
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(int(status.Load()))
+	})
+	address := "http://" + host + ":" + strconv.Itoa(port) + "/db/_bulk_docs"
+
+	tests := []struct {
+		name     string
+		method   string
+		replay   bool
+		status   int
+		attempts int32
+	}{
+		{"GET 500", "GET", false, http.StatusInternalServerError, 3},
+		{"POST 500", "POST", false, http.StatusInternalServerError, 1},
+		{"PUT 503", "PUT", false, http.StatusServiceUnavailable, 1},
+		{"POST 429", "POST", false, http.StatusTooManyRequests, 3},
+		{"replayable POST 500", "POST", true, http.StatusInternalServerError, 3},
+	}
+	for _, test := range tests {
+		attempts.Store(0)
+		status.Store(int32(test.status))
+		req, _ := http.NewRequest(test.method, address, bytes.NewReader([]byte(`{"docs":[]}`)))
+		if test.replay {
+			req = Replayable(req)
+		}
+		res, err := Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		res.Body.Close()
+		if got := attempts.Load(); got != test.attempts {
+			t.Errorf("%s: %d attempts, want %d", test.name, got, test.attempts)
+		}
+	}
+}
+
+func TestDoRetriesRefusedConnections(t *testing.T) {
+	setHTTPOptions(t, testHTTPOptions)
+	err := func() error {
+		req, _ := http.NewRequest("POST", "http://127.0.0.1:1/db/_bulk_docs", strings.NewReader("{}"))
+		_, err := Do(req)
+		return err
+	}()
+	if err == nil {
+		t.Fatal("request to a closed port succeeded")
+	}
+	if !retryable(nil, err, false) {
+		t.Errorf("a refused connection is not retryable: %v", err)
+	}
+}
+
+func TestDoFailsStalledBody(t *testing.T) {
+	setHTTPOptions(t, testHTTPOptions)
+	release := make(chan struct{})
+	defer close(release)
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"rows":[`))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	req, _ := http.NewRequest("GET", "http://"+host+":"+strconv.Itoa(port)+"/db/_all_docs", nil)
+	res, err := Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	started := time.Now()
+	body, err := io.ReadAll(res.Body)
+	if err == nil || !strings.Contains(err.Error(), "no data received") {
+		t.Fatalf("stalled body read %q, %v", body, err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("stalled body failed after %s", elapsed)
+	}
+	if ExitCode(err) == ExitInterrupted {
+		t.Errorf("a read timeout is reported as an interruption")
+	}
+}
+
+func TestIdleReaderIgnoresSlowCaller(t *testing.T) {
+	canceled := false
+	reader := newIdleReader(io.NopCloser(strings.NewReader("abcdef")), 20*time.Millisecond, func() { canceled = true })
+	buf := make([]byte, 3)
+	reader.Read(buf)
+	time.Sleep(60 * time.Millisecond)
+	if n, err := reader.Read(buf); n != 3 || err != nil || canceled {
+		t.Errorf("a slow caller timed out: %d, %v, canceled %t", n, err, canceled)
+	}
+	reader.Close()
+}
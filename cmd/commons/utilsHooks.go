@@ -0,0 +1,103 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/report"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+const hookStatusRunning = "running"
+
+// Hooks are shell commands run around the operation on each database, they get the
+// context in the DBACKUP_* environment variables. A failing pre hook aborts the operation.
+type Hooks struct {
+	Pre     string `json:"pre"`
+	Post    string `json:"post"`
+	OnError string `json:"on_error"`
+}
+
+// GetHooks returns the hooks of the flags, falling back to the ones of the config
+// file for the operation (backup or restore).
+func GetHooks(cmd *cobra.Command, operation string) Hooks {
+	config, _ := GetConfig(cmd)
+	hooks := config.Hooks[operation]
+	if pre, _ := cmd.Flags().GetString("pre-hook"); pre != "" {
+		hooks.Pre = pre
+	}
+	if post, _ := cmd.Flags().GetString("post-hook"); post != "" {
+		hooks.Post = post
+	}
+	if onError, _ := cmd.Flags().GetString("on-error-hook"); onError != "" {
+		hooks.OnError = onError
+	}
+	return hooks
+}
+
+func (h Hooks) Before(result report.DatabaseResult) error {
+	if h.Pre == "" {
+		return nil
+	}
+	if err := runHook("pre", h.Pre, result, hookStatusRunning, nil); err != nil {
+		return fmt.Errorf("pre hook failed, operation aborted: %w", err)
+	}
+	return nil
+}
+
+// After runs the post hook when the operation succeeded and the on-error hook
+// otherwise, a failing post hook makes the operation fail.
+func (h Hooks) After(result report.DatabaseResult, err error) error {
+	if err != nil {
+		if h.OnError != "" {
+			if hookErr := runHook("on-error", h.OnError, result, report.StatusFailed, err); hookErr != nil {
+				slog.Error("on-error hook failed", "db", result.Database, "error", hookErr)
+			}
+		}
+		return err
+	}
+	if h.Post == "" {
+		return nil
+	}
+	if hookErr := runHook("post", h.Post, result, report.StatusOK, nil); hookErr != nil {
+		hookErr = fmt.Errorf("post hook failed: %w", hookErr)
+		return h.After(result, hookErr)
+	}
+	return nil
+}
+
+func runHook(name string, command string, result report.DatabaseResult, status string, opErr error) error {
+	var bytes int64
+	if result.File != "" {
+		if info, err := os.Stat(result.File); err == nil {
+			bytes = info.Size()
+		}
+	}
+	env := []string{
+		"DBACKUP_HOOK=" + name,
+		"DBACKUP_OPERATION=" + result.Operation,
+		"DBACKUP_HOST=" + result.Host,
+		"DBACKUP_DB=" + result.Database,
+		"DBACKUP_FILE=" + result.File,
+		"DBACKUP_STATUS=" + status,
+		"DBACKUP_DOC_COUNT=" + strconv.Itoa(result.Documents),
+		"DBACKUP_BYTES=" + strconv.FormatInt(bytes, 10),
+	}
+	if opErr != nil {
+		env = append(env, "DBACKUP_ERROR="+opErr.Error())
+	}
+
+	slog.Info("running "+name+" hook", "db", result.Database, "phase", name+"-hook", "command", command)
+	cmdExec := exec.Command("sh", "-c", command)
+	cmdExec.Env = append(os.Environ(), env...)
+	cmdExec.Stdout = Out
+	cmdExec.Stderr = os.Stderr
+	return cmdExec.Run()
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/report"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "hooks.log")
+	record := `echo "$DBACKUP_HOOK $DBACKUP_OPERATION $DBACKUP_DB $DBACKUP_STATUS $DBACKUP_DOC_COUNT $DBACKUP_ERROR" >> ` + log
+	hooks := Hooks{Pre: record, Post: record, OnError: record}
+	result := report.DatabaseResult{Operation: "backup", Database: "orders", Documents: 3}
+
+	if err := hooks.Before(result); err != nil {
+		t.Fatal(err)
+	}
+	if err := hooks.After(result, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := hooks.After(result, errors.New("boom")); err == nil || err.Error() != "boom" {
+		t.Errorf("After changed the error of the operation: %v", err)
+	}
+	body, _ := os.ReadFile(log)
+	want := "pre backup orders running 3 \npost backup orders ok 3 \non-error backup orders failed 3 boom\n"
+	if string(body) != want {
+		t.Errorf("hooks ran with\n%s\nwant\n%s", body, want)
+	}
+}
+
+func TestHooksFailures(t *testing.T) {
+	result := report.DatabaseResult{Operation: "restore", Database: "orders"}
+	if err := (Hooks{Pre: "exit 3"}).Before(result); err == nil || !strings.Contains(err.Error(), "operation aborted") {
+		t.Errorf("a failing pre hook did not abort: %v", err)
+	}
+
+	marker := filepath.Join(t.TempDir(), "on-error")
+	hooks := Hooks{Post: "exit 1", OnError: "touch " + marker}
+	if err := hooks.After(result, nil); err == nil || !strings.Contains(err.Error(), "post hook failed") {
+		t.Errorf("a failing post hook did not fail the operation: %v", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("the on-error hook did not run after the post hook failed")
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/instance"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	InstanceFile   = "instance.json"
+	NodeConfigFile = "config.json"
+)
+
+// nodeConfigKeys are the settings that belong to the node itself and are never
+// copied on another one, a nil list stands for the whole section.
+var nodeConfigKeys = map[string][]string{
+	"couchdb": {"uuid", "database_dir", "view_index_dir"},
+	"chttpd":  {"bind_address", "port"},
+	"httpd":   {"bind_address", "port"},
+	"log":     {"file"},
+	"ssl":     nil,
+}
+
+// ConfigChange is a setting of the node config that an instance restore writes.
+type ConfigChange struct {
+	Section string
+	Key     string
+	Value   string
+}
+
+// IsSystemDatabase tells the databases of CouchDB itself (_users, _replicator,
+// _global_changes) from the ones of the applications.
+func IsSystemDatabase(dbName string) bool {
+	return strings.HasPrefix(dbName, "_")
+}
+
+// FetchInstance reads the version, the cluster membership and the config of the node.
+func FetchInstance(host string, port int, user string, password string) (instance.Instance, instance.Config, error) {
+	m := instance.Instance{Version: instance.Version, Host: host, CreatedAt: time.Now()}
+	baseURL := urlProtocol + host + ":" + strconv.Itoa(port)
+
+	body, err := couchRequest("GET", baseURL+"/", user, password, nil)
+	if err != nil {
+		return m, nil, fmt.Errorf("error reading the server version: %w", err)
+	}
+	var server struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(body, &server); err != nil {
+		return m, nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	m.CouchDBVersion = server.Version
+
+	if m.Membership, err = GetMembership(host, port, user, password); err != nil {
+		return m, nil, err
+	}
+	config, err := GetNodeConfig(host, port, user, password)
+	return m, config, err
+}
+
+func GetMembership(host string, port int, user string, password string) (instance.Membership, error) {
+	var membership instance.Membership
+	body, err := couchRequest("GET", urlProtocol+host+":"+strconv.Itoa(port)+"/_membership", user, password, nil)
+	if err != nil {
+		return membership, fmt.Errorf("error reading the cluster membership: %w", err)
+	}
+	if err := json.Unmarshal(body, &membership); err != nil {
+		return membership, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	return membership, nil
+}
+
+func GetNodeConfig(host string, port int, user string, password string) (instance.Config, error) {
+	var config instance.Config
+	body, err := couchRequest("GET", urlProtocol+host+":"+strconv.Itoa(port)+"/_node/_local/_config", user, password, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the node config: %w", err)
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	return config, nil
+}
+
+// WriteInstance saves the node config and then the instance file, which marks
+// the snapshot as complete. The config holds the admin password hashes, so
+// only the owner can read it.
+func WriteInstance(dir string, m instance.Instance, config instance.Config) error {
+	body, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling the node config: %v", err)
+	}
+	fileName := filepath.Join(dir, NodeConfigFile)
+	if err := writeFileAtomic(fileName, append(body, '\n'), 0600); err != nil {
+		return fmt.Errorf("error writing the node config %s: %v", fileName, err)
+	}
+
+	if body, err = json.MarshalIndent(m, "", "  "); err != nil {
+		return fmt.Errorf("error marshalling the instance: %v", err)
+	}
+	fileName = filepath.Join(dir, InstanceFile)
+	if err := writeFileAtomic(fileName, append(body, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing the instance %s: %v", fileName, err)
+	}
+	return nil
+}
+
+func LoadInstance(dir string) (instance.Instance, instance.Config, error) {
+	var m instance.Instance
+	fileName := filepath.Join(dir, InstanceFile)
+	body, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return m, nil, NewExitError(ExitUsage, fmt.Errorf("%s is not a complete instance snapshot, %s is missing", dir, InstanceFile))
+	}
+	if err != nil {
+		return m, nil, fmt.Errorf("error reading the instance %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, nil, fmt.Errorf("error reading the instance %s: %v", fileName, err)
+	}
+	if m.Version > instance.Version {
+		return m, nil, fmt.Errorf("instance %s has version %d, this dbackupcli reads up to version %d", fileName, m.Version, instance.Version)
+	}
+
+	var config instance.Config
+	fileName = filepath.Join(dir, NodeConfigFile)
+	if body, err = os.ReadFile(fileName); err != nil {
+		return m, nil, fmt.Errorf("error reading the node config %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return m, nil, fmt.Errorf("error reading the node config %s: %v", fileName, err)
+	}
+	return m, config, nil
+}
+
+// NodeConfigChanges lists the settings of saved that differ on the node, leaving out
+// the ones of the node itself and, unless withAdmins, the server admins. Settings
+// the node has and saved does not are kept.
+func NodeConfigChanges(current instance.Config, saved instance.Config, withAdmins bool) []ConfigChange {
+	var changes []ConfigChange
+	for section, values := range saved {
+		if section == "admins" && !withAdmins {
+			continue
+		}
+		for key, value := range values {
+			if isNodeConfigKey(section, key) {
+				continue
+			}
+			if old, ok := current[section][key]; ok && old == value {
+				continue
+			}
+			changes = append(changes, ConfigChange{Section: section, Key: key, Value: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Section != changes[j].Section {
+			return changes[i].Section < changes[j].Section
+		}
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+func isNodeConfigKey(section string, key string) bool {
+	keys, ok := nodeConfigKeys[section]
+	return ok && (keys == nil || slices.Contains(keys, key))
+}
+
+// SetNodeConfig writes the changes in the config of the node, the values are
+// not logged as they can be secrets.
+func SetNodeConfig(host string, port int, user string, password string, changes []ConfigChange) error {
+	baseURL := urlProtocol + host + ":" + strconv.Itoa(port) + "/_node/_local/_config/"
+	for _, change := range changes {
+		body, _ := json.Marshal(change.Value)
+		address := baseURL + url.PathEscape(change.Section) + "/" + url.PathEscape(change.Key)
+		if _, err := couchRequest("PUT", address, user, password, body); err != nil {
+			return fmt.Errorf("error setting %s/%s in the node config: %w", change.Section, change.Key, err)
+		}
+		slog.Info("node config restored", "host", host, "section", change.Section, "key", change.Key)
+	}
+	return nil
+}
+
+// MissingNodes lists the cluster nodes of saved that are not part of the cluster of current.
+func MissingNodes(saved instance.Membership, current instance.Membership) []string {
+	var missing []string
+	for _, node := range saved.ClusterNodes {
+		if !slices.Contains(current.ClusterNodes, node) {
+			missing = append(missing, node)
+		}
+	}
+	return missing
+}
+
+// JoinNode adds a node to the cluster, the node must be running and share the
+// Erlang cookie of the cluster.
+func JoinNode(host string, port int, user string, password string, node string) error {
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/_node/_local/_nodes/" + url.PathEscape(node)
+	if _, err := couchRequest("PUT", address, user, password, []byte("{}")); err != nil {
+		return fmt.Errorf("error adding %s to the cluster: %w", node, err)
+	}
+	slog.Info("node added to the cluster", "host", host, "node", node)
+	return nil
+}
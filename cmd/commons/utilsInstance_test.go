@@ -0,0 +1,74 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/instance"
+	"reflect"
+	"testing"
+)
+
+func TestIsSystemDatabase(t *testing.T) {
+	tests := map[string]bool{"_users": true, "_replicator": true, "_global_changes": true, "users": false, "my_db": false}
+	for name, want := range tests {
+		if got := IsSystemDatabase(name); got != want {
+			t.Errorf("IsSystemDatabase(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestNodeConfigChanges(t *testing.T) {
+	current := instance.Config{
+		"couchdb": {"uuid": "node-b", "max_document_size": "8000000"},
+		"chttpd":  {"port": "5984", "max_http_request_size": "4294967296"},
+		"admins":  {"admin": "-pbkdf2-new"},
+		"local":   {"only_here": "1"},
+	}
+	saved := instance.Config{
+		"couchdb": {"uuid": "node-a", "database_dir": "/old/data", "max_document_size": "50000000"},
+		"chttpd":  {"port": "6984", "bind_address": "0.0.0.0", "max_http_request_size": "4294967296"},
+		"admins":  {"admin": "-pbkdf2-old"},
+		"ssl":     {"cert_file": "/old/cert.pem"},
+		"log":     {"file": "/old/couch.log", "level": "debug"},
+	}
+
+	tests := []struct {
+		name       string
+		withAdmins bool
+		want       []ConfigChange
+	}{
+		{"without admins", false, []ConfigChange{
+			{"couchdb", "max_document_size", "50000000"},
+			{"log", "level", "debug"},
+		}},
+		{"with admins", true, []ConfigChange{
+			{"admins", "admin", "-pbkdf2-old"},
+			{"couchdb", "max_document_size", "50000000"},
+			{"log", "level", "debug"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := NodeConfigChanges(current, saved, test.withAdmins); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("NodeConfigChanges() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if got := NodeConfigChanges(saved, saved, true); len(got) != 0 {
+		t.Errorf("NodeConfigChanges() of the same config = %v", got)
+	}
+}
+
+func TestMissingNodes(t *testing.T) {
+	saved := instance.Membership{ClusterNodes: []string{"couchdb@a", "couchdb@b", "couchdb@c"}}
+	current := instance.Membership{ClusterNodes: []string{"couchdb@a", "couchdb@c"}}
+	if got := MissingNodes(saved, current); !reflect.DeepEqual(got, []string{"couchdb@b"}) {
+		t.Errorf("MissingNodes() = %v", got)
+	}
+	if got := MissingNodes(current, saved); len(got) != 0 {
+		t.Errorf("MissingNodes() = %v, want none", got)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	LockSuffix    = ".lock"
+	PartialSuffix = ".partial"
+)
+
+var unsafeLockChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Lock is a file created exclusively, so that two runs cannot write the same
+// dump or restore the same database at the same time.
+type Lock struct {
+	fileName string
+}
+
+type lockHolder struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Command  string    `json:"command"`
+	Started  time.Time `json:"started"`
+}
+
+// AcquireLock creates the lock file, failing when another run holds it. A lock
+// left by a process of this host that no longer exists is taken over.
+func AcquireLock(fileName string) (*Lock, error) {
+	hostname, _ := os.Hostname()
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			body, _ := json.Marshal(lockHolder{PID: os.Getpid(), Hostname: hostname, Command: runReport.Command, Started: time.Now()})
+			_, err = f.Write(body)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(fileName)
+				return nil, fmt.Errorf("error writing the lock %s: %v", fileName, err)
+			}
+			return &Lock{fileName: fileName}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("error creating the lock %s: %v", fileName, err)
+		}
+
+		holder, err := readLock(fileName)
+		if attempt == 0 && err == nil && holder.Hostname == hostname && !processAlive(holder.PID) {
+			slog.Warn("removing the stale lock", "lock", fileName, "pid", holder.PID)
+			if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf(ErrRemoveFile, fileName, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s is held by another run", fileName)
+		}
+		return nil, fmt.Errorf("%s is held by another run: %s (pid %d on %s) started at %s, remove it if that run is no longer active",
+			fileName, holder.Command, holder.PID, holder.Hostname, holder.Started.Format(time.RFC3339))
+	}
+}
+
+// LockDatabase takes the lock of a database in the temp directory, it protects
+// the database from the restores started on this host.
+func LockDatabase(host string, port int, dbName string) (*Lock, error) {
+	name := unsafeLockChars.ReplaceAllString(host+"_"+strconv.Itoa(port)+"_"+dbName, "_")
+	return AcquireLock(filepath.Join(os.TempDir(), "dbackupcli-"+name+LockSuffix))
+}
+
+func (l *Lock) Release() {
+	if err := os.Remove(l.fileName); err != nil && !os.IsNotExist(err) {
+		slog.Error("error releasing the lock", "lock", l.fileName, "error", err)
+	}
+}
+
+func readLock(fileName string) (lockHolder, error) {
+	var holder lockHolder
+	body, err := os.ReadFile(fileName)
+	if err != nil {
+		return holder, err
+	}
+	err = json.Unmarshal(body, &holder)
+	return holder, err
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// Output is a dump being written: the script writes Partial, which replaces File
+// only on Commit, so that a failed run never destroys the previous dump.
+type Output struct {
+	File    string
+	Partial string
+	lock    *Lock
+}
+
+// CreateOutput locks the destination and removes the incomplete dump of a previous run.
+func CreateOutput(fileName string) (*Output, error) {
+	lock, err := AcquireLock(fileName + LockSuffix)
+	if err != nil {
+		return nil, err
+	}
+	output := &Output{File: fileName, Partial: fileName + PartialSuffix, lock: lock}
+	if err := os.Remove(output.Partial); err != nil && !os.IsNotExist(err) {
+		lock.Release()
+		return nil, fmt.Errorf(ErrRemoveFile, output.Partial, err)
+	}
+	return output, nil
+}
+
+// Commit flushes the complete dump to disk and renames it over the destination.
+func (o *Output) Commit() error {
+	f, err := os.Open(o.Partial)
+	if err != nil {
+		return fmt.Errorf(ErrOpenDump, o.Partial, err)
+	}
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return fmt.Errorf(ErrWriteDump, o.Partial, err)
+	}
+	if err := os.Rename(o.Partial, o.File); err != nil {
+		return fmt.Errorf("error renaming %s to %s: %v", o.Partial, o.File, err)
+	}
+	// The rename itself is durable only once the directory is flushed
+	if dir, err := os.Open(filepath.Dir(o.File)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Close releases the lock, a dump that was not committed is left with PartialSuffix.
+func (o *Output) Close() {
+	if info, err := os.Stat(o.Partial); err == nil {
+		if info.Size() == 0 {
+			os.Remove(o.Partial)
+		} else {
+			slog.Warn("the incomplete dump was kept", "file", o.Partial)
+		}
+	}
+	o.lock.Release()
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeLock(t *testing.T, fileName string, holder lockHolder) {
+	t.Helper()
+	body, _ := json.Marshal(holder)
+	if err := os.WriteFile(fileName, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPID returns the PID of a process that has already exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip("cannot start a process:", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestAcquireLock(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "db.json"+LockSuffix)
+	lock, err := AcquireLock(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, err := readLock(fileName)
+	if err != nil || holder.PID != os.Getpid() {
+		t.Errorf("lock holder = %+v, %v", holder, err)
+	}
+	if _, err := AcquireLock(fileName); err == nil {
+		t.Errorf("the lock was acquired twice")
+	}
+	lock.Release()
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("the lock was not removed on release")
+	}
+}
+
+func TestAcquireLockStaleTakeover(t *testing.T) {
+	hostname, _ := os.Hostname()
+	tests := []struct {
+		name     string
+		holder   lockHolder
+		takeover bool
+	}{
+		{"dead process of this host", lockHolder{PID: deadPID(t), Hostname: hostname}, true},
+		{"live process of this host", lockHolder{PID: os.Getpid(), Hostname: hostname}, false},
+		{"process of another host", lockHolder{PID: deadPID(t), Hostname: hostname + "-other"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "db.json"+LockSuffix)
+			test.holder.Started = time.Now()
+			writeLock(t, fileName, test.holder)
+			lock, err := AcquireLock(fileName)
+			if (err == nil) != test.takeover {
+				t.Fatalf("AcquireLock() error = %v, want takeover %t", err, test.takeover)
+			}
+			if lock != nil {
+				lock.Release()
+			}
+		})
+	}
+
+	// A lock that cannot be read is never taken over
+	fileName := filepath.Join(t.TempDir(), "db.json"+LockSuffix)
+	if err := os.WriteFile(fileName, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcquireLock(fileName); err == nil {
+		t.Errorf("an unreadable lock was taken over")
+	}
+}
+
+func TestOutputCommit(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(fileName, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileName+PartialSuffix, []byte("left by a failed run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := CreateOutput(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(output.Partial); !os.IsNotExist(err) {
+		t.Errorf("the partial dump of the previous run was not removed")
+	}
+	if _, err := CreateOutput(fileName); err == nil {
+		t.Errorf("the destination was not locked")
+	}
+	if err := os.WriteFile(output.Partial, []byte("complete"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	output.Close()
+
+	if body, _ := os.ReadFile(fileName); string(body) != "complete" {
+		t.Errorf("dump = %q, want the committed one", body)
+	}
+	if _, err := os.Stat(fileName + LockSuffix); !os.IsNotExist(err) {
+		t.Errorf("the lock was not released")
+	}
+}
+
+func TestOutputCloseWithoutCommit(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(fileName, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output, err := CreateOutput(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(output.Partial, []byte("half"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	output.Close()
+
+	if body, _ := os.ReadFile(fileName); string(body) != "previous" {
+		t.Errorf("a failed run replaced the previous dump with %q", body)
+	}
+	if _, err := os.Stat(output.Partial); err != nil {
+		t.Errorf("the incomplete dump was not kept: %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Selector is a Mango selector evaluated on the documents of a dump, without CouchDB.
+// Strings are ordered as CouchDB orders the ASCII ones, see collateStrings.
+type Selector struct {
+	cond condition
+}
+
+type condition func(value any, found bool) bool
+
+// ParseSelector compiles a Mango selector, rejecting the operators it does not know.
+func ParseSelector(raw []byte) (Selector, error) {
+	var selector map[string]any
+	if err := json.Unmarshal(raw, &selector); err != nil {
+		return Selector{}, fmt.Errorf("invalid selector, it must be a JSON object: %v", err)
+	}
+	cond, err := compileObject(selector)
+	if err != nil {
+		return Selector{}, fmt.Errorf("invalid selector: %v", err)
+	}
+	return Selector{cond: cond}, nil
+}
+
+// Matches tells whether the document matches the selector.
+func (s Selector) Matches(doc []byte) (bool, error) {
+	var value map[string]any
+	if err := json.Unmarshal(doc, &value); err != nil {
+		return false, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	return s.cond(value, true), nil
+}
+
+// compileObject compiles the conditions of an object, all of them must hold. A key is
+// either an operator or a field, whose value is an object of conditions or an implicit $eq.
+func compileObject(object map[string]any) (condition, error) {
+	var conds []condition
+	for key, arg := range object {
+		var cond condition
+		var err error
+		if strings.HasPrefix(key, "$") {
+			cond, err = compileOperator(key, arg)
+		} else {
+			cond, err = compileField(key, arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+	}
+	return allOf(conds), nil
+}
+
+func compileField(path string, arg any) (condition, error) {
+	// An object holds operators or the conditions of nested fields
+	var cond condition
+	var err error
+	if object, ok := arg.(map[string]any); ok {
+		cond, err = compileObject(object)
+	} else {
+		cond, err = compileOperator("$eq", arg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fields := splitFieldPath(path)
+	return func(value any, found bool) bool {
+		for _, field := range fields {
+			object, ok := value.(map[string]any)
+			if !ok || !found {
+				value, found = nil, false
+				break
+			}
+			value, found = object[field]
+		}
+		return cond(value, found)
+	}, nil
+}
+
+func compileOperator(op string, arg any) (condition, error) {
+	switch op {
+	case "$and", "$or", "$nor":
+		items, ok := arg.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s needs an array", op)
+		}
+		var conds []condition
+		for _, item := range items {
+			object, ok := item.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s needs an array of objects", op)
+			}
+			cond, err := compileObject(object)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, cond)
+		}
+		switch op {
+		case "$and":
+			return allOf(conds), nil
+		case "$or":
+			return anyOf(conds), nil
+		default:
+			either := anyOf(conds)
+			return func(value any, found bool) bool { return !either(value, found) }, nil
+		}
+	case "$not":
+		object, ok := arg.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("$not needs an object")
+		}
+		cond, err := compileObject(object)
+		if err != nil {
+			return nil, err
+		}
+		return func(value any, found bool) bool { return !cond(value, found) }, nil
+	case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+		return func(value any, found bool) bool {
+			if !found {
+				return false
+			}
+			c := collate(value, arg)
+			switch op {
+			case "$eq":
+				return c == 0
+			case "$ne":
+				return c != 0
+			case "$gt":
+				return c > 0
+			case "$gte":
+				return c >= 0
+			case "$lt":
+				return c < 0
+			default:
+				return c <= 0
+			}
+		}, nil
+	case "$exists":
+		want, ok := arg.(bool)
+		if !ok {
+			return nil, fmt.Errorf("$exists needs a boolean")
+		}
+		return func(value any, found bool) bool { return found == want }, nil
+	case "$type":
+		want, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("$type needs a string")
+		}
+		return func(value any, found bool) bool { return found && jsonType(value) == want }, nil
+	case "$in", "$nin", "$all":
+		items, ok := arg.([]any)
+		if !ok {
+			return nil, fmt.Errorf("%s needs an array", op)
+		}
+		contains := func(value any) bool {
+			return slices.ContainsFunc(items, func(item any) bool { return collate(value, item) == 0 })
+		}
+		switch op {
+		case "$in":
+			return func(value any, found bool) bool {
+				if array, ok := value.([]any); ok {
+					return slices.ContainsFunc(array, contains)
+				}
+				return found && contains(value)
+			}, nil
+		case "$nin":
+			return func(value any, found bool) bool {
+				if array, ok := value.([]any); ok {
+					return !slices.ContainsFunc(array, contains)
+				}
+				return found && !contains(value)
+			}, nil
+		default:
+			return func(value any, found bool) bool {
+				array, ok := value.([]any)
+				return ok && !slices.ContainsFunc(items, func(item any) bool {
+					return !slices.ContainsFunc(array, func(v any) bool { return collate(v, item) == 0 })
+				})
+			}, nil
+		}
+	case "$size":
+		size, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("$size needs a number")
+		}
+		return func(value any, found bool) bool {
+			array, ok := value.([]any)
+			return ok && float64(len(array)) == size
+		}, nil
+	case "$mod":
+		items, ok := arg.([]any)
+		if !ok || len(items) != 2 {
+			return nil, fmt.Errorf("$mod needs [divisor, remainder]")
+		}
+		divisor, ok1 := items[0].(float64)
+		remainder, ok2 := items[1].(float64)
+		if !ok1 || !ok2 || divisor == 0 {
+			return nil, fmt.Errorf("$mod needs a non-zero divisor and a remainder")
+		}
+		return func(value any, found bool) bool {
+			n, ok := value.(float64)
+			return ok && n == math.Trunc(n) && math.Mod(n, divisor) == remainder
+		}, nil
+	case "$regex":
+		pattern, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("$regex needs a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid $regex: %v", err)
+		}
+		return func(value any, found bool) bool {
+			s, ok := value.(string)
+			return ok && re.MatchString(s)
+		}, nil
+	case "$beginsWith":
+		prefix, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("$beginsWith needs a string")
+		}
+		return func(value any, found bool) bool {
+			s, ok := value.(string)
+			return ok && strings.HasPrefix(s, prefix)
+		}, nil
+	case "$elemMatch", "$allMatch":
+		object, ok := arg.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s needs an object", op)
+		}
+		cond, err := compileObject(object)
+		if err != nil {
+			return nil, err
+		}
+		return func(value any, found bool) bool {
+			array, ok := value.([]any)
+			if !ok {
+				return false
+			}
+			match := func(item any) bool { return cond(item, true) }
+			if op == "$elemMatch" {
+				return slices.ContainsFunc(array, match)
+			}
+			return len(array) > 0 && !slices.ContainsFunc(array, func(item any) bool { return !match(item) })
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", op)
+}
+
+func allOf(conds []condition) condition {
+	return func(value any, found bool) bool {
+		return !slices.ContainsFunc(conds, func(cond condition) bool { return !cond(value, found) })
+	}
+}
+
+func anyOf(conds []condition) condition {
+	return func(value any, found bool) bool {
+		return slices.ContainsFunc(conds, func(cond condition) bool { return cond(value, found) })
+	}
+}
+
+// splitFieldPath splits a.b.c into its fields, a dot escaped with a backslash is kept.
+func splitFieldPath(path string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch {
+		case path[i] == '\\' && i+1 < len(path) && path[i+1] == '.':
+			field.WriteByte('.')
+			i++
+		case path[i] == '.':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(path[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// collate orders two JSON values as CouchDB does: null, booleans, numbers, strings,
+// arrays, objects. The keys of the objects are compared sorted, CouchDB compares them
+// in the order of the document.
+func collate(a any, b any) int {
+	rank := func(value any) int {
+		return slices.Index([]string{"null", "boolean", "number", "string", "array", "object"}, jsonType(value))
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+	switch a := a.(type) {
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case !a:
+			return -1
+		default:
+			return 1
+		}
+	case float64:
+		switch b := b.(float64); {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		default:
+			return 0
+		}
+	case string:
+		return collateStrings(a, b.(string))
+	case []any:
+		b := b.([]any)
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if c := collate(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+		return len(a) - len(b)
+	case map[string]any:
+		b := b.(map[string]any)
+		keysA, keysB := sortedKeys(a), sortedKeys(b)
+		for i := 0; i < len(keysA) && i < len(keysB); i++ {
+			if c := collateStrings(keysA[i], keysB[i]); c != 0 {
+				return c
+			}
+			if c := collate(a[keysA[i]], b[keysB[i]]); c != 0 {
+				return c
+			}
+		}
+		return len(keysA) - len(keysB)
+	}
+	return 0
+}
+
+// icuPunctuation is the order of the ASCII punctuation in the ICU collation of CouchDB,
+// before the digits and the letters, see
+// https://docs.couchdb.org/en/stable/ddocs/views/collation.html#collation-specification
+const icuPunctuation = " \t\n\r^_-,;:!?.'\"()[]{}@*/\\&#%`+<=>|~$"
+
+// collateStrings orders two strings as the ICU collation of CouchDB does for ASCII:
+// punctuation, digits, then letters regardless of case, a lowercase letter before
+// its uppercase only when the strings are otherwise equal ("a" < "A" < "aa" < "b").
+// The other characters follow the letters by code point, so accented letters are not
+// sorted with their base letter as CouchDB does.
+func collateStrings(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	for i := 0; i < len(ra) && i < len(rb); i++ {
+		if c := collationWeight(ra[i]) - collationWeight(rb[i]); c != 0 {
+			return c
+		}
+	}
+	if len(ra) != len(rb) {
+		return len(ra) - len(rb)
+	}
+	for i := range ra {
+		if la, lb := unicode.IsLower(ra[i]), unicode.IsLower(rb[i]); la != lb {
+			if la {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(a, b)
+}
+
+func collationWeight(r rune) int {
+	switch {
+	case r >= '0' && r <= '9':
+		return 0x100 + int(r-'0')
+	case r < utf8.RuneSelf && unicode.IsLetter(r):
+		return 0x200 + int(unicode.ToLower(r)-'a')
+	case r < utf8.RuneSelf:
+		// The control characters, which are ignored by ICU, come first
+		return strings.IndexRune(icuPunctuation, r) + 1
+	default:
+		return 0x300 + int(unicode.ToLower(r))
+	}
+}
+
+func sortedKeys(object map[string]any) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, collateStrings)
+	return keys
+}
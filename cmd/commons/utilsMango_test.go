@@ -0,0 +1,164 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestSelectorOperators(t *testing.T) {
+	doc := `{"_id":"order:1","type":"invoice","total":120,"paid":false,"note":null,
+		"customer":{"name":"Acme","address":{"city":"Turin"}},"a.b":"dotted",
+		"tags":["urgent","eu"],"lines":[{"sku":"A","qty":2},{"sku":"B","qty":5}]}`
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{`{}`, true},
+		{`{"type":"invoice"}`, true},
+		{`{"type":"order"}`, false},
+		{`{"type":{"$eq":"invoice"}}`, true},
+		{`{"type":{"$ne":"invoice"}}`, false},
+		{`{"missing":{"$ne":"x"}}`, false},
+		{`{"total":{"$gt":100}}`, true},
+		{`{"total":{"$gt":120}}`, false},
+		{`{"total":{"$gte":120}}`, true},
+		{`{"total":{"$lt":120}}`, false},
+		{`{"total":{"$lte":120}}`, true},
+		{`{"total":{"$gt":100,"$lt":200}}`, true},
+		{`{"total":{"$lt":"a"}}`, true},
+		{`{"paid":{"$lt":0}}`, true},
+		{`{"note":{"$lt":false}}`, true},
+		{`{"customer.name":"Acme"}`, true},
+		{`{"customer.address.city":"Turin"}`, true},
+		{`{"customer":{"address":{"city":"Milan"}}}`, false},
+		{`{"a\\.b":"dotted"}`, true},
+		{`{"note":{"$exists":true}}`, true},
+		{`{"missing":{"$exists":false}}`, true},
+		{`{"customer.missing":{"$exists":true}}`, false},
+		{`{"note":{"$type":"null"}}`, true},
+		{`{"total":{"$type":"number"}}`, true},
+		{`{"tags":{"$type":"array"}}`, true},
+		{`{"customer":{"$type":"object"}}`, true},
+		{`{"paid":{"$type":"boolean"}}`, true},
+		{`{"type":{"$type":"number"}}`, false},
+		{`{"type":{"$in":["order","invoice"]}}`, true},
+		{`{"tags":{"$in":["eu","us"]}}`, true},
+		{`{"type":{"$nin":["order","invoice"]}}`, false},
+		{`{"tags":{"$nin":["us"]}}`, true},
+		{`{"missing":{"$nin":["x"]}}`, false},
+		{`{"tags":{"$all":["eu","urgent"]}}`, true},
+		{`{"tags":{"$all":["eu","us"]}}`, false},
+		{`{"tags":{"$size":2}}`, true},
+		{`{"tags":{"$size":3}}`, false},
+		{`{"total":{"$mod":[7,1]}}`, true},
+		{`{"total":{"$mod":[7,2]}}`, false},
+		{`{"type":{"$regex":"^inv"}}`, true},
+		{`{"type":{"$regex":"^INV"}}`, false},
+		{`{"total":{"$regex":"1"}}`, false},
+		{`{"type":{"$beginsWith":"invo"}}`, true},
+		{`{"type":{"$beginsWith":"Invo"}}`, false},
+		{`{"lines":{"$elemMatch":{"sku":"B","qty":{"$gt":4}}}}`, true},
+		{`{"lines":{"$elemMatch":{"sku":"A","qty":{"$gt":4}}}}`, false},
+		{`{"lines":{"$allMatch":{"qty":{"$gt":1}}}}`, true},
+		{`{"lines":{"$allMatch":{"qty":{"$gt":2}}}}`, false},
+		{`{"$and":[{"type":"invoice"},{"total":120}]}`, true},
+		{`{"$and":[{"type":"invoice"},{"total":121}]}`, false},
+		{`{"$or":[{"type":"order"},{"total":120}]}`, true},
+		{`{"$or":[{"type":"order"},{"total":121}]}`, false},
+		{`{"$nor":[{"type":"order"},{"total":121}]}`, true},
+		{`{"$nor":[{"type":"order"},{"total":120}]}`, false},
+		{`{"$not":{"type":"order"}}`, true},
+		{`{"type":{"$not":{"$eq":"invoice"}}}`, false},
+	}
+	for _, test := range tests {
+		selector, err := ParseSelector([]byte(test.selector))
+		if err != nil {
+			t.Errorf("ParseSelector(%s) = %v", test.selector, err)
+			continue
+		}
+		got, err := selector.Matches([]byte(doc))
+		if err != nil || got != test.want {
+			t.Errorf("%s matches = %t, %v, want %t", test.selector, got, err, test.want)
+		}
+	}
+}
+
+func TestParseSelectorErrors(t *testing.T) {
+	for _, selector := range []string{
+		`[]`,
+		`{"type":`,
+		`{"$and":{"type":"x"}}`,
+		`{"$or":["x"]}`,
+		`{"$not":"x"}`,
+		`{"a":{"$exists":"yes"}}`,
+		`{"a":{"$type":1}}`,
+		`{"a":{"$in":"x"}}`,
+		`{"a":{"$size":"2"}}`,
+		`{"a":{"$mod":[0,1]}}`,
+		`{"a":{"$mod":[2]}}`,
+		`{"a":{"$regex":"("}}`,
+		`{"a":{"$beginsWith":1}}`,
+		`{"a":{"$elemMatch":[]}}`,
+		`{"a":{"$text":"x"}}`,
+	} {
+		if _, err := ParseSelector([]byte(selector)); err == nil {
+			t.Errorf("ParseSelector(%s) accepted", selector)
+		}
+	}
+}
+
+func TestCollationOrder(t *testing.T) {
+	// The order of the CouchDB documentation, views collation specification
+	ordered := []string{
+		`null`, `false`, `true`,
+		`1`, `2`, `3.0`, `4`,
+		`" "`, `"^"`, `"_"`, `"-"`, `","`, `";"`, `":"`, `"!"`, `"?"`, `"."`, `"'"`, `"\""`,
+		`"("`, `")"`, `"["`, `"]"`, `"{"`, `"}"`, `"@"`, `"*"`, `"/"`, `"\\"`, `"&"`, `"#"`,
+		`"%"`, "\"`\"", `"+"`, `"<"`, `"="`, `">"`, `"|"`, `"~"`, `"$"`,
+		`"0"`, `"9"`,
+		`"a"`, `"A"`, `"aa"`, `"b"`, `"B"`, `"ba"`, `"bb"`,
+		`["a"]`, `["b"]`, `["b","c"]`, `["b","c","a"]`, `["b","d"]`, `["b","d","e"]`,
+		`{"a":1}`, `{"a":2}`, `{"b":1}`, `{"b":2}`, `{"b":2,"c":2}`,
+	}
+	values := make([]any, len(ordered))
+	for i, raw := range ordered {
+		if err := json.Unmarshal([]byte(raw), &values[i]); err != nil {
+			t.Fatalf("%s: %v", raw, err)
+		}
+	}
+	for i := range values {
+		for j := range values {
+			got := collate(values[i], values[j])
+			if (i < j && got >= 0) || (i > j && got <= 0) || (i == j && got != 0) {
+				t.Errorf("collate(%s, %s) = %d", ordered[i], ordered[j], got)
+			}
+		}
+	}
+
+	words := []string{"Zoe", "apple", "Apple", "_id", "10", "9", "banana", "b", "é"}
+	slices.SortFunc(words, collateStrings)
+	if want := []string{"_id", "10", "9", "apple", "Apple", "b", "banana", "Zoe", "é"}; !reflect.DeepEqual(words, want) {
+		t.Errorf("sorted = %q, want %q", words, want)
+	}
+}
+
+func TestSplitFieldPath(t *testing.T) {
+	tests := map[string][]string{
+		"a":         {"a"},
+		"a.b.c":     {"a", "b", "c"},
+		`a\.b.c`:    {"a.b", "c"},
+		`a\b`:       {`a\b`},
+		"customer.": {"customer", ""},
+	}
+	for path, want := range tests {
+		if got := splitFieldPath(path); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitFieldPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
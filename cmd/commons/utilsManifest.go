@@ -0,0 +1,199 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"dbackupcli/cmd/struct/couchdb"
+	"dbackupcli/cmd/struct/manifest"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ManifestSuffix = ".manifest.json"
+
+// ManifestFile is the sidecar of a dump: dump.json has its settings in dump.manifest.json.
+func ManifestFile(dumpFile string) string {
+	return strings.TrimSuffix(dumpFile, ".json") + ManifestSuffix
+}
+
+// IsDumpFile tells the dumps of a backup directory from their sidecars and from
+// the leftovers of the runs that did not complete.
+func IsDumpFile(name string) bool {
+	return strings.HasSuffix(name, ".json") && !strings.HasSuffix(name, ManifestSuffix)
+}
+
+// FetchManifest reads the security object and the revs limit of a database, db is
+// its info already read with GetDB.
+func FetchManifest(host string, port int, user string, password string, db couchdb.Database) (manifest.Manifest, error) {
+	m := manifest.Manifest{
+		Version:   manifest.Version,
+		Database:  db.DbName,
+		CreatedAt: time.Now(),
+		DocCount:  db.DocCount,
+		UpdateSeq: db.UpdateSeq,
+		Props:     db.Props,
+		Cluster:   db.Cluster,
+	}
+	baseURL := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + db.DbName
+
+	security, err := couchRequest("GET", baseURL+"/_security", user, password, nil)
+	if err != nil {
+		return m, fmt.Errorf("error reading the security of %s: %w", db.DbName, err)
+	}
+	m.Security = json.RawMessage(bytes.TrimSpace(security))
+
+	revsLimit, err := couchRequest("GET", baseURL+"/_revs_limit", user, password, nil)
+	if err != nil {
+		return m, fmt.Errorf("error reading the revs limit of %s: %w", db.DbName, err)
+	}
+	if m.RevsLimit, err = strconv.Atoi(strings.TrimSpace(string(revsLimit))); err != nil {
+		return m, fmt.Errorf("invalid revs limit %q of %s", strings.TrimSpace(string(revsLimit)), db.DbName)
+	}
+	return m, nil
+}
+
+// WriteManifest saves the manifest next to the dump, replacing the previous one in one step.
+func WriteManifest(dumpFile string, m manifest.Manifest) error {
+	fileName := ManifestFile(dumpFile)
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling the manifest: %v", err)
+	}
+	if err := writeFileAtomic(fileName, append(body, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing manifest %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a temporary file and renames it over fileName, so that
+// the readers find either the old content or the new one.
+func writeFileAtomic(fileName string, body []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// LoadManifest reads the manifest of a dump, found is false for the dumps taken
+// before the manifests existed.
+func LoadManifest(dumpFile string) (m manifest.Manifest, found bool, err error) {
+	fileName := ManifestFile(dumpFile)
+	body, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, fmt.Errorf("error reading manifest %s: %v", fileName, err)
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, false, fmt.Errorf("error reading manifest %s: %v", fileName, err)
+	}
+	if m.Version > manifest.Version {
+		return m, false, fmt.Errorf("manifest %s has version %d, this dbackupcli reads up to version %d", fileName, m.Version, manifest.Version)
+	}
+	return m, true, nil
+}
+
+// CreateDatabase creates dbName partitioned and sharded as recorded in the manifest,
+// the restore script would otherwise create it with the defaults of the server.
+func CreateDatabase(host string, port int, user string, password string, dbName string, m manifest.Manifest) error {
+	query := url.Values{}
+	if m.Props.Partitioned {
+		query.Set("partitioned", "true")
+	}
+	if m.Cluster.Q > 0 {
+		query.Set("q", strconv.Itoa(m.Cluster.Q))
+	}
+	if m.Cluster.N > 0 {
+		query.Set("n", strconv.Itoa(m.Cluster.N))
+	}
+	dbURL := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName
+	if len(query) != 0 {
+		dbURL += "?" + query.Encode()
+	}
+	if _, err := couchRequest("PUT", dbURL, user, password, nil); err != nil {
+		return fmt.Errorf("error creating the database %s: %w", dbName, err)
+	}
+	slog.Info("database created", "db", dbName, "host", host, "partitioned", m.Props.Partitioned, "q", m.Cluster.Q, "n", m.Cluster.N)
+	return nil
+}
+
+// ApplyManifest puts back the security object and the revs limit recorded in the manifest.
+func ApplyManifest(host string, port int, user string, password string, dbName string, m manifest.Manifest) error {
+	baseURL := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName
+	if len(m.Security) != 0 {
+		if _, err := couchRequest("PUT", baseURL+"/_security", user, password, m.Security); err != nil {
+			return fmt.Errorf("error restoring the security of %s: %w", dbName, err)
+		}
+	}
+	if m.RevsLimit > 0 {
+		if _, err := couchRequest("PUT", baseURL+"/_revs_limit", user, password, []byte(strconv.Itoa(m.RevsLimit))); err != nil {
+			return fmt.Errorf("error restoring the revs limit of %s: %w", dbName, err)
+		}
+	}
+	slog.Info("database settings restored", "db", dbName, "host", host, "revs_limit", m.RevsLimit)
+	return nil
+}
+
+func couchRequest(method string, address string, user string, password string, body []byte) ([]byte, error) {
+	return sendCouchRequest(method, address, user, password, body, false)
+}
+
+// couchQuery posts a query that only reads the database, to _all_docs with keys, to
+// _find or to _bulk_get, so that it can be retried as a GET.
+func couchQuery(address string, user string, password string, body []byte) ([]byte, error) {
+	return sendCouchRequest("POST", address, user, password, body, true)
+}
+
+func sendCouchRequest(method string, address string, user string, password string, body []byte, replay bool) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, address, reader)
+	if err != nil {
+		return nil, fmt.Errorf(ErrCreateHTTPRequest, err)
+	}
+	if replay {
+		req = Replayable(req)
+	}
+	req.Header.Add(headerContentType, valueJSON)
+	req.SetBasicAuth(user, password)
+	res, err := Do(req)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf(ErrReadResponseBody, err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, statusError(res, resBody)
+	}
+	return resBody, nil
+}
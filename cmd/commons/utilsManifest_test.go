@@ -0,0 +1,131 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"dbackupcli/cmd/struct/couchdb"
+	"dbackupcli/cmd/struct/manifest"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestManifestFile(t *testing.T) {
+	if got := ManifestFile("/backups/db.json"); got != "/backups/db.manifest.json" {
+		t.Errorf("ManifestFile() = %q", got)
+	}
+	tests := map[string]bool{
+		"db.json":                true,
+		"db.manifest.json":       false,
+		"db.json.partial":        false,
+		"db.json.lock":           false,
+		"_users.json":            true,
+		"db.manifest.json.1.tmp": false,
+	}
+	for name, want := range tests {
+		if got := IsDumpFile(name); got != want {
+			t.Errorf("IsDumpFile(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "db.json")
+	if _, found, err := LoadManifest(dumpFile); found || err != nil {
+		t.Fatalf("LoadManifest() of a dump without manifest = %t, %v", found, err)
+	}
+
+	m := manifest.Manifest{
+		Version:   manifest.Version,
+		Database:  "db",
+		DocCount:  3,
+		Props:     couchdb.Props{Partitioned: true},
+		Cluster:   couchdb.Cluster{N: 3, Q: 8},
+		RevsLimit: 500,
+		Security:  json.RawMessage(`{"admins":{"names":["alice"]}}`),
+		Selection: &manifest.Selection{IDPrefix: "user:"},
+	}
+	if err := WriteManifest(dumpFile, m); err != nil {
+		t.Fatal(err)
+	}
+	got, found, err := LoadManifest(dumpFile)
+	if err != nil || !found {
+		t.Fatalf("LoadManifest() = %t, %v", found, err)
+	}
+	// MarshalIndent indents the security object too
+	var security bytes.Buffer
+	if err := json.Compact(&security, got.Security); err != nil {
+		t.Fatal(err)
+	}
+	got.Security = security.Bytes()
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("LoadManifest() = %+v, want %+v", got, m)
+	}
+
+	m.Version = manifest.Version + 1
+	if err := WriteManifest(dumpFile, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadManifest(dumpFile); err == nil {
+		t.Errorf("a manifest of a newer version was accepted")
+	}
+
+	if err := os.WriteFile(ManifestFile(dumpFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadManifest(dumpFile); err == nil {
+		t.Errorf("a corrupted manifest was accepted")
+	}
+}
+
+func TestFetchAndApplyManifest(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]string{}
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests[r.Method+" "+r.URL.RequestURI()] = string(body)
+		mu.Unlock()
+		switch r.Method + " " + r.URL.Path {
+		case "GET /db/_security":
+			io.WriteString(w, `{"members":{"roles":["staff"]}}`+"\n")
+		case "GET /db/_revs_limit":
+			io.WriteString(w, "250\n")
+		default:
+			io.WriteString(w, `{"ok":true}`)
+		}
+	})
+
+	m, err := FetchManifest(host, port, "admin", "secret", couchdb.Database{DbName: "db", DocCount: 2, Cluster: couchdb.Cluster{N: 1, Q: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RevsLimit != 250 || string(m.Security) != `{"members":{"roles":["staff"]}}` || m.Cluster.Q != 2 {
+		t.Errorf("FetchManifest() = %+v", m)
+	}
+
+	m.Props.Partitioned = true
+	if err := CreateDatabase(host, port, "admin", "secret", "copy", m); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyManifest(host, port, "admin", "secret", "copy", m); err != nil {
+		t.Fatal(err)
+	}
+	for request, body := range map[string]string{
+		"PUT /copy?n=1&partitioned=true&q=2": "",
+		"PUT /copy/_security":                `{"members":{"roles":["staff"]}}`,
+		"PUT /copy/_revs_limit":              "250",
+	} {
+		if got, ok := requests[request]; !ok || got != body {
+			t.Errorf("request %s sent %t with body %q, want %q", request, ok, got, body)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"dbackupcli/cmd/struct/couchdb"
+	"dbackupcli/cmd/struct/report"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsPrefix = "dbackupcli_"
+
+var metricLine = regexp.MustCompile(`^(\w+)\{(.*)\} (\S+)$`)
+var metricLabel = regexp.MustCompile(`(\w+)="((?:[^"\\]|\\.)*)"`)
+
+type metricKey struct {
+	Operation string
+	Host      string
+	Database  string
+}
+
+type databaseMetrics struct {
+	LastRun     float64
+	LastSuccess float64
+	Success     bool
+	Duration    float64
+	Bytes       int64
+	Documents   int
+	Failures    int
+	Stats       *report.DatabaseStats
+}
+
+// Metrics keeps the outcome of the runs in the Prometheus text format, it is
+// written as a node_exporter textfile after each run or served on /metrics by the daemon.
+type Metrics struct {
+	mu        sync.Mutex
+	databases map[metricKey]*databaseMetrics
+	runs      map[string]int
+	runTimes  map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		databases: make(map[metricKey]*databaseMetrics),
+		runs:      make(map[string]int),
+		runTimes:  make(map[string]float64),
+	}
+}
+
+func DatabaseStats(db couchdb.Database) *report.DatabaseStats {
+	return &report.DatabaseStats{
+		DocCount:     db.DocCount,
+		DocDelCount:  db.DocDelCount,
+		SizeFile:     db.Sizes.File,
+		SizeExternal: db.Sizes.External,
+		SizeActive:   db.Sizes.Active,
+	}
+}
+
+func (m *Metrics) Observe(results []report.DatabaseResult, finished time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, result := range results {
+		if result.Status == report.StatusSkipped {
+			continue
+		}
+		key := metricKey{Operation: result.Operation, Host: result.Host, Database: result.Database}
+		db, ok := m.databases[key]
+		if !ok {
+			db = &databaseMetrics{}
+			m.databases[key] = db
+		}
+		db.LastRun = float64(finished.Unix())
+		db.Success = result.Status == report.StatusOK
+		db.Duration = result.Duration
+		db.Bytes = result.Bytes
+		db.Documents = result.Documents
+		if result.Stats != nil {
+			db.Stats = result.Stats
+		}
+		if db.Success {
+			db.LastSuccess = db.LastRun
+		} else {
+			db.Failures++
+		}
+	}
+}
+
+func (m *Metrics) ObserveRun(command string, exitCode int, finished time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runs[command] = exitCode
+	m.runTimes[command] = float64(finished.Unix())
+}
+
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]metricKey, 0, len(m.databases))
+	for key := range m.databases {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Database < b.Database
+	})
+
+	var sb strings.Builder
+	gauge := func(name string, help string, value func(db *databaseMetrics) (float64, bool)) {
+		fmt.Fprintf(&sb, "# HELP %s%s %s\n# TYPE %s%s gauge\n", metricsPrefix, name, help, metricsPrefix, name)
+		for _, key := range keys {
+			if v, ok := value(m.databases[key]); ok {
+				fmt.Fprintf(&sb, "%s%s{%s} %s\n", metricsPrefix, name, key.labels(), formatMetric(v))
+			}
+		}
+	}
+	gauge("last_run_timestamp_seconds", "Unix time of the last run on the database.", func(db *databaseMetrics) (float64, bool) {
+		return db.LastRun, db.LastRun != 0
+	})
+	gauge("last_success_timestamp_seconds", "Unix time of the last successful run on the database.", func(db *databaseMetrics) (float64, bool) {
+		return db.LastSuccess, db.LastSuccess != 0
+	})
+	gauge("last_run_success", "Whether the last run on the database succeeded.", func(db *databaseMetrics) (float64, bool) {
+		return boolMetric(db.Success), db.LastRun != 0
+	})
+	gauge("last_duration_seconds", "Duration of the last run on the database.", func(db *databaseMetrics) (float64, bool) {
+		return db.Duration, db.LastRun != 0
+	})
+	gauge("last_bytes", "Size in bytes of the dump of the last run on the database.", func(db *databaseMetrics) (float64, bool) {
+		return float64(db.Bytes), db.LastRun != 0
+	})
+	gauge("last_documents", "Documents handled by the last run on the database.", func(db *databaseMetrics) (float64, bool) {
+		return float64(db.Documents), db.LastRun != 0
+	})
+	gauge("database_doc_count", "doc_count of the CouchDB database info.", func(db *databaseMetrics) (float64, bool) {
+		return statMetric(db.Stats, func(s *report.DatabaseStats) int { return s.DocCount })
+	})
+	gauge("database_doc_del_count", "doc_del_count of the CouchDB database info.", func(db *databaseMetrics) (float64, bool) {
+		return statMetric(db.Stats, func(s *report.DatabaseStats) int { return s.DocDelCount })
+	})
+	gauge("database_size_file_bytes", "sizes.file of the CouchDB database info.", func(db *databaseMetrics) (float64, bool) {
+		return statMetric(db.Stats, func(s *report.DatabaseStats) int { return s.SizeFile })
+	})
+	gauge("database_size_external_bytes", "sizes.external of the CouchDB database info.", func(db *databaseMetrics) (float64, bool) {
+		return statMetric(db.Stats, func(s *report.DatabaseStats) int { return s.SizeExternal })
+	})
+	gauge("database_size_active_bytes", "sizes.active of the CouchDB database info.", func(db *databaseMetrics) (float64, bool) {
+		return statMetric(db.Stats, func(s *report.DatabaseStats) int { return s.SizeActive })
+	})
+
+	fmt.Fprintf(&sb, "# HELP %sfailures_total Failed runs on the database.\n# TYPE %sfailures_total counter\n", metricsPrefix, metricsPrefix)
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "%sfailures_total{%s} %d\n", metricsPrefix, key.labels(), m.databases[key].Failures)
+	}
+
+	commands := make([]string, 0, len(m.runs))
+	for command := range m.runs {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	fmt.Fprintf(&sb, "# HELP %slast_exit_code Exit code of the last run of the command.\n# TYPE %slast_exit_code gauge\n", metricsPrefix, metricsPrefix)
+	for _, command := range commands {
+		fmt.Fprintf(&sb, "%slast_exit_code{command=%q} %d\n", metricsPrefix, command, m.runs[command])
+	}
+	fmt.Fprintf(&sb, "# HELP %slast_exit_timestamp_seconds Unix time of the last run of the command.\n# TYPE %slast_exit_timestamp_seconds gauge\n", metricsPrefix, metricsPrefix)
+	for _, command := range commands {
+		fmt.Fprintf(&sb, "%slast_exit_timestamp_seconds{command=%q} %s\n", metricsPrefix, command, formatMetric(m.runTimes[command]))
+	}
+
+	n, err := io.WriteString(w, sb.String())
+	return int64(n), err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(headerContentType, "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+func (key metricKey) labels() string {
+	return fmt.Sprintf("operation=%q,host=%q,database=%q", key.Operation, key.Host, key.Database)
+}
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func statMetric(stats *report.DatabaseStats, field func(s *report.DatabaseStats) int) (float64, bool) {
+	if stats == nil {
+		return 0, false
+	}
+	return float64(field(stats)), true
+}
+
+// LoadMetricsTextfile reads back the metrics written by a previous run, so the
+// last success of every database and the failure counters survive across runs.
+func LoadMetricsTextfile(fileName string) (*Metrics, error) {
+	m := NewMetrics()
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, fmt.Errorf("error opening metrics file %s: %v", fileName, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		match := metricLine.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		labels := make(map[string]string)
+		for _, label := range metricLabel.FindAllStringSubmatch(match[2], -1) {
+			labels[label[1]], _ = strconv.Unquote(`"` + label[2] + `"`)
+		}
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			continue
+		}
+
+		if command, ok := labels["command"]; ok {
+			switch match[1] {
+			case metricsPrefix + "last_exit_code":
+				m.runs[command] = int(value)
+			case metricsPrefix + "last_exit_timestamp_seconds":
+				m.runTimes[command] = value
+			}
+			continue
+		}
+		key := metricKey{Operation: labels["operation"], Host: labels["host"], Database: labels["database"]}
+		db, ok := m.databases[key]
+		if !ok {
+			db = &databaseMetrics{}
+			m.databases[key] = db
+		}
+		switch match[1] {
+		case metricsPrefix + "last_run_timestamp_seconds":
+			db.LastRun = value
+		case metricsPrefix + "last_success_timestamp_seconds":
+			db.LastSuccess = value
+		case metricsPrefix + "last_run_success":
+			db.Success = value == 1
+		case metricsPrefix + "last_duration_seconds":
+			db.Duration = value
+		case metricsPrefix + "last_bytes":
+			db.Bytes = int64(value)
+		case metricsPrefix + "last_documents":
+			db.Documents = int(value)
+		case metricsPrefix + "failures_total":
+			db.Failures = int(value)
+		case metricsPrefix + "database_doc_count":
+			loadedStats(db).DocCount = int(value)
+		case metricsPrefix + "database_doc_del_count":
+			loadedStats(db).DocDelCount = int(value)
+		case metricsPrefix + "database_size_file_bytes":
+			loadedStats(db).SizeFile = int(value)
+		case metricsPrefix + "database_size_external_bytes":
+			loadedStats(db).SizeExternal = int(value)
+		case metricsPrefix + "database_size_active_bytes":
+			loadedStats(db).SizeActive = int(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return m, fmt.Errorf("error reading metrics file %s: %v", fileName, err)
+	}
+	return m, nil
+}
+
+func loadedStats(db *databaseMetrics) *report.DatabaseStats {
+	if db.Stats == nil {
+		db.Stats = &report.DatabaseStats{}
+	}
+	return db.Stats
+}
+
+// WriteMetricsTextfile replaces the textfile in one step, as node_exporter may read it at any time.
+func WriteMetricsTextfile(fileName string, m *Metrics) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating metrics file %s: %v", fileName, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := m.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing metrics file %s: %v", fileName, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing metrics file %s: %v", fileName, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error writing metrics file %s: %v", fileName, err)
+	}
+	if err := os.Rename(tmp.Name(), fileName); err != nil {
+		return fmt.Errorf("error writing metrics file %s: %v", fileName, err)
+	}
+	return nil
+}
+
+// WriteRunMetrics adds the results of the current run to the metrics textfile.
+func WriteRunMetrics(fileName string, command string, err error) error {
+	m, loadErr := LoadMetricsTextfile(fileName)
+	if loadErr != nil {
+		return loadErr
+	}
+	finished := time.Now()
+	m.Observe(runReport.Databases, finished)
+	m.ObserveRun(command, ExitCode(err), finished)
+	return WriteMetricsTextfile(fileName, m)
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"dbackupcli/cmd/struct/report"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsTextfileRoundTrip(t *testing.T) {
+	first := time.Unix(1750000000, 0)
+	m := NewMetrics()
+	m.Observe([]report.DatabaseResult{
+		{Operation: "backup", Host: "couch", Database: "orders", Status: report.StatusOK, Duration: 1.5, Bytes: 2048, Documents: 10,
+			Stats: &report.DatabaseStats{DocCount: 10, SizeFile: 4096}},
+		{Operation: "backup", Host: "couch", Database: "users", Status: report.StatusFailed},
+		{Operation: "backup", Host: "couch", Database: "skipped", Status: report.StatusSkipped},
+	}, first)
+	m.ObserveRun("backupAll", ExitPartial, first)
+
+	fileName := filepath.Join(t.TempDir(), "dbackupcli.prom")
+	if err := WriteMetricsTextfile(fileName, m); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadMetricsTextfile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second failing run keeps the last success and counts the failures
+	second := first.Add(time.Hour)
+	loaded.Observe([]report.DatabaseResult{
+		{Operation: "backup", Host: "couch", Database: "orders", Status: report.StatusFailed},
+		{Operation: "backup", Host: "couch", Database: "users", Status: report.StatusFailed},
+	}, second)
+	var out bytes.Buffer
+	if _, err := loaded.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, want := range []string{
+		`dbackupcli_last_success_timestamp_seconds{operation="backup",host="couch",database="orders"} 1750000000`,
+		`dbackupcli_last_run_timestamp_seconds{operation="backup",host="couch",database="orders"} 1750003600`,
+		`dbackupcli_failures_total{operation="backup",host="couch",database="orders"} 1`,
+		`dbackupcli_failures_total{operation="backup",host="couch",database="users"} 2`,
+		`dbackupcli_database_doc_count{operation="backup",host="couch",database="orders"} 10`,
+		`dbackupcli_last_exit_code{command="backupAll"} 5`,
+	} {
+		if !strings.Contains(text, want+"\n") {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	if strings.Contains(text, `database="skipped"`) {
+		t.Errorf("skipped database recorded")
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Database names allowed by CouchDB, see https://docs.couchdb.org/en/stable/api/database/common.html#put--db
+var databaseNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_$()+/-]*$`)
+
+const maxDatabaseNameLength = 238
+
+func ValidateDatabaseName(name string) error {
+	if len(name) > maxDatabaseNameLength {
+		return fmt.Errorf("invalid database name %q: longer than %d characters", name, maxDatabaseNameLength)
+	}
+	if !databaseNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid database name %q: it must start with a lowercase letter and contain only a-z, 0-9, _, $, (, ), +, - and /", name)
+	}
+	return nil
+}
+
+// NameMapper computes the target database of a dump: an explicit mapping wins,
+// otherwise the prefix and the suffix are added to the original name.
+type NameMapper struct {
+	Prefix  string
+	Suffix  string
+	Mapping map[string]string
+}
+
+func NewNameMapper(prefix string, suffix string, pairs []string, mappingFile string) (NameMapper, error) {
+	mapper := NameMapper{Prefix: prefix, Suffix: suffix, Mapping: map[string]string{}}
+
+	if mappingFile != "" {
+		f, err := os.Open(mappingFile)
+		if err != nil {
+			return NameMapper{}, fmt.Errorf("error opening mapping file %s: %v", mappingFile, err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				pairs = append(pairs, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return NameMapper{}, fmt.Errorf("error reading mapping file %s: %v", mappingFile, err)
+		}
+	}
+
+	for _, pair := range pairs {
+		oldName, newName, found := strings.Cut(pair, "=")
+		oldName, newName = strings.TrimSpace(oldName), strings.TrimSpace(newName)
+		if !found || oldName == "" || newName == "" {
+			return NameMapper{}, fmt.Errorf("invalid mapping %q, expected old=new", pair)
+		}
+		mapper.Mapping[oldName] = newName
+	}
+	return mapper, nil
+}
+
+func (m NameMapper) Target(name string) string {
+	if target, ok := m.Mapping[name]; ok {
+		return target
+	}
+	return m.Prefix + name + m.Suffix
+}
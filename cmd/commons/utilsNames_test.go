@@ -0,0 +1,59 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateDatabaseName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"orders", true},
+		{"team/orders-2025_v(1)+$", true},
+		{"Orders", false},
+		{"1orders", false},
+		{"_users", false},
+		{"orders.json", false},
+		{"", false},
+		{strings.Repeat("a", maxDatabaseNameLength), true},
+		{strings.Repeat("a", maxDatabaseNameLength+1), false},
+	}
+	for _, test := range tests {
+		if err := ValidateDatabaseName(test.name); (err == nil) != test.valid {
+			t.Errorf("ValidateDatabaseName(%q) = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestNameMapper(t *testing.T) {
+	mappingFile := filepath.Join(t.TempDir(), "mapping.txt")
+	os.WriteFile(mappingFile, []byte("# renamed databases\nusers = accounts\n\n"), 0600)
+	mapper, err := NewNameMapper("restored_", "_copy", []string{"orders=orders-2025"}, mappingFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"orders":   "orders-2025",
+		"users":    "accounts",
+		"invoices": "restored_invoices_copy",
+	}
+	for name, want := range tests {
+		if got := mapper.Target(name); got != want {
+			t.Errorf("Target(%q) = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, pair := range []string{"orders", "=accounts", "users="} {
+		if _, err := NewNameMapper("", "", []string{pair}, ""); err == nil {
+			t.Errorf("invalid mapping %q accepted", pair)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"dbackupcli/cmd/struct/report"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	NotifyWebhook = "webhook"
+	NotifySlack   = "slack"
+	NotifyTeams   = "teams"
+	NotifySMTP    = "smtp"
+)
+
+const (
+	NotifyOnFailure = "on-failure"
+	NotifyOnSuccess = "on-success"
+	NotifyAlways    = "always"
+)
+
+var notifyPolicies = []string{NotifyOnFailure, NotifyOnSuccess, NotifyAlways}
+
+const defaultNotifyText = `dbackupcli {{.Run.Command}} on {{.Hostname}}: {{.Run.Status}} (exit code {{.Run.ExitCode}})
+{{if .Run.Error}}Error: {{.Run.Error}}
+{{end}}{{range .Run.Databases}}- {{.Database}} on {{.Host}}: {{.Status}}, {{.Documents}} documents, {{bytes .Bytes}} in {{printf "%.1f" .Duration}}s{{if .Error}}, error: {{.Error}}{{end}}
+{{end}}`
+
+const defaultNotifySubject = `[dbackupcli] {{.Run.Command}} {{.Run.Status}} on {{.Hostname}}`
+
+// Notification is a sink that is told about the outcome of a run, Template and
+// Subject are Go text/template rendered with the run report.
+type Notification struct {
+	Name     string            `json:"name"`
+	Type     string            `json:"type"`
+	When     string            `json:"when"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	To       []string          `json:"to"`
+	Subject  string            `json:"subject"`
+	Template string            `json:"template"`
+}
+
+type SMTPConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	From     string `json:"from"`
+}
+
+type NotificationData struct {
+	Run      report.RunReport
+	Hostname string
+	Failed   []report.DatabaseResult
+}
+
+type webhookPayload struct {
+	Event    string           `json:"event"`
+	Hostname string           `json:"hostname"`
+	Text     string           `json:"text"`
+	Report   report.RunReport `json:"report"`
+}
+
+type teamsPayload struct {
+	Type       string `json:"@type"`
+	Context    string `json:"@context"`
+	Summary    string `json:"summary"`
+	ThemeColor string `json:"themeColor"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+}
+
+// GetNotifications returns the sinks selected with --notify from the config and
+// the ones given directly with the --notify-* flags, with the SMTP server to use.
+func GetNotifications(cmd *cobra.Command) ([]Notification, SMTPConfig, error) {
+	config, err := GetConfig(cmd)
+	if err != nil {
+		return nil, SMTPConfig{}, err
+	}
+	when, _ := cmd.Flags().GetString("notify-on")
+	if !slices.Contains(notifyPolicies, when) {
+		return nil, SMTPConfig{}, fmt.Errorf("invalid notification policy %q, must be one of: on-failure, on-success, always", when)
+	}
+	templateFile, _ := cmd.Flags().GetString("notify-template")
+	var tmpl string
+	if templateFile != "" {
+		body, err := os.ReadFile(templateFile)
+		if err != nil {
+			return nil, SMTPConfig{}, fmt.Errorf("error reading notification template %s: %v", templateFile, err)
+		}
+		tmpl = string(body)
+	}
+
+	var notifications []Notification
+	names, _ := cmd.Flags().GetStringSlice("notify")
+	for _, name := range names {
+		i := slices.IndexFunc(config.Notifications, func(n Notification) bool { return n.Name == name })
+		if i < 0 {
+			return nil, SMTPConfig{}, fmt.Errorf("notification %s not found in the config file", name)
+		}
+		notifications = append(notifications, config.Notifications[i])
+	}
+	for _, sink := range []string{NotifyWebhook, NotifySlack, NotifyTeams} {
+		if url, _ := cmd.Flags().GetString("notify-" + sink); url != "" {
+			notifications = append(notifications, Notification{Name: sink, Type: sink, When: when, URL: url, Template: tmpl})
+		}
+	}
+	if to, _ := cmd.Flags().GetStringSlice("notify-email"); len(to) != 0 {
+		notifications = append(notifications, Notification{Name: "email", Type: NotifySMTP, When: when, To: to, Template: tmpl})
+	}
+
+	for i := range notifications {
+		if notifications[i].When == "" {
+			notifications[i].When = NotifyOnFailure
+		}
+		if !slices.Contains(notifyPolicies, notifications[i].When) {
+			return nil, SMTPConfig{}, fmt.Errorf("invalid notification policy %q, must be one of: on-failure, on-success, always", notifications[i].When)
+		}
+		if !slices.Contains([]string{NotifyWebhook, NotifySlack, NotifyTeams, NotifySMTP}, notifications[i].Type) {
+			return nil, SMTPConfig{}, fmt.Errorf("invalid notification type %q, must be one of: webhook, slack, teams, smtp", notifications[i].Type)
+		}
+	}
+
+	server := config.SMTP
+	if host, _ := cmd.Flags().GetString("smtp-host"); host != "" {
+		server.Host = host
+	}
+	if cmd.Flags().Changed("smtp-port") || server.Port == 0 {
+		server.Port, _ = cmd.Flags().GetInt("smtp-port")
+	}
+	if user, _ := cmd.Flags().GetString("smtp-user"); user != "" {
+		server.User = user
+	}
+	if password, _ := cmd.Flags().GetString("smtp-password"); password != "" {
+		server.Password = password
+	}
+	if from, _ := cmd.Flags().GetString("smtp-from"); from != "" {
+		server.From = from
+	}
+	return notifications, server, nil
+}
+
+// Notify sends the run report to every sink whose policy matches the outcome,
+// a failing sink is logged and does not change the exit code.
+func Notify(notifications []Notification, server SMTPConfig, run report.RunReport) {
+	data := NotificationData{Run: run}
+	data.Hostname, _ = os.Hostname()
+	for _, result := range run.Databases {
+		if result.Status == report.StatusFailed {
+			data.Failed = append(data.Failed, result)
+		}
+	}
+
+	for _, notification := range notifications {
+		if !notification.matches(run.Status) {
+			continue
+		}
+		if err := notification.send(server, data); err != nil {
+			slog.Error("error sending the notification", "notification", notification.Name, "type", notification.Type, "error", err)
+			continue
+		}
+		slog.Info("notification sent", "notification", notification.Name, "type", notification.Type)
+	}
+}
+
+func (n Notification) matches(status string) bool {
+	switch n.When {
+	case NotifyAlways:
+		return true
+	case NotifyOnSuccess:
+		return status == report.RunOK
+	}
+	return status == report.RunFailed || status == report.RunPartial
+}
+
+func (n Notification) send(server SMTPConfig, data NotificationData) error {
+	text, err := renderNotification(n.Template, defaultNotifyText, data)
+	if err != nil {
+		return err
+	}
+
+	var payload any
+	switch n.Type {
+	case NotifySMTP:
+		return sendMail(server, n, text, data)
+	case NotifySlack:
+		payload = map[string]string{"text": text}
+	case NotifyTeams:
+		color := "2EB886"
+		if data.Run.Status != report.RunOK {
+			color = "D00000"
+		}
+		title, err := renderNotification(n.Subject, defaultNotifySubject, data)
+		if err != nil {
+			return err
+		}
+		payload = teamsPayload{Type: "MessageCard", Context: "https://schema.org/extensions", Summary: title,
+			ThemeColor: color, Title: title, Text: strings.ReplaceAll(text, "\n", "  \n")}
+	default:
+		if n.Template != "" {
+			return postWebhook(n, []byte(text))
+		}
+		payload = webhookPayload{Event: data.Run.Command + "." + data.Run.Status, Hostname: data.Hostname, Text: text, Report: data.Run}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("error marshalling the notification: %v", err)
+	}
+	return postWebhook(n, body)
+}
+
+func renderNotification(text string, fallback string, data NotificationData) (string, error) {
+	if text == "" {
+		text = fallback
+	}
+	tmpl, err := template.New("notification").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			body, err := json.Marshal(v)
+			return string(body), err
+		},
+		"bytes": FormatBytes,
+	}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("error parsing the notification template: %v", err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("error rendering the notification template: %v", err)
+	}
+	return out.String(), nil
+}
+
+func postWebhook(n Notification, body []byte) error {
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf(ErrCreateHTTPRequest, err)
+	}
+	req.Header.Add(headerContentType, valueJSON)
+	for key, value := range n.Headers {
+		req.Header.Set(key, value)
+	}
+	res, err := Do(req)
+	if err != nil {
+		return fmt.Errorf(ErrPerformHTTPRequest, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("webhook returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func sendMail(server SMTPConfig, n Notification, text string, data NotificationData) error {
+	if server.Host == "" || server.From == "" || len(n.To) == 0 {
+		return fmt.Errorf("the smtp host, the sender and the recipients are required to send an email")
+	}
+	subject, err := renderNotification(n.Subject, defaultNotifySubject, data)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", server.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.TrimSpace(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if server.User != "" {
+		auth = smtp.PlainAuth("", server.User, server.Password, server.Host)
+	}
+	addr := server.Host + ":" + strconv.Itoa(server.Port)
+	if err := smtp.SendMail(addr, auth, server.From, n.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("error sending the email through %s: %v", addr, err)
+	}
+	return nil
+}
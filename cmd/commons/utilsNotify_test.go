@@ -0,0 +1,78 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/report"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotificationMatches(t *testing.T) {
+	tests := []struct {
+		when   string
+		status string
+		want   bool
+	}{
+		{NotifyOnFailure, report.RunFailed, true},
+		{NotifyOnFailure, report.RunPartial, true},
+		{NotifyOnFailure, report.RunOK, false},
+		{NotifyOnFailure, report.RunAborted, false},
+		{NotifyOnSuccess, report.RunOK, true},
+		{NotifyOnSuccess, report.RunFailed, false},
+		{NotifyAlways, report.RunAborted, true},
+	}
+	for _, test := range tests {
+		if got := (Notification{When: test.when}).matches(test.status); got != test.want {
+			t.Errorf("%s with %s = %t, want %t", test.when, test.status, got, test.want)
+		}
+	}
+}
+
+func TestRenderNotification(t *testing.T) {
+	data := NotificationData{Hostname: "backup-1", Run: report.RunReport{
+		Command: "backupAll", Status: report.RunPartial, ExitCode: ExitPartial,
+		Databases: []report.DatabaseResult{{Database: "orders", Host: "couch", Status: report.StatusFailed, Bytes: 2048, Error: "boom"}},
+	}}
+	text, err := renderNotification("", defaultNotifyText, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"dbackupcli backupAll on backup-1: partial (exit code 5)", "- orders on couch: failed, 0 documents, 2.0 KiB", "error: boom"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("notification %q lacks %q", text, want)
+		}
+	}
+
+	custom, err := renderNotification(`{{.Run.Command}} {{json .Run.ExitCode}}`, defaultNotifyText, data)
+	if err != nil || custom != "backupAll 5" {
+		t.Errorf("custom template = %q, %v", custom, err)
+	}
+	if _, err := renderNotification(`{{.Run.Command`, defaultNotifyText, data); err == nil {
+		t.Errorf("invalid template accepted")
+	}
+}
+
+func TestNotifySlack(t *testing.T) {
+	var payload map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+	}))
+	defer server.Close()
+
+	run := report.RunReport{Command: "backup", Status: report.RunFailed, ExitCode: ExitFailure, Error: "boom"}
+	Notify([]Notification{
+		{Name: "slack", Type: NotifySlack, When: NotifyOnFailure, URL: server.URL},
+		{Name: "never", Type: NotifySlack, When: NotifyOnSuccess, URL: "http://127.0.0.1:1"},
+	}, SMTPConfig{}, run)
+	if !strings.Contains(payload["text"], "dbackupcli backup on") || !strings.Contains(payload["text"], "Error: boom") {
+		t.Errorf("unexpected Slack payload %v", payload)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/report"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+	OutputYAML = "yaml"
+)
+
+var outputFormat = OutputText
+
+// Out receives the messages meant for humans, the prompts and the output of the
+// scripts and of the hooks: stdout with the text format, stderr with a structured one.
+var Out io.Writer = os.Stdout
+
+// SetupOutput selects the format of the command results. With a structured format
+// stdout only carries the result document, so Out is moved to stderr.
+func SetupOutput(format string) error {
+	switch format {
+	case OutputText:
+		Out = os.Stdout
+	case OutputJSON, OutputYAML:
+		Out = os.Stderr
+	default:
+		return fmt.Errorf("invalid output %q, must be one of: text, json, yaml", format)
+	}
+	outputFormat = format
+	return nil
+}
+
+func StructuredOutput() bool {
+	return outputFormat != OutputText
+}
+
+// outFile is the file behind Out, for the terminal checks and the prompts.
+func outFile() *os.File {
+	if f, ok := Out.(*os.File); ok {
+		return f
+	}
+	return os.Stdout
+}
+
+// PrintResult writes the result of a command in the selected format, text is
+// called instead for the text format.
+func PrintResult(result any, text func()) {
+	switch outputFormat {
+	case OutputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			slog.Error("error encoding the result", "error", err)
+		}
+	case OutputYAML:
+		encoder := yaml.NewEncoder(os.Stdout)
+		if err := encoder.Encode(result); err != nil {
+			slog.Error("error encoding the result", "error", err)
+		}
+		encoder.Close()
+	default:
+		if text != nil {
+			text()
+		}
+	}
+}
+
+func SetupLogging(format string, level string) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q, must be one of: debug, info, warn, error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, options)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, options)))
+	default:
+		return fmt.Errorf("invalid log format %q, must be one of: text, json", format)
+	}
+	return nil
+}
+
+// FinishResult completes the result of an operation on a database, logs its outcome
+// and records it in the run report.
+func FinishResult(result *report.DatabaseResult, started time.Time, err error) {
+	result.Duration = time.Since(started).Seconds()
+	if result.File != "" {
+		if info, statErr := os.Stat(result.File); statErr == nil {
+			result.Bytes = info.Size()
+		}
+	}
+
+	attrs := []any{"operation", result.Operation, "db", result.Database, "host", result.Host, "phase", "done",
+		"bytes", result.Bytes, "duration", result.Duration}
+	if result.Conflicts > 0 {
+		attrs = append(attrs, "conflicts", result.Conflicts)
+	}
+	if result.Deleted > 0 {
+		attrs = append(attrs, "deleted", result.Deleted)
+	}
+	if result.Attachments > 0 {
+		attrs = append(attrs, "attachments", result.Attachments)
+	}
+	if err != nil {
+		result.Status = report.StatusFailed
+		result.Error = err.Error()
+		slog.Error(result.Operation+" failed", append(attrs, "error", err)...)
+	} else {
+		result.Status = report.StatusOK
+		slog.Info(result.Operation+" completed", attrs...)
+	}
+	RecordResult(*result)
+}
@@ -0,0 +1,36 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSetupOutput(t *testing.T) {
+	stdout := os.Stdout
+	t.Cleanup(func() { SetupOutput(OutputText) })
+
+	if err := SetupOutput(OutputJSON); err != nil {
+		t.Fatal(err)
+	}
+	if Out != os.Stderr || !StructuredOutput() {
+		t.Errorf("json output: human messages not moved to stderr")
+	}
+	if os.Stdout != stdout {
+		t.Errorf("json output replaced os.Stdout")
+	}
+
+	if err := SetupOutput(OutputText); err != nil {
+		t.Fatal(err)
+	}
+	if Out != os.Stdout || StructuredOutput() {
+		t.Errorf("text output: human messages not on stdout")
+	}
+
+	if err := SetupOutput("xml"); err == nil {
+		t.Errorf("invalid output accepted")
+	}
+}
@@ -0,0 +1,382 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"bytes"
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ChangeCreate is a document missing from the database
+	ChangeCreate = "create"
+	// ChangeRecreate is a document deleted in the database since the backup
+	ChangeRecreate = "recreate"
+	// ChangeUpdate is a document changed in the database since the backup
+	ChangeUpdate = "update"
+	// ChangeUnchanged is a document the same in the database and in the backup
+	ChangeUnchanged = "unchanged"
+)
+
+// maxDiffValue is the length of the values shown in a diff, the longer ones are cut.
+const maxDiffValue = 80
+
+// DocumentFilter chooses the documents of a dump for a partial restore, a document is
+// chosen when it matches all the filters that are set.
+type DocumentFilter struct {
+	IDs      map[string]bool
+	IDPrefix string
+	Selector *Selector
+}
+
+// NewDocumentFilter builds the filter of a partial restore from the IDs, the file with
+// one ID per line, the ID prefix and the Mango selector, all of them optional.
+func NewDocumentFilter(ids []string, idsFile string, prefix string, selector string) (DocumentFilter, error) {
+	filter := DocumentFilter{IDPrefix: prefix}
+	if idsFile != "" {
+		f, err := os.Open(idsFile)
+		if err != nil {
+			return filter, fmt.Errorf("error reading the IDs file %s: %v", idsFile, err)
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if id := strings.TrimSpace(scanner.Text()); id != "" && !strings.HasPrefix(id, "#") {
+				ids = append(ids, id)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return filter, fmt.Errorf("error reading the IDs file %s: %v", idsFile, err)
+		}
+		if len(ids) == 0 {
+			return filter, fmt.Errorf("the IDs file %s has no IDs", idsFile)
+		}
+	}
+	if len(ids) > 0 {
+		filter.IDs = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			filter.IDs[id] = true
+		}
+	}
+	if selector != "" {
+		parsed, err := ParseSelector([]byte(selector))
+		if err != nil {
+			return filter, err
+		}
+		filter.Selector = &parsed
+	}
+	return filter, nil
+}
+
+// Active tells whether the filter chooses a part of the dump.
+func (f DocumentFilter) Active() bool {
+	return f.IDs != nil || f.IDPrefix != "" || f.Selector != nil
+}
+
+// Matches tells whether the document of the dump is chosen.
+func (f DocumentFilter) Matches(id string, doc []byte) (bool, error) {
+	if f.IDs != nil && !f.IDs[id] {
+		return false, nil
+	}
+	if !strings.HasPrefix(id, f.IDPrefix) {
+		return false, nil
+	}
+	if f.Selector != nil {
+		return f.Selector.Matches(doc)
+	}
+	return true, nil
+}
+
+// DocumentChange is a document of the dump compared with the one in the database.
+type DocumentChange struct {
+	ID      string        `json:"id" yaml:"id"`
+	Action  string        `json:"action" yaml:"action"`
+	LiveRev string        `json:"live_rev,omitempty" yaml:"live_rev,omitempty"`
+	Fields  []FieldChange `json:"fields,omitempty" yaml:"fields,omitempty"`
+	doc     []byte
+}
+
+// FieldChange is a top-level field that differs, Live or Backup empty when missing.
+type FieldChange struct {
+	Field  string `json:"field" yaml:"field"`
+	Live   string `json:"live,omitempty" yaml:"live,omitempty"`
+	Backup string `json:"backup,omitempty" yaml:"backup,omitempty"`
+}
+
+// SelectDumpDocuments returns the documents of the dump chosen by the filter, the
+// winning revision of each one. The tombstones are left out, a partial restore puts
+// documents back and never deletes them.
+func SelectDumpDocuments(fileName string, filter DocumentFilter) ([][]byte, error) {
+	var docs [][]byte
+	seen := make(map[string]bool)
+	err := ReadDump(fileName, func(doc []byte) error {
+		var ref couchdb.DocRef
+		if err := json.Unmarshal(doc, &ref); err != nil {
+			return fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		// With --with-conflicts the losing leaves follow the winning revision
+		if seen[ref.ID] || ref.Deleted {
+			return nil
+		}
+		seen[ref.ID] = true
+		matched, err := filter.Matches(ref.ID, doc)
+		if err != nil || !matched {
+			return err
+		}
+		docs = append(docs, slices.Clone(doc))
+		return nil
+	})
+	return docs, err
+}
+
+// DiffDocuments compares the documents of the dump with their current revisions in
+// the database.
+func DiffDocuments(host string, port int, user string, password string, dbName string, docs [][]byte) ([]DocumentChange, error) {
+	var changes []DocumentChange
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/_all_docs?include_docs=true"
+	for start := 0; start < len(docs); start += selectionBatchSize {
+		batch := docs[start:min(start+selectionBatchSize, len(docs))]
+		ids := make([]string, 0, len(batch))
+		for _, doc := range batch {
+			var ref couchdb.DocRef
+			if err := json.Unmarshal(doc, &ref); err != nil {
+				return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+			}
+			ids = append(ids, ref.ID)
+		}
+		payload, err := json.Marshal(map[string][]string{"keys": ids})
+		if err != nil {
+			return nil, fmt.Errorf(ErrMarshalJSON, err)
+		}
+		body, err := couchQuery(address, user, password, payload)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the documents of %s: %w", dbName, err)
+		}
+		var response struct {
+			Rows []struct {
+				Key   string `json:"key"`
+				Error string `json:"error"`
+				Value struct {
+					Rev     string `json:"rev"`
+					Deleted bool   `json:"deleted"`
+				} `json:"value"`
+				Doc json.RawMessage `json:"doc"`
+			} `json:"rows"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		if len(response.Rows) != len(batch) {
+			return nil, fmt.Errorf("error reading the documents of %s: %d rows for %d keys", dbName, len(response.Rows), len(batch))
+		}
+		for i, row := range response.Rows {
+			change := DocumentChange{ID: ids[i], LiveRev: row.Value.Rev, doc: batch[i]}
+			switch {
+			case row.Error != "":
+				change.Action = ChangeCreate
+			case row.Value.Deleted:
+				change.Action = ChangeRecreate
+			default:
+				if change.Fields, err = diffFields(row.Doc, batch[i]); err != nil {
+					return nil, err
+				}
+				change.Action = ChangeUpdate
+				if len(change.Fields) == 0 {
+					change.Action = ChangeUnchanged
+				}
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// diffFields lists the top-level fields that differ, the revision metadata aside and
+// the attachments compared by their digests.
+func diffFields(live []byte, backup []byte) ([]FieldChange, error) {
+	var liveFields, backupFields map[string]json.RawMessage
+	if err := json.Unmarshal(live, &liveFields); err != nil {
+		return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	if err := json.Unmarshal(backup, &backupFields); err != nil {
+		return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	keys := make(map[string]bool)
+	for key := range liveFields {
+		keys[key] = true
+	}
+	for key := range backupFields {
+		keys[key] = true
+	}
+	var fields []FieldChange
+	for _, key := range sortedSet(keys) {
+		switch key {
+		case "_id", "_rev", "_revisions", "_conflicts", "_deleted_conflicts":
+			continue
+		}
+		liveValue, backupValue := liveFields[key], backupFields[key]
+		if key == "_attachments" {
+			liveValue, backupValue = attachmentDigests(liveValue), attachmentDigests(backupValue)
+		}
+		if sameJSON(liveValue, backupValue) {
+			continue
+		}
+		fields = append(fields, FieldChange{Field: key, Live: diffValue(liveValue), Backup: diffValue(backupValue)})
+	}
+	return fields, nil
+}
+
+// attachmentDigests reduces _attachments to the digest of every attachment.
+func attachmentDigests(raw json.RawMessage) json.RawMessage {
+	if len(raw) == 0 {
+		return nil
+	}
+	var atts map[string]attachment
+	if json.Unmarshal(raw, &atts) != nil {
+		return raw
+	}
+	digests := make(map[string]string, len(atts))
+	for name, att := range atts {
+		digests[name] = att.Digest
+	}
+	out, _ := json.Marshal(digests)
+	return out
+}
+
+func sameJSON(a json.RawMessage, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var va, vb any
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	return collate(va, vb) == 0
+}
+
+func diffValue(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var compacted bytes.Buffer
+	if json.Compact(&compacted, raw) != nil {
+		compacted.Reset()
+		compacted.Write(raw)
+	}
+	value := compacted.String()
+	if len(value) > maxDiffValue {
+		value = value[:maxDiffValue-3] + "..."
+	}
+	return value
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// PrintDiff shows the changes a partial restore would make, the unchanged documents
+// only counted.
+func PrintDiff(changes []DocumentChange) {
+	var unchanged int
+	for _, change := range changes {
+		switch change.Action {
+		case ChangeCreate:
+			fmt.Fprintf(Out, "+ %s (missing from the database, it would be created)\n", change.ID)
+		case ChangeRecreate:
+			fmt.Fprintf(Out, "+ %s (deleted in the database at %s, it would be recreated)\n", change.ID, change.LiveRev)
+		case ChangeUpdate:
+			fmt.Fprintf(Out, "~ %s (changed in the database at %s, it would be overwritten)\n", change.ID, change.LiveRev)
+			for _, field := range change.Fields {
+				if field.Live != "" {
+					fmt.Fprintf(Out, "    - %s: %s\n", field.Field, field.Live)
+				}
+				if field.Backup != "" {
+					fmt.Fprintf(Out, "    + %s: %s\n", field.Field, field.Backup)
+				}
+			}
+		default:
+			unchanged++
+		}
+	}
+	if unchanged > 0 {
+		fmt.Fprintf(Out, "%d documents are the same in the database and would be left alone\n", unchanged)
+	}
+}
+
+// ApplyDocumentChanges writes the documents of the backup as new revisions on top of
+// the ones in the database, so that they win over the deletions and the edits made
+// since the backup. The attachments saved apart are read from attachmentsDir. It
+// returns the number of documents written and the ones that failed.
+func ApplyDocumentChanges(host string, port int, user string, password string, dbName string, changes []DocumentChange, attachmentsDir string) (int, []error) {
+	var written int
+	var errs []error
+	for _, change := range changes {
+		if change.Action == ChangeUnchanged {
+			continue
+		}
+		if err := putDocumentChange(host, port, user, password, dbName, change, attachmentsDir); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		written++
+	}
+	return written, errs
+}
+
+// PutDesignDocs puts the design documents of the dump as new revisions on top of the
+// ones in revs, as the restore script cannot update a design document that exists.
+// It returns the number of design documents written.
+func PutDesignDocs(host string, port int, user string, password string, dbName string, docs [][]byte, revs map[string]string, attachmentsDir string) (int, error) {
+	for i, doc := range docs {
+		var ref couchdb.DocRef
+		if err := json.Unmarshal(doc, &ref); err != nil {
+			return i, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		change := DocumentChange{ID: ref.ID, Action: ChangeUpdate, LiveRev: revs[ref.ID], doc: doc}
+		if err := putDocumentChange(host, port, user, password, dbName, change, attachmentsDir); err != nil {
+			return i, err
+		}
+	}
+	return len(docs), nil
+}
+
+func putDocumentChange(host string, port int, user string, password string, dbName string, change DocumentChange, attachmentsDir string) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(change.doc, &fields); err != nil {
+		return fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	for _, key := range []string{"_rev", "_revisions", "_conflicts", "_deleted_conflicts"} {
+		delete(fields, key)
+	}
+	// A deleted document is recreated without a revision, an existing one is updated
+	if change.Action == ChangeUpdate {
+		rev, _ := json.Marshal(change.LiveRev)
+		fields["_rev"] = rev
+	}
+	doc, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf(ErrMarshalJSON, err)
+	}
+	if attachmentsDir != "" && HasBlobs(doc) {
+		return putBlobDocument(host, port, user, password, dbName, change.ID, doc, attachmentsDir, "")
+	}
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/" + docPath(change.ID)
+	if _, err := couchRequest("PUT", address, user, password, doc); err != nil {
+		return fmt.Errorf("error restoring the document %s: %w", change.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDocumentFilter(t *testing.T) {
+	idsFile := filepath.Join(t.TempDir(), "ids.txt")
+	if err := os.WriteFile(idsFile, []byte("# deleted by mistake\norder:2\n\n  order:3  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filter, err := NewDocumentFilter([]string{"order:1"}, idsFile, "order:", `{"type":"order"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"order:1": true, "order:2": true, "order:3": true}; !reflect.DeepEqual(filter.IDs, want) {
+		t.Errorf("IDs = %v, want %v", filter.IDs, want)
+	}
+	tests := []struct {
+		id   string
+		doc  string
+		want bool
+	}{
+		{"order:1", `{"_id":"order:1","type":"order"}`, true},
+		{"order:3", `{"_id":"order:3","type":"invoice"}`, false},
+		{"order:4", `{"_id":"order:4","type":"order"}`, false},
+	}
+	for _, test := range tests {
+		if got, err := filter.Matches(test.id, []byte(test.doc)); err != nil || got != test.want {
+			t.Errorf("Matches(%s) = %t, %v, want %t", test.id, got, err, test.want)
+		}
+	}
+
+	if empty, _ := NewDocumentFilter(nil, "", "", ""); empty.Active() {
+		t.Errorf("a filter without options is active")
+	}
+	if prefix, _ := NewDocumentFilter(nil, "", "x", ""); !prefix.Active() {
+		t.Errorf("a filter with a prefix is not active")
+	}
+	commentsOnly := filepath.Join(t.TempDir(), "empty.txt")
+	os.WriteFile(commentsOnly, []byte("# nothing\n"), 0644)
+	if _, err := NewDocumentFilter(nil, commentsOnly, "", ""); err == nil {
+		t.Errorf("an IDs file without IDs was accepted")
+	}
+	if _, err := NewDocumentFilter(nil, "", "", `{"a":{"$bad":1}}`); err == nil {
+		t.Errorf("an invalid selector was accepted")
+	}
+}
+
+func TestSelectDumpDocuments(t *testing.T) {
+	fileName := writeDump(t,
+		`{"_id":"a","_rev":"2-w","type":"order"}`,
+		`{"_id":"a","_rev":"2-l","type":"order","loser":true}`,
+		`{"_id":"b","_rev":"1-b","type":"invoice"}`,
+		`{"_id":"c","_rev":"3-c","_deleted":true}`,
+		`{"_id":"d","_rev":"1-d","type":"order"}`,
+	)
+	filter, _ := NewDocumentFilter(nil, "", "", `{"type":"order"}`)
+	docs, err := SelectDumpDocuments(fileName, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, doc := range docs {
+		got = append(got, string(doc))
+	}
+	if want := []string{`{"_id":"a","_rev":"2-w","type":"order"}`, `{"_id":"d","_rev":"1-d","type":"order"}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SelectDumpDocuments() = %v, want %v", got, want)
+	}
+}
+
+func TestDiffAndApplyDocuments(t *testing.T) {
+	var mu sync.Mutex
+	puts := map[string]map[string]any{}
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Method == "POST" {
+			io.WriteString(w, `{"rows":[
+				{"key":"missing","error":"not_found"},
+				{"id":"deleted","key":"deleted","value":{"rev":"3-d","deleted":true},"doc":null},
+				{"id":"changed","key":"changed","value":{"rev":"5-c"},"doc":{"_id":"changed","_rev":"5-c","total":99,"extra":"x","_attachments":{"f":{"digest":"md5-new","stub":true}}}},
+				{"id":"same","key":"same","value":{"rev":"2-s"},"doc":{"_id":"same","_rev":"2-s","n":{"b":1,"a":2}}},
+				{"id":"broken","key":"broken","value":{"rev":"1-x"},"doc":{"_id":"broken","_rev":"1-x"}}]}`)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/db/")
+		var doc map[string]any
+		json.Unmarshal(body, &doc)
+		mu.Lock()
+		puts[id] = doc
+		mu.Unlock()
+		if id == "broken" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"error":"forbidden","reason":"validation"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, `{"ok":true}`)
+	})
+
+	docs := [][]byte{
+		[]byte(`{"_id":"missing","_rev":"1-m","n":1}`),
+		[]byte(`{"_id":"deleted","_rev":"2-d","_revisions":{"start":2,"ids":["d","a"]},"n":2}`),
+		[]byte(`{"_id":"changed","_rev":"4-c","total":120,"_attachments":{"f":{"digest":"md5-old","data":"eA=="}}}`),
+		[]byte(`{"_id":"same","_rev":"2-s","n":{"a":2,"b":1}}`),
+		[]byte(`{"_id":"broken","_rev":"1-x","n":` + fmt.Sprintf("%q", strings.Repeat("x", 100)) + `}`),
+	}
+	changes, err := DiffDocuments(host, port, "admin", "secret", "db", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, change := range changes {
+		actions = append(actions, change.ID+"="+change.Action)
+	}
+	if want := []string{"missing=create", "deleted=recreate", "changed=update", "same=unchanged", "broken=update"}; !reflect.DeepEqual(actions, want) {
+		t.Fatalf("actions = %v, want %v", actions, want)
+	}
+	wantFields := []FieldChange{
+		{Field: "_attachments", Live: `{"f":"md5-new"}`, Backup: `{"f":"md5-old"}`},
+		{Field: "extra", Live: `"x"`},
+		{Field: "total", Live: "99", Backup: "120"},
+	}
+	if !reflect.DeepEqual(changes[2].Fields, wantFields) {
+		t.Errorf("fields = %+v, want %+v", changes[2].Fields, wantFields)
+	}
+	if backup := changes[4].Fields[0].Backup; len(backup) != maxDiffValue || !strings.HasSuffix(backup, "...") {
+		t.Errorf("a long value is shown as %q", backup)
+	}
+
+	previous := Out
+	t.Cleanup(func() { Out = previous })
+	var printed bytes.Buffer
+	Out = &printed
+	PrintDiff(changes)
+	for _, line := range []string{"+ missing (missing", "+ deleted (deleted in the database at 3-d", "~ changed (changed in the database at 5-c", "    - total: 99", "    + total: 120", "1 documents are the same"} {
+		if !strings.Contains(printed.String(), line) {
+			t.Errorf("the diff has no %q:\n%s", line, printed.String())
+		}
+	}
+
+	written, errs := ApplyDocumentChanges(host, port, "admin", "secret", "db", changes, "")
+	if written != 3 || len(errs) != 1 {
+		t.Errorf("ApplyDocumentChanges() = %d, %v", written, errs)
+	}
+	if _, ok := puts["same"]; ok {
+		t.Errorf("an unchanged document was written")
+	}
+	if _, ok := puts["missing"]["_rev"]; ok {
+		t.Errorf("a missing document was created with a revision")
+	}
+	if _, ok := puts["deleted"]["_revisions"]; ok || puts["deleted"]["_rev"] != nil {
+		t.Errorf("a deleted document was recreated as %v", puts["deleted"])
+	}
+	if puts["changed"]["_rev"] != "5-c" || puts["changed"]["total"] != float64(120) {
+		t.Errorf("a changed document was written as %v", puts["changed"])
+	}
+}
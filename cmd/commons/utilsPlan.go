@@ -0,0 +1,75 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+)
+
+// RestoreBatchSize is the number of documents the script uploads with each _bulk_docs request.
+const RestoreBatchSize = 5000
+
+const DryRunBanner = "Dry run: nothing will be changed on the server or on the filesystem"
+
+type PlanStep struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value" yaml:"value"`
+}
+
+type Plan struct {
+	Title string     `json:"title" yaml:"title"`
+	Steps []PlanStep `json:"steps" yaml:"steps"`
+}
+
+func PrintPlan(title string, steps []PlanStep) {
+	PrintResult(Plan{Title: title, Steps: steps}, func() {
+		fmt.Fprintln(Out, title)
+		w := tabwriter.NewWriter(Out, 0, 4, 2, ' ', 0)
+		for _, step := range steps {
+			fmt.Fprintf(w, "  %s:\t%s\n", step.Name, step.Value)
+		}
+		w.Flush()
+	})
+}
+
+// CountDumpDocs counts the documents of the dump, the deleted ones apart from the others.
+func CountDumpDocs(fileName string) (docs int, designs int, deleted int, err error) {
+	var counter dumpCounter
+	err = ReadDump(fileName, func(doc []byte) error {
+		counter.add(doc)
+		return nil
+	})
+	return counter.docs, counter.designs, counter.deleted, err
+}
+
+func Batches(docs int) int {
+	return (docs + RestoreBatchSize - 1) / RestoreBatchSize
+}
+
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func DescribeFile(fileName string) string {
+	info, err := os.Stat(fileName)
+	if os.IsNotExist(err) {
+		return fileName + " (new file)"
+	}
+	if err != nil {
+		return fmt.Sprintf("%s (%v)", fileName, err)
+	}
+	return fmt.Sprintf("%s (existing file of %s would be overwritten)", fileName, FormatBytes(info.Size()))
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:               "0 B",
+		1023:            "1023 B",
+		1024:            "1.0 KiB",
+		1536:            "1.5 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+		3 << 40:         "3.0 TiB",
+	}
+	for n, want := range tests {
+		if got := FormatBytes(n); got != want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	tests := map[int]int{0: 0, 1: 1, RestoreBatchSize: 1, RestoreBatchSize + 1: 2, 3 * RestoreBatchSize: 3}
+	for docs, want := range tests {
+		if got := Batches(docs); got != want {
+			t.Errorf("Batches(%d) = %d, want %d", docs, got, want)
+		}
+	}
+}
+
+func TestCountDumpDocs(t *testing.T) {
+	dump := writeDump(t,
+		`{"_id":"a","_rev":"1-a"}`,
+		`{"_id":"b","_rev":"1-b"}`,
+		`{"_id":"_design/views","_rev":"1-v"}`,
+		`{"_id":"c","_rev":"2-c","_deleted":true}`,
+	)
+	docs, designs, deleted, err := CountDumpDocs(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs != 2 || designs != 1 || deleted != 1 {
+		t.Errorf("CountDumpDocs = %d docs, %d designs, %d deleted, want 2, 1, 1", docs, designs, deleted)
+	}
+}
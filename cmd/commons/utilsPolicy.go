@@ -0,0 +1,80 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+type Policy struct {
+	ProtectedHosts     []string `json:"protected_hosts"`
+	ProtectedDatabases []string `json:"protected_databases"`
+	ForbidRestoreAll   []string `json:"forbid_restore_all"`
+}
+
+func GetPolicy(cmd *cobra.Command) Policy {
+	config, _ := GetConfig(cmd)
+	policy := config.Policy
+	hosts, _ := cmd.Flags().GetStringSlice("protected-host")
+	dbs, _ := cmd.Flags().GetStringSlice("protected-db")
+	policy.ProtectedHosts = append(policy.ProtectedHosts, hosts...)
+	policy.ProtectedDatabases = append(policy.ProtectedDatabases, dbs...)
+	return policy
+}
+
+func (p Policy) IsProtected(host string, dbName string) bool {
+	return matchAny(p.ProtectedHosts, host) || matchAny(p.ProtectedDatabases, dbName)
+}
+
+// RestoreAllForbidden reports whether restoreAll is forbidden against the active
+// profile, either by its name or by the host of one of the listed profiles.
+func (p Policy) RestoreAllForbidden(config Config, profileName string, host string) bool {
+	for _, name := range p.ForbidRestoreAll {
+		if name == profileName {
+			return true
+		}
+		if profile, ok := config.Profiles[name]; ok && profile.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func ConfirmTypedName(dbName string, acknowledged []string) error {
+	if len(acknowledged) != 0 {
+		if slices.Contains(acknowledged, dbName) {
+			return nil
+		}
+		return NewExitError(ExitUsage, fmt.Errorf("database %s is protected and was not listed in --i-know-what-im-doing", dbName))
+	}
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return NewExitError(ExitUsage, fmt.Errorf("database %s is protected, pass --i-know-what-im-doing=%s to confirm in non-interactive mode", dbName, dbName))
+	}
+
+	fmt.Fprintf(Out, "Database %s is protected. Type its name to confirm: ", dbName)
+	reader := bufio.NewReader(os.Stdin)
+	input, _ := reader.ReadString('\n')
+	if strings.TrimSpace(input) != dbName {
+		return NewExitError(ExitUserAbort, fmt.Errorf("operation canceled. The name does not match the database %s", dbName))
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched || pattern == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPolicyIsProtected(t *testing.T) {
+	policy := Policy{
+		ProtectedHosts:     []string{"prod-*.example.com"},
+		ProtectedDatabases: []string{"billing", "orders-*"},
+	}
+	tests := []struct {
+		host      string
+		db        string
+		protected bool
+	}{
+		{"prod-1.example.com", "anything", true},
+		{"staging.example.com", "billing", true},
+		{"staging.example.com", "orders-2025", true},
+		{"staging.example.com", "orders", false},
+		{"127.0.0.1", "users", false},
+	}
+	for _, test := range tests {
+		if got := policy.IsProtected(test.host, test.db); got != test.protected {
+			t.Errorf("IsProtected(%q, %q) = %t, want %t", test.host, test.db, got, test.protected)
+		}
+	}
+}
+
+func TestPolicyRestoreAllForbidden(t *testing.T) {
+	config := Config{Profiles: map[string]Profile{
+		"prod":    {Host: "couch.example.com"},
+		"staging": {Host: "staging.example.com"},
+	}}
+	policy := Policy{ForbidRestoreAll: []string{"prod"}}
+	tests := []struct {
+		profile   string
+		host      string
+		forbidden bool
+	}{
+		{"prod", "", true},
+		{"", "couch.example.com", true},
+		{"staging", "staging.example.com", false},
+		{"", "127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := policy.RestoreAllForbidden(config, test.profile, test.host); got != test.forbidden {
+			t.Errorf("RestoreAllForbidden(%q, %q) = %t, want %t", test.profile, test.host, got, test.forbidden)
+		}
+	}
+}
+
+func TestConfirmTypedNameAcknowledged(t *testing.T) {
+	if err := ConfirmTypedName("billing", []string{"users", "billing"}); err != nil {
+		t.Errorf("listed database not confirmed: %v", err)
+	}
+	err := ConfirmTypedName("billing", []string{"users"})
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != ExitUsage {
+		t.Errorf("unlisted database: got %v, want a usage error", err)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+	"github.com/spf13/cobra"
+)
+
+const (
+	progressBarWidth    = 30
+	progressTTYInterval = 500 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+)
+
+// Progress tracks the documents and bytes processed for a database, the known
+// totals come from the database info (doc_count and sizes.external) or from the dump.
+// A Progress created with Child also advances its parent, which is used as the
+// aggregate over an entire instance.
+type Progress struct {
+	mu         sync.Mutex
+	label      string
+	totalDocs  int64
+	totalBytes int64
+	docs       int64
+	bytes      int64
+	start      time.Time
+	parent     *Progress
+}
+
+func NewProgress(label string, totalDocs int64, totalBytes int64) *Progress {
+	return &Progress{label: label, totalDocs: totalDocs, totalBytes: totalBytes, start: time.Now()}
+}
+
+func (p *Progress) Child(label string, totalDocs int64, totalBytes int64) *Progress {
+	child := NewProgress(label, totalDocs, totalBytes)
+	child.parent = p
+	return child
+}
+
+func (p *Progress) Set(docs int64, bytes int64) {
+	p.mu.Lock()
+	deltaDocs, deltaBytes := docs-p.docs, bytes-p.bytes
+	p.docs, p.bytes = docs, bytes
+	p.mu.Unlock()
+	if p.parent != nil {
+		p.parent.add(deltaDocs, deltaBytes)
+	}
+}
+
+func (p *Progress) add(docs int64, bytes int64) {
+	p.mu.Lock()
+	p.docs += docs
+	p.bytes += bytes
+	p.mu.Unlock()
+}
+
+// Complete marks the totals as reached, so the aggregate is not left behind
+// by estimations that were lower than the real totals.
+func (p *Progress) Complete() {
+	p.mu.Lock()
+	docs, bytes := max(p.docs, p.totalDocs), max(p.bytes, p.totalBytes)
+	p.mu.Unlock()
+	p.Set(docs, bytes)
+}
+
+func (p *Progress) snapshot() (docs, bytes, totalDocs, totalBytes int64, elapsed time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.docs, p.bytes, p.totalDocs, p.totalBytes, time.Since(p.start)
+}
+
+func (p *Progress) fraction() float64 {
+	docs, bytes, totalDocs, totalBytes, _ := p.snapshot()
+	switch {
+	case totalDocs > 0:
+		return min(float64(docs)/float64(totalDocs), 1)
+	case totalBytes > 0:
+		return min(float64(bytes)/float64(totalBytes), 1)
+	}
+	return 0
+}
+
+func (p *Progress) eta() string {
+	_, _, _, _, elapsed := p.snapshot()
+	fraction := p.fraction()
+	if fraction <= 0 || fraction >= 1 {
+		return "-"
+	}
+	remaining := time.Duration(float64(elapsed) * (1 - fraction) / fraction)
+	return remaining.Round(time.Second).String()
+}
+
+func (p *Progress) rates() (docsPerSec float64, bytesPerSec float64) {
+	docs, bytes, _, _, elapsed := p.snapshot()
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		return float64(docs) / seconds, float64(bytes) / seconds
+	}
+	return 0, 0
+}
+
+func (p *Progress) Bar() string {
+	filled := int(p.fraction() * progressBarWidth)
+	docs, _, totalDocs, _, _ := p.snapshot()
+	docsPerSec, bytesPerSec := p.rates()
+	return fmt.Sprintf("%s [%s%s] %3.0f%% %d/%d docs %.0f docs/s %s/s ETA %s",
+		p.label, strings.Repeat("#", filled), strings.Repeat(".", progressBarWidth-filled),
+		p.fraction()*100, docs, totalDocs, docsPerSec, FormatBytes(int64(bytesPerSec)), p.eta())
+}
+
+func (p *Progress) LogLine() string {
+	docs, bytes, totalDocs, totalBytes, elapsed := p.snapshot()
+	docsPerSec, bytesPerSec := p.rates()
+	return fmt.Sprintf("progress db=%s docs=%d/%d bytes=%d/%d percent=%.0f docs_per_sec=%.0f bytes_per_sec=%.0f elapsed=%s eta=%s",
+		p.label, docs, totalDocs, bytes, totalBytes, p.fraction()*100, docsPerSec, bytesPerSec, elapsed.Round(time.Second), p.eta())
+}
+
+func ProgressEnabled(cmd *cobra.Command) bool {
+	noProgress, _ := cmd.Flags().GetBool("no-progress")
+	return !noProgress
+}
+
+// StartProgress samples the progress of p at regular intervals and renders it as a bar
+// when stdout is a terminal, or as periodic log lines otherwise. The returned function
+// takes a last sample and stops the rendering.
+func StartProgress(p *Progress, sample func() (docs int64, bytes int64)) (stop func()) {
+	tty := isatty.IsTerminal(outFile().Fd())
+	interval := progressLogInterval
+	if tty {
+		interval = progressTTYInterval
+	}
+
+	render := func() {
+		p.Set(sample())
+		if tty {
+			line := p.Bar()
+			if p.parent != nil {
+				line += " | total " + p.parent.Bar()
+			}
+			fmt.Fprint(Out, "\r"+line+"\x1b[K")
+		} else {
+			fmt.Fprintln(Out, p.LogLine())
+		}
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				render()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+		render()
+		if tty {
+			fmt.Fprintln(Out)
+		}
+	}
+}
+
+// FileSampler follows a file while it is written, counting its size and the lines
+// starting with a JSON object, which in a dump correspond to the documents.
+func FileSampler(fileName string) func() (int64, int64) {
+	var offset, docs int64
+	afterNewline := false
+	buf := make([]byte, 256*1024)
+	return func() (int64, int64) {
+		f, err := os.Open(fileName)
+		if err != nil {
+			return 0, 0
+		}
+		defer f.Close()
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return docs, offset
+		}
+		for {
+			n, err := f.Read(buf)
+			for _, b := range buf[:n] {
+				if afterNewline && b == '{' {
+					docs++
+				}
+				afterNewline = b == '\n'
+			}
+			offset += int64(n)
+			if err != nil || n == 0 {
+				break
+			}
+		}
+		return docs, offset
+	}
+}
+
+// DatabaseSampler polls the database info, reporting the documents and the bytes
+// added since the sampler has been created.
+func DatabaseSampler(host string, port int, user string, password string, dbName string) func() (int64, int64) {
+	_, initial, _ := GetDB(host, port, user, password, dbName)
+	var docs, bytes int64
+	return func() (int64, int64) {
+		if statusCode, Database, err := GetDB(host, port, user, password, dbName); err == nil && statusCode == 200 {
+			docs = int64(Database.DocCount - initial.DocCount)
+			bytes = int64(Database.Sizes.External - initial.Sizes.External)
+		}
+		return docs, bytes
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProgressFraction(t *testing.T) {
+	p := NewProgress("orders", 200, 0)
+	p.Set(50, 1000)
+	if got := p.fraction(); got != 0.25 {
+		t.Errorf("fraction = %v, want 0.25", got)
+	}
+	// The documents may exceed an estimated total
+	p.Set(300, 2000)
+	if got := p.fraction(); got != 1 {
+		t.Errorf("fraction = %v, want 1", got)
+	}
+
+	bytesOnly := NewProgress("users", 0, 4000)
+	bytesOnly.Set(0, 1000)
+	if got := bytesOnly.fraction(); got != 0.25 {
+		t.Errorf("fraction by bytes = %v, want 0.25", got)
+	}
+	if got := NewProgress("empty", 0, 0).fraction(); got != 0 {
+		t.Errorf("fraction without totals = %v, want 0", got)
+	}
+}
+
+func TestProgressChildUpdatesParent(t *testing.T) {
+	total := NewProgress("instance", 300, 0)
+	orders := total.Child("orders", 100, 0)
+	users := total.Child("users", 200, 0)
+
+	orders.Set(40, 400)
+	users.Set(60, 600)
+	orders.Set(100, 1000)
+	docs, bytes, _, _, _ := total.snapshot()
+	if docs != 160 || bytes != 1600 {
+		t.Errorf("aggregate = %d docs %d bytes, want 160 and 1600", docs, bytes)
+	}
+
+	users.Complete()
+	if docs, _, _, _, _ := total.snapshot(); docs != 300 {
+		t.Errorf("aggregate after Complete = %d docs, want 300", docs)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	p := NewProgress("orders", 10, 0)
+	p.Set(5, 0)
+	bar := p.Bar()
+	if !strings.HasPrefix(bar, "orders [###############...............]  50% 5/10 docs") {
+		t.Errorf("unexpected bar %q", bar)
+	}
+	if line := p.LogLine(); !strings.Contains(line, "db=orders docs=5/10") || !strings.Contains(line, "percent=50") {
+		t.Errorf("unexpected log line %q", line)
+	}
+}
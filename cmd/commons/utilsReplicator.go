@@ -0,0 +1,160 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const (
+	ReplicatorDatabase = "_replicator"
+	// RedactedSecret replaces the passwords and tokens of the replications in the dumps.
+	RedactedSecret = "REDACTED"
+)
+
+// RedactReplicatorDump replaces in place the credentials of the replications of a
+// _replicator dump with RedactedSecret, the user names are kept.
+func RedactReplicatorDump(fileName string) (int, error) {
+	var redacted int
+	tmpFile := fileName + ".redact"
+	defer os.Remove(tmpFile)
+	_, err := TransformDump(fileName, tmpFile, func(doc []byte) ([]byte, error) {
+		return rewriteReplication(doc, func(secret string) string {
+			redacted++
+			return RedactedSecret
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, fileName, err)
+	}
+	return redacted, nil
+}
+
+// PrepareReplicatorDump copies a _replicator dump in dst filling the redacted
+// credentials with password. Without a password the replications with redacted
+// credentials are left out, so that they do not start failing on the new node.
+func PrepareReplicatorDump(src string, dst string, password string) (skipped []string, err error) {
+	_, err = TransformDump(src, dst, func(doc []byte) ([]byte, error) {
+		redacted := false
+		rewritten, err := rewriteReplication(doc, func(secret string) string {
+			if secret != RedactedSecret {
+				return secret
+			}
+			redacted = true
+			return password
+		})
+		if err != nil || !redacted {
+			return doc, err
+		}
+		if password == "" {
+			var ref struct {
+				ID string `json:"_id"`
+			}
+			json.Unmarshal(doc, &ref)
+			skipped = append(skipped, ref.ID)
+			return nil, nil
+		}
+		return rewritten, nil
+	})
+	return skipped, err
+}
+
+// rewriteReplication passes every credential of the source and the target of a
+// replication document to fn, the document is returned unchanged when it has none.
+func rewriteReplication(doc []byte, fn func(secret string) string) ([]byte, error) {
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+
+	changed := false
+	for _, name := range []string{"source", "target"} {
+		switch endpoint := fields[name].(type) {
+		case string:
+			fields[name] = rewriteURL(endpoint, fn, &changed)
+		case map[string]any:
+			if address, ok := endpoint["url"].(string); ok {
+				endpoint["url"] = rewriteURL(address, fn, &changed)
+			}
+			if headers, ok := endpoint["headers"].(map[string]any); ok {
+				for header, value := range headers {
+					if value, ok := value.(string); ok && strings.EqualFold(header, "Authorization") {
+						headers[header] = rewriteAuthorization(value, fn)
+						changed = true
+					}
+				}
+			}
+			if auth, ok := endpoint["auth"].(map[string]any); ok {
+				changed = rewriteField(auth, "basic", "password", fn) || changed
+				changed = rewriteField(auth, "iam", "api_key", fn) || changed
+			}
+		}
+	}
+	if !changed {
+		return doc, nil
+	}
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fields); err != nil {
+		return nil, fmt.Errorf("error marshalling the replication: %v", err)
+	}
+	return bytes.TrimSpace(out.Bytes()), nil
+}
+
+func rewriteURL(address string, fn func(secret string) string, changed *bool) string {
+	u, err := url.Parse(address)
+	if err != nil || u.User == nil {
+		return address
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		return address
+	}
+	u.User = url.UserPassword(u.User.Username(), fn(password))
+	*changed = true
+	return u.String()
+}
+
+// rewriteAuthorization keeps the scheme and, for Basic, the user name of an Authorization header.
+func rewriteAuthorization(value string, fn func(secret string) string) string {
+	scheme, credentials, found := strings.Cut(value, " ")
+	if !found {
+		return fn(value)
+	}
+	if strings.EqualFold(scheme, "Basic") {
+		if decoded, err := base64.StdEncoding.DecodeString(credentials); err == nil {
+			if user, password, found := strings.Cut(string(decoded), ":"); found {
+				return scheme + " " + base64.StdEncoding.EncodeToString([]byte(user+":"+fn(password)))
+			}
+		}
+	}
+	return scheme + " " + fn(credentials)
+}
+
+func rewriteField(auth map[string]any, method string, key string, fn func(secret string) string) bool {
+	values, ok := auth[method].(map[string]any)
+	if !ok {
+		return false
+	}
+	secret, ok := values[key].(string)
+	if !ok {
+		return false
+	}
+	values[key] = fn(secret)
+	return true
+}
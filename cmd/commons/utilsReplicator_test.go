@@ -0,0 +1,98 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewriteReplication(t *testing.T) {
+	basic := base64.StdEncoding.EncodeToString([]byte("bob:hunter2"))
+	redactedBasic := base64.StdEncoding.EncodeToString([]byte("bob:" + RedactedSecret))
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{
+			"url credentials",
+			`{"_id":"r1","source":"http://bob:hunter2@a:5984/db","target":"http://b:5984/db"}`,
+			`{"_id":"r1","source":"http://bob:REDACTED@a:5984/db","target":"http://b:5984/db"}`,
+		},
+		{
+			"basic authorization header",
+			`{"_id":"r2","source":{"url":"http://a:5984/db","headers":{"Authorization":"Basic ` + basic + `"}},"target":"db"}`,
+			`{"_id":"r2","source":{"headers":{"Authorization":"Basic ` + redactedBasic + `"},"url":"http://a:5984/db"},"target":"db"}`,
+		},
+		{
+			"bearer authorization header",
+			`{"_id":"r3","target":{"url":"http://b/db","headers":{"authorization":"Bearer abc"}}}`,
+			`{"_id":"r3","target":{"headers":{"authorization":"Bearer REDACTED"},"url":"http://b/db"}}`,
+		},
+		{
+			"auth object",
+			`{"_id":"r4","source":{"url":"http://a/db","auth":{"basic":{"username":"bob","password":"hunter2"}}},"target":{"url":"http://b/db","auth":{"iam":{"api_key":"k"}}}}`,
+			`{"_id":"r4","source":{"auth":{"basic":{"password":"REDACTED","username":"bob"}},"url":"http://a/db"},"target":{"auth":{"iam":{"api_key":"REDACTED"}},"url":"http://b/db"}}`,
+		},
+		{
+			"no credentials, unchanged",
+			`{"_id":"r5", "source":"http://a/db","target":"http://bob@b/db","worker_processes":4}`,
+			`{"_id":"r5", "source":"http://a/db","target":"http://bob@b/db","worker_processes":4}`,
+		},
+		{
+			"numbers kept",
+			`{"_id":"r6","source":"http://u:p@a/db","target":"db","since_seq":12345678901234567890}`,
+			`{"_id":"r6","since_seq":12345678901234567890,"source":"http://u:REDACTED@a/db","target":"db"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := rewriteReplication([]byte(test.doc), func(string) string { return RedactedSecret })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("rewriteReplication() = %s\nwant %s", got, test.want)
+			}
+		})
+	}
+
+	if _, err := rewriteReplication([]byte(`{"_id":`), strings.ToUpper); err == nil {
+		t.Errorf("an invalid document was accepted")
+	}
+}
+
+func TestRedactAndPrepareReplicatorDump(t *testing.T) {
+	fileName := writeDump(t,
+		`{"_id":"with-secret","source":"http://bob:hunter2@a/db","target":"db"}`,
+		`{"_id":"plain","source":"http://a/db","target":"db"}`,
+	)
+	redacted, err := RedactReplicatorDump(fileName)
+	if err != nil || redacted != 1 {
+		t.Fatalf("RedactReplicatorDump() = %d, %v", redacted, err)
+	}
+
+	filled := fileName + ".filled"
+	skipped, err := PrepareReplicatorDump(fileName, filled, "newpass")
+	if err != nil || len(skipped) != 0 {
+		t.Fatalf("PrepareReplicatorDump() = %v, %v", skipped, err)
+	}
+	var docs []string
+	ReadDump(filled, func(doc []byte) error {
+		docs = append(docs, string(doc))
+		return nil
+	})
+	if len(docs) != 2 || !strings.Contains(docs[0], "bob:newpass@") {
+		t.Errorf("filled dump = %v", docs)
+	}
+
+	skipped, err = PrepareReplicatorDump(fileName, fileName+".skipped", "")
+	if err != nil || !reflect.DeepEqual(skipped, []string{"with-secret"}) {
+		t.Errorf("PrepareReplicatorDump() without a password = %v, %v", skipped, err)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/report"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+var runReport = report.RunReport{Databases: []report.DatabaseResult{}}
+
+func StartRunReport(command string) {
+	runReport.Command = command
+	runReport.StartedAt = time.Now()
+	runReport.Databases = []report.DatabaseResult{}
+}
+
+func RecordResult(result report.DatabaseResult) {
+	runReport.Databases = append(runReport.Databases, result)
+}
+
+// FinishRunReport completes the report of the whole run, with the outcome of every
+// database and the exit code of the process.
+func FinishRunReport(err error) report.RunReport {
+	runReport.FinishedAt = time.Now()
+	runReport.Duration = runReport.FinishedAt.Sub(runReport.StartedAt).Seconds()
+	runReport.ExitCode = ExitCode(err)
+	switch runReport.ExitCode {
+	case ExitOK:
+		runReport.Status = report.RunOK
+	case ExitPartial:
+		runReport.Status = report.RunPartial
+	case ExitUserAbort, ExitInterrupted:
+		runReport.Status = report.RunAborted
+	default:
+		runReport.Status = report.RunFailed
+	}
+	runReport.Error = ""
+	if err != nil {
+		runReport.Error = err.Error()
+	}
+	return runReport
+}
+
+func WriteRunReport(fileName string, run report.RunReport) error {
+	body, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling the run report: %v", err)
+	}
+	if err := os.WriteFile(fileName, append(body, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing the run report %s: %v", fileName, err)
+	}
+	return nil
+}
@@ -0,0 +1,486 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"dbackupcli/cmd/struct/repository"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	repositoryConfig    = "config.json"
+	repositoryChunks    = "chunks"
+	repositorySnapshots = "snapshots"
+	repositoryIndex     = "index"
+
+	// ShortIDLength is the length of the snapshot IDs that are printed
+	ShortIDLength = 8
+	// LatestSnapshot selects the most recent snapshot in place of an ID
+	LatestSnapshot = "latest"
+)
+
+// Backend stores the files of a repository by key, a slash separated path.
+type Backend interface {
+	// Put writes the content of key, replacing it at once
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Has(key string) (bool, error)
+	// List returns the keys under prefix
+	List(prefix string) ([]string, error)
+	Remove(key string) error
+}
+
+// OpenBackend returns the backend of a repository location. Only the local disk is
+// supported, as a path or a file:// URL.
+func OpenBackend(location string) (Backend, error) {
+	if dir, ok := strings.CutPrefix(location, "file://"); ok {
+		return LocalBackend{Dir: dir}, nil
+	}
+	if scheme, _, ok := strings.Cut(location, "://"); ok {
+		return nil, NewExitError(ExitUsage, fmt.Errorf("unsupported storage backend %q, the repository must be a local directory", scheme))
+	}
+	return LocalBackend{Dir: location}, nil
+}
+
+// LocalBackend stores the repository in a directory of the local disk.
+type LocalBackend struct {
+	Dir string
+}
+
+func (b LocalBackend) path(key string) string {
+	return filepath.Join(b.Dir, filepath.FromSlash(key))
+}
+
+func (b LocalBackend) Put(key string, r io.Reader) error {
+	fileName := b.path(key)
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*"+PartialSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+func (b LocalBackend) Get(key string) (io.ReadCloser, error) {
+	return os.Open(b.path(key))
+}
+
+func (b LocalBackend) Has(key string) (bool, error) {
+	_, err := os.Stat(b.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b LocalBackend) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(b.path(prefix), func(fileName string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), PartialSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Dir, fileName)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+	return keys, err
+}
+
+func (b LocalBackend) Remove(key string) error {
+	return os.Remove(b.path(key))
+}
+
+// Repository is a deduplicating store of backups: the files are cut in content-defined
+// chunks, stored once each compressed and named by the SHA-256 of their content.
+type Repository struct {
+	Location string
+	Config   repository.Config
+	backend  Backend
+}
+
+// InitRepository creates an empty repository at location.
+func InitRepository(location string) (*Repository, error) {
+	backend, err := OpenBackend(location)
+	if err != nil {
+		return nil, err
+	}
+	if exists, err := backend.Has(repositoryConfig); err != nil {
+		return nil, fmt.Errorf("error reading the repository %s: %v", location, err)
+	} else if exists {
+		return nil, NewExitError(ExitUsage, fmt.Errorf("a repository already exists in %s", location))
+	}
+	config := repository.Config{
+		Version:     repository.Version,
+		ID:          randomID(),
+		CreatedAt:   time.Now().UTC(),
+		ChunkerSeed: randomID(),
+		MinChunk:    512 << 10,
+		AvgChunk:    1 << 20,
+		MaxChunk:    8 << 20,
+		Compression: "gzip",
+	}
+	if err := putJSON(backend, repositoryConfig, config); err != nil {
+		return nil, fmt.Errorf("error writing the repository %s: %v", location, err)
+	}
+	return &Repository{Location: location, Config: config, backend: backend}, nil
+}
+
+// OpenRepository opens the repository at location, created by InitRepository.
+func OpenRepository(location string) (*Repository, error) {
+	backend, err := OpenBackend(location)
+	if err != nil {
+		return nil, err
+	}
+	var config repository.Config
+	if err := getJSON(backend, repositoryConfig, &config); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, NewExitError(ExitUsage, fmt.Errorf("%s is not a repository, create it with repo init", location))
+		}
+		return nil, fmt.Errorf("error reading the repository %s: %v", location, err)
+	}
+	if config.Version > repository.Version {
+		return nil, fmt.Errorf("the repository %s has version %d, this dbackupcli reads up to %d", location, config.Version, repository.Version)
+	}
+	return &Repository{Location: location, Config: config, backend: backend}, nil
+}
+
+// Backup stores source, a dump or a backup directory, as a new snapshot. The chunks
+// already in the repository are not stored again.
+func (r *Repository) Backup(source string, tags []string) (repository.Snapshot, error) {
+	hostname, _ := os.Hostname()
+	absSource, _ := filepath.Abs(source)
+	snapshot := repository.Snapshot{ID: randomID(), CreatedAt: time.Now().UTC(), Hostname: hostname, Source: absSource, Tags: tags}
+	index := repository.Index{Snapshot: snapshot.ID}
+	seen := make(map[string]bool)
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return snapshot, err
+	}
+	root := source
+	if !info.IsDir() {
+		root = filepath.Dir(source)
+	}
+	err = filepath.WalkDir(source, func(fileName string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || strings.HasSuffix(name, LockSuffix) || strings.HasSuffix(name, PartialSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, fileName)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		file := repository.File{Path: filepath.ToSlash(rel), Mode: uint32(info.Mode().Perm())}
+		entries, err := r.storeFile(fileName, &file, seen)
+		if err != nil {
+			return fmt.Errorf("error storing %s: %v", fileName, err)
+		}
+		index.Chunks = append(index.Chunks, entries...)
+		snapshot.Files = append(snapshot.Files, file)
+		snapshot.Size += file.Size
+		return nil
+	})
+	if err != nil {
+		return snapshot, err
+	}
+	for _, entry := range index.Chunks {
+		snapshot.Added += entry.Stored
+	}
+
+	// The index goes first, a snapshot is visible only when all of it is stored
+	if err := putJSON(r.backend, path.Join(repositoryIndex, snapshot.ID+".json"), index); err != nil {
+		return snapshot, fmt.Errorf("error writing the index: %v", err)
+	}
+	if err := putJSON(r.backend, snapshotKey(snapshot.ID), snapshot); err != nil {
+		return snapshot, fmt.Errorf("error writing the snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// storeFile cuts the file in chunks and stores the new ones, returning their index entries.
+func (r *Repository) storeFile(fileName string, file *repository.File, seen map[string]bool) ([]repository.IndexEntry, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []repository.IndexEntry
+	chunker := NewChunker(f, r.Config.ChunkerSeed, r.Config.MinChunk, r.Config.AvgChunk, r.Config.MaxChunk)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(chunk)
+		id := hex.EncodeToString(sum[:])
+		file.Chunks = append(file.Chunks, id)
+		file.Size += int64(len(chunk))
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		exists, err := r.backend.Has(chunkKey(id))
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err := zw.Write(chunk); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		stored := int64(compressed.Len())
+		if err := r.backend.Put(chunkKey(id), &compressed); err != nil {
+			return nil, err
+		}
+		slog.Debug("chunk stored", "chunk", id[:ShortIDLength], "length", len(chunk), "stored", stored)
+		entries = append(entries, repository.IndexEntry{ID: id, Length: int64(len(chunk)), Stored: stored})
+	}
+}
+
+// Snapshots returns the snapshots of the repository from the oldest to the newest.
+func (r *Repository) Snapshots() ([]repository.Snapshot, error) {
+	keys, err := r.backend.List(repositorySnapshots)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the snapshots: %v", err)
+	}
+	var snapshots []repository.Snapshot
+	for _, key := range keys {
+		var snapshot repository.Snapshot
+		if err := getJSON(r.backend, key, &snapshot); err != nil {
+			return nil, fmt.Errorf("error reading the snapshot %s: %v", key, err)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	slices.SortFunc(snapshots, func(a, b repository.Snapshot) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// FindSnapshot returns the snapshot whose ID starts with prefix, or the most recent
+// one for "latest".
+func (r *Repository) FindSnapshot(prefix string) (repository.Snapshot, error) {
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return repository.Snapshot{}, err
+	}
+	if prefix == LatestSnapshot {
+		if len(snapshots) == 0 {
+			return repository.Snapshot{}, NewExitError(ExitUsage, errors.New("the repository has no snapshots"))
+		}
+		return snapshots[len(snapshots)-1], nil
+	}
+	var found []repository.Snapshot
+	for _, snapshot := range snapshots {
+		if prefix != "" && strings.HasPrefix(snapshot.ID, prefix) {
+			found = append(found, snapshot)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return repository.Snapshot{}, NewExitError(ExitUsage, fmt.Errorf("no snapshot with ID %q", prefix))
+	case 1:
+		return found[0], nil
+	default:
+		return repository.Snapshot{}, NewExitError(ExitUsage, fmt.Errorf("the ID %q matches %d snapshots", prefix, len(found)))
+	}
+}
+
+// Extract writes the files of the snapshot under target, checking every chunk.
+func (r *Repository) Extract(snapshot repository.Snapshot, target string) error {
+	for _, file := range snapshot.Files {
+		rel := filepath.FromSlash(file.Path)
+		if !filepath.IsLocal(rel) {
+			return fmt.Errorf("the snapshot %s has an invalid path %s", snapshot.ID[:ShortIDLength], file.Path)
+		}
+		fileName := filepath.Join(target, rel)
+		if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+			return err
+		}
+		if err := r.extractFile(file, fileName); err != nil {
+			return fmt.Errorf("error restoring %s: %v", file.Path, err)
+		}
+	}
+	return nil
+}
+
+func (r *Repository) extractFile(file repository.File, fileName string) error {
+	partial := fileName + PartialSuffix
+	defer os.Remove(partial)
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(file.Mode))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	for _, id := range file.Chunks {
+		chunk, err := r.readChunk(id)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(chunk); err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partial, fileName)
+}
+
+// readChunk reads and decompresses a chunk, checking that its content matches its ID.
+func (r *Repository) readChunk(id string) ([]byte, error) {
+	rc, err := r.backend.Get(chunkKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("error reading the chunk %s: %v", id, err)
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the chunk %s: %v", id, err)
+	}
+	chunk, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the chunk %s: %v", id, err)
+	}
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("the chunk %s is corrupted", id)
+	}
+	return chunk, nil
+}
+
+// Check verifies that every chunk referenced by the snapshots is in the repository,
+// and with readData that every chunk stored reads back to its content.
+func (r *Repository) Check(readData bool) (repository.CheckResult, error) {
+	result := repository.CheckResult{Repository: r.Location, ReadData: readData, Errors: []string{}}
+	snapshots, err := r.Snapshots()
+	if err != nil {
+		return result, err
+	}
+	result.Snapshots = len(snapshots)
+	keys, err := r.backend.List(repositoryChunks)
+	if err != nil {
+		return result, fmt.Errorf("error listing the chunks: %v", err)
+	}
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[path.Base(key)] = true
+	}
+	result.Chunks = len(stored)
+
+	referenced := make(map[string]bool)
+	for _, snapshot := range snapshots {
+		for _, file := range snapshot.Files {
+			for _, id := range file.Chunks {
+				if !stored[id] && !referenced[id] {
+					result.Errors = append(result.Errors, fmt.Sprintf("snapshot %s: %s: chunk %s is missing", snapshot.ID[:ShortIDLength], file.Path, id))
+				}
+				referenced[id] = true
+			}
+		}
+	}
+	for id := range stored {
+		if !referenced[id] {
+			result.Unused++
+		}
+	}
+	if readData {
+		for _, key := range keys {
+			if _, err := r.readChunk(path.Base(key)); err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		}
+	}
+	return result, nil
+}
+
+func snapshotKey(id string) string {
+	return path.Join(repositorySnapshots, id+".json")
+}
+
+func chunkKey(id string) string {
+	return path.Join(repositoryChunks, id[:2], id)
+}
+
+func randomID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func putJSON(backend Backend, key string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf(ErrMarshalJSON, err)
+	}
+	return backend.Put(key, bytes.NewReader(data))
+}
+
+func getJSON(backend Backend, key string, value any) error {
+	rc, err := backend.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := json.NewDecoder(rc).Decode(value); err != nil {
+		return fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testRepository creates a repository cutting small chunks, so that a few hundred
+// kilobytes make many of them.
+func testRepository(t *testing.T) *Repository {
+	t.Helper()
+	r, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Config.MinChunk, r.Config.AvgChunk, r.Config.MaxChunk = 1<<10, 4<<10, 16<<10
+	return r
+}
+
+func TestRepositoryRoundTrip(t *testing.T) {
+	r := testRepository(t)
+	if _, err := InitRepository(r.Location); ExitCode(err) != ExitUsage {
+		t.Errorf("a second init returned %v", err)
+	}
+
+	source := filepath.Join(t.TempDir(), "backup")
+	files := map[string][]byte{
+		"orders.json":                randomData(3, 300<<10),
+		"orders.manifest.json":       []byte(`{"version":1}`),
+		"users.json":                 randomData(4, 100<<10),
+		"nested/empty.json":          {},
+		"orders.json.lock":           []byte("skipped"),
+		"users.json" + PartialSuffix: []byte("skipped"),
+	}
+	for name, content := range files {
+		fileName := filepath.Join(source, name)
+		os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err := os.WriteFile(fileName, content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := r.Backup(source, []string{"nightly"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Size != 400<<10+13 || len(first.Files) != 4 {
+		t.Errorf("snapshot of %d bytes and %d files", first.Size, len(first.Files))
+	}
+
+	// One byte changed: the second snapshot stores only the chunks around it
+	edited := bytes.Clone(files["orders.json"])
+	edited[150<<10] ^= 0xff
+	files["orders.json"] = edited
+	if err := os.WriteFile(filepath.Join(source, "orders.json"), edited, 0640); err != nil {
+		t.Fatal(err)
+	}
+	second, err := r.Backup(source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Added == 0 || second.Added > 40<<10 {
+		t.Errorf("the second snapshot added %d bytes for a single byte edit", second.Added)
+	}
+
+	opened, err := OpenRepository(r.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := opened.Snapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[0].ID != first.ID || snapshots[1].ID != second.ID {
+		t.Fatalf("Snapshots() = %v, %v", snapshots, err)
+	}
+	latest, err := opened.FindSnapshot(LatestSnapshot)
+	if err != nil || latest.ID != second.ID {
+		t.Errorf("FindSnapshot(latest) = %s, %v", latest.ID, err)
+	}
+	found, err := opened.FindSnapshot(first.ID[:ShortIDLength])
+	if err != nil || found.ID != first.ID {
+		t.Errorf("FindSnapshot(short ID) = %s, %v", found.ID, err)
+	}
+	if _, err := opened.FindSnapshot("zzzz"); ExitCode(err) != ExitUsage {
+		t.Errorf("FindSnapshot() of a missing ID returned %v", err)
+	}
+
+	target := t.TempDir()
+	if err := opened.Extract(latest, target); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(target, name))
+		skipped := name == "orders.json.lock" || name == "users.json"+PartialSuffix
+		if skipped {
+			if err == nil {
+				t.Errorf("%s was stored", name)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s restored with %d bytes, %v, want %d identical bytes", name, len(got), err, len(content))
+		}
+	}
+	if info, err := os.Stat(filepath.Join(target, "users.json")); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("the mode of the files is not restored: %v", err)
+	}
+
+	result, err := opened.Check(true)
+	if err != nil || len(result.Errors) != 0 || result.Snapshots != 2 || result.Unused != 0 {
+		t.Errorf("Check() = %+v, %v", result, err)
+	}
+}
+
+func TestRepositoryCheckCorruption(t *testing.T) {
+	r := testRepository(t)
+	source := filepath.Join(t.TempDir(), "db.json")
+	if err := os.WriteFile(source, randomData(5, 64<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := r.Backup(source, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := filepath.Join(r.Location, chunkKey(snapshot.Files[0].Chunks[0]))
+	if err := os.WriteFile(corrupted, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(r.Location, chunkKey(snapshot.Files[0].Chunks[1]))
+	if err := os.Remove(missing); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := r.Check(false)
+	if err != nil || len(result.Errors) != 1 {
+		t.Errorf("Check(false) = %v, %v, want the missing chunk", result.Errors, err)
+	}
+	result, err = r.Check(true)
+	if err != nil || len(result.Errors) != 2 {
+		t.Errorf("Check(true) = %v, %v, want the missing and the corrupted chunk", result.Errors, err)
+	}
+	if err := r.Extract(snapshot, t.TempDir()); err == nil {
+		t.Errorf("a snapshot with a corrupted chunk was extracted")
+	}
+}
+
+func TestOpenBackend(t *testing.T) {
+	if backend, err := OpenBackend("file:///backups/repo"); err != nil || backend.(LocalBackend).Dir != "/backups/repo" {
+		t.Errorf("OpenBackend(file://) = %v, %v", backend, err)
+	}
+	if _, err := OpenBackend("s3://bucket/repo"); ExitCode(err) != ExitUsage {
+		t.Errorf("OpenBackend(s3://) returned %v", err)
+	}
+	if _, err := OpenRepository(t.TempDir()); ExitCode(err) != ExitUsage {
+		t.Errorf("OpenRepository() of an empty directory returned %v", err)
+	}
+}
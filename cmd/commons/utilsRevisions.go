@@ -0,0 +1,124 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ExpandConflicts replaces in the dump every document with conflicts with all its
+// leaves and their revision history, so that a restore with new_edits false rebuilds
+// the same revision tree. It returns the number of conflicted documents.
+func ExpandConflicts(host string, port int, user string, password string, dbName string, fileName string) (int, error) {
+	tmpFile := fileName + ".conflicts"
+	defer os.Remove(tmpFile)
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, tmpFile, err)
+	}
+	defer out.Close()
+	writer, err := NewDumpWriter(out)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, tmpFile, err)
+	}
+
+	var conflicted int
+	err = ReadDump(fileName, func(doc []byte) error {
+		leaves := [][]byte{doc}
+		if bytes.Contains(doc, []byte(`"_conflicts":`)) {
+			var ref struct {
+				ID        string   `json:"_id"`
+				Conflicts []string `json:"_conflicts"`
+			}
+			if err := json.Unmarshal(doc, &ref); err != nil {
+				return fmt.Errorf(ErrUnmarshalJSON, err)
+			}
+			if len(ref.Conflicts) > 0 {
+				var err error
+				if leaves, err = GetLeaves(host, port, user, password, dbName, ref.ID); err != nil {
+					return err
+				}
+				conflicted++
+			}
+		}
+		for _, leaf := range leaves {
+			if err := writer.Write(leaf); err != nil {
+				return fmt.Errorf(ErrWriteDump, tmpFile, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, fileName, err)
+	}
+	return conflicted, nil
+}
+
+// GetLeaves reads every leaf revision of a document, deleted ones included, each
+// with its _revisions and its attachments, compacted on one line.
+func GetLeaves(host string, port int, user string, password string, dbName string, docID string) ([][]byte, error) {
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/" + docPath(docID) +
+		"?open_revs=all&revs=true&attachments=true&att_encoding_info=true"
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, fmt.Errorf(ErrCreateHTTPRequest, err)
+	}
+	// Without it CouchDB answers open_revs with multipart/mixed
+	req.Header.Add("Accept", valueJSON)
+	req.SetBasicAuth(user, password)
+	res, err := Do(req)
+	if err != nil {
+		return nil, connectionError(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf(ErrReadResponseBody, err)
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("error reading the revisions of %s: %w", docID, statusError(res, body))
+	}
+
+	var revs []struct {
+		OK json.RawMessage `json:"ok"`
+	}
+	if err := json.Unmarshal(body, &revs); err != nil {
+		return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	var leaves [][]byte
+	for _, rev := range revs {
+		if len(rev.OK) == 0 {
+			continue
+		}
+		var leaf bytes.Buffer
+		if err := json.Compact(&leaf, rev.OK); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		leaves = append(leaves, leaf.Bytes())
+	}
+	return leaves, nil
+}
+
+// docPath escapes a document id for the URL, keeping the slash of the design documents.
+func docPath(docID string) string {
+	if name, found := strings.CutPrefix(docID, "_design/"); found {
+		return "_design/" + url.PathEscape(name)
+	}
+	return url.PathEscape(docID)
+}
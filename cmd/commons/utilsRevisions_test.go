@@ -0,0 +1,86 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestExpandConflicts(t *testing.T) {
+	var requested []string
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.RequestURI())
+		if r.Header.Get("Accept") != valueJSON {
+			t.Errorf("open_revs requested without Accept: application/json")
+		}
+		w.Write([]byte(`[
+			{"ok": {"_id": "a b", "_rev": "2-x", "_revisions": {"start": 2, "ids": ["x", "r"]}}},
+			{"missing": "3-gone"},
+			{"ok": {"_id": "a b", "_rev": "2-y", "_deleted": true, "_revisions": {"start": 2, "ids": ["y", "r"]}}}
+		]`))
+	})
+	fileName := writeDump(t,
+		`{"_id":"plain","_rev":"1-p"}`,
+		`{"_id":"a b","_rev":"2-x","_conflicts":["2-y"]}`,
+		`{"_id":"resolved","_rev":"3-r","_conflicts":[]}`,
+	)
+
+	conflicted, err := ExpandConflicts(host, port, "admin", "secret", "db", fileName)
+	if err != nil || conflicted != 1 {
+		t.Fatalf("ExpandConflicts() = %d, %v", conflicted, err)
+	}
+	if want := []string{"/db/a%20b?open_revs=all&revs=true&attachments=true&att_encoding_info=true"}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("requests = %v, want %v", requested, want)
+	}
+
+	var docs []string
+	if err := ReadDump(fileName, func(doc []byte) error {
+		docs = append(docs, string(doc))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`{"_id":"plain","_rev":"1-p"}`,
+		`{"_id":"a b","_rev":"2-x","_revisions":{"start":2,"ids":["x","r"]}}`,
+		`{"_id":"a b","_rev":"2-y","_deleted":true,"_revisions":{"start":2,"ids":["y","r"]}}`,
+		`{"_id":"resolved","_rev":"3-r","_conflicts":[]}`,
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("dump = %v\nwant %v", docs, want)
+	}
+
+	// The leaves of a document count once
+	if count, _, err := VerifyDump(fileName); err != nil || count != 3 {
+		t.Errorf("VerifyDump() = %d, %v, want 3", count, err)
+	}
+}
+
+func TestGetLeavesError(t *testing.T) {
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+	})
+	if _, err := GetLeaves(host, port, "admin", "secret", "db", "gone"); err == nil {
+		t.Errorf("a missing document returned no error")
+	}
+}
+
+func TestDocPath(t *testing.T) {
+	tests := map[string]string{
+		"plain":          "plain",
+		"a/b c":          "a%2Fb%20c",
+		"_design/views":  "_design/views",
+		"_design/a b":    "_design/a%20b",
+		"_local/session": "_local%2Fsession",
+	}
+	for id, want := range tests {
+		if got := docPath(id); got != want {
+			t.Errorf("docPath(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
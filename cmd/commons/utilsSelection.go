@@ -0,0 +1,245 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"dbackupcli/cmd/struct/manifest"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// selectionBatchSize is the number of documents read with each _all_docs request
+	selectionBatchSize = 500
+	// findPageSize is the number of IDs read with each _find request
+	findPageSize = 1000
+	// idsPageSize is the number of IDs read with each _all_docs request of listIDs
+	idsPageSize = 10000
+)
+
+// SelectionActive tells whether the selection chooses a part of the database.
+func SelectionActive(selection manifest.Selection) bool {
+	return len(selection.Selector) > 0 || selection.IDPrefix != "" || selection.Partition != ""
+}
+
+// ValidateSelection checks the selector and the partition name before anything is dumped.
+func ValidateSelection(selection manifest.Selection) error {
+	if len(selection.Selector) > 0 {
+		var selector map[string]json.RawMessage
+		if err := json.Unmarshal(selection.Selector, &selector); err != nil {
+			return NewExitError(ExitUsage, fmt.Errorf("invalid selector, it must be a JSON object: %v", err))
+		}
+	}
+	if partition := selection.Partition; partition != "" && (strings.HasPrefix(partition, "_") || strings.Contains(partition, ":")) {
+		return NewExitError(ExitUsage, fmt.Errorf("invalid partition %q, it cannot start with _ or contain :", partition))
+	}
+	return nil
+}
+
+// SelectsID tells whether the document with this ID can be part of the selection, the
+// selector aside as it needs the body of the document.
+func SelectsID(selection manifest.Selection, id string) bool {
+	if selection.Partition != "" && !strings.HasPrefix(id, selection.Partition+":") {
+		return false
+	}
+	return strings.HasPrefix(id, selection.IDPrefix)
+}
+
+// DescribeSelection tells which documents the selection chooses, for the plans and the logs.
+func DescribeSelection(selection manifest.Selection) string {
+	var parts []string
+	if selection.Partition != "" {
+		parts = append(parts, "in partition "+selection.Partition)
+	}
+	if selection.IDPrefix != "" {
+		parts = append(parts, "with IDs starting with "+selection.IDPrefix)
+	}
+	if len(selection.Selector) > 0 {
+		parts = append(parts, "matching "+string(selection.Selector))
+	}
+	if len(parts) == 0 {
+		return "all the documents"
+	}
+	return "the documents " + strings.Join(parts, ", ")
+}
+
+// DumpSelection writes to fileName the dump of the documents chosen by the selection,
+// read as the backup script reads the whole database, the design documents included
+// only when the ID prefix asks for them. It returns the number of documents dumped.
+func DumpSelection(host string, port int, user string, password string, dbName string, selection manifest.Selection, attachments bool, conflicts bool, fileName string) (int, error) {
+	ids, err := selectIDs(host, port, user, password, dbName, selection)
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := os.Create(fileName)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, fileName, err)
+	}
+	defer out.Close()
+	writer, err := NewDumpWriter(out)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, fileName, err)
+	}
+
+	// The encoding tells which digests are of the data compressed by CouchDB
+	query := "include_docs=true&att_encoding_info=true"
+	if attachments {
+		query += "&attachments=true"
+	}
+	if conflicts {
+		query += "&conflicts=true"
+	}
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/_all_docs?" + query
+	var dumped int
+	for start := 0; start < len(ids); start += selectionBatchSize {
+		payload, err := json.Marshal(map[string][]string{"keys": ids[start:min(start+selectionBatchSize, len(ids))]})
+		if err != nil {
+			return 0, fmt.Errorf(ErrMarshalJSON, err)
+		}
+		body, err := couchQuery(address, user, password, payload)
+		if err != nil {
+			return 0, fmt.Errorf("error reading the documents of %s: %w", dbName, err)
+		}
+		var response struct {
+			Rows []struct {
+				Doc json.RawMessage `json:"doc"`
+			} `json:"rows"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return 0, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		for _, row := range response.Rows {
+			// The documents deleted since their IDs were read come back without a body
+			if len(row.Doc) == 0 || bytes.Equal(row.Doc, []byte("null")) {
+				continue
+			}
+			var compacted bytes.Buffer
+			if err := json.Compact(&compacted, row.Doc); err != nil {
+				return 0, fmt.Errorf(ErrUnmarshalJSON, err)
+			}
+			if err := writer.Write(compacted.Bytes()); err != nil {
+				return 0, fmt.Errorf(ErrWriteDump, fileName, err)
+			}
+			dumped++
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, fileName, err)
+	}
+	return dumped, nil
+}
+
+// selectIDs lists the sorted IDs of the documents chosen by the selection, with _find
+// when there is a selector and with _all_docs otherwise.
+func selectIDs(host string, port int, user string, password string, dbName string, selection manifest.Selection) ([]string, error) {
+	base := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName
+	if selection.Partition != "" {
+		base += "/_partition/" + url.PathEscape(selection.Partition)
+	}
+	var ids []string
+	var err error
+	if len(selection.Selector) > 0 {
+		ids, err = findIDs(base, user, password, selection)
+	} else {
+		ids, err = listIDs(base, user, password, selection.IDPrefix)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error selecting the documents of %s: %w", dbName, err)
+	}
+	slices.Sort(ids)
+	return slices.Compact(ids), nil
+}
+
+// findIDs pages through _find with the bookmark, the ID prefix added to the selector.
+func findIDs(base string, user string, password string, selection manifest.Selection) ([]string, error) {
+	selector := selection.Selector
+	if selection.IDPrefix != "" {
+		// The IDs are compared as strings by _find, so the prefix is a range
+		idRange, err := json.Marshal(map[string]any{"_id": map[string]string{"$gte": selection.IDPrefix, "$lt": selection.IDPrefix + "\ufff0"}})
+		if err != nil {
+			return nil, fmt.Errorf(ErrMarshalJSON, err)
+		}
+		selector = json.RawMessage(`{"$and":[` + string(selection.Selector) + `,` + string(idRange) + `]}`)
+	}
+	var ids []string
+	var bookmark string
+	for {
+		request := map[string]any{"selector": selector, "fields": []string{"_id"}, "limit": findPageSize}
+		if bookmark != "" {
+			request["bookmark"] = bookmark
+		}
+		payload, err := json.Marshal(request)
+		if err != nil {
+			return nil, fmt.Errorf(ErrMarshalJSON, err)
+		}
+		body, err := couchQuery(base+"/_find", user, password, payload)
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			Docs []struct {
+				ID string `json:"_id"`
+			} `json:"docs"`
+			Bookmark string `json:"bookmark"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		for _, doc := range response.Docs {
+			ids = append(ids, doc.ID)
+		}
+		if len(response.Docs) < findPageSize || response.Bookmark == "" || response.Bookmark == bookmark {
+			return ids, nil
+		}
+		bookmark = response.Bookmark
+	}
+}
+
+// listIDs reads the IDs from _all_docs, only the ones starting with prefix, page by
+// page as GetDocRevs.
+func listIDs(base string, user string, password string, prefix string) ([]string, error) {
+	address := base + "/_all_docs?limit=" + strconv.Itoa(idsPageSize)
+	var query string
+	if prefix != "" {
+		startKey, _ := json.Marshal(prefix)
+		endKey, _ := json.Marshal(prefix + "\ufff0")
+		address += "&endkey=" + url.QueryEscape(string(endKey))
+		query = "&startkey=" + url.QueryEscape(string(startKey))
+	}
+	var ids []string
+	for {
+		body, err := couchRequest("GET", address+query, user, password, nil)
+		if err != nil {
+			return nil, err
+		}
+		var response struct {
+			Rows []struct {
+				ID string `json:"id"`
+			} `json:"rows"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		for _, row := range response.Rows {
+			ids = append(ids, row.ID)
+		}
+		if len(response.Rows) < idsPageSize {
+			return ids, nil
+		}
+		// The next page starts after the last ID read
+		startKey, err := json.Marshal(ids[len(ids)-1])
+		if err != nil {
+			return nil, fmt.Errorf(ErrMarshalJSON, err)
+		}
+		query = "&skip=1&startkey=" + url.QueryEscape(string(startKey))
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/manifest"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidateSelection(t *testing.T) {
+	tests := []struct {
+		selection manifest.Selection
+		valid     bool
+	}{
+		{manifest.Selection{}, true},
+		{manifest.Selection{Selector: json.RawMessage(`{"type":"order"}`)}, true},
+		{manifest.Selection{Selector: json.RawMessage(`["type"]`)}, false},
+		{manifest.Selection{Selector: json.RawMessage(`{"type":`)}, false},
+		{manifest.Selection{Partition: "eu"}, true},
+		{manifest.Selection{Partition: "_design"}, false},
+		{manifest.Selection{Partition: "eu:west"}, false},
+	}
+	for _, test := range tests {
+		err := ValidateSelection(test.selection)
+		if test.valid && err != nil {
+			t.Errorf("ValidateSelection(%+v) = %v", test.selection, err)
+		}
+		if !test.valid && ExitCode(err) != ExitUsage {
+			t.Errorf("ValidateSelection(%+v) = %v, want a usage error", test.selection, err)
+		}
+	}
+}
+
+func TestSelectsID(t *testing.T) {
+	tests := []struct {
+		selection manifest.Selection
+		id        string
+		want      bool
+	}{
+		{manifest.Selection{}, "anything", true},
+		{manifest.Selection{IDPrefix: "order:"}, "order:1", true},
+		{manifest.Selection{IDPrefix: "order:"}, "user:1", false},
+		{manifest.Selection{Partition: "eu"}, "eu:1", true},
+		{manifest.Selection{Partition: "eu"}, "europe:1", false},
+		{manifest.Selection{Partition: "eu", IDPrefix: "eu:order"}, "eu:order1", true},
+		{manifest.Selection{Partition: "eu", IDPrefix: "eu:order"}, "eu:user1", false},
+		{manifest.Selection{Selector: json.RawMessage(`{"type":"x"}`)}, "any", true},
+	}
+	for _, test := range tests {
+		if got := SelectsID(test.selection, test.id); got != test.want {
+			t.Errorf("SelectsID(%+v, %q) = %t, want %t", test.selection, test.id, got, test.want)
+		}
+	}
+}
+
+func TestDescribeSelection(t *testing.T) {
+	tests := []struct {
+		selection manifest.Selection
+		want      string
+		active    bool
+	}{
+		{manifest.Selection{}, "all the documents", false},
+		{manifest.Selection{IDPrefix: "order:"}, "the documents with IDs starting with order:", true},
+		{
+			manifest.Selection{Partition: "eu", IDPrefix: "eu:o", Selector: json.RawMessage(`{"type":"order"}`)},
+			`the documents in partition eu, with IDs starting with eu:o, matching {"type":"order"}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		if got := DescribeSelection(test.selection); got != test.want {
+			t.Errorf("DescribeSelection() = %q, want %q", got, test.want)
+		}
+		if got := SelectionActive(test.selection); got != test.active {
+			t.Errorf("SelectionActive(%+v) = %t, want %t", test.selection, got, test.active)
+		}
+	}
+}
+
+// selectionCouch answers _all_docs and _find over the documents docs, returning the
+// requests it got.
+func selectionCouch(t *testing.T, docs map[string]string) (string, int, *[]string) {
+	var requests []string
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		switch {
+		case r.Method == "GET" && strings.HasSuffix(r.URL.Path, "/_all_docs"):
+			var rows []string
+			for id := range docs {
+				rows = append(rows, fmt.Sprintf(`{"id":%q}`, id))
+			}
+			fmt.Fprintf(w, `{"rows":[%s]}`, strings.Join(rows, ","))
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_find"):
+			var request struct {
+				Bookmark string `json:"bookmark"`
+			}
+			json.Unmarshal(body, &request)
+			// The first page is full, the second one ends the results
+			if request.Bookmark == "" {
+				ids := make([]string, findPageSize)
+				for i := range ids {
+					ids[i] = `{"_id":"order:1"}`
+				}
+				fmt.Fprintf(w, `{"docs":[%s],"bookmark":"page2"}`, strings.Join(ids, ","))
+			} else {
+				io.WriteString(w, `{"docs":[{"_id":"order:2"},{"_id":"order:gone"}],"bookmark":"page3"}`)
+			}
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/_all_docs"):
+			var request struct {
+				Keys []string `json:"keys"`
+			}
+			json.Unmarshal(body, &request)
+			var rows []string
+			for _, id := range request.Keys {
+				if doc, ok := docs[id]; ok {
+					rows = append(rows, fmt.Sprintf(`{"id":%q,"doc":%s}`, id, doc))
+				} else {
+					rows = append(rows, fmt.Sprintf(`{"key":%q,"error":"not_found"}`, id))
+				}
+			}
+			fmt.Fprintf(w, `{"rows":[%s]}`, strings.Join(rows, ","))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+	})
+	return host, port, &requests
+}
+
+func TestDumpSelectionWithPrefix(t *testing.T) {
+	docs := map[string]string{
+		"order:2": `{"_id":"order:2","_rev":"1-b", "type":"order"}`,
+		"order:1": `{"_id":"order:1","_rev":"1-a","type":"order"}`,
+	}
+	host, port, requests := selectionCouch(t, docs)
+	fileName := writeDump(t)
+
+	dumped, err := DumpSelection(host, port, "admin", "secret", "db", manifest.Selection{IDPrefix: "order:"}, true, false, fileName)
+	if err != nil || dumped != 2 {
+		t.Fatalf("DumpSelection() = %d, %v", dumped, err)
+	}
+	if want := `GET /db/_all_docs?limit=10000&endkey=%22order%3A%EF%BF%B0%22&startkey=%22order%3A%22 `; (*requests)[0] != want {
+		t.Errorf("IDs listed with %q, want %q", (*requests)[0], want)
+	}
+	if want := `POST /db/_all_docs?include_docs=true&att_encoding_info=true&attachments=true {"keys":["order:1","order:2"]}`; (*requests)[1] != want {
+		t.Errorf("documents read with %q, want %q", (*requests)[1], want)
+	}
+
+	var got []string
+	ReadDump(fileName, func(doc []byte) error {
+		got = append(got, string(doc))
+		return nil
+	})
+	want := []string{`{"_id":"order:1","_rev":"1-a","type":"order"}`, `{"_id":"order:2","_rev":"1-b","type":"order"}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dump = %v, want %v", got, want)
+	}
+}
+
+func TestDumpSelectionWithSelector(t *testing.T) {
+	docs := map[string]string{
+		"order:1": `{"_id":"order:1","_rev":"1-a"}`,
+		"order:2": `{"_id":"order:2","_rev":"1-b"}`,
+	}
+	host, port, requests := selectionCouch(t, docs)
+	fileName := writeDump(t)
+	selection := manifest.Selection{Partition: "order", IDPrefix: "order:", Selector: json.RawMessage(`{"type":"order"}`)}
+
+	// order:gone was deleted between _find and _all_docs, the IDs found twice are read once
+	dumped, err := DumpSelection(host, port, "admin", "secret", "db", selection, false, true, fileName)
+	if err != nil || dumped != 2 {
+		t.Fatalf("DumpSelection() = %d, %v", dumped, err)
+	}
+	if len(*requests) != 3 {
+		t.Fatalf("requests = %v", *requests)
+	}
+	first := (*requests)[0]
+	if !strings.HasPrefix(first, "POST /db/_partition/order/_find ") ||
+		!strings.Contains(first, `"selector":{"$and":[{"type":"order"},{"_id":{"$gte":"order:","$lt":"order:`+"\ufff0"+`"}}]}`) {
+		t.Errorf("first _find = %s", first)
+	}
+	if !strings.Contains((*requests)[1], `"bookmark":"page2"`) {
+		t.Errorf("second _find = %s", (*requests)[1])
+	}
+	if want := `POST /db/_all_docs?include_docs=true&att_encoding_info=true&conflicts=true {"keys":["order:1","order:2","order:gone"]}`; (*requests)[2] != want {
+		t.Errorf("documents read with %q, want %q", (*requests)[2], want)
+	}
+}
+
+func TestListIDsPages(t *testing.T) {
+	var all []string
+	for i := range idsPageSize*2 + 5 {
+		all = append(all, fmt.Sprintf("order:%06d", i))
+	}
+	var requests []string
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+		query := r.URL.Query()
+		var startKey string
+		json.Unmarshal([]byte(query.Get("startkey")), &startKey)
+		start := sort.SearchStrings(all, startKey)
+		if query.Get("skip") == "1" {
+			start++
+		}
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		var rows []string
+		for _, id := range all[start:min(start+limit, len(all))] {
+			rows = append(rows, fmt.Sprintf(`{"id":%q}`, id))
+		}
+		fmt.Fprintf(w, `{"rows":[%s]}`, strings.Join(rows, ","))
+	})
+
+	ids, err := listIDs(urlProtocol+host+":"+strconv.Itoa(port)+"/db", "admin", "secret", "order:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, all) {
+		t.Errorf("IDs = %d, want %d", len(ids), len(all))
+	}
+	if len(requests) != 3 || !strings.Contains(requests[1], "&skip=1&startkey=%22order%3A009999%22") {
+		t.Errorf("requests = %v", requests)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// scriptWaitDelay is how long the backup script has to clean up after being
+// asked to stop, before it is killed.
+const scriptWaitDelay = 30 * time.Second
+
+// runContext is canceled by SIGINT or SIGTERM, requests created without a
+// context of their own are bound to it by Do.
+var runContext = context.Background()
+
+// SignalContext returns a context canceled by the first SIGINT or SIGTERM, so that
+// the operation in progress stops and removes its temporary files. A second signal
+// exits at once with ExitInterrupted.
+func SignalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-signals
+		if !ok {
+			return
+		}
+		slog.Warn("interrupted, cleaning up (press Ctrl-C again to force the exit)", "signal", sig.String())
+		cancel()
+		if _, ok := <-signals; ok {
+			slog.Error("forced exit, temporary and partial files may be left behind")
+			os.Exit(ExitInterrupted)
+		}
+	}()
+
+	runContext = ctx
+	return ctx, func() {
+		signal.Stop(signals)
+		close(signals)
+		cancel()
+	}
+}
+
+// RunScript runs the backup script, when ctx is canceled the script gets SIGTERM
+// so that it can stop curl and remove its temporary files.
+func RunScript(ctx context.Context, script string, args []string) error {
+	cmdExec := exec.CommandContext(ctx, "bash", append([]string{script}, args...)...)
+	cmdExec.Stderr = os.Stderr
+	cmdExec.Stdout = Out
+	cmdExec.Cancel = func() error {
+		return cmdExec.Process.Signal(syscall.SIGTERM)
+	}
+	cmdExec.WaitDelay = scriptWaitDelay
+	err := cmdExec.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalContextCanceledBySignal(t *testing.T) {
+	ctx, stop := SignalContext()
+	defer stop()
+	t.Cleanup(func() { runContext = context.Background() })
+
+	if runContext != ctx {
+		t.Errorf("the requests are not bound to the signal context")
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGTERM did not cancel the context")
+	}
+}
+
+func TestRunScriptCleansUpOnCancel(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "cleaned")
+	script := filepath.Join(dir, "script.sh")
+	body := "trap 'touch \"$1\"; exit 143' TERM\nwhile true; do sleep 0.05; done\n"
+	if err := os.WriteFile(script, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	err := RunScript(ctx, script, []string{marker})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RunScript returned %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("the script did not get SIGTERM to clean up: %v", err)
+	}
+}
+
+func TestRunScriptError(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(script, []byte("exit 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunScript(context.Background(), script, nil); err == nil {
+		t.Errorf("the failure of the script was not returned")
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	safetyDirEnv = "DBACKUPCLI_SAFETY_DIR"
+	// snapshotSuffixLength is the length of the random suffix of the snapshot IDs
+	snapshotSuffixLength = 6
+)
+
+// snapshotIDPattern matches the snapshot IDs, the older ones had no random suffix.
+var snapshotIDPattern = regexp.MustCompile(`^[a-z_][a-z0-9_$()+-]*-[0-9]{8}-[0-9]{6}(-[0-9a-f]{6})?$`)
+
+type SafetySnapshot struct {
+	ID        string    `json:"id"`
+	Host      string    `json:"host"`
+	Port      int       `json:"port"`
+	Database  string    `json:"database"`
+	File      string    `json:"file"`
+	DocCount  int       `json:"doc_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func GetSafetyDir(cmd *cobra.Command) string {
+	if dir, _ := cmd.Flags().GetString("safety-dir"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv(safetyDirEnv); dir != "" {
+		return dir
+	}
+	config, _ := GetConfig(cmd)
+	return config.SafetyDir
+}
+
+func CreateSafetySnapshot(ctx context.Context, script string, dir string, host string, port int, user string, password string, db couchdb.Database) (SafetySnapshot, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return SafetySnapshot{}, fmt.Errorf("error creating safety directory %s: %v", dir, err)
+	}
+
+	now := time.Now()
+	id, err := reserveSnapshotID(dir, db.DbName, now)
+	if err != nil {
+		return SafetySnapshot{}, err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(snapshotMetaFile(dir, id))
+		}
+	}()
+	snapshot := SafetySnapshot{
+		ID:        id,
+		Host:      host,
+		Port:      port,
+		Database:  db.DbName,
+		DocCount:  db.DocCount,
+		CreatedAt: now,
+	}
+	snapshot.File = filepath.Join(dir, snapshot.ID+".json")
+
+	output, err := CreateOutput(snapshot.File)
+	if err != nil {
+		return SafetySnapshot{}, err
+	}
+	defer output.Close()
+	args := PrepareCmdAuthArgs([]string{"-b", "-d", db.DbName, "-f", output.Partial}, user, password, host, port)
+	if err := RunScript(ctx, script, args); err != nil {
+		return SafetySnapshot{}, fmt.Errorf("error taking the safety snapshot of %s: %w", db.DbName, err)
+	}
+	settings, err := FetchManifest(host, port, user, password, db)
+	if err != nil {
+		return SafetySnapshot{}, err
+	}
+	if err := output.Commit(); err != nil {
+		return SafetySnapshot{}, err
+	}
+	if err := WriteManifest(snapshot.File, settings); err != nil {
+		return SafetySnapshot{}, err
+	}
+
+	meta, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return SafetySnapshot{}, fmt.Errorf("error marshalling snapshot metadata: %v", err)
+	}
+	if err := os.WriteFile(snapshotMetaFile(dir, snapshot.ID), meta, 0600); err != nil {
+		return SafetySnapshot{}, fmt.Errorf("error writing snapshot metadata: %v", err)
+	}
+	committed = true
+	return snapshot, nil
+}
+
+// reserveSnapshotID picks the ID of a new snapshot, the database and the time with a
+// random suffix, and creates its metadata file so that no other restore can take it.
+func reserveSnapshotID(dir string, dbName string, now time.Time) (string, error) {
+	prefix := strings.ReplaceAll(dbName, "/", "_") + "-" + now.Format("20060102-150405") + "-"
+	for range 10 {
+		id := prefix + randomID()[:snapshotSuffixLength]
+		f, err := os.OpenFile(snapshotMetaFile(dir, id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error writing snapshot metadata: %v", err)
+		}
+		f.Close()
+		return id, nil
+	}
+	return "", fmt.Errorf("error choosing the ID of the safety snapshot of %s", dbName)
+}
+
+// ValidateSnapshotID checks that id is the ID of a safety snapshot, so that it cannot
+// point outside of the safety directory.
+func ValidateSnapshotID(id string) error {
+	if !snapshotIDPattern.MatchString(id) {
+		return NewExitError(ExitUsage, fmt.Errorf("invalid snapshot ID %q, expected <database>-<yyyymmdd>-<hhmmss>-<suffix>", id))
+	}
+	return nil
+}
+
+func LoadSafetySnapshot(dir string, id string) (SafetySnapshot, error) {
+	if err := ValidateSnapshotID(id); err != nil {
+		return SafetySnapshot{}, err
+	}
+	body, err := os.ReadFile(snapshotMetaFile(dir, id))
+	if err != nil {
+		return SafetySnapshot{}, fmt.Errorf("error reading safety snapshot %s: %v", id, err)
+	}
+	var snapshot SafetySnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return SafetySnapshot{}, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	return snapshot, nil
+}
+
+func snapshotMetaFile(dir string, id string) string {
+	return filepath.Join(dir, id+".meta.json")
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReserveSnapshotIDIsUnique(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 6, 1, 10, 15, 0, 0, time.UTC)
+	seen := make(map[string]bool)
+	for range 50 {
+		id, err := reserveSnapshotID(dir, "team/orders", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[id] {
+			t.Fatalf("ID %s reserved twice", id)
+		}
+		seen[id] = true
+		if err := ValidateSnapshotID(id); err != nil {
+			t.Errorf("reserved ID %s does not validate: %v", id, err)
+		}
+		if _, err := os.Stat(snapshotMetaFile(dir, id)); err != nil {
+			t.Errorf("metadata file of %s not created: %v", id, err)
+		}
+	}
+}
+
+func TestValidateSnapshotID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"orders-20250601-101500-3fa2c1", true},
+		{"team_orders-20250601-101500-3fa2c1", true},
+		{"orders-20250601-101500", true},
+		{"../orders-20250601-101500", false},
+		{"orders-20250601-101500/../../etc", false},
+		{"/etc/passwd", false},
+		{"orders", false},
+		{"orders-20250601-101500-XYZ", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		err := ValidateSnapshotID(test.id)
+		if (err == nil) != test.valid {
+			t.Errorf("ValidateSnapshotID(%q) = %v, want valid %t", test.id, err, test.valid)
+		}
+	}
+	if _, err := LoadSafetySnapshot(t.TempDir(), "../secret"); err == nil {
+		t.Errorf("LoadSafetySnapshot accepted a path")
+	}
+}
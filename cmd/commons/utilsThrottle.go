@@ -0,0 +1,257 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const ErrInvalidBandwidth = "invalid bandwidth %q, use a number of bytes per second like 512KB/s or 20MB/s"
+
+var bandwidthFormat = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kmgKMG]?)(i?)[bB]?(?:/s)?$`)
+var windowFormat = regexp.MustCompile(`^(\d{1,2}):(\d{2})-(\d{1,2}):(\d{2})=(.+)$`)
+
+// Throttle limits the traffic to CouchDB, zero means unlimited.
+type Throttle struct {
+	Bandwidth      int64
+	RequestsPerSec float64
+}
+
+func (t Throttle) String() string {
+	bandwidth, requests := "unlimited", "unlimited"
+	if t.Bandwidth > 0 {
+		bandwidth = FormatBytes(t.Bandwidth) + "/s"
+	}
+	if t.RequestsPerSec > 0 {
+		requests = strconv.FormatFloat(t.RequestsPerSec, 'f', -1, 64) + " req/s"
+	}
+	return bandwidth + ", " + requests
+}
+
+// ThrottleWindow applies a throttle between two times of the day, End can be
+// before Start for a window across midnight.
+type ThrottleWindow struct {
+	Start    int
+	End      int
+	Throttle Throttle
+}
+
+type limiter struct {
+	mu          sync.Mutex
+	throttle    Throttle
+	lastRequest time.Time
+	available   float64
+	lastFill    time.Time
+}
+
+var trafficLimiter = &limiter{}
+
+func ParseBandwidth(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	match := bandwidthFormat.FindStringSubmatch(value)
+	if match == nil {
+		return 0, fmt.Errorf(ErrInvalidBandwidth, value)
+	}
+	n, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf(ErrInvalidBandwidth, value)
+	}
+	unit := 1000.0
+	if match[3] == "i" {
+		unit = 1024
+	}
+	switch strings.ToUpper(match[2]) {
+	case "K":
+		n *= unit
+	case "M":
+		n *= unit * unit
+	case "G":
+		n *= unit * unit * unit
+	}
+	return int64(n), nil
+}
+
+// ParseThrottleWindows reads windows like "08:00-20:00=5MB/s" or "08:00-20:00=5MB/s,10rps".
+func ParseThrottleWindows(values []string) ([]ThrottleWindow, error) {
+	var windows []ThrottleWindow
+	for _, value := range values {
+		match := windowFormat.FindStringSubmatch(strings.TrimSpace(value))
+		if match == nil {
+			return nil, fmt.Errorf("invalid throttle window %q, use HH:MM-HH:MM=<bandwidth>[,<requests>rps]", value)
+		}
+		var minutes [4]int
+		for i := range minutes {
+			minutes[i], _ = strconv.Atoi(match[i+1])
+		}
+		if minutes[0] > 23 || minutes[2] > 23 || minutes[1] > 59 || minutes[3] > 59 {
+			return nil, fmt.Errorf("invalid throttle window %q, hours must be 00-23 and minutes 00-59", value)
+		}
+
+		window := ThrottleWindow{Start: minutes[0]*60 + minutes[1], End: minutes[2]*60 + minutes[3]}
+		for _, limit := range strings.Split(match[5], ",") {
+			limit = strings.TrimSpace(limit)
+			if rps, ok := strings.CutSuffix(limit, "rps"); ok {
+				requests, err := strconv.ParseFloat(rps, 64)
+				if err != nil || requests < 0 {
+					return nil, fmt.Errorf("invalid requests per second %q in throttle window %q", limit, value)
+				}
+				window.Throttle.RequestsPerSec = requests
+				continue
+			}
+			if limit == "unlimited" {
+				continue
+			}
+			bandwidth, err := ParseBandwidth(limit)
+			if err != nil {
+				return nil, err
+			}
+			window.Throttle.Bandwidth = bandwidth
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// ThrottleAt returns the throttle of the first window containing t, or fallback.
+func ThrottleAt(windows []ThrottleWindow, fallback Throttle, t time.Time) Throttle {
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range windows {
+		if w.Start <= w.End && minute >= w.Start && minute < w.End {
+			return w.Throttle
+		}
+		if w.Start > w.End && (minute >= w.Start || minute < w.End) {
+			return w.Throttle
+		}
+	}
+	return fallback
+}
+
+// GetThrottle reads --max-bandwidth and --max-requests-per-sec, falling back to the profile.
+func GetThrottle(cmd *cobra.Command) (Throttle, error) {
+	_, profile, err := GetProfile(cmd)
+	if err != nil {
+		return Throttle{}, err
+	}
+	bandwidth, _ := cmd.Flags().GetString("max-bandwidth")
+	if !cmd.Flags().Changed("max-bandwidth") && profile.MaxBandwidth != "" {
+		bandwidth = profile.MaxBandwidth
+	}
+	requests, _ := cmd.Flags().GetFloat64("max-requests-per-sec")
+	if !cmd.Flags().Changed("max-requests-per-sec") && profile.MaxRequestsPerSec != 0 {
+		requests = profile.MaxRequestsPerSec
+	}
+	if requests < 0 {
+		return Throttle{}, fmt.Errorf("max requests per second cannot be negative")
+	}
+
+	var throttle Throttle
+	throttle.Bandwidth, err = ParseBandwidth(bandwidth)
+	throttle.RequestsPerSec = requests
+	return throttle, err
+}
+
+func SetThrottle(throttle Throttle) {
+	trafficLimiter.mu.Lock()
+	defer trafficLimiter.mu.Unlock()
+	trafficLimiter.throttle = throttle
+	trafficLimiter.available = float64(throttle.Bandwidth)
+	trafficLimiter.lastFill = time.Now()
+}
+
+func CurrentThrottle() Throttle {
+	trafficLimiter.mu.Lock()
+	defer trafficLimiter.mu.Unlock()
+	return trafficLimiter.throttle
+}
+
+// waitRequest blocks until a new request can be sent without exceeding the request rate.
+func (l *limiter) waitRequest(ctx context.Context) error {
+	l.mu.Lock()
+	var wait time.Duration
+	if l.throttle.RequestsPerSec > 0 {
+		next := l.lastRequest.Add(time.Duration(float64(time.Second) / l.throttle.RequestsPerSec))
+		wait = max(time.Until(next), 0)
+		l.lastRequest = time.Now().Add(wait)
+	}
+	l.mu.Unlock()
+	return sleepContext(ctx, wait)
+}
+
+// waitBytes takes n bytes from a bucket refilled at the bandwidth, holding at most one second of traffic.
+func (l *limiter) waitBytes(n int) error {
+	l.mu.Lock()
+	rate := float64(l.throttle.Bandwidth)
+	if rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.available = min(l.available+now.Sub(l.lastFill).Seconds()*rate, rate)
+	l.lastFill = now
+	l.available -= float64(n)
+	var wait time.Duration
+	if l.available < 0 {
+		wait = time.Duration(-l.available / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	return sleepContext(runContext, wait)
+}
+
+func (l *limiter) chunk() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.throttle.Bandwidth <= 0 {
+		return 0
+	}
+	return int(max(l.throttle.Bandwidth/10, 1))
+}
+
+// throttledReader limits the bytes read from a request or response body.
+type throttledReader struct {
+	r io.ReadCloser
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if size := trafficLimiter.chunk(); size > 0 && len(p) > size {
+		p = p[:size]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if waitErr := trafficLimiter.waitBytes(n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (t throttledReader) Close() error {
+	return t.r.Close()
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		valid bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512KB/s", 512000, true},
+		{"512KiB/s", 524288, true},
+		{"20MB/s", 20000000, true},
+		{"1.5M", 1500000, true},
+		{"2GiB", 2 << 30, true},
+		{"fast", 0, false},
+		{"-5MB/s", 0, false},
+		{"5TB/s", 0, false},
+	}
+	for _, test := range tests {
+		got, err := ParseBandwidth(test.value)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("ParseBandwidth(%q) = %d, %v, want %d valid %t", test.value, got, err, test.want, test.valid)
+		}
+	}
+}
+
+func TestThrottleWindows(t *testing.T) {
+	windows, err := ParseThrottleWindows([]string{"08:00-20:00=5MB/s", "22:00-06:00=unlimited,50rps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := Throttle{Bandwidth: 1000}
+	at := func(hour, minute int) Throttle {
+		return ThrottleAt(windows, fallback, time.Date(2025, 6, 1, hour, minute, 0, 0, time.Local))
+	}
+	tests := []struct {
+		hour, minute int
+		want         Throttle
+	}{
+		{8, 0, Throttle{Bandwidth: 5000000}},
+		{19, 59, Throttle{Bandwidth: 5000000}},
+		{20, 0, fallback},
+		{23, 30, Throttle{RequestsPerSec: 50}},
+		{3, 0, Throttle{RequestsPerSec: 50}},
+		{6, 0, fallback},
+	}
+	for _, test := range tests {
+		if got := at(test.hour, test.minute); got != test.want {
+			t.Errorf("ThrottleAt(%02d:%02d) = %+v, want %+v", test.hour, test.minute, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"8-20=5MB/s", "25:00-06:00=1MB/s", "08:00-20:00=fast", "08:00-20:00=-1rps"} {
+		if _, err := ParseThrottleWindows([]string{value}); err == nil {
+			t.Errorf("invalid window %q accepted", value)
+		}
+	}
+}
+
+func TestLimiterRequestRate(t *testing.T) {
+	l := &limiter{throttle: Throttle{RequestsPerSec: 50}}
+	started := time.Now()
+	for range 6 {
+		if err := l.waitRequest(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first request goes at once, the next five wait 20ms each
+	if elapsed := time.Since(started); elapsed < 90*time.Millisecond {
+		t.Errorf("6 requests at 50 req/s took %s", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.waitRequest(ctx); err == nil {
+		t.Errorf("waitRequest ignored a canceled context")
+	}
+}
+
+func TestThrottledReaderBandwidth(t *testing.T) {
+	previous := CurrentThrottle()
+	t.Cleanup(func() { SetThrottle(previous) })
+	SetThrottle(Throttle{Bandwidth: 10000})
+
+	// The bucket starts full with one second of traffic, the rest waits
+	started := time.Now()
+	n, err := io.Copy(io.Discard, throttledReader{io.NopCloser(strings.NewReader(strings.Repeat("x", 13000)))})
+	if err != nil || n != 13000 {
+		t.Fatalf("copied %d bytes, %v", n, err)
+	}
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Errorf("13000 bytes at 10000 B/s took %s", elapsed)
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bytes"
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// tombstoneBatchSize is the number of revisions read with each _bulk_get request.
+const tombstoneBatchSize = 500
+
+// changesPageSize is the number of rows read with each _changes request of getDeletedRevs.
+const changesPageSize = 10000
+
+// AppendTombstones adds to the end of the dump the deleted documents, invisible to
+// _all_docs, read from the changes feed with their revision history, so that a restore
+// with new_edits false deletes them again. Only the IDs accepted by keep are added, all
+// of them when it is nil. It returns the number of deleted documents.
+func AppendTombstones(host string, port int, user string, password string, dbName string, fileName string, keep func(id string) bool) (int, error) {
+	deleted, err := getDeletedRevs(host, port, user, password, dbName)
+	if err != nil {
+		return 0, err
+	}
+	if keep != nil {
+		deleted = slices.DeleteFunc(deleted, func(ref couchdb.DocRef) bool { return !keep(ref.ID) })
+	}
+
+	tmpFile := fileName + ".deleted"
+	defer os.Remove(tmpFile)
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, tmpFile, err)
+	}
+	defer out.Close()
+	writer, err := NewDumpWriter(out)
+	if err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, tmpFile, err)
+	}
+
+	err = ReadDump(fileName, func(doc []byte) error {
+		if err := writer.Write(doc); err != nil {
+			return fmt.Errorf(ErrWriteDump, tmpFile, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var captured int
+	var lastID string
+	for start := 0; start < len(deleted); start += tombstoneBatchSize {
+		batch := deleted[start:min(start+tombstoneBatchSize, len(deleted))]
+		tombstones, err := getTombstones(host, port, user, password, dbName, batch)
+		if err != nil {
+			return 0, err
+		}
+		for _, deletion := range tombstones {
+			if err := writer.Write(deletion.doc); err != nil {
+				return 0, fmt.Errorf(ErrWriteDump, tmpFile, err)
+			}
+			if deletion.id != lastID {
+				captured++
+				lastID = deletion.id
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, fileName); err != nil {
+		return 0, fmt.Errorf(ErrWriteDump, fileName, err)
+	}
+	return captured, nil
+}
+
+type tombstone struct {
+	id  string
+	doc []byte
+}
+
+// getDeletedRevs lists from the changes feed the leaf revisions of the documents whose
+// winning revision is a deletion, the leaves of a document one after the other. The feed
+// is read page by page, each one from the last_seq of the previous, so that a large
+// database is not held in a single response.
+func getDeletedRevs(host string, port int, user string, password string, dbName string) ([]couchdb.DocRef, error) {
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/_changes?style=all_docs&limit=" + strconv.Itoa(changesPageSize)
+	// A document changed while the feed is read comes again in a later page, its last
+	// row replaces the leaves of the previous ones
+	leaves := make(map[string][]couchdb.DocRef)
+	var ids []string
+	var query string
+	for {
+		body, err := couchRequest("GET", address+query, user, password, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the changes of %s: %w", dbName, err)
+		}
+		var changes couchdb.Changes
+		if err := json.Unmarshal(body, &changes); err != nil {
+			return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+		}
+		for _, row := range changes.Results {
+			if _, seen := leaves[row.ID]; !seen {
+				ids = append(ids, row.ID)
+			}
+			var refs []couchdb.DocRef
+			if row.Deleted {
+				for _, change := range row.Changes {
+					refs = append(refs, couchdb.DocRef{ID: row.ID, Rev: change.Rev, Deleted: true})
+				}
+			}
+			leaves[row.ID] = refs
+		}
+		if len(changes.Results) < changesPageSize {
+			break
+		}
+		// The sequences are strings since CouchDB 2.0 and numbers before
+		since, ok := changes.LastSeq.(string)
+		if !ok {
+			seq, err := json.Marshal(changes.LastSeq)
+			if err != nil {
+				return nil, fmt.Errorf(ErrMarshalJSON, err)
+			}
+			since = string(seq)
+		}
+		query = "&since=" + url.QueryEscape(since)
+	}
+	var deleted []couchdb.DocRef
+	for _, id := range ids {
+		deleted = append(deleted, leaves[id]...)
+	}
+	return deleted, nil
+}
+
+// getTombstones reads the revisions of refs with their _revisions, compacted on one line.
+// The revisions purged or compacted away since the changes were read are left out.
+func getTombstones(host string, port int, user string, password string, dbName string, refs []couchdb.DocRef) ([]tombstone, error) {
+	type bulkGetDoc struct {
+		ID  string `json:"id"`
+		Rev string `json:"rev"`
+	}
+	request := struct {
+		Docs []bulkGetDoc `json:"docs"`
+	}{}
+	for _, ref := range refs {
+		request.Docs = append(request.Docs, bulkGetDoc{ID: ref.ID, Rev: ref.Rev})
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf(ErrMarshalJSON, err)
+	}
+
+	address := urlProtocol + host + ":" + strconv.Itoa(port) + "/" + dbName + "/_bulk_get?revs=true&attachments=true&att_encoding_info=true"
+	body, err := couchQuery(address, user, password, payload)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the deleted documents of %s: %w", dbName, err)
+	}
+	var response struct {
+		Results []struct {
+			ID   string `json:"id"`
+			Docs []struct {
+				OK json.RawMessage `json:"ok"`
+			} `json:"docs"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+	}
+	var tombstones []tombstone
+	for _, result := range response.Results {
+		for _, doc := range result.Docs {
+			if len(doc.OK) == 0 {
+				continue
+			}
+			var compacted bytes.Buffer
+			if err := json.Compact(&compacted, doc.OK); err != nil {
+				return nil, fmt.Errorf(ErrUnmarshalJSON, err)
+			}
+			tombstones = append(tombstones, tombstone{id: result.ID, doc: compacted.Bytes()})
+		}
+	}
+	return tombstones, nil
+}
+
+// isTombstone tells whether a document of the dump is a deletion.
+func isTombstone(doc []byte) bool {
+	if !bytes.Contains(doc, []byte(`"_deleted":true`)) {
+		return false
+	}
+	var ref couchdb.DocRef
+	return json.Unmarshal(doc, &ref) == nil && ref.Deleted
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestAppendTombstones(t *testing.T) {
+	var bulkGet struct {
+		Docs []struct {
+			ID  string `json:"id"`
+			Rev string `json:"rev"`
+		} `json:"docs"`
+	}
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/db/_changes":
+			w.Write([]byte(`{"last_seq":"9-x","results":[
+				{"seq":"1-a","id":"live","changes":[{"rev":"1-l"}]},
+				{"seq":"2-a","id":"gone","deleted":true,"changes":[{"rev":"3-d"},{"rev":"2-c"}]},
+				{"seq":"3-a","id":"other","deleted":true,"changes":[{"rev":"2-o"}]},
+				{"seq":"4-a","id":"purged","deleted":true,"changes":[{"rev":"2-p"}]}]}`))
+		case "/db/_bulk_get":
+			body, _ := io.ReadAll(r.Body)
+			json.Unmarshal(body, &bulkGet)
+			w.Write([]byte(`{"results":[
+				{"id":"gone","docs":[{"ok":{"_id":"gone","_rev":"3-d","_deleted":true,"_revisions":{"start":3,"ids":["d","b","a"]}}}]},
+				{"id":"gone","docs":[{"ok":{"_id":"gone","_rev":"2-c","_deleted":true}}]},
+				{"id":"purged","docs":[{"error":{"id":"purged","rev":"2-p","error":"not_found"}}]}]}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	})
+	fileName := writeDump(t, `{"_id":"live","_rev":"1-l"}`)
+
+	captured, err := AppendTombstones(host, port, "admin", "secret", "db", fileName, func(id string) bool { return id != "other" })
+	if err != nil || captured != 1 {
+		t.Fatalf("AppendTombstones() = %d, %v, want 1", captured, err)
+	}
+	var requested []string
+	for _, doc := range bulkGet.Docs {
+		requested = append(requested, doc.ID+"@"+doc.Rev)
+	}
+	if want := []string{"gone@3-d", "gone@2-c", "purged@2-p"}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("_bulk_get docs = %v, want %v", requested, want)
+	}
+
+	var docs []string
+	var tombstones int
+	ReadDump(fileName, func(doc []byte) error {
+		docs = append(docs, string(doc))
+		if isTombstone(doc) {
+			tombstones++
+		}
+		return nil
+	})
+	want := []string{
+		`{"_id":"live","_rev":"1-l"}`,
+		`{"_id":"gone","_rev":"3-d","_deleted":true,"_revisions":{"start":3,"ids":["d","b","a"]}}`,
+		`{"_id":"gone","_rev":"2-c","_deleted":true}`,
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("dump = %v\nwant %v", docs, want)
+	}
+	if tombstones != 2 {
+		t.Errorf("tombstones = %d, want 2", tombstones)
+	}
+}
+
+func TestGetDeletedRevsPages(t *testing.T) {
+	// The rows of the feed, with numeric sequences as CouchDB 1.x, the last ones
+	// change again documents of the first page
+	type row struct {
+		Seq     int                    `json:"seq"`
+		ID      string                 `json:"id"`
+		Deleted bool                   `json:"deleted,omitempty"`
+		Changes []couchdb.AllDocsValue `json:"changes"`
+	}
+	var rows []row
+	for i := range changesPageSize*2 + 3 {
+		rows = append(rows, row{ID: fmt.Sprintf("doc-%06d", i), Deleted: i%2 == 0, Changes: []couchdb.AllDocsValue{{Rev: "1-a"}}})
+	}
+	rows = append(rows,
+		row{ID: "doc-000000", Changes: []couchdb.AllDocsValue{{Rev: "2-b"}}},
+		row{ID: "doc-000001", Deleted: true, Changes: []couchdb.AllDocsValue{{Rev: "2-b"}, {Rev: "2-c"}}})
+	for i := range rows {
+		rows[i].Seq = i + 1
+	}
+
+	var requests []string
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RawQuery)
+		since, _ := strconv.Atoi(r.URL.Query().Get("since"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		page := rows[since:min(since+limit, len(rows))]
+		json.NewEncoder(w).Encode(map[string]any{"results": page, "last_seq": page[len(page)-1].Seq})
+	})
+
+	deleted, err := getDeletedRevs(host, port, "admin", "secret", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 3 || requests[1] != "style=all_docs&limit=10000&since=10000" {
+		t.Errorf("requests = %v", requests)
+	}
+	if want := changesPageSize + 3; len(deleted) != want {
+		t.Fatalf("deleted revisions = %d, want %d", len(deleted), want)
+	}
+	// doc-000000 was restored and doc-000001 deleted after the first page was read
+	if want := []couchdb.DocRef{{ID: "doc-000001", Rev: "2-b", Deleted: true}, {ID: "doc-000001", Rev: "2-c", Deleted: true}}; !reflect.DeepEqual(deleted[:2], want) {
+		t.Errorf("first deleted revisions = %v, want %v", deleted[:2], want)
+	}
+}
+
+func TestIsTombstone(t *testing.T) {
+	tests := map[string]bool{
+		`{"_id":"a","_rev":"2-x","_deleted":true}`:            true,
+		`{"_id":"a","_rev":"2-x"}`:                            false,
+		`{"_id":"a","_rev":"2-x","note":"\"_deleted\":true"}`: false,
+		`{"_id":"a","_rev":"2-x","_deleted":false}`:           false,
+	}
+	for doc, want := range tests {
+		if got := isTombstone([]byte(doc)); got != want {
+			t.Errorf("isTombstone(%s) = %t, want %t", doc, got, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"bufio"
+	"bytes"
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// VerifyDump checks that the dump is complete and that every document is valid JSON,
+// returning the number of documents and of deleted documents it contains, the leaves
+// of a document counted once.
+func VerifyDump(fileName string) (int, int, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, 0, fmt.Errorf(ErrOpenDump, fileName, err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReaderSize(f, 1024*1024)
+	var counter dumpCounter
+	var last []byte
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return 0, 0, fmt.Errorf(ErrReadDump, fileName, err)
+		}
+		doc := bytes.TrimSpace(line)
+		switch {
+		case len(doc) == 0:
+		case lineNumber == 1:
+			if string(doc) != dumpHeader {
+				return 0, 0, verificationError("dump %s does not start with the bulk docs header", fileName)
+			}
+		case string(doc) == dumpFooter:
+		default:
+			doc := bytes.TrimSuffix(doc, []byte(","))
+			if !json.Valid(doc) {
+				return 0, 0, verificationError("dump %s has an invalid document at line %d", fileName, lineNumber)
+			}
+			counter.add(doc)
+		}
+		if len(doc) != 0 {
+			last = doc
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if string(last) != dumpFooter {
+		return 0, 0, verificationError("dump %s is truncated, the closing %s is missing", fileName, dumpFooter)
+	}
+	return counter.docs + counter.designs, counter.deleted, nil
+}
+
+// VerifyRestore checks that the restored database holds at least the documents of the dump.
+func VerifyRestore(host string, port int, user string, password string, dbName string, expected int) (couchdb.Database, error) {
+	_, db, err := GetDB(host, port, user, password, dbName)
+	if err != nil {
+		return db, err
+	}
+	if db.DocCount < expected {
+		return db, verificationError("database %s has %d documents after the restore, expected at least %d", dbName, db.DocCount, expected)
+	}
+	return db, nil
+}
+
+func verificationError(format string, args ...any) error {
+	return NewExitError(ExitVerification, fmt.Errorf(format, args...))
+}
@@ -0,0 +1,37 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package commons
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyDump(t *testing.T) {
+	dump := writeDump(t,
+		`{"_id":"a","_rev":"1-a"}`,
+		`{"_id":"_design/views","_rev":"1-v"}`,
+		`{"_id":"b","_rev":"2-b","_deleted":true}`,
+	)
+	docs, deleted, err := VerifyDump(dump)
+	if err != nil || docs != 2 || deleted != 1 {
+		t.Errorf("VerifyDump = %d docs, %d deleted, %v, want 2, 1, nil", docs, deleted, err)
+	}
+
+	dir := t.TempDir()
+	broken := map[string]string{
+		"truncated": "{\"new_edits\":false,\"docs\":[\n{\"_id\":\"a\",\"_rev\":\"1-a\"},\n",
+		"invalid":   "{\"new_edits\":false,\"docs\":[\n{\"_id\":\"a\",\"_rev\":\n]}\n",
+		"no header": "{\"_id\":\"a\",\"_rev\":\"1-a\"}\n]}\n",
+	}
+	for name, content := range broken {
+		fileName := filepath.Join(dir, name+".json")
+		os.WriteFile(fileName, []byte(content), 0600)
+		if _, _, err := VerifyDump(fileName); ExitCode(err) != ExitVerification {
+			t.Errorf("%s dump: got %v, want a verification error", name, err)
+		}
+	}
+}
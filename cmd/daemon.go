@@ -0,0 +1,207 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+package cmd
+
+import (
+	"context"
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/report"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// daemonCmd represents the daemon command
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Runs a backup of the entire CouchDB istance at a fixed interval",
+	Long: `Runs a backup of the entire CouchDB istance at a fixed interval, every run is saved
+in a new directory named after its start time and the metrics can be served on /metrics.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, host, password, port := commons.GetAuthFlagValues(cmd)
+		dir, _ := cmd.Flags().GetString("filedir")
+		if commons.CheckFlags(append([]string{}, dir, user, password, host)) {
+			return commons.MissingFlags("daemon")
+		}
+		options := dumpOptions{}
+		options.attachments, _ = cmd.Flags().GetString("attachments")
+		if err := options.validate(); err != nil {
+			slog.Error("invalid flags", "error", err)
+			return err
+		}
+		if options.attachments == commons.AttachmentsSeparate {
+			// The runs share the blob store, each one downloads only the new attachments
+			options.blobStore = filepath.Join(dir, commons.BlobStoreDir)
+		}
+		interval, _ := cmd.Flags().GetDuration("interval")
+		if interval <= 0 {
+			slog.Error("the interval must be positive", "interval", interval)
+			return commons.NewExitError(commons.ExitUsage, errors.New("invalid interval"))
+		}
+		metricsFile, _ := cmd.Flags().GetString("metrics-textfile")
+		listen, _ := cmd.Flags().GetString("metrics-listen")
+		notifications, server, err := commons.GetNotifications(cmd)
+		if err != nil {
+			slog.Error("invalid notifications", "error", err)
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+
+		windowFlags, _ := cmd.Flags().GetStringArray("throttle-window")
+		windows, err := commons.ParseThrottleWindows(windowFlags)
+		if err != nil {
+			slog.Error("invalid throttle window", "error", err)
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+		schedule := throttleSchedule{windows: windows, fallback: commons.CurrentThrottle()}
+		hooks := commons.GetHooks(cmd, "backup")
+		metrics := commons.NewMetrics()
+		if metricsFile != "" {
+			loaded, err := commons.LoadMetricsTextfile(metricsFile)
+			if err != nil {
+				slog.Warn("error loading the previous metrics", "file", metricsFile, "error", err)
+			} else {
+				metrics = loaded
+			}
+		}
+
+		tmpFile, err := scripts.GetEmbeddedScripts()
+		defer os.Remove(tmpFile)
+		if err != nil {
+			slog.Error("error preparing the backup script", "error", err)
+			return err
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			slog.Error("error creating the backup directory", "dir", dir, "error", err)
+			return err
+		}
+
+		ctx, stop := context.WithCancel(cmd.Context())
+		defer stop()
+
+		if listen != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics)
+			server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+			go func() {
+				if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					slog.Error("error serving the metrics", "listen", listen, "error", err)
+					stop()
+				}
+			}()
+			defer server.Close()
+			slog.Info("serving metrics", "listen", listen, "path", "/metrics")
+		}
+
+		slog.Info("daemon started", "host", host, "dir", dir, "interval", interval.String())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			schedule.apply(time.Now())
+			run := runDaemonBackup(ctx, tmpFile, host, port, user, password, dir, options, hooks, metrics, metricsFile)
+			recordCatalog(cmd, run)
+			commons.Notify(notifications, server, run)
+			select {
+			case <-ctx.Done():
+				slog.Info("daemon stopped")
+				return nil
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+// throttleSchedule picks the throttle of each run from the time-of-day windows,
+// outside of them --max-bandwidth and --max-requests-per-sec apply.
+type throttleSchedule struct {
+	windows  []commons.ThrottleWindow
+	fallback commons.Throttle
+}
+
+func (s throttleSchedule) apply(now time.Time) {
+	throttle := commons.ThrottleAt(s.windows, s.fallback, now)
+	if throttle != commons.CurrentThrottle() {
+		slog.Info("throttle changed", "throttle", throttle.String())
+	}
+	commons.SetThrottle(throttle)
+}
+
+func runDaemonBackup(ctx context.Context, tmpFile string, host string, port int, user string, password string, dir string, options dumpOptions, hooks commons.Hooks, metrics *commons.Metrics, metricsFile string) report.RunReport {
+	commons.StartRunReport("daemon")
+	runDir := filepath.Join(dir, time.Now().Format("20060102-150405"))
+
+	dbsList, err := commons.GetDBs(host, port, user, password)
+	if err != nil {
+		slog.Error("error listing the databases", "host", host, "error", err)
+	} else if err = os.Mkdir(runDir, os.ModePerm); err != nil {
+		slog.Error("error creating the backup directory", "dir", runDir, "error", err)
+	} else {
+		results, errs := backupInstance(ctx, tmpFile, host, port, user, password, runDir, dbsList, systemBackup{}, options, false, hooks)
+		err = commons.RunError(results, errs)
+		metrics.Observe(results, time.Now())
+	}
+	metrics.ObserveRun("daemon", commons.ExitCode(err), time.Now())
+
+	if metricsFile != "" {
+		if err := commons.WriteMetricsTextfile(metricsFile, metrics); err != nil {
+			slog.Error("error writing the metrics", "file", metricsFile, "error", err)
+		}
+	}
+	return commons.FinishRunReport(err)
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.SetUsageTemplate(`
+Usage: dbackupcli {{.Use}} [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -f, --filedir	The directory where to save the backups, every run creates a sub directory
+ -u, --user		The CouchDB username for the auth
+ -p, --password		The CouchDB password for the auth
+ --host			The host of the remote CouchDB, with or without 'https://'
+ --port			The port of the remote CouchDB, default is 5984
+ --interval		The time between two backups (e.g. 30m, 6h), default is 24h
+ --attachments		How to save the attachments, default is inline. With separate they are
+			saved as binary files in the blob store <filedir>/blobs shared by the runs,
+			which download only the attachments that are not there yet
+ --tag			A tag recorded with the backup in the catalog, can be repeated
+ --catalog		The catalog where to record the backup, default is ~/.dbackupcli-catalog.jsonl
+ --metrics-listen	The address where to serve the metrics on /metrics (e.g. :9101)
+ --throttle-window	A time-of-day window with its own throttle, e.g. 08:00-20:00=5MB/s or
+			22:00-06:00=unlimited,50rps, can be repeated. Outside of the windows
+			--max-bandwidth and --max-requests-per-sec apply. Checked at the start of each run
+ --pre-hook		A shell command run before the backup of each database, a non-zero exit skips it
+ --post-hook		A shell command run after each successful backup
+ --on-error-hook		A shell command run when the backup of a database fails
+
+The first backup starts immediately, the daemon stops on SIGINT or SIGTERM.
+
+Examples:
+ dbackupcli daemon -f backups -u admin -p root --host 127.0.0.1 --interval 6h --metrics-listen :9101
+ dbackupcli daemon -f backups --profile prod --metrics-textfile /var/lib/node_exporter/dbackupcli.prom
+ dbackupcli daemon -f backups --profile prod --max-bandwidth 2MB/s --throttle-window 20:00-07:00=unlimited
+`)
+	daemonCmd.Flags().BoolP("help", "h", false, "Help message")
+	daemonCmd.Flags().String("host", "", "The remote CouchDB host, can be provided with or without 'https://'")
+	daemonCmd.Flags().Int("port", 5984, "The remote CouchDB port (Default: 5984)")
+	daemonCmd.Flags().StringP("filedir", "f", "", "The name of the directory where to backup (Default: empty)")
+	daemonCmd.Flags().StringP("user", "u", "", "The username to authenticate to the CouchDB (Default: empty)")
+	daemonCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
+	daemonCmd.Flags().Duration("interval", 24*time.Hour, "The time between two backups (Default: 24h)")
+	daemonCmd.Flags().String("attachments", commons.AttachmentsInline, "How to save the attachments: inline or separate (Default: inline)")
+	daemonCmd.Flags().StringSlice("tag", nil, "The tags to record with the backup in the catalog (Default: empty)")
+	daemonCmd.Flags().String("catalog", "", "The catalog where to record the backup (Default: $DBACKUPCLI_CATALOG)")
+	daemonCmd.Flags().String("metrics-listen", "", "The address where to serve the metrics (Default: empty)")
+	daemonCmd.Flags().StringArray("throttle-window", nil, "A time-of-day window with its own throttle, e.g. 08:00-20:00=5MB/s (Default: empty)")
+	daemonCmd.Flags().String("pre-hook", "", "The shell command to run before each backup (Default: empty)")
+	daemonCmd.Flags().String("post-hook", "", "The shell command to run after each successful backup (Default: empty)")
+	daemonCmd.Flags().String("on-error-hook", "", "The shell command to run when a backup fails (Default: empty)")
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+package cmd
+
+import (
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/instance"
+	"dbackupcli/cmd/struct/report"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// instanceBackupCmd represents the instance-backup command
+var instanceBackupCmd = &cobra.Command{
+	Use:   "instance-backup",
+	Short: "Takes a snapshot of the entire CouchDB node, system databases and config included",
+	Long: `Takes a snapshot of the entire CouchDB node: every database, _users, _replicator and
+_global_changes included, the node config and the cluster membership, so that instance-restore
+can rebuild a fresh node into the same shape.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, host, password, port := commons.GetAuthFlagValues(cmd)
+		dir, _ := cmd.Flags().GetString("filedir")
+		if commons.CheckFlags(append([]string{}, dir, user, password, host)) {
+			return commons.MissingFlags("instance-backup")
+		}
+		options := getDumpOptions(cmd)
+		if err := options.validate(); err != nil {
+			slog.Error("invalid flags", "error", err)
+			return err
+		}
+		systemDbs := systemBackup{include: true}
+		systemDbs.keepCredentials, _ = cmd.Flags().GetBool("keep-replicator-credentials")
+
+		dbsList, err := commons.GetDBs(host, port, user, password)
+		if err != nil {
+			slog.Error("error listing the databases", "host", host, "error", err)
+			return err
+		}
+		saved, config, err := commons.FetchInstance(host, port, user, password)
+		if err != nil {
+			slog.Error("error reading the node", "host", host, "error", err)
+			return err
+		}
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			planBackupAll(host, port, user, password, dir, dbsList, systemDbs, options)
+			commons.PrintPlan("Instance of "+host+":", []commons.PlanStep{
+				{Name: "CouchDB version", Value: saved.CouchDBVersion},
+				{Name: "Cluster nodes", Value: strings.Join(saved.Membership.ClusterNodes, ", ")},
+				{Name: "Node config", Value: fmt.Sprintf("%d sections, saved in %s/%s", len(config), dir, commons.NodeConfigFile)},
+			})
+			return nil
+		}
+
+		tmpFile, err := scripts.GetEmbeddedScripts()
+		defer os.Remove(tmpFile)
+		if err != nil {
+			slog.Error("error preparing the backup script", "error", err)
+			return err
+		}
+
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			slog.Error("error creating the backup directory", "dir", dir, "error", err)
+			return err
+		}
+
+		results, errs := backupInstance(cmd.Context(), tmpFile, host, port, user, password, dir, dbsList, systemDbs, options, commons.ProgressEnabled(cmd), commons.GetHooks(cmd, "backup"))
+		var instanceErr error
+		if cmd.Context().Err() == nil {
+			if instanceErr = writeInstance(dir, saved, config, results, systemDbs); instanceErr != nil {
+				slog.Error("error saving the instance", "dir", dir, "error", instanceErr)
+			}
+		}
+		commons.PrintResult(results, nil)
+		if err := commons.RunError(results, errs); err != nil {
+			return err
+		}
+		return instanceErr
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(instanceBackupCmd)
+	instanceBackupCmd.SetUsageTemplate(`
+Usage: dbackupcli {{.Use}} [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -f, --filedir	The directory where to save the snapshot of the node,
+				if not present the backup will create the directory
+ -u, --user		The CouchDB username for the auth, it must be a server admin
+ -p, --password		The CouchDB password for the auth
+ --host			The host of the remote CouchDB, with or without 'https://'
+ --port			The port of the remote CouchDB, default is 5984
+ --keep-replicator-credentials	Keep the passwords of the replications in the dump of _replicator
+ --with-conflicts	Export all the leaves of the conflicted documents with their revision history
+ --include-deleted	Export the deleted documents as tombstones, restored as deletions
+ --attachments		How to save the attachments, default is inline:
+				inline		base64 encoded inside their documents
+				separate	as binary files in <db>.json.attachments, named by their digest
+ --blob-store		The directory shared by the backups where to save the separate attachments,
+				the ones already there are not downloaded again
+ --tag			A tag recorded with the backup in the catalog, can be repeated
+ --catalog		The catalog where to record the backup, default is ~/.dbackupcli-catalog.jsonl
+ --dry-run		Print what the backup would do without doing it
+ --no-progress		Show the output of the backup script instead of the progress bars
+ --pre-hook		A shell command run before the backup of each database, a non-zero exit skips it
+ --post-hook		A shell command run after each successful backup
+ --on-error-hook		A shell command run when the backup of a database fails
+
+Examples:
+ dbackupcli instance-backup -f node1-snapshot -u admin -p root --host 127.0.0.1
+ dbackupcli instance-backup --filedir node1-snapshot --user admin -p root --host 127.0.0.1 --port 9876
+`)
+	instanceBackupCmd.Flags().BoolP("help", "h", false, "Help message")
+	instanceBackupCmd.Flags().String("host", "", "The remote CouchDB host, can be provided with or without 'https://'")
+	instanceBackupCmd.Flags().Int("port", 5984, "The remote CouchDB port (Default: 5984)")
+	instanceBackupCmd.Flags().StringP("filedir", "f", "", "The name of the directory where to save the snapshot (Default: empty)")
+	instanceBackupCmd.Flags().StringP("user", "u", "", "The username to authenticate to the CouchDB (Default: empty)")
+	instanceBackupCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
+	instanceBackupCmd.Flags().Bool("keep-replicator-credentials", false, "Do not redact the credentials of the replications (Default: false)")
+	instanceBackupCmd.Flags().Bool("with-conflicts", false, "Export the conflicting revisions with their history (Default: false)")
+	instanceBackupCmd.Flags().Bool("include-deleted", false, "Export the deleted documents from the changes feed (Default: false)")
+	instanceBackupCmd.Flags().String("attachments", commons.AttachmentsInline, "How to save the attachments: inline or separate (Default: inline)")
+	instanceBackupCmd.Flags().String("blob-store", "", "The directory shared by the backups where to save the separate attachments (Default: empty)")
+	instanceBackupCmd.Flags().StringSlice("tag", nil, "The tags to record with the backup in the catalog (Default: empty)")
+	instanceBackupCmd.Flags().String("catalog", "", "The catalog where to record the backup (Default: $DBACKUPCLI_CATALOG)")
+	instanceBackupCmd.Flags().Bool("dry-run", false, "Print the backup plan without executing it (Default: false)")
+	instanceBackupCmd.Flags().Bool("no-progress", false, "Disable the progress bars (Default: false)")
+	instanceBackupCmd.Flags().String("pre-hook", "", "The shell command to run before each backup (Default: empty)")
+	instanceBackupCmd.Flags().String("post-hook", "", "The shell command to run after each successful backup (Default: empty)")
+	instanceBackupCmd.Flags().String("on-error-hook", "", "The shell command to run when a backup fails (Default: empty)")
+}
+
+// writeInstance completes the snapshot with the list of the databases dumped, an
+// interrupted snapshot is left without it.
+func writeInstance(dir string, saved instance.Instance, config instance.Config, results []report.DatabaseResult, systemDbs systemBackup) error {
+	for _, result := range results {
+		if result.Status == report.StatusOK {
+			saved.Databases = append(saved.Databases, result.Database)
+			if result.Database == commons.ReplicatorDatabase {
+				saved.ReplicatorRedacted = !systemDbs.keepCredentials
+			}
+		}
+	}
+	return commons.WriteInstance(dir, saved, config)
+}
@@ -0,0 +1,222 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+package cmd
+
+import (
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/instance"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// instanceRestoreCmd represents the instance-restore command
+var instanceRestoreCmd = &cobra.Command{
+	Use:   "instance-restore",
+	Short: "Rebuilds a CouchDB node from a snapshot taken with instance-backup",
+	Long: `Rebuilds a CouchDB node from a snapshot taken with instance-backup: it restores the
+databases, system databases included, and the node config. The replications are restored last,
+so that they do not start before their databases are in place.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, host, password, port := commons.GetAuthFlagValues(cmd)
+		dir, _ := cmd.Flags().GetString("filedir")
+		if commons.CheckFlags(append([]string{}, dir, user, password, host)) {
+			return commons.MissingFlags("instance-restore")
+		}
+
+		policy := commons.GetPolicy(cmd)
+		profileName, _, _ := commons.GetProfile(cmd)
+		config, _ := commons.GetConfig(cmd)
+		if policy.RestoreAllForbidden(config, profileName, host) {
+			slog.Error("instance-restore is forbidden by the policy", "host", host)
+			return commons.NewExitError(commons.ExitUsage, fmt.Errorf("instance-restore is forbidden by the policy on %s", host))
+		}
+		acknowledged, _ := cmd.Flags().GetStringSlice("i-know-what-im-doing")
+		skipConfig, _ := cmd.Flags().GetBool("skip-config")
+		withAdmins, _ := cmd.Flags().GetBool("with-admins")
+		joinNodes, _ := cmd.Flags().GetBool("join-nodes")
+		replicatorPassword, _ := cmd.Flags().GetString("replicator-password")
+
+		saved, savedConfig, err := commons.LoadInstance(dir)
+		if err != nil {
+			slog.Error("error loading the instance snapshot", "dir", dir, "error", err)
+			return err
+		}
+		dumps := instanceDumps(dir, saved)
+
+		membership, err := commons.GetMembership(host, port, user, password)
+		if err != nil {
+			slog.Error("error reading the cluster membership", "host", host, "error", err)
+			return err
+		}
+		missingNodes := commons.MissingNodes(saved.Membership, membership)
+
+		var settings, admins []commons.ConfigChange
+		if !skipConfig {
+			config, err := commons.GetNodeConfig(host, port, user, password)
+			if err != nil {
+				slog.Error("error reading the node config", "host", host, "error", err)
+				return err
+			}
+			// The admins are changed last, the new passwords could differ from the ones of this run
+			for _, change := range commons.NodeConfigChanges(config, savedConfig, withAdmins) {
+				if change.Section == "admins" {
+					admins = append(admins, change)
+				} else {
+					settings = append(settings, change)
+				}
+			}
+		}
+
+		if saved.ReplicatorRedacted {
+			cleanup, err := prepareReplicatorDumps(dumps, replicatorPassword)
+			if err != nil {
+				return err
+			}
+			defer cleanup()
+		}
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			planRestoreAll(host, port, user, password, dumps, policy)
+			planInstanceRestore(host, dir, saved, missingNodes, joinNodes, append(settings, admins...))
+			return nil
+		}
+
+		for _, node := range missingNodes {
+			if !joinNodes {
+				slog.Warn("node of the snapshot missing from the cluster, use --join-nodes to add it", "node", node)
+				continue
+			}
+			if err := commons.JoinNode(host, port, user, password, node); err != nil {
+				slog.Error("error adding the node to the cluster", "node", node, "error", err)
+				return err
+			}
+		}
+		if err := commons.SetNodeConfig(host, port, user, password, settings); err != nil {
+			slog.Error("error restoring the node config", "host", host, "error", err)
+			return err
+		}
+
+		tmpFile, err := scripts.GetEmbeddedScripts()
+		defer os.Remove(tmpFile)
+		if err != nil {
+			slog.Error("error preparing the restore script", "error", err)
+			return err
+		}
+
+		results, errs := restoreDumps(cmd.Context(), tmpFile, host, port, user, password, dumps, policy, acknowledged, commons.ProgressEnabled(cmd), commons.GetHooks(cmd, "restore"))
+		var adminsErr error
+		if cmd.Context().Err() == nil {
+			if adminsErr = commons.SetNodeConfig(host, port, user, password, admins); adminsErr != nil {
+				slog.Error("error restoring the server admins", "host", host, "error", adminsErr)
+			}
+		}
+		commons.PrintResult(results, nil)
+		if err := commons.RunError(results, errs); err != nil {
+			return err
+		}
+		return adminsErr
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(instanceRestoreCmd)
+	instanceRestoreCmd.SetUsageTemplate(`
+Usage: dbackupcli {{.Use}} [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -f, --filedir		The directory containing the snapshot taken with instance-backup
+ -u, --user		The CouchDB username for the auth, it must be a server admin
+ -p, --password		The CouchDB password for the auth
+ --host			The host of the remote CouchDB, with or without 'https://'
+ --port			The port of the remote CouchDB, default is 5984
+ --replicator-password	The password to put in place of the redacted credentials of the replications,
+				without it the replications with redacted credentials are not restored
+ --skip-config		Do not restore the node config
+ --with-admins		Restore also the server admins of the node config, replacing their passwords
+ --join-nodes		Add to the cluster the nodes of the snapshot that are not part of it
+ --i-know-what-im-doing	Comma separated protected databases to restore into without typing their names
+ --dry-run		Print what the restore would do without doing it
+ --no-progress		Show the output of the restore script instead of the progress bars
+ --pre-hook		A shell command run before the restore of each database, a non-zero exit skips it
+ --post-hook		A shell command run after each successful restore
+ --on-error-hook		A shell command run when the restore of a database fails
+
+Examples:
+ dbackupcli instance-restore -f node1-snapshot -u admin -p root --host 127.0.0.1
+ dbackupcli instance-restore -f node1-snapshot -u admin -p root --host 10.0.0.2 --replicator-password secret --with-admins
+`)
+	instanceRestoreCmd.Flags().BoolP("help", "h", false, "Help message")
+	instanceRestoreCmd.Flags().String("host", "", "The remote CouchDB host, can be provided with or without 'https://'")
+	instanceRestoreCmd.Flags().Int("port", 5984, "The remote CouchDB port (Default: 5984)")
+	instanceRestoreCmd.Flags().StringP("filedir", "f", "", "The name of the directory containing the snapshot (Default: empty)")
+	instanceRestoreCmd.Flags().StringP("user", "u", "", "The user to authenticate to the CouchDB (Default: empty)")
+	instanceRestoreCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
+	instanceRestoreCmd.Flags().String("replicator-password", "", "The password of the replications with redacted credentials (Default: empty)")
+	instanceRestoreCmd.Flags().Bool("skip-config", false, "Do not restore the node config (Default: false)")
+	instanceRestoreCmd.Flags().Bool("with-admins", false, "Restore the server admins of the node config (Default: false)")
+	instanceRestoreCmd.Flags().Bool("join-nodes", false, "Add the missing nodes of the snapshot to the cluster (Default: false)")
+	instanceRestoreCmd.Flags().StringSlice("i-know-what-im-doing", nil, "The names of the protected databases to restore into without prompting (Default: empty)")
+	instanceRestoreCmd.Flags().Bool("dry-run", false, "Print the restore plan without executing it (Default: false)")
+	instanceRestoreCmd.Flags().Bool("no-progress", false, "Disable the progress bars (Default: false)")
+	instanceRestoreCmd.Flags().String("pre-hook", "", "The shell command to run before each restore (Default: empty)")
+	instanceRestoreCmd.Flags().String("post-hook", "", "The shell command to run after each successful restore (Default: empty)")
+	instanceRestoreCmd.Flags().String("on-error-hook", "", "The shell command to run when a restore fails (Default: empty)")
+}
+
+// instanceDumps orders the dumps of a snapshot: the system databases first, so that
+// the users exist, and _replicator last, so that the replications find their databases.
+func instanceDumps(dir string, saved instance.Instance) []restoreDump {
+	var system, applications, replicator []restoreDump
+	for _, dbName := range saved.Databases {
+		dump := restoreDump{File: filepath.Join(dir, dbName+".json"), Database: dbName}
+		if _, err := os.Stat(dump.File); err != nil {
+			slog.Warn("dump of the snapshot missing, the database is not restored", "db", dbName, "file", dump.File)
+			continue
+		}
+		switch {
+		case dbName == commons.ReplicatorDatabase:
+			replicator = append(replicator, dump)
+		case commons.IsSystemDatabase(dbName):
+			system = append(system, dump)
+		default:
+			applications = append(applications, dump)
+		}
+	}
+	return append(append(system, applications...), replicator...)
+}
+
+func planInstanceRestore(host string, dir string, saved instance.Instance, missingNodes []string, joinNodes bool, changes []commons.ConfigChange) {
+	nodes := "the same as the snapshot"
+	if len(missingNodes) > 0 {
+		nodes = "missing " + strings.Join(missingNodes, ", ")
+		if joinNodes {
+			nodes += ", they would be added"
+		}
+	}
+	config := "nothing to change"
+	if len(changes) > 0 {
+		keys := make([]string, len(changes))
+		for i, change := range changes {
+			keys[i] = change.Section + "/" + change.Key
+		}
+		config = strings.Join(keys, ", ")
+	}
+	replications := "restored with their credentials"
+	if saved.ReplicatorRedacted {
+		replications = "credentials redacted, filled with --replicator-password or not restored"
+	}
+	commons.PrintPlan("Instance restore of "+dir+" on "+host+":", []commons.PlanStep{
+		{Name: "Snapshot", Value: fmt.Sprintf("%s, CouchDB %s, taken at %s", saved.Host, saved.CouchDBVersion, saved.CreatedAt.Format("2006-01-02 15:04:05"))},
+		{Name: "Cluster nodes", Value: nodes},
+		{Name: "Node config", Value: config},
+		{Name: "Replications", Value: replications},
+	})
+}
@@ -6,8 +6,9 @@ package cmd
 
 import (
 	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/struct/report"
 	"fmt"
-	"os"
+	"log/slog"
 
 	"github.com/spf13/cobra"
 )
@@ -17,23 +18,27 @@ var listCmd = &cobra.Command{
 	Use:   "listdbs",
 	Short: "List the databases contained in the specified CouchDB",
 	Long:  `List the databases contained in the specified CouchDB`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		user, host, password, port := commons.GetAuthFlagValues(cmd)
 		if commons.CheckFlags(append([]string{}, user, password, host)) {
-			fmt.Println("missing on or more flags/arguments\n\nCheck using 'dbackupcli backup -h'")
-			os.Exit(1)
+			return commons.MissingFlags("listdbs")
 		}
 
 		dbNames, err := commons.GetDBs(host, port, user, password)
 		if err != nil {
-			fmt.Println(err)
-			return
+			slog.Error("error listing the databases", "host", host, "error", err)
+			return err
 		}
 
-		if dbNames != nil {
-			fmt.Printf("Found %d databases\n", len(dbNames))
-			fmt.Println("List of databases: \n", dbNames)
-		}
+		result := report.DatabaseList{Host: host, Count: len(dbNames), Databases: dbNames}
+		commons.PrintResult(result, func() {
+			fmt.Fprintf(commons.Out, "Found %d databases\n", len(dbNames))
+			fmt.Fprintln(commons.Out, "List of databases:")
+			for _, db := range dbNames {
+				fmt.Fprintln(commons.Out, " "+db)
+			}
+		})
+		return nil
 	},
 }
 
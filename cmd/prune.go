@@ -0,0 +1,189 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+package cmd
+
+import (
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/struct/report"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Removes the old backups of a repository and the attachments no longer used",
+	Long: `Removes the oldest backups of a repository beyond --keep-last, then removes from its
+blob store the attachments that no retained backup references any more.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, _ := cmd.Flags().GetString("filedir")
+		if commons.CheckFlags([]string{dir}) {
+			return commons.MissingFlags("prune")
+		}
+		store, _ := cmd.Flags().GetString("blob-store")
+		if store == "" {
+			store = filepath.Join(dir, commons.BlobStoreDir)
+		}
+		keepLast, _ := cmd.Flags().GetInt("keep-last")
+		grace, _ := cmd.Flags().GetDuration("grace")
+		if keepLast < 0 || grace < 0 {
+			slog.Error("--keep-last and --grace cannot be negative", "keep-last", keepLast, "grace", grace.String())
+			return commons.NewExitError(commons.ExitUsage, errors.New("invalid retention"))
+		}
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+		lock, err := commons.AcquireLock(store + commons.LockSuffix)
+		if err != nil {
+			slog.Error("error locking the blob store", "dir", store, "error", err)
+			return err
+		}
+		defer lock.Release()
+
+		backups, err := listBackups(dir, store)
+		if err != nil {
+			slog.Error("error listing the backups", "dir", dir, "error", err)
+			return err
+		}
+		result := report.PruneResult{Repository: dir, DryRun: dryRun, RemovedBackups: []string{}, KeptBackups: len(backups)}
+		if keepLast > 0 && len(backups) > keepLast {
+			for _, backup := range backups[:len(backups)-keepLast] {
+				if !dryRun {
+					if err := backup.remove(); err != nil {
+						slog.Error("error removing the backup", "backup", backup.name, "error", err)
+						return err
+					}
+					slog.Info("backup removed", "backup", backup.name)
+				}
+				result.RemovedBackups = append(result.RemovedBackups, backup.name)
+			}
+			result.KeptBackups = keepLast
+		}
+
+		if _, err := os.Stat(store); err == nil {
+			skip := []string{store}
+			if dryRun {
+				// The dumps of the backups that would be removed do not count
+				for _, backup := range backups[:len(result.RemovedBackups)] {
+					skip = append(skip, backup.paths...)
+				}
+			}
+			referenced, err := commons.ReferencedBlobs(dir, skip...)
+			if err != nil {
+				slog.Error("error reading the backups", "dir", dir, "error", err)
+				return err
+			}
+			garbage, err := commons.CollectBlobs(store, referenced, grace, dryRun)
+			if err != nil {
+				slog.Error("error collecting the blobs", "dir", store, "error", err)
+				return err
+			}
+			result.RemovedBlobs, result.FreedBytes, result.KeptBlobs = garbage.Removed, garbage.Bytes, garbage.Kept
+		} else if !os.IsNotExist(err) {
+			slog.Error("error reading the blob store", "dir", store, "error", err)
+			return err
+		}
+
+		slog.Info("prune completed", "dir", dir, "backups_removed", len(result.RemovedBackups), "blobs_removed", result.RemovedBlobs,
+			"bytes", result.FreedBytes, "dry_run", dryRun)
+		commons.PrintResult(result, func() {
+			verb := "Removed"
+			if dryRun {
+				fmt.Fprintln(commons.Out, commons.DryRunBanner)
+				verb = "Would remove"
+			}
+			fmt.Fprintf(commons.Out, "%s %d backups, kept %d\n", verb, len(result.RemovedBackups), result.KeptBackups)
+			for _, name := range result.RemovedBackups {
+				fmt.Fprintln(commons.Out, " "+name)
+			}
+			fmt.Fprintf(commons.Out, "%s %d unreferenced attachments (%s), kept %d\n", verb, result.RemovedBlobs, commons.FormatBytes(result.FreedBytes), result.KeptBlobs)
+		})
+		return nil
+	},
+}
+
+// repositoryBackup is a backup of a repository: the directory of a run of backupAll,
+// instance-backup or daemon, or a dump with its sidecars.
+type repositoryBackup struct {
+	name    string
+	paths   []string
+	modTime time.Time
+}
+
+func (b repositoryBackup) remove() error {
+	for _, path := range b.paths {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBackups lists the backups of the repository from the oldest to the newest.
+func listBackups(dir string, store string) ([]repositoryBackup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []repositoryBackup
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		backup := repositoryBackup{name: entry.Name(), paths: []string{path}}
+		switch {
+		case entry.IsDir() && (path == filepath.Clean(store) || strings.HasSuffix(entry.Name(), commons.AttachmentsSuffix)):
+			continue
+		case entry.IsDir():
+		case commons.IsDumpFile(entry.Name()):
+			backup.paths = append(backup.paths, commons.ManifestFile(path), commons.AttachmentsDir(path))
+		default:
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		backup.modTime = info.ModTime()
+		backups = append(backups, backup)
+	}
+	slices.SortFunc(backups, func(a, b repositoryBackup) int {
+		return a.modTime.Compare(b.modTime)
+	})
+	return backups, nil
+}
+
+func init() {
+	rootCmd.AddCommand(pruneCmd)
+	pruneCmd.SetUsageTemplate(`
+Usage: dbackupcli {{.Use}} [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -f, --filedir		The repository: the directory of the backups sharing a blob store
+ --blob-store		The blob store of the repository, default is <filedir>/blobs
+ --keep-last		The number of most recent backups to keep, default is 0 to keep them all
+ --grace		The attachments changed more recently are kept, as a running backup may be
+			using them, default is 24h
+ --dry-run		Print what prune would remove without removing it
+
+The backups of the repository are the sub directories of the runs of backupAll, instance-backup
+and daemon and the dumps with their manifests, ordered by modification time.
+
+Examples:
+ dbackupcli prune -f backups --keep-last 7
+ dbackupcli prune -f backups --keep-last 30 --dry-run
+`)
+	pruneCmd.Flags().BoolP("help", "h", false, "Help message")
+	pruneCmd.Flags().StringP("filedir", "f", "", "The directory of the backups to prune (Default: empty)")
+	pruneCmd.Flags().String("blob-store", "", "The blob store of the repository (Default: <filedir>/blobs)")
+	pruneCmd.Flags().Int("keep-last", 0, "The number of most recent backups to keep, 0 keeps them all (Default: 0)")
+	pruneCmd.Flags().Duration("grace", 24*time.Hour, "Keep the attachments changed within this time (Default: 24h)")
+	pruneCmd.Flags().Bool("dry-run", false, "Print what would be removed without removing it (Default: false)")
+}
@@ -0,0 +1,68 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package cmd
+
+import (
+	"dbackupcli/cmd/commons"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestListBackups(t *testing.T) {
+	dir := t.TempDir()
+	store := filepath.Join(dir, commons.BlobStoreDir)
+	now := time.Now()
+	files := []struct {
+		name string
+		dir  bool
+		age  time.Duration
+	}{
+		{"2025-01-02", true, 2 * time.Hour},
+		{"2025-01-01", true, 3 * time.Hour},
+		{"db.json", false, time.Hour},
+		{"db.manifest.json", false, time.Hour},
+		{"db.json" + commons.AttachmentsSuffix, true, time.Hour},
+		{commons.BlobStoreDir, true, 5 * time.Hour},
+		{"notes.txt", false, 4 * time.Hour},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		var err error
+		if file.dir {
+			err = os.Mkdir(path, 0755)
+		} else {
+			err = os.WriteFile(path, []byte("{}"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-file.age), now.Add(-file.age))
+	}
+
+	backups, err := listBackups(dir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, backup := range backups {
+		names = append(names, backup.name)
+	}
+	if want := []string{"2025-01-01", "2025-01-02", "db.json"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("listBackups() = %v, want %v", names, want)
+	}
+
+	// Removing a dump removes its sidecars with it
+	if err := backups[2].remove(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"db.json", "db.manifest.json", "db.json" + commons.AttachmentsSuffix} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed with the backup", name)
+		}
+	}
+}
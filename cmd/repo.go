@@ -0,0 +1,366 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+package cmd
+
+import (
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/scripts"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// repoCmd represents the repo command
+var repoCmd = &cobra.Command{
+	Use:   "repo",
+	Short: "Manages a deduplicating repository of backups",
+	Long: `Manages a repository where the backups are cut in content-defined chunks, stored
+once each compressed, so that many snapshots of a slowly changing database cost little
+more than one.`,
+}
+
+// repoInitCmd represents the repo init command
+var repoInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Creates an empty repository",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		location, _ := cmd.Flags().GetString("repo")
+		if commons.CheckFlags([]string{location}) {
+			return commons.MissingFlags("repo init")
+		}
+		repo, err := commons.InitRepository(location)
+		if err != nil {
+			slog.Error("error creating the repository", "repo", location, "error", err)
+			return err
+		}
+		slog.Info("repository created", "repo", location, "id", repo.Config.ID[:commons.ShortIDLength])
+		commons.PrintResult(repo.Config, func() {
+			fmt.Fprintf(commons.Out, "Created repository %s in %s\n", repo.Config.ID[:commons.ShortIDLength], location)
+		})
+		return nil
+	},
+}
+
+// repoBackupCmd represents the repo backup command
+var repoBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Stores a dump or a backup directory as a new snapshot",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		location, _ := cmd.Flags().GetString("repo")
+		if commons.CheckFlags([]string{location}) || len(args) != 1 {
+			return commons.MissingFlags("repo backup")
+		}
+		tags, _ := cmd.Flags().GetStringSlice("tag")
+		repo, err := commons.OpenRepository(location)
+		if err != nil {
+			slog.Error("error opening the repository", "repo", location, "error", err)
+			return err
+		}
+		snapshot, err := repo.Backup(args[0], tags)
+		if err != nil {
+			slog.Error("error storing the snapshot", "repo", location, "source", args[0], "error", err)
+			return err
+		}
+		slog.Info("snapshot stored", "repo", location, "snapshot", snapshot.ID[:commons.ShortIDLength], "files", len(snapshot.Files),
+			"bytes", snapshot.Size, "added", snapshot.Added)
+		commons.PrintResult(snapshot, func() {
+			fmt.Fprintf(commons.Out, "Snapshot %s stored: %d files, %s, %s added to the repository\n", snapshot.ID[:commons.ShortIDLength],
+				len(snapshot.Files), commons.FormatBytes(snapshot.Size), commons.FormatBytes(snapshot.Added))
+		})
+		return nil
+	},
+}
+
+// repoSnapshotsCmd represents the repo snapshots command
+var repoSnapshotsCmd = &cobra.Command{
+	Use:   "snapshots",
+	Short: "Lists the snapshots of a repository",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		location, _ := cmd.Flags().GetString("repo")
+		if commons.CheckFlags([]string{location}) {
+			return commons.MissingFlags("repo snapshots")
+		}
+		repo, err := commons.OpenRepository(location)
+		if err != nil {
+			slog.Error("error opening the repository", "repo", location, "error", err)
+			return err
+		}
+		snapshots, err := repo.Snapshots()
+		if err != nil {
+			slog.Error("error listing the snapshots", "repo", location, "error", err)
+			return err
+		}
+		commons.PrintResult(snapshots, func() {
+			fmt.Fprintf(commons.Out, "%-8s  %-20s  %-16s  %10s  %10s  %s\n", "ID", "Time", "Host", "Size", "Added", "Source")
+			for _, snapshot := range snapshots {
+				source := snapshot.Source
+				if len(snapshot.Tags) > 0 {
+					source += " [" + strings.Join(snapshot.Tags, ",") + "]"
+				}
+				fmt.Fprintf(commons.Out, "%-8s  %-20s  %-16s  %10s  %10s  %s\n", snapshot.ID[:commons.ShortIDLength], snapshot.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+					snapshot.Hostname, commons.FormatBytes(snapshot.Size), commons.FormatBytes(snapshot.Added), source)
+			}
+			fmt.Fprintf(commons.Out, "%d snapshots\n", len(snapshots))
+		})
+		return nil
+	},
+}
+
+// repoRestoreCmd represents the repo restore command
+var repoRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Restores a snapshot into CouchDB or into a directory",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		location, _ := cmd.Flags().GetString("repo")
+		if commons.CheckFlags([]string{location}) || len(args) != 1 {
+			return commons.MissingFlags("repo restore")
+		}
+		target, _ := cmd.Flags().GetString("target")
+		user, host, password, port := commons.GetAuthFlagValues(cmd)
+		if target == "" && commons.CheckFlags([]string{user, password, host}) {
+			return commons.MissingFlags("repo restore")
+		}
+
+		repo, err := commons.OpenRepository(location)
+		if err != nil {
+			slog.Error("error opening the repository", "repo", location, "error", err)
+			return err
+		}
+		snapshot, err := repo.FindSnapshot(args[0])
+		if err != nil {
+			slog.Error("error finding the snapshot", "repo", location, "snapshot", args[0], "error", err)
+			return err
+		}
+		if target != "" {
+			if err := repo.Extract(snapshot, target); err != nil {
+				slog.Error("error restoring the snapshot", "snapshot", snapshot.ID[:commons.ShortIDLength], "target", target, "error", err)
+				return err
+			}
+			slog.Info("snapshot restored", "snapshot", snapshot.ID[:commons.ShortIDLength], "target", target, "files", len(snapshot.Files))
+			fmt.Fprintf(commons.Out, "Restored %d files of snapshot %s in %s\n", len(snapshot.Files), snapshot.ID[:commons.ShortIDLength], target)
+			return nil
+		}
+
+		policy := commons.GetPolicy(cmd)
+		profileName, _, _ := commons.GetProfile(cmd)
+		config, _ := commons.GetConfig(cmd)
+		if policy.RestoreAllForbidden(config, profileName, host) {
+			slog.Error("the restore of a snapshot is forbidden by the policy", "host", host)
+			return commons.NewExitError(commons.ExitUsage, fmt.Errorf("restoreAll is forbidden by the policy on %s", host))
+		}
+		acknowledged, _ := cmd.Flags().GetStringSlice("i-know-what-im-doing")
+		prefix, _ := cmd.Flags().GetString("target-prefix")
+		suffix, _ := cmd.Flags().GetString("target-suffix")
+		mappings, _ := cmd.Flags().GetStringArray("map")
+		mapper, err := commons.NewNameMapper(prefix, suffix, mappings, "")
+		if err != nil {
+			slog.Error("invalid name mapping", "error", err)
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+
+		dir, err := os.MkdirTemp("", "dbackupcli-snapshot-")
+		if err != nil {
+			slog.Error("error creating the temporary directory", "error", err)
+			return err
+		}
+		defer os.RemoveAll(dir)
+		if err := repo.Extract(snapshot, dir); err != nil {
+			slog.Error("error restoring the snapshot", "snapshot", snapshot.ID[:commons.ShortIDLength], "error", err)
+			return err
+		}
+		dumps, err := listRestoreDumps(dir, mapper)
+		if err != nil {
+			return err
+		}
+		if len(dumps) == 0 {
+			slog.Error("the snapshot has no dumps", "snapshot", snapshot.ID[:commons.ShortIDLength])
+			return commons.NewExitError(commons.ExitUsage, errors.New("no dumps to restore"))
+		}
+		replicatorPassword, _ := cmd.Flags().GetString("replicator-password")
+		cleanup, err := prepareReplicatorDumps(dumps, replicatorPassword)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			planRestoreAll(host, port, user, password, dumps, policy)
+			return nil
+		}
+
+		tmpFile, err := scripts.GetEmbeddedScripts()
+		defer os.Remove(tmpFile)
+		if err != nil {
+			slog.Error("error preparing the restore script", "error", err)
+			return err
+		}
+		results, errs := restoreDumps(cmd.Context(), tmpFile, host, port, user, password, dumps, policy, acknowledged, commons.ProgressEnabled(cmd), commons.GetHooks(cmd, "restore"))
+		commons.PrintResult(results, nil)
+		return commons.RunError(results, errs)
+	},
+}
+
+// repoCheckCmd represents the repo check command
+var repoCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Verifies the integrity of a repository",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		location, _ := cmd.Flags().GetString("repo")
+		if commons.CheckFlags([]string{location}) {
+			return commons.MissingFlags("repo check")
+		}
+		readData, _ := cmd.Flags().GetBool("read-data")
+		repo, err := commons.OpenRepository(location)
+		if err != nil {
+			slog.Error("error opening the repository", "repo", location, "error", err)
+			return err
+		}
+		result, err := repo.Check(readData)
+		if err != nil {
+			slog.Error("error checking the repository", "repo", location, "error", err)
+			return err
+		}
+		for _, problem := range result.Errors {
+			slog.Error("repository check", "repo", location, "error", problem)
+		}
+		commons.PrintResult(result, func() {
+			fmt.Fprintf(commons.Out, "%d snapshots, %d chunks, %d unused\n", result.Snapshots, result.Chunks, result.Unused)
+			if len(result.Errors) == 0 {
+				fmt.Fprintln(commons.Out, "No errors found")
+			}
+			for _, problem := range result.Errors {
+				fmt.Fprintln(commons.Out, " "+problem)
+			}
+		})
+		if len(result.Errors) > 0 {
+			return commons.NewExitError(commons.ExitVerification, fmt.Errorf("%d errors found in the repository %s", len(result.Errors), location))
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(repoCmd)
+	repoCmd.AddCommand(repoInitCmd, repoBackupCmd, repoSnapshotsCmd, repoRestoreCmd, repoCheckCmd)
+	repoCmd.SetUsageTemplate(`
+Usage: dbackupcli repo <command> [flags]
+
+Commands:
+ init			Create an empty repository
+ backup <path>		Store a dump or a backup directory as a new snapshot
+ snapshots		List the snapshots of the repository
+ restore <snapshot-id>	Restore a snapshot into CouchDB or into a directory
+ check			Verify the integrity of the repository
+
+The files are cut in chunks at boundaries chosen by their content, so a database
+changed here and there shares most of its chunks with the previous snapshot. Each chunk is stored once, compressed with gzip, under chunks/ named
+by its SHA-256. Only local directories are supported as repositories.
+
+Examples:
+ dbackupcli repo init -r /srv/repo
+ dbackupcli backupAll -f nightly --profile prod && dbackupcli repo backup -r /srv/repo nightly
+ dbackupcli repo restore -r /srv/repo latest --profile staging
+`)
+	for _, command := range []*cobra.Command{repoInitCmd, repoBackupCmd, repoSnapshotsCmd, repoRestoreCmd, repoCheckCmd} {
+		command.Flags().BoolP("help", "h", false, "Help message")
+		command.Flags().StringP("repo", "r", "", "The directory of the repository (Default: empty)")
+	}
+
+	repoInitCmd.SetUsageTemplate(`
+Usage: dbackupcli repo init [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -r, --repo		The directory of the repository to create
+
+Examples:
+ dbackupcli repo init -r /srv/repo
+`)
+
+	repoBackupCmd.SetUsageTemplate(`
+Usage: dbackupcli repo backup <path> [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -r, --repo		The directory of the repository
+ --tag			A tag of the snapshot, can be repeated
+
+The path is a dump, with its manifest and attachments when they are next to it,
+or a directory written by backupAll, instance-backup or daemon.
+
+Examples:
+ dbackupcli repo backup -r /srv/repo nightly
+ dbackupcli repo backup -r /srv/repo my-db.json --tag before-migration
+`)
+	repoBackupCmd.Flags().StringSlice("tag", nil, "The tags of the snapshot (Default: empty)")
+
+	repoSnapshotsCmd.SetUsageTemplate(`
+Usage: dbackupcli repo snapshots [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -r, --repo		The directory of the repository
+
+Examples:
+ dbackupcli repo snapshots -r /srv/repo
+ dbackupcli repo snapshots -r /srv/repo --output json
+`)
+
+	repoRestoreCmd.SetUsageTemplate(`
+Usage: dbackupcli repo restore <snapshot-id> [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -r, --repo		The directory of the repository
+ --target		Write the files of the snapshot in this directory instead of restoring them
+ --i-know-what-im-doing	Comma separated protected databases to restore into without typing their names
+ --target-prefix	A prefix to add to the name of every restored database
+ --target-suffix	A suffix to add to the name of every restored database
+ --map			Restore the dump of a database into another one (e.g. --map old=new), can be repeated
+ --replicator-password	The password to put in place of the redacted credentials of the replications,
+				without it the replications with redacted credentials are not restored
+ --dry-run		Print what the restore would do without doing it
+ --no-progress		Show the output of the restore script instead of the progress bars
+ -u, --user		The CouchDB username for the auth
+ -p, --password		The CouchDB password for the auth
+ --host			The host of the remote CouchDB, with or without 'https://'
+ --port			The port of the remote CouchDB, default is 5984
+
+The snapshot ID can be shortened to any unique prefix, latest is the most recent one.
+The dumps of the snapshot are restored like restoreAll does.
+
+Examples:
+ dbackupcli repo restore -r /srv/repo 3f2a9c1e -u admin -p root --host 127.0.0.1
+ dbackupcli repo restore -r /srv/repo latest --target restored
+`)
+	repoRestoreCmd.Flags().String("target", "", "The directory where to write the files of the snapshot (Default: empty)")
+	repoRestoreCmd.Flags().String("host", "", "The remote CouchDB host, can be provided with or without 'https://'")
+	repoRestoreCmd.Flags().Int("port", 5984, "The remote CouchDB port (Default: 5984)")
+	repoRestoreCmd.Flags().StringP("user", "u", "", "The user to authenticate to the CouchDB (Default: empty)")
+	repoRestoreCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
+	repoRestoreCmd.Flags().StringSlice("i-know-what-im-doing", nil, "The names of the protected databases to restore into without prompting (Default: empty)")
+	repoRestoreCmd.Flags().String("target-prefix", "", "The prefix to add to the restored database names (Default: empty)")
+	repoRestoreCmd.Flags().String("target-suffix", "", "The suffix to add to the restored database names (Default: empty)")
+	repoRestoreCmd.Flags().StringArray("map", nil, "Restore a database into another one, as old=new (Default: empty)")
+	repoRestoreCmd.Flags().String("replicator-password", "", "The password of the replications with redacted credentials (Default: empty)")
+	repoRestoreCmd.Flags().Bool("dry-run", false, "Print the restore plan without executing it (Default: false)")
+	repoRestoreCmd.Flags().Bool("no-progress", false, "Disable the progress bars (Default: false)")
+
+	repoCheckCmd.SetUsageTemplate(`
+Usage: dbackupcli repo check [flags]
+
+Flags:
+ -h, --help		Show this help message
+ -r, --repo		The directory of the repository
+ --read-data		Also read every chunk back and check it against its SHA-256
+
+Examples:
+ dbackupcli repo check -r /srv/repo --read-data
+`)
+	repoCheckCmd.Flags().Bool("read-data", false, "Read and verify the content of every chunk (Default: false)")
+}
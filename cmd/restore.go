@@ -5,78 +5,332 @@ package cmd
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"dbackupcli/cmd/commons"
 	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/couchdb"
+	"dbackupcli/cmd/struct/manifest"
+	"dbackupcli/cmd/struct/report"
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
 )
 
+const (
+	modeReplace      = "replace"
+	modeMerge        = "merge"
+	modeSkipExisting = "skip-existing"
+	modeNewerWins    = "newer-wins"
+	modeFail         = "fail"
+)
+
+var restoreModes = []string{modeReplace, modeMerge, modeSkipExisting, modeNewerWins, modeFail}
+
 // restoreCouchdbCmd represents the restoreCouchdb command
 var restoreCmd = &cobra.Command{
 	Use:   "restore",
 	Short: "Operates a restore of a dump file in a database on CouchDB",
 	Long:  `Operates a restore of a dump.json in the specified database on a certain CouchDB.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, host, password, port := commons.GetAuthFlagValues(cmd)
+		database, _ := cmd.Flags().GetString("database")
+		file, _ := cmd.Flags().GetString("file")
+		if commons.CheckFlags(append([]string{}, database, file, user, password, host)) {
+			return commons.MissingFlags("restore")
+		}
+		sourceFile := file
+
+		if err := commons.ValidateDatabaseName(database); err != nil {
+			slog.Error("invalid target database", "db", database, "error", err)
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+
+		mode, _ := cmd.Flags().GetString("mode")
+		if !slices.Contains(restoreModes, mode) {
+			slog.Error("invalid mode, must be one of: "+strings.Join(restoreModes, ", "), "mode", mode)
+			return commons.NewExitError(commons.ExitUsage, fmt.Errorf("invalid mode %q", mode))
+		}
+
+		ids, _ := cmd.Flags().GetStringSlice("ids")
+		idsFile, _ := cmd.Flags().GetString("ids-file")
+		idPrefix, _ := cmd.Flags().GetString("id-prefix")
+		selector, _ := cmd.Flags().GetString("selector")
+		filter, err := commons.NewDocumentFilter(ids, idsFile, idPrefix, selector)
+		if err != nil {
+			slog.Error("invalid document filter", "error", err)
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+
+		protected := commons.GetPolicy(cmd).IsProtected(host, database)
+		if filter.Active() {
+			return partialRestore(cmd, filter, file, host, port, user, password, database, protected)
+		}
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			planRestore(mode, file, host, port, user, password, database, protected, commons.GetSafetyDir(cmd))
+			return nil
+		}
+
 		tmpFile, err := scripts.GetEmbeddedScripts()
 		defer os.Remove(tmpFile)
 		if err != nil {
-			fmt.Println(err)
-			return
+			slog.Error("error preparing the restore script", "error", err)
+			return err
 		}
 
-		user, host, password, port := commons.GetAuthFlagValues(cmd)
-		database, _ := cmd.Flags().GetString("database")
-		file, _ := cmd.Flags().GetString("file")
-		if commons.CheckFlags(append([]string{}, database, file, user, password, host)) {
-			fmt.Println("missing on or more flags/arguments\n\nCheck using 'dbackupcli couchdb backup -h'")
-			os.Exit(1)
+		lock, err := commons.LockDatabase(host, port, database)
+		if err != nil {
+			slog.Error("error locking the database", "db", database, "host", host, "error", err)
+			return err
+		}
+		defer lock.Release()
+
+		if protected {
+			acknowledged, _ := cmd.Flags().GetStringSlice("i-know-what-im-doing")
+			if err := commons.ConfirmTypedName(database, acknowledged); err != nil {
+				slog.Error("restore not confirmed", "db", database, "host", host, "error", err)
+				return err
+			}
 		}
 
 		statusCode, Database, err := commons.GetDB(host, port, user, password, database)
+		if err != nil && statusCode != 404 {
+			slog.Error("error reading the database info", "db", database, "host", host, "error", err)
+			return err
+		}
+
+		if Database.DocCount != 0 {
+			switch mode {
+			case modeReplace:
+				if !protected {
+					fmt.Fprintf(commons.Out, "Database %s already exists. Do you want to overwrite it? (y/n): ", Database.DbName)
+					reader := bufio.NewReader(os.Stdin)
+					input, _ := reader.ReadString('\n')
+					input = strings.TrimSpace(input)
+
+					if input != "y" && input != "Y" {
+						return commons.UserAbort("operation canceled. The database will not be overwritten")
+					}
+				}
+			case modeFail:
+				slog.Error("database already exists and is not empty, stopping", "db", database, "host", host, "docs", Database.DocCount)
+				return fmt.Errorf("database %s already exists and is not empty", database)
+			}
+		}
+
+		settings, hasSettings, err := commons.LoadManifest(sourceFile)
 		if err != nil {
-			fmt.Printf("%v", err)
+			slog.Error("error reading the database settings", "db", database, "file", sourceFile, "error", err)
+			return err
+		}
+
+		result := report.DatabaseResult{Operation: "restore", Host: host, Database: database, File: sourceFile}
+		result.Documents, _, _, _ = commons.CountDumpDocs(file)
+		hooks := commons.GetHooks(cmd, "restore")
+		if err := hooks.Before(result); err != nil {
+			slog.Error("restore aborted", "db", database, "host", host, "phase", "pre-hook", "error", err)
+			return hooks.After(result, err)
 		}
 
+		// The design documents already in the database, put apart from the restore script
+		var designs existingDesigns
 		if Database.DocCount != 0 {
-			if statusCode == 200 {
-				fmt.Printf("Database %s already exists. Do you want to overwrite it? (y/n): ", Database.DbName)
-				reader := bufio.NewReader(os.Stdin)
-				input, _ := reader.ReadString('\n')
-				input = strings.TrimSpace(input)
-
-				if input != "y" && input != "Y" {
-					fmt.Printf("operation canceled. The database will not be overwritten")
-					return
+			switch mode {
+			case modeReplace:
+				if safetyDir := commons.GetSafetyDir(cmd); safetyDir != "" {
+					fmt.Fprintf(commons.Out, "Taking a safety snapshot of %s in %s...\n", Database.DbName, safetyDir)
+					snapshot, err := commons.CreateSafetySnapshot(cmd.Context(), tmpFile, safetyDir, host, port, user, password, Database)
+					if err != nil {
+						slog.Error("error taking the safety snapshot", "db", database, "host", host, "phase", "snapshot", "error", err)
+						return hooks.After(result, err)
+					}
+					slog.Info("safety snapshot saved", "db", database, "host", host, "phase", "snapshot", "snapshot", snapshot.ID, "file", snapshot.File)
+					fmt.Fprintf(commons.Out, "Safety snapshot %s saved to %s\n", snapshot.ID, snapshot.File)
+					fmt.Fprintf(commons.Out, "Use 'dbackupcli undo-restore %s' to put it back\n", snapshot.ID)
 				}
-				fmt.Println("Overwriting database...")
+				fmt.Fprintln(commons.Out, "Overwriting database...")
 				if err := commons.DeleteDatabase(host, port, user, password, database); err != nil {
-					fmt.Printf("%v", err)
-					return
+					slog.Error("error deleting the database", "db", database, "host", host, "phase", "delete", "error", err)
+					return hooks.After(result, err)
 				}
-			} else {
-				fmt.Printf("%v", err)
-				return
+			case modeMerge, modeSkipExisting, modeNewerWins:
+				if mode == modeMerge {
+					fmt.Fprintf(commons.Out, "Merging dump into the existing database %s...\n", Database.DbName)
+				}
+				filtered, err := filterDumpForMode(mode, file, host, port, user, password, database, &designs)
+				if filtered != "" {
+					defer os.Remove(filtered)
+				}
+				if err != nil {
+					slog.Error("error filtering the dump", "db", database, "host", host, "phase", "filter", "error", err)
+					return hooks.After(result, err)
+				}
+				file = filtered
+			}
+		}
+
+		if hasSettings {
+			if err := createFromManifest(settings, host, port, user, password, database); err != nil {
+				slog.Error("error creating the database", "db", database, "host", host, "phase", "create", "error", err)
+				return hooks.After(result, err)
 			}
 		}
 
-		var cmdArgs []string = []string{"-r", "-d", database, "-f", file, "-c"}
+		var cmdArgs []string = []string{"-r", "-d", database, "-c"}
 		cmdArgs = commons.PrepareCmdAuthArgs(cmdArgs, user, password, host, port)
+		progress := commons.ProgressEnabled(cmd)
+		if progress {
+			cmdArgs = append(cmdArgs, "-q")
+		}
 
-		cmdExec := exec.Command("bash", append([]string{tmpFile}, cmdArgs...)...)
-		cmdExec.Stderr = os.Stderr
-		cmdExec.Stdout = os.Stdout
-		if err := cmdExec.Run(); err != nil {
-			fmt.Println("Error: ", err)
-		} else {
-			fmt.Println("Restore completed successfully!")
+		result.Documents, _, _, _ = commons.CountDumpDocs(file)
+		started := time.Now()
+		slog.Info("restore started", "db", database, "host", host, "phase", "start", "file", result.File, "mode", mode)
+
+		stopProgress := func() {}
+		if progress {
+			stopProgress = startRestoreProgress(nil, file, host, port, user, password, database)
 		}
+		err = runRestore(cmd.Context(), tmpFile, cmdArgs, file, sourceFile, host, port, user, password, database)
+		stopProgress()
+		if err == nil && len(designs.docs) > 0 {
+			attachmentsDir, _ := commons.AttachmentsLocation(sourceFile)
+			var count int
+			count, err = commons.PutDesignDocs(host, port, user, password, database, designs.docs, designs.revs, attachmentsDir)
+			result.Documents += count
+			slog.Info("existing design documents replaced", "db", database, "host", host, "phase", "designs", "docs", count)
+		}
+		if err == nil && hasSettings {
+			err = commons.ApplyManifest(host, port, user, password, database, settings)
+		}
+		if err == nil {
+			err = verifyRestore(&result, sourceFile, host, port, user, password)
+		}
+		err = hooks.After(result, err)
+		commons.FinishResult(&result, started, err)
+		commons.PrintResult(result, func() {
+			if err != nil {
+				fmt.Fprintln(commons.Out, "Error: ", err)
+			} else {
+				fmt.Fprintln(commons.Out, "Restore completed successfully!")
+			}
+		})
+		return err
 	},
 }
 
+// partialRestore puts back into an existing database only the documents of the dump
+// chosen by the filter, as new revisions on top of the current ones, after showing
+// how they differ from the documents in the database.
+func partialRestore(cmd *cobra.Command, filter commons.DocumentFilter, file string, host string, port int, user string, password string, database string, protected bool) error {
+	statusCode, _, err := commons.GetDB(host, port, user, password, database)
+	if statusCode == 404 {
+		slog.Error("database not found, a partial restore needs an existing database", "db", database, "host", host)
+		return commons.NewExitError(commons.ExitUsage, fmt.Errorf("database %s does not exist, restore the whole dump instead", database))
+	}
+	if err != nil {
+		slog.Error("error reading the database info", "db", database, "host", host, "error", err)
+		return err
+	}
+
+	docs, err := commons.SelectDumpDocuments(file, filter)
+	if err != nil {
+		slog.Error("error reading the dump", "file", file, "error", err)
+		return err
+	}
+	changes, err := commons.DiffDocuments(host, port, user, password, database, docs)
+	if err != nil {
+		slog.Error("error comparing the documents", "db", database, "host", host, "error", err)
+		return err
+	}
+	var pending int
+	for _, change := range changes {
+		if change.Action != commons.ChangeUnchanged {
+			pending++
+		}
+	}
+
+	printDiff := func() {
+		fmt.Fprintf(commons.Out, "%d documents of %s match, %d would be restored into %s:\n", len(changes), file, pending, database)
+		commons.PrintDiff(changes)
+	}
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		commons.PrintResult(changes, func() {
+			fmt.Fprintln(commons.Out, commons.DryRunBanner)
+			printDiff()
+		})
+		return nil
+	}
+	printDiff()
+	if pending == 0 {
+		return nil
+	}
+
+	lock, err := commons.LockDatabase(host, port, database)
+	if err != nil {
+		slog.Error("error locking the database", "db", database, "host", host, "error", err)
+		return err
+	}
+	defer lock.Release()
+
+	if protected {
+		acknowledged, _ := cmd.Flags().GetStringSlice("i-know-what-im-doing")
+		if err := commons.ConfirmTypedName(database, acknowledged); err != nil {
+			slog.Error("restore not confirmed", "db", database, "host", host, "error", err)
+			return err
+		}
+	} else if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+		if !isatty.IsTerminal(os.Stdin.Fd()) {
+			return commons.NewExitError(commons.ExitUsage, fmt.Errorf("pass --yes to restore the documents in non-interactive mode"))
+		}
+		fmt.Fprintf(commons.Out, "Do you want to restore these %d documents? (y/n): ", pending)
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+
+		if input != "y" && input != "Y" {
+			return commons.UserAbort("operation canceled. The documents will not be restored")
+		}
+	}
+
+	result := report.DatabaseResult{Operation: "restore", Host: host, Database: database, File: file, Documents: pending}
+	hooks := commons.GetHooks(cmd, "restore")
+	if err := hooks.Before(result); err != nil {
+		slog.Error("restore aborted", "db", database, "host", host, "phase", "pre-hook", "error", err)
+		return hooks.After(result, err)
+	}
+
+	started := time.Now()
+	slog.Info("partial restore started", "db", database, "host", host, "phase", "start", "file", file, "docs", pending)
+	attachmentsDir, _ := commons.AttachmentsLocation(file)
+	restored, errs := commons.ApplyDocumentChanges(host, port, user, password, database, changes, attachmentsDir)
+	for _, docErr := range errs {
+		slog.Error("error restoring a document", "db", database, "host", host, "phase", "restore", "error", docErr)
+	}
+	result.Documents = restored
+	if len(errs) > 0 {
+		err = fmt.Errorf("%d of %d documents were not restored", len(errs), pending)
+	}
+	err = hooks.After(result, err)
+	commons.FinishResult(&result, started, err)
+	commons.PrintResult(result, func() {
+		if err != nil {
+			fmt.Fprintln(commons.Out, "Error: ", err)
+		} else {
+			fmt.Fprintf(commons.Out, "%d documents restored successfully!\n", restored)
+		}
+	})
+	return err
+}
+
 func init() {
 	rootCmd.AddCommand(restoreCmd)
 	restoreCmd.SetUsageTemplate(`
@@ -90,10 +344,40 @@ Flags:
  -p, --password		The CouchDB password for the auth
  --host			The host of the remote CouchDB, with or without 'https://'
  --port			The port of the remote CouchDB, default is 5984
+ --safety-dir		The directory where to snapshot a database before overwriting it,
+				can also be set with the DBACKUPCLI_SAFETY_DIR environment variable
+ --i-know-what-im-doing	Confirm the restore into a protected database without typing its name
+ --dry-run		Print what the restore would do without doing it
+ --no-progress		Show the output of the restore script instead of the progress bar
+ --pre-hook		A shell command run before the restore, a non-zero exit aborts it
+ --post-hook		A shell command run after a successful restore
+ --on-error-hook		A shell command run when the restore fails
+ --ids			Restore only the documents with these IDs, into the existing database
+ --ids-file		Restore only the documents whose IDs are in this file, one per line
+ --id-prefix		Restore only the documents whose IDs start with this prefix
+ --selector		Restore only the documents matching this Mango selector, evaluated on the dump:
+			the strings are ordered as CouchDB orders the ASCII ones, the accented letters
+			after z and not with their base letter
+ --yes			Restore the chosen documents without asking for confirmation
+ --mode			How to handle an existing non-empty database, default is replace:
+				replace		delete the database and restore the dump (asks for confirmation)
+				merge		keep the database and merge the revision trees of the dump,
+						the design documents of the dump replace the existing ones
+				skip-existing	restore only the documents whose id is not in the database
+				newer-wins	restore only the documents with a higher revision generation
+				fail		stop without touching the database
 
 Examples:
  dbackupcli restore -d my-db -f dump.json -u admin -p root --host 127.0.0.1 --port 9876
  dbackupcli restore --database my-db --file dump.json --user admin -p root --host 127.0.0.1 -c.
+ dbackupcli restore -d my-db -f dump.json -u admin -p root --host 127.0.0.1 --mode skip-existing
+ dbackupcli restore -d my-db -f dump.json -u admin -p root --host 127.0.0.1 --ids order-17,order-42
+ dbackupcli restore -d my-db -f dump.json -u admin -p root --host 127.0.0.1 --selector '{"type":"invoice"}' --dry-run
+
+With --ids, --ids-file, --id-prefix or --selector only the documents of the dump matching all
+of them are restored, --mode aside: the differences with the database are shown first and the
+documents are written as new revisions, so they replace the ones edited or deleted since the
+backup and leave the rest of the database alone.
 `)
 	restoreCmd.Flags().BoolP("help", "h", false, "Help message")
 	restoreCmd.Flags().String("host", "", "The remote CouchDB host, can be provided with or without 'https://'")
@@ -103,4 +387,259 @@ Examples:
 	restoreCmd.Flags().StringP("user", "u", "", "The user to authenticate to the CouchDB (Default: empty)")
 	restoreCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
 	restoreCmd.Flags().BoolP("createdb", "c", false, "Create the database if it does not exist on the remote couchdb (Default: false)")
+	restoreCmd.Flags().String("mode", modeReplace, "How to handle an existing database: replace, merge, skip-existing, newer-wins or fail (Default: replace)")
+	restoreCmd.Flags().StringSlice("i-know-what-im-doing", nil, "The name of the protected database to restore into without prompting (Default: empty)")
+	restoreCmd.Flags().String("safety-dir", "", "The directory where to snapshot a database before overwriting it (Default: $DBACKUPCLI_SAFETY_DIR)")
+	restoreCmd.Flags().Bool("dry-run", false, "Print the restore plan without executing it (Default: false)")
+	restoreCmd.Flags().String("pre-hook", "", "The shell command to run before the restore (Default: empty)")
+	restoreCmd.Flags().String("post-hook", "", "The shell command to run after a successful restore (Default: empty)")
+	restoreCmd.Flags().String("on-error-hook", "", "The shell command to run when the restore fails (Default: empty)")
+	restoreCmd.Flags().StringSlice("ids", nil, "The IDs of the documents to restore (Default: empty)")
+	restoreCmd.Flags().String("ids-file", "", "The file with the IDs of the documents to restore, one per line (Default: empty)")
+	restoreCmd.Flags().String("id-prefix", "", "The prefix of the IDs of the documents to restore (Default: empty)")
+	restoreCmd.Flags().String("selector", "", "The Mango selector of the documents to restore (Default: empty)")
+	restoreCmd.Flags().Bool("yes", false, "Restore the chosen documents without confirmation (Default: false)")
+	restoreCmd.Flags().Bool("no-progress", false, "Disable the progress bar (Default: false)")
+}
+
+// runRestore uploads file with the restore script. When the attachments of the source
+// dump were saved apart, the documents that have them are left to the script and put
+// one by one afterwards, together with the bodies of their attachments.
+func runRestore(ctx context.Context, tmpFile string, cmdArgs []string, file string, source string, host string, port int, user string, password string, database string) error {
+	attachmentsDir, separate := commons.AttachmentsLocation(source)
+	if !separate {
+		return commons.RunScript(ctx, tmpFile, append(cmdArgs, "-f", file))
+	}
+	bulk, err := os.CreateTemp("", "dbackupcli-*.json")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %v", err)
+	}
+	bulk.Close()
+	defer os.Remove(bulk.Name())
+	_, err = commons.TransformDump(file, bulk.Name(), func(doc []byte) ([]byte, error) {
+		if commons.HasBlobs(doc) {
+			return nil, nil
+		}
+		return doc, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := commons.RunScript(ctx, tmpFile, append(cmdArgs, "-f", bulk.Name())); err != nil {
+		return err
+	}
+	count, err := commons.UploadBlobDocuments(host, port, user, password, database, file, attachmentsDir)
+	if err != nil {
+		return err
+	}
+	slog.Info("documents with attachments restored", "db", database, "host", host, "phase", "attachments", "docs", count)
+	return nil
+}
+
+// startRestoreProgress follows the restore of a dump by polling the target database,
+// when total is not nil the progress is also added to the instance aggregate.
+func startRestoreProgress(total *commons.Progress, file string, host string, port int, user string, password string, database string) func() {
+	docs, designs, _, _ := commons.CountDumpDocs(file)
+	var size int64
+	if info, err := os.Stat(file); err == nil {
+		size = info.Size()
+	}
+
+	var p *commons.Progress
+	if total != nil {
+		p = total.Child(database, int64(docs+designs), size)
+	} else {
+		p = commons.NewProgress(database, int64(docs+designs), size)
+	}
+	stop := commons.StartProgress(p, commons.DatabaseSampler(host, port, user, password, database))
+	return func() {
+		stop()
+		p.Complete()
+	}
+}
+
+// modeFilter tells which documents of the dump have to be uploaded to a database
+// that already contains the documents in revs.
+func modeFilter(mode string, revs map[string]string) func(ref couchdb.DocRef) bool {
+	return func(ref couchdb.DocRef) bool {
+		rev, exists := revs[ref.ID]
+		if !exists || mode == modeMerge {
+			return true
+		}
+		return mode == modeNewerWins && commons.RevGeneration(ref.Rev) > commons.RevGeneration(rev)
+	}
+}
+
+func planRestore(mode string, file string, host string, port int, user string, password string, database string, protected bool, safetyDir string) {
+	docs, designs, deleted, err := commons.CountDumpDocs(file)
+	if err != nil {
+		slog.Error("error planning the restore", "db", database, "host", host, "error", err)
+		return
+	}
+	steps := []commons.PlanStep{
+		{Name: "Dump file", Value: file},
+		{Name: "Documents in dump", Value: fmt.Sprintf("%d (%d design documents)", docs+designs, designs)},
+	}
+	if deleted > 0 {
+		steps = append(steps, commons.PlanStep{Name: "Deleted documents", Value: fmt.Sprintf("%d, they would be restored as deletions", deleted)})
+	}
+	steps = append(steps,
+		commons.PlanStep{Name: "Target database", Value: database},
+		commons.PlanStep{Name: "Mode", Value: mode},
+	)
+	if protected {
+		steps = append(steps, commons.PlanStep{Name: "Protection", Value: "protected, typing the database name is required"})
+	}
+
+	upload := docs + designs + deleted
+	statusCode, Database, err := commons.GetDB(host, port, user, password, database)
+	switch {
+	case statusCode == 404:
+		steps = append(steps, commons.PlanStep{Name: "Existing database", Value: "none, it would be created"})
+	case err != nil:
+		slog.Error("error planning the restore", "db", database, "host", host, "error", err)
+		return
+	case Database.DocCount == 0:
+		steps = append(steps, commons.PlanStep{Name: "Existing database", Value: "empty"})
+	default:
+		existing := fmt.Sprintf("%d documents, %s", Database.DocCount, commons.FormatBytes(int64(Database.Sizes.External)))
+		switch mode {
+		case modeReplace:
+			steps = append(steps, commons.PlanStep{Name: "Existing database", Value: existing + ", it would be DELETED after confirmation"})
+			if safetyDir != "" {
+				steps = append(steps, commons.PlanStep{Name: "Safety snapshot", Value: "it would be saved in " + safetyDir})
+			}
+		case modeFail:
+			steps = append(steps, commons.PlanStep{Name: "Existing database", Value: existing + ", the restore would stop"})
+			upload = 0
+		case modeMerge:
+			steps = append(steps, commons.PlanStep{Name: "Existing database", Value: existing + ", the revision trees would be merged"})
+		case modeSkipExisting, modeNewerWins:
+			revs, err := commons.GetDocRevs(host, port, user, password, database)
+			if err != nil {
+				slog.Error("error planning the restore", "db", database, "host", host, "error", err)
+				return
+			}
+			keep := modeFilter(mode, revs)
+			upload = 0
+			err = commons.ReadDump(file, func(doc []byte) error {
+				var ref couchdb.DocRef
+				if err := json.Unmarshal(doc, &ref); err != nil {
+					return fmt.Errorf(commons.ErrUnmarshalJSON, err)
+				}
+				if keep(ref) {
+					upload++
+				}
+				return nil
+			})
+			if err != nil {
+				slog.Error("error planning the restore", "db", database, "host", host, "error", err)
+				return
+			}
+			steps = append(steps, commons.PlanStep{Name: "Existing database", Value: existing + ", it would be kept"})
+		}
+	}
+	steps = append(steps, commons.PlanStep{Name: "Database settings", Value: describeManifest(file)})
+	if attachmentsDir, separate := commons.AttachmentsLocation(file); separate {
+		steps = append(steps, commons.PlanStep{Name: "Attachments", Value: "binary files in " + attachmentsDir + ", put with their documents"})
+	}
+	steps = append(steps,
+		commons.PlanStep{Name: "Documents to upload", Value: strconv.Itoa(upload)},
+		commons.PlanStep{Name: "Batches", Value: fmt.Sprintf("%d of up to %d documents", commons.Batches(upload), commons.RestoreBatchSize)},
+	)
+
+	fmt.Fprintln(commons.Out, commons.DryRunBanner)
+	commons.PrintPlan("Restore plan:", steps)
+}
+
+func describeManifest(file string) string {
+	settings, found, err := commons.LoadManifest(file)
+	switch {
+	case err != nil:
+		return err.Error()
+	case !found:
+		return "none recorded, the server defaults would be kept"
+	}
+	var security bytes.Buffer
+	json.Compact(&security, settings.Security)
+	description := fmt.Sprintf("partitioned %t, q=%d, n=%d, revs limit %d, security %s",
+		settings.Props.Partitioned, settings.Cluster.Q, settings.Cluster.N, settings.RevsLimit, security.String())
+	if settings.Selection != nil {
+		description += ", partial backup of " + commons.DescribeSelection(*settings.Selection)
+	}
+	return description
+}
+
+// existingDesigns are the design documents of the dump that are already in the target
+// database, with the current revisions of its documents.
+type existingDesigns struct {
+	docs [][]byte
+	revs map[string]string
+}
+
+// filterDumpForMode writes in a temp file the documents of the dump that have to be
+// uploaded to the existing database according to the restore mode. The design
+// documents already in the database are left out and added to designs: the restore
+// script puts them without a revision, which CouchDB rejects as a conflict.
+func filterDumpForMode(mode string, file string, host string, port int, user string, password string, database string, designs *existingDesigns) (string, error) {
+	revs, err := commons.GetDocRevs(host, port, user, password, database)
+	if err != nil {
+		return "", err
+	}
+	designs.revs = revs
+
+	tmp, err := os.CreateTemp("", "dbackupcli-*.json")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file: %v", err)
+	}
+	tmp.Close()
+
+	keep := modeFilter(mode, revs)
+	count, err := commons.TransformDump(file, tmp.Name(), func(doc []byte) ([]byte, error) {
+		var ref couchdb.DocRef
+		if err := json.Unmarshal(doc, &ref); err != nil {
+			return nil, fmt.Errorf(commons.ErrUnmarshalJSON, err)
+		}
+		if !keep(ref) {
+			return nil, nil
+		}
+		if rev, exists := revs[ref.ID]; exists && strings.HasPrefix(ref.ID, "_design/") {
+			// The same revision is already there, there is nothing to put
+			if rev != ref.Rev && !ref.Deleted {
+				designs.docs = append(designs.docs, slices.Clone(doc))
+			}
+			return nil, nil
+		}
+		return doc, nil
+	})
+	if err != nil {
+		return tmp.Name(), err
+	}
+	slog.Info("documents selected for restore", "db", database, "host", host, "phase", "filter", "docs", count, "designs", len(designs.docs), "mode", mode)
+	return tmp.Name(), nil
+}
+
+// createFromManifest creates the database partitioned and sharded as recorded in the
+// manifest when it does not exist, the restore script would use the server defaults.
+func createFromManifest(settings manifest.Manifest, host string, port int, user string, password string, database string) error {
+	statusCode, _, err := commons.GetDB(host, port, user, password, database)
+	if statusCode != 404 {
+		return err
+	}
+	return commons.CreateDatabase(host, port, user, password, database, settings)
+}
+
+// verifyRestore checks that every document of the dump made it to the target database
+// and records the stats of the restored database.
+func verifyRestore(result *report.DatabaseResult, file string, host string, port int, user string, password string) error {
+	docs, designs, deleted, err := commons.CountDumpDocs(file)
+	if err != nil {
+		return err
+	}
+	result.Deleted = deleted
+	Database, err := commons.VerifyRestore(host, port, user, password, result.Database, docs+designs)
+	if Database.DbName != "" {
+		result.Stats = commons.DatabaseStats(Database)
+	}
+	return err
 }
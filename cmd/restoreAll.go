@@ -4,12 +4,18 @@ Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
 package cmd
 
 import (
+	"context"
 	"dbackupcli/cmd/commons"
 	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/manifest"
+	"dbackupcli/cmd/struct/report"
 	"fmt"
+	"log/slog"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -19,43 +25,229 @@ var restoreAllCmd = &cobra.Command{
 	Use:   "restoreAll",
 	Short: "Operates a restore of a dump of an entire CouchDB istance",
 	Long:  `Operates a restore of a dump of an entire CouchDB istance contained inside a directory.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, host, password, port := commons.GetAuthFlagValues(cmd)
+		dir, _ := cmd.Flags().GetString("filedir")
+		if commons.CheckFlags(append([]string{}, dir, user, password, host)) {
+			return commons.MissingFlags("restoreAll")
+		}
+
+		policy := commons.GetPolicy(cmd)
+		profileName, _, _ := commons.GetProfile(cmd)
+		config, _ := commons.GetConfig(cmd)
+		if policy.RestoreAllForbidden(config, profileName, host) {
+			slog.Error("restoreAll is forbidden by the policy", "host", host)
+			return commons.NewExitError(commons.ExitUsage, fmt.Errorf("restoreAll is forbidden by the policy on %s", host))
+		}
+		acknowledged, _ := cmd.Flags().GetStringSlice("i-know-what-im-doing")
+
+		prefix, _ := cmd.Flags().GetString("target-prefix")
+		suffix, _ := cmd.Flags().GetString("target-suffix")
+		mappings, _ := cmd.Flags().GetStringArray("map")
+		mappingFile, _ := cmd.Flags().GetString("map-file")
+		mapper, err := commons.NewNameMapper(prefix, suffix, mappings, mappingFile)
+		if err != nil {
+			slog.Error("invalid name mapping", "error", err)
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+
+		dumps, err := listRestoreDumps(dir, mapper)
+		if err != nil {
+			return err
+		}
+		replicatorPassword, _ := cmd.Flags().GetString("replicator-password")
+		cleanup, err := prepareReplicatorDumps(dumps, replicatorPassword)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			planRestoreAll(host, port, user, password, dumps, policy)
+			return nil
+		}
+
 		tmpFile, err := scripts.GetEmbeddedScripts()
 		defer os.Remove(tmpFile)
 		if err != nil {
-			fmt.Println(err)
-			return
+			slog.Error("error preparing the restore script", "error", err)
+			return err
 		}
 
-		user, host, password, port := commons.GetAuthFlagValues(cmd)
-		dir, _ := cmd.Flags().GetString("filedir")
-		if commons.CheckFlags(append([]string{}, dir, user, password, host)) {
-			fmt.Println("missing on or more flags/arguments\n\nCheck using 'dbackupcli restoreAll -h'")
-			os.Exit(1)
+		results, errs := restoreDumps(cmd.Context(), tmpFile, host, port, user, password, dumps, policy, acknowledged, commons.ProgressEnabled(cmd), commons.GetHooks(cmd, "restore"))
+		commons.PrintResult(results, nil)
+		return commons.RunError(results, errs)
+	},
+}
+
+// restoreDump is a dump of a backup directory and the database where it is restored.
+type restoreDump struct {
+	File     string
+	Database string
+	// Upload is the file sent to CouchDB in place of File, when it had to be rewritten
+	Upload string
+}
+
+func (d restoreDump) upload() string {
+	if d.Upload != "" {
+		return d.Upload
+	}
+	return d.File
+}
+
+// listRestoreDumps lists the dumps of a backup directory with their target databases.
+func listRestoreDumps(dir string, mapper commons.NameMapper) ([]restoreDump, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("error reading the backup directory", "dir", dir, "error", err)
+		return nil, err
+	}
+	files = slices.DeleteFunc(files, func(file os.DirEntry) bool {
+		return file.IsDir() || !commons.IsDumpFile(file.Name())
+	})
+
+	// As instance-restore, the system databases go first and _replicator last
+	var system, applications, replicator []restoreDump
+	for _, file := range files {
+		sourceName, _ := strings.CutSuffix(file.Name(), ".json")
+		dump := restoreDump{File: filepath.Join(dir, file.Name()), Database: sourceName}
+		// The dumps of _users, _replicator and _global_changes written by backupAll
+		// --include-system keep their names, which are reserved to CouchDB
+		switch {
+		case sourceName == commons.ReplicatorDatabase:
+			replicator = append(replicator, dump)
+			continue
+		case commons.IsSystemDatabase(sourceName):
+			system = append(system, dump)
+			continue
 		}
+		dump.Database = mapper.Target(sourceName)
+		if err := commons.ValidateDatabaseName(dump.Database); err != nil {
+			slog.Error("invalid target database", "file", file.Name(), "error", err)
+			return nil, commons.NewExitError(commons.ExitUsage, err)
+		}
+		applications = append(applications, dump)
+	}
+	return append(append(system, applications...), replicator...), nil
+}
 
-		var cmdArgs []string = []string{"-r", "-c"}
-		cmdArgs = commons.PrepareCmdAuthArgs(cmdArgs, user, password, host, port)
-		files, err := os.ReadDir(dir)
+// prepareReplicatorDumps uploads in place of the _replicator dumps a copy with the
+// redacted credentials filled with password, without a password the replications
+// with redacted credentials are left out. The returned function removes the copies.
+func prepareReplicatorDumps(dumps []restoreDump, password string) (func(), error) {
+	var copies []string
+	cleanup := func() {
+		for _, name := range copies {
+			os.Remove(name)
+		}
+	}
+	for i, dump := range dumps {
+		if dump.Database != commons.ReplicatorDatabase {
+			continue
+		}
+		tmp, err := os.CreateTemp("", "dbackupcli-replicator-*.json")
+		if err != nil {
+			slog.Error("error preparing the replications", "error", err)
+			cleanup()
+			return nil, err
+		}
+		tmp.Close()
+		copies = append(copies, tmp.Name())
+		skipped, err := commons.PrepareReplicatorDump(dump.File, tmp.Name(), password)
 		if err != nil {
-			fmt.Println("Error: ", err)
-			return
-		}
-
-		for _, file := range files {
-			dbName, _ := strings.CutSuffix(file.Name(), ".json")
-			restoreArgs := append(cmdArgs, "-d", dbName, "-f", dir+"/"+file.Name())
-			cmdExec := exec.Command("bash", append([]string{tmpFile}, restoreArgs...)...)
-			cmdExec.Stderr = os.Stderr
-			cmdExec.Stdout = os.Stdout
-			if err := cmdExec.Run(); err != nil {
-				fmt.Println("Error: ", err)
-			} else {
-				fmt.Println("Restore completed successfully!")
+			slog.Error("error preparing the replications", "file", dump.File, "error", err)
+			cleanup()
+			return nil, err
+		}
+		if len(skipped) > 0 {
+			slog.Warn("replications with redacted credentials are not restored, use --replicator-password to restore them", "ids", strings.Join(skipped, ","))
+		}
+		dumps[i].Upload = tmp.Name()
+	}
+	return cleanup, nil
+}
+
+// restoreDumps restores the dumps one after the other, with the settings of their manifests.
+func restoreDumps(ctx context.Context, tmpFile string, host string, port int, user string, password string, dumps []restoreDump, policy commons.Policy, acknowledged []string, progress bool, hooks commons.Hooks) ([]report.DatabaseResult, []error) {
+	var cmdArgs []string = []string{"-r", "-c"}
+	cmdArgs = commons.PrepareCmdAuthArgs(cmdArgs, user, password, host, port)
+	var total *commons.Progress
+	if progress {
+		cmdArgs = append(cmdArgs, "-q")
+		var totalDocs, totalBytes int64
+		for _, dump := range dumps {
+			docs, designs, _, _ := commons.CountDumpDocs(dump.upload())
+			totalDocs += int64(docs + designs)
+			if info, err := os.Stat(dump.upload()); err == nil {
+				totalBytes += info.Size()
 			}
 		}
+		total = commons.NewProgress("instance", totalDocs, totalBytes)
+	}
 
-	},
+	var results []report.DatabaseResult
+	var errs []error
+	for _, dump := range dumps {
+		if ctx.Err() != nil {
+			break
+		}
+		dbName := dump.Database
+		result := report.DatabaseResult{Operation: "restore", Host: host, Database: dbName, File: dump.File}
+		if policy.IsProtected(host, dbName) {
+			if err := commons.ConfirmTypedName(dbName, acknowledged); err != nil {
+				slog.Warn("restore of protected database skipped", "db", dbName, "host", host, "error", err)
+				result.Status = report.StatusSkipped
+				result.Error = err.Error()
+				commons.RecordResult(result)
+				results = append(results, result)
+				continue
+			}
+		}
+		restoreArgs := append(cmdArgs, "-d", dbName)
+		result.Documents, _, _, _ = commons.CountDumpDocs(dump.upload())
+		started := time.Now()
+		slog.Info("restore started", "db", dbName, "host", host, "phase", "start", "file", result.File)
+
+		lock, err := commons.LockDatabase(host, port, dbName)
+		if err == nil {
+			err = hooks.Before(result)
+		}
+		var settings manifest.Manifest
+		var hasSettings bool
+		if err == nil {
+			settings, hasSettings, err = commons.LoadManifest(dump.File)
+		}
+		if err == nil && hasSettings {
+			err = createFromManifest(settings, host, port, user, password, dbName)
+		}
+		if err == nil {
+			stopProgress := func() {}
+			if progress {
+				stopProgress = startRestoreProgress(total, dump.upload(), host, port, user, password, dbName)
+			}
+			err = runRestore(ctx, tmpFile, restoreArgs, dump.upload(), dump.File, host, port, user, password, dbName)
+			stopProgress()
+			if err == nil && hasSettings {
+				err = commons.ApplyManifest(host, port, user, password, dbName, settings)
+			}
+			if err == nil {
+				err = verifyRestore(&result, dump.upload(), host, port, user, password)
+			}
+		}
+		err = hooks.After(result, err)
+		commons.FinishResult(&result, started, err)
+		if lock != nil {
+			lock.Release()
+		}
+		results = append(results, result)
+		if err != nil {
+			errs = append(errs, err)
+			fmt.Fprintln(commons.Out, "Error: ", err)
+		} else {
+			fmt.Fprintln(commons.Out, "Restore completed successfully!")
+		}
+	}
+	return results, errs
 }
 
 func init() {
@@ -67,6 +259,18 @@ Flags:
  -h, --help		Show this help message
  -d, --database		The database where to restore the dump
  -f, --filedir		The directory containing the istance's dump to restore (e.g dump-directory)
+ --i-know-what-im-doing	Comma separated protected databases to restore into without typing their names
+ --target-prefix	A prefix to add to the name of every restored database
+ --target-suffix	A suffix to add to the name of every restored database
+ --map			Restore the dump of a database into another one (e.g. --map old=new), can be repeated
+ --map-file		A file with one old=new mapping per line, mapped databases ignore prefix and suffix
+ --replicator-password	The password to put in place of the redacted credentials of the replications,
+				without it the replications with redacted credentials are not restored
+ --dry-run		Print what the restore would do without doing it
+ --no-progress		Show the output of the restore script instead of the progress bars
+ --pre-hook		A shell command run before the restore of each database, a non-zero exit skips it
+ --post-hook		A shell command run after each successful restore
+ --on-error-hook		A shell command run when the restore of a database fails
  -u, --user		The CouchDB username for the auth
  -p, --password		The CouchDB password for the auth
  --host			The host of the remote CouchDB, with or without 'https://'
@@ -75,12 +279,62 @@ Flags:
 Examples:
  dbackupcli restore -d my-db -f backup_dir -u admin -p root --host 127.0.0.1 --port 9876
  dbackupcli restore --database my-db --filedir backup_dir --user admin -p root --host 127.0.0.1 -c.
+ dbackupcli restoreAll -f backup_dir -u admin -p root --host 127.0.0.1 --target-prefix staging_ --map users=staging_accounts
 `)
 	restoreAllCmd.Flags().BoolP("help", "h", false, "Help message")
 	restoreAllCmd.Flags().String("host", "", "The remote CouchDB host, can be provided with or without 'https://'")
 	restoreAllCmd.Flags().Int("port", 5984, "The remote CouchDB port (Default: 5984)")
 	restoreAllCmd.Flags().StringP("filedir", "f", "", "The name of the directory containing the istance's dump to restore (Default: empty)")
+	restoreAllCmd.Flags().StringSlice("i-know-what-im-doing", nil, "The names of the protected databases to restore into without prompting (Default: empty)")
+	restoreAllCmd.Flags().String("target-prefix", "", "The prefix to add to the restored database names (Default: empty)")
+	restoreAllCmd.Flags().String("target-suffix", "", "The suffix to add to the restored database names (Default: empty)")
+	restoreAllCmd.Flags().StringArray("map", nil, "Restore a database into another one, as old=new (Default: empty)")
+	restoreAllCmd.Flags().String("map-file", "", "The file containing one old=new mapping per line (Default: empty)")
+	restoreAllCmd.Flags().String("replicator-password", "", "The password of the replications with redacted credentials (Default: empty)")
+	restoreAllCmd.Flags().Bool("dry-run", false, "Print the restore plan without executing it (Default: false)")
+	restoreAllCmd.Flags().Bool("no-progress", false, "Disable the progress bars (Default: false)")
+	restoreAllCmd.Flags().String("pre-hook", "", "The shell command to run before each restore (Default: empty)")
+	restoreAllCmd.Flags().String("post-hook", "", "The shell command to run after each successful restore (Default: empty)")
+	restoreAllCmd.Flags().String("on-error-hook", "", "The shell command to run when a restore fails (Default: empty)")
 	restoreAllCmd.Flags().StringP("user", "u", "", "The user to authenticate to the CouchDB (Default: empty)")
 	restoreAllCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
 	restoreAllCmd.Flags().BoolP("createdb", "c", false, "Create the database if it does not exist on the remote couchdb (Default: false)")
 }
+
+func planRestoreAll(host string, port int, user string, password string, dumps []restoreDump, policy commons.Policy) {
+	fmt.Fprintln(commons.Out, commons.DryRunBanner)
+	var totalDocs int
+	for _, dump := range dumps {
+		dbName := dump.Database
+		docs, designs, deleted, err := commons.CountDumpDocs(dump.upload())
+		if err != nil {
+			slog.Error("error reading the dump", "file", dump.File, "error", err)
+			continue
+		}
+		// The tombstones are uploaded with the documents, as restore counts them
+		upload := docs + designs + deleted
+		totalDocs += upload
+
+		existing := "none, it would be created"
+		statusCode, Database, err := commons.GetDB(host, port, user, password, dbName)
+		if statusCode == 200 {
+			existing = fmt.Sprintf("%d documents, %s, the revision trees would be merged", Database.DocCount, commons.FormatBytes(int64(Database.Sizes.External)))
+		} else if statusCode != 404 {
+			existing = fmt.Sprintf("unknown (%v)", err)
+		}
+		steps := []commons.PlanStep{
+			{Name: "Target database", Value: dbName},
+			{Name: "Existing database", Value: existing},
+			{Name: "Documents to upload", Value: fmt.Sprintf("%d (%d design documents, %d deleted)", upload, designs, deleted)},
+			{Name: "Batches", Value: fmt.Sprintf("%d of up to %d documents", commons.Batches(upload), commons.RestoreBatchSize)},
+		}
+		if attachmentsDir, separate := commons.AttachmentsLocation(dump.File); separate {
+			steps = append(steps, commons.PlanStep{Name: "Attachments", Value: "binary files in " + attachmentsDir + ", put with their documents"})
+		}
+		if policy.IsProtected(host, dbName) {
+			steps = append(steps, commons.PlanStep{Name: "Protection", Value: "protected, typing the database name is required"})
+		}
+		commons.PrintPlan("Restore of "+dump.File+":", steps)
+	}
+	fmt.Fprintf(commons.Out, "Total: %d documents in %d databases\n", totalDocs, len(dumps))
+}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/struct/report"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestListRestoreDumpsSystemDatabases(t *testing.T) {
+	// The directory written by backupAll --include-system
+	dir := t.TempDir()
+	for _, name := range []string{"_global_changes.json", "_replicator.json", "_users.json", "orders.json", "orders.manifest.json", "users.json.partial"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		mapper commons.NameMapper
+		want   []string
+	}{
+		{"same names", commons.NameMapper{}, []string{"_global_changes", "_users", "orders", "_replicator"}},
+		{"prefix", commons.NameMapper{Prefix: "staging_"}, []string{"_global_changes", "_users", "staging_orders", "_replicator"}},
+		{"suffix", commons.NameMapper{Suffix: "_copy"}, []string{"_global_changes", "_users", "orders_copy", "_replicator"}},
+		{"mapping", commons.NameMapper{Mapping: map[string]string{"orders": "orders2", "_users": "users2"}}, []string{"_global_changes", "_users", "orders2", "_replicator"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dumps, err := listRestoreDumps(dir, test.mapper)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, dump := range dumps {
+				got = append(got, dump.Database)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("databases = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if _, err := listRestoreDumps(dir, commons.NameMapper{Mapping: map[string]string{"orders": "Orders"}}); commons.ExitCode(err) != commons.ExitUsage {
+		t.Errorf("an invalid target database returned %v", err)
+	}
+}
+
+func TestPrepareReplicatorDumps(t *testing.T) {
+	dir := t.TempDir()
+	replicator := filepath.Join(dir, "_replicator.json")
+	os.WriteFile(replicator, []byte(`{"new_edits":false,"docs":[
+{"_id":"plain","source":"http://a:5984/db","target":"db"},
+{"_id":"redacted","source":"http://bob:REDACTED@a:5984/db","target":"db"}
+]}`), 0644)
+	orders := filepath.Join(dir, "orders.json")
+	os.WriteFile(orders, []byte(`{"new_edits":false,"docs":[
+{"_id":"o1"}
+]}`), 0644)
+
+	tests := []struct {
+		name     string
+		password string
+		want     []string
+		secret   string
+	}{
+		{"with a password", "secret", []string{"plain", "redacted"}, "bob:secret@"},
+		{"without a password", "", []string{"plain"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dumps := []restoreDump{{File: orders, Database: "orders"}, {File: replicator, Database: commons.ReplicatorDatabase}}
+			cleanup, err := prepareReplicatorDumps(dumps, test.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dumps[0].upload() != orders {
+				t.Errorf("the dump of orders is uploaded from %s", dumps[0].upload())
+			}
+			upload := dumps[1].upload()
+			if upload == replicator {
+				t.Fatal("the redacted dump of _replicator is uploaded")
+			}
+			if got := dumpIDs(t, upload); !slices.Equal(got, test.want) {
+				t.Errorf("replications = %v, want %v", got, test.want)
+			}
+			data, _ := os.ReadFile(upload)
+			if strings.Contains(string(data), commons.RedactedSecret) || !strings.Contains(string(data), test.secret) {
+				t.Errorf("the credentials were not filled: %s", data)
+			}
+			cleanup()
+			if _, err := os.Stat(upload); !os.IsNotExist(err) {
+				t.Errorf("the copy of the dump was kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestRestoreDumpsProtectedSkipped(t *testing.T) {
+	dumps := []restoreDump{{File: "orders.json", Database: "orders"}, {File: "users.json", Database: "users"}}
+	policy := commons.Policy{ProtectedDatabases: []string{"*"}}
+
+	results, errs := restoreDumps(t.Context(), "", "127.0.0.1", 1, "admin", "secret", dumps, policy, []string{"other"}, false, commons.Hooks{})
+	if len(errs) != 0 {
+		t.Fatalf("errors = %v", errs)
+	}
+	for _, result := range results {
+		if result.Status != report.StatusSkipped {
+			t.Errorf("%s: status %s, want %s", result.Database, result.Status, report.StatusSkipped)
+		}
+	}
+	if code := commons.ExitCode(commons.RunError(results, errs)); code != commons.ExitUsage {
+		t.Errorf("a run that restored nothing exits with %d, want %d", code, commons.ExitUsage)
+	}
+}
+
+func TestPlanRestoreAllBatches(t *testing.T) {
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+	})
+	// A full batch of documents, the design document and the tombstone need a second one
+	docs := []string{`{"_id":"_design/app","_rev":"1-a"}`, `{"_id":"gone","_rev":"2-g","_deleted":true}`}
+	for i := range commons.RestoreBatchSize {
+		docs = append(docs, fmt.Sprintf(`{"_id":"doc-%d","_rev":"1-d"}`, i))
+	}
+	file := filepath.Join(t.TempDir(), "orders.json")
+	os.WriteFile(file, []byte(`{"new_edits":false,"docs":[`+"\n"+strings.Join(docs, ",\n")+"\n]}"), 0644)
+
+	previous := commons.Out
+	t.Cleanup(func() { commons.Out = previous })
+	var printed bytes.Buffer
+	commons.Out = &printed
+	planRestoreAll(host, port, "admin", "secret", []restoreDump{{File: file, Database: "orders"}}, commons.Policy{})
+
+	for _, want := range []string{"5002 (1 design documents, 1 deleted)", "2 of up to 5000 documents", "Total: 5002 documents in 1 databases"} {
+		if !strings.Contains(printed.String(), want) {
+			t.Errorf("the plan does not show %q:\n%s", want, printed.String())
+		}
+	}
+}
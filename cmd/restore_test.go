@@ -0,0 +1,101 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package cmd
+
+import (
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// fakeCouch starts a server answering as CouchDB with handler and returns its host and port.
+func fakeCouch(t *testing.T, handler http.HandlerFunc) (string, int) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	host, port, _ := strings.Cut(strings.TrimPrefix(server.URL, "http://"), ":")
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, portNumber
+}
+
+func dumpIDs(t *testing.T, fileName string) []string {
+	t.Helper()
+	var ids []string
+	err := commons.ReadDump(fileName, func(doc []byte) error {
+		var ref couchdb.DocRef
+		if err := json.Unmarshal(doc, &ref); err != nil {
+			return err
+		}
+		ids = append(ids, ref.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestFilterDumpForModeDesignDocs(t *testing.T) {
+	host, port := fakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"total_rows":4,"rows":[
+			{"id":"_design/changed","value":{"rev":"1-old"}},
+			{"id":"_design/same","value":{"rev":"2-same"}},
+			{"id":"existing","value":{"rev":"1-e"}},
+			{"id":"older","value":{"rev":"3-o"}}]}`))
+	})
+	dump := filepath.Join(t.TempDir(), "dump.json")
+	os.WriteFile(dump, []byte(`{"new_edits":false,"docs":[
+{"_id":"_design/changed","_rev":"2-new","views":{}},
+{"_id":"_design/new","_rev":"1-n","views":{}},
+{"_id":"_design/same","_rev":"2-same","views":{}},
+{"_id":"existing","_rev":"2-e"},
+{"_id":"missing","_rev":"1-m"},
+{"_id":"older","_rev":"2-o"}
+]}
+`), 0600)
+
+	tests := []struct {
+		mode    string
+		ids     []string
+		designs []string
+	}{
+		{modeMerge, []string{"_design/new", "existing", "missing", "older"}, []string{"_design/changed"}},
+		{modeSkipExisting, []string{"_design/new", "missing"}, nil},
+		{modeNewerWins, []string{"_design/new", "existing", "missing"}, []string{"_design/changed"}},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			var designs existingDesigns
+			filtered, err := filterDumpForMode(test.mode, dump, host, port, "admin", "secret", "db", &designs)
+			defer os.Remove(filtered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids := dumpIDs(t, filtered); !slices.Equal(ids, test.ids) {
+				t.Errorf("dump = %v, want %v", ids, test.ids)
+			}
+			var designIDs []string
+			for _, doc := range designs.docs {
+				var ref couchdb.DocRef
+				json.Unmarshal(doc, &ref)
+				designIDs = append(designIDs, ref.ID)
+			}
+			if !slices.Equal(designIDs, test.designs) {
+				t.Errorf("designs = %v, want %v", designIDs, test.designs)
+			}
+		})
+	}
+}
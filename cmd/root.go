@@ -4,6 +4,8 @@ Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
 package cmd
 
 import (
+	"dbackupcli/cmd/commons"
+	"log/slog"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -17,13 +19,64 @@ su database NoSQL Couchdb eseguendo:
 - Elencare i database presenti nell'istanza di CouchDB
 - Backup/Restore di un singolo database
 - Backup/Restore di un'intera istanza CouchDB`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		logFormat, _ := cmd.Flags().GetString("log-format")
+		logLevel, _ := cmd.Flags().GetString("log-level")
+		if err := commons.SetupLogging(logFormat, logLevel); err != nil {
+			return err
+		}
+		if err := commons.CheckConfig(cmd); err != nil {
+			cmd.SilenceUsage = true
+			return err
+		}
+		output, _ := cmd.Flags().GetString("output")
+		if err := commons.SetupOutput(output); err != nil {
+			return err
+		}
+		if _, _, err := commons.GetNotifications(cmd); err != nil {
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+		if err := commons.SetupHTTP(cmd); err != nil {
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+		throttle, err := commons.GetThrottle(cmd)
+		if err != nil {
+			return commons.NewExitError(commons.ExitUsage, err)
+		}
+		commons.SetThrottle(throttle)
+		// From here on the commands log their own errors, cobra only reports usage mistakes
+		cmd.SilenceErrors = true
+		cmd.SilenceUsage = true
+		commons.StartRunReport(cmd.Name())
+		return nil
+	},
 }
 
 func Execute() {
-	err := rootCmd.Execute()
-	if err != nil {
-		os.Exit(1)
+	ctx, stop := commons.SignalContext()
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	stop()
+	run := commons.FinishRunReport(err)
+	if reportFile, _ := cmd.Flags().GetString("report"); reportFile != "" {
+		if reportErr := commons.WriteRunReport(reportFile, run); reportErr != nil {
+			slog.Error("error writing the run report", "file", reportFile, "error", reportErr)
+		}
 	}
+	if cmd == backupCmd || cmd == backupAllCmd || cmd == instanceBackupCmd {
+		recordCatalog(cmd, run)
+	}
+	// The daemon updates its metrics and sends its notifications after every backup
+	if metricsFile, _ := cmd.Flags().GetString("metrics-textfile"); metricsFile != "" && cmd != daemonCmd {
+		if metricsErr := commons.WriteRunMetrics(metricsFile, cmd.Name(), err); metricsErr != nil {
+			slog.Error("error writing the metrics", "file", metricsFile, "error", metricsErr)
+		}
+	}
+	if run.Command != "" && cmd != daemonCmd {
+		if notifications, server, notifyErr := commons.GetNotifications(cmd); notifyErr == nil {
+			commons.Notify(notifications, server, run)
+		}
+	}
+	os.Exit(commons.ExitCode(err))
 }
 
 func init() {
@@ -35,9 +88,89 @@ Operation:
 	restore		Perform the restore of a dumped database
 	listdbs		List all the databases in the specified CouchDB
 	backupAll	Perform a backup of the entire CouchDB 
+	undo-restore	Put back the safety snapshot taken before a restore
+	instance-backup	Take a snapshot of the entire node, system databases and config included
+	instance-restore	Rebuild a node from a snapshot taken with instance-backup
+	daemon		Perform a backup of the entire CouchDB at a fixed interval
+	prune		Remove the old backups of a repository and the attachments no longer used
+	repo		Manage a deduplicating repository of snapshots
+	backups		List and inspect the backups recorded in the catalog
+
+Global flags:
+	--config		The JSON config file with profiles and policy, default is ~/.dbackupcli.json
+	--profile		The profile of the config file to take host, port and credentials from
+	--protected-host	A host (or pattern) whose databases require typing their name to be overwritten
+	--protected-db		A database name (or pattern) that requires typing its name to be overwritten
+	-o, --output		The format of the command results: text, json or yaml, default is text
+	--log-format		The format of the logs written on stderr: text or json, default is text
+	--log-level		The minimum level of the logs: debug, info, warn or error, default is info
+	--report		The JSON file where to write the report of the run
+	--metrics-textfile	The node_exporter textfile (.prom) where to write the metrics of the run
+	--connect-timeout	The timeout to connect to CouchDB, default is 10s
+	--read-timeout		The timeout to wait for the response of CouchDB or for more of its body, default is 60s
+	--retries		The retries of a read failed with a connection error, 429 or 5xx, default is 3,
+				the writes are retried only after a refused connection or a 429
+	--retry-backoff		The wait before the first retry, doubled at every retry, default is 500ms
+	--retry-max-backoff	The maximum wait between two retries, default is 30s
+	--max-bandwidth		The maximum transfer rate to CouchDB (e.g. 512KB/s, 20MB/s), default is unlimited
+	--max-requests-per-sec	The maximum number of requests per second to CouchDB, default is unlimited
+	--notify		The notifications of the config file to send at the end of the run
+	--notify-webhook	The URL where to post the JSON run report
+	--notify-slack		The Slack incoming webhook URL where to send the outcome of the run
+	--notify-teams		The Teams incoming webhook URL where to send the outcome of the run
+	--notify-email		The email addresses where to send the outcome of the run
+	--notify-on		When to notify: on-failure, on-success or always, default is on-failure
+	--notify-template	The Go template file for the body of the notifications
+	--smtp-host		The SMTP server used for the emails
+	--smtp-port		The port of the SMTP server, default is 25
+	--smtp-user		The SMTP username, no authentication when empty
+	--smtp-password		The SMTP password
+	--smtp-from		The sender address of the emails
+
+Exit codes:
+	0	Success
+	1	Generic failure
+	2	Invalid flags, arguments or config
+	3	Authentication failure (401/403 from CouchDB)
+	4	Connection failure
+	5	Partial failure, some of the databases failed
+	6	Verification of the dump or of the restored database failed
+	7	Aborted by the user
+	130	Interrupted by SIGINT or SIGTERM
 
 Use "{{.Use}} [operation]" -h" for more information about a module.
 `)
 
 	rootCmd.Flags().BoolP("help", "h", false, "Help message for dbackupcli")
+	rootCmd.PersistentFlags().String("config", "", "The JSON config file with profiles and policy (Default: ~/.dbackupcli.json)")
+	rootCmd.PersistentFlags().String("profile", "", "The profile of the config file to use (Default: empty)")
+	rootCmd.PersistentFlags().StringSlice("protected-host", nil, "Hosts whose databases are protected (Default: empty)")
+	rootCmd.PersistentFlags().StringSlice("protected-db", nil, "Database name patterns that are protected (Default: empty)")
+	rootCmd.PersistentFlags().StringP("output", "o", commons.OutputText, "The format of the command results: text, json or yaml (Default: text)")
+	rootCmd.PersistentFlags().String("log-format", "text", "The format of the logs on stderr: text or json (Default: text)")
+	rootCmd.PersistentFlags().String("log-level", "info", "The minimum log level: debug, info, warn or error (Default: info)")
+	rootCmd.PersistentFlags().String("report", "", "The JSON file where to write the run report (Default: empty)")
+	rootCmd.PersistentFlags().String("metrics-textfile", "", "The node_exporter textfile where to write the run metrics (Default: empty)")
+	rootCmd.PersistentFlags().Duration("connect-timeout", commons.DefaultHTTPOptions.ConnectTimeout, "The timeout to connect to CouchDB (Default: 10s)")
+	rootCmd.PersistentFlags().Duration("read-timeout", commons.DefaultHTTPOptions.ReadTimeout, "The timeout to wait for the response of CouchDB (Default: 60s)")
+	rootCmd.PersistentFlags().Int("retries", commons.DefaultHTTPOptions.Retries, "The retries of a failed request (Default: 3)")
+	rootCmd.PersistentFlags().Duration("retry-backoff", commons.DefaultHTTPOptions.RetryBackoff, "The wait before the first retry (Default: 500ms)")
+	rootCmd.PersistentFlags().Duration("retry-max-backoff", commons.DefaultHTTPOptions.RetryMaxBackoff, "The maximum wait between two retries (Default: 30s)")
+	rootCmd.PersistentFlags().String("max-bandwidth", "", "The maximum transfer rate to CouchDB, e.g. 20MB/s (Default: unlimited)")
+	rootCmd.PersistentFlags().Float64("max-requests-per-sec", 0, "The maximum number of requests per second to CouchDB (Default: unlimited)")
+	rootCmd.PersistentFlags().StringSlice("notify", nil, "The notifications of the config file to send (Default: empty)")
+	rootCmd.PersistentFlags().String("notify-webhook", "", "The URL where to post the JSON run report (Default: empty)")
+	rootCmd.PersistentFlags().String("notify-slack", "", "The Slack incoming webhook URL (Default: empty)")
+	rootCmd.PersistentFlags().String("notify-teams", "", "The Teams incoming webhook URL (Default: empty)")
+	rootCmd.PersistentFlags().StringSlice("notify-email", nil, "The email addresses to notify (Default: empty)")
+	rootCmd.PersistentFlags().String("notify-on", commons.NotifyOnFailure, "When to notify: on-failure, on-success or always (Default: on-failure)")
+	rootCmd.PersistentFlags().String("notify-template", "", "The Go template file for the notification body (Default: empty)")
+	rootCmd.PersistentFlags().String("smtp-host", "", "The SMTP server used for the emails (Default: empty)")
+	rootCmd.PersistentFlags().Int("smtp-port", 25, "The port of the SMTP server (Default: 25)")
+	rootCmd.PersistentFlags().String("smtp-user", "", "The SMTP username (Default: empty)")
+	rootCmd.PersistentFlags().String("smtp-password", "", "The SMTP password (Default: empty)")
+	rootCmd.PersistentFlags().String("smtp-from", "", "The sender address of the emails (Default: empty)")
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return commons.NewExitError(commons.ExitUsage, err)
+	})
 }
@@ -40,7 +40,15 @@ usage(){
     echo -e "\t       -- can also set with 'COUCHDB_PASS' environment var"
     echo -e "\t-l   Number of lines (documents) to Restore at a time. [Default: 5000] (Restore Only)"
     echo -e "\t-t   Number of CPU threads to use when parsing data [Default: nProcs-1] (Backup Only)"
-    echo -e "\t-a   Number of times to Attempt import before failing [Default: 3] (Restore Only)"
+    echo -e "\t-a   Number of times to Attempt a request before failing [Default: 3]"
+    echo -e "\t-w   Seconds to wait before the first retry, doubled at every attempt [Default: 1]"
+    echo -e "\t-W   Maximum seconds to wait between two attempts [Default: 30]"
+    echo -e "\t-C   Seconds allowed to connect to CouchDB [Default: 10]"
+    echo -e "\t-S   Seconds a transfer can stall before being aborted [Default: 300]"
+    echo -e "\t-L   Maximum transfer rate in bytes per second, as accepted by curl --limit-rate [Default: unlimited]"
+    echo -e "\t-Q   Maximum number of requests per second [Default: unlimited]"
+    echo -e "\t-k   Export the conflicts of the documents, as _conflicts (Backup Only)"
+    echo -e "\t-n   Export the attachments as stubs, without their data (Backup Only)"
     echo -e "\t-c   Create DB on demand, if they are not listed."
     echo -e "\t-q   Run in quiet mode. Suppress output, except for errors and warnings."
     echo -e "\t-z   Compress output file (Backup Only)"
@@ -94,6 +102,49 @@ checkdiskspace(){
         exit 1
     fi
 }
+backoff(){
+## Sleeps before a new attempt: exponential backoff from $backoffBase seconds up to
+## $backoffMax, with jitter in the upper half. Example call:   backoff $attemptcount
+    interruptible sleep $(awk -v b="$backoffBase" -v m="$backoffMax" -v n="$1" 'BEGIN { srand(); d = b * 2 ^ (n - 1); if (d > m) d = m; printf "%.3f\n", d / 2 + rand() * d / 2 }')
+}
+throttle(){
+## Waits so that requests are not sent more often than $maxRequests per second
+    if [ "x$maxRequests" = "x" ]; then
+        return 0
+    fi
+    now=$(date +%s.%N)
+    if [ ! "x$lastRequest" = "x" ]; then
+        interruptible sleep $(awk -v l="$lastRequest" -v n="$now" -v r="$maxRequests" 'BEGIN { w = l + 1 / r - n; printf "%.3f\n", (w > 0 ? w : 0) }')
+    fi
+    lastRequest=$(date +%s.%N)
+}
+interruptible(){
+## Runs a command in the background and waits for it, so that an interruption stops it
+## at once instead of after it completes. Example call:   interruptible curl ...
+    "$@" &
+    wait $!
+}
+cleanup(){
+## Removes the temporary files of the run, on any exit
+    set +o noglob
+    rm -rf "${workdir}"
+    if [ $restore = true ]; then
+        rm -f ${file_name_orig}-design* ${file_name_orig}-nodesign* ${file_name_orig}.split*
+    fi
+}
+interrupted(){
+## Stops the running commands on SIGINT/SIGTERM and exits with the code of the signal.
+## The output of an interrupted backup is left to the caller. Example call:   interrupted 130
+    trap '' INT TERM
+    echo "... WARN: Interrupted, cleaning up"
+    kill $(jobs -p) 2>/dev/null
+    wait
+    if [ $backup = true ]; then
+        set +o noglob
+        rm -f ${file_name}.tmp ${file_name}.thread* ${file_name}.sedtmp
+    fi
+    exit $1
+}
 ## END FUNCTIONS
 
 # Catch no args:
@@ -110,12 +161,20 @@ port=5984
 OPTIND=1
 lines=5000
 attempts=3
+backoffBase=1
+backoffMax=30
+connectTimeout=10
+stallTimeout=300
+maxRate=""
+maxRequests=""
 createDBsOnDemand=false
+conflicts=false
+stubs=false
 verboseMode=true
 compress=false
 timestamp=false
 
-while getopts ":h?H:d:f:u:p:P:l:t:a:c?q?z?T?V?b?B?r?R?" opt; do
+while getopts ":h?H:d:f:u:p:P:l:t:a:w:W:C:S:L:Q:k?n?c?q?z?T?V?b?B?r?R?" opt; do
     case "$opt" in
         h) usage;;
         b|B) backup=true ;;
@@ -129,6 +188,14 @@ while getopts ":h?H:d:f:u:p:P:l:t:a:c?q?z?T?V?b?B?r?R?" opt; do
         l) lines="${OPTARG}" ;;
         t) threads="${OPTARG}" ;;
         a) attempts="${OPTARG}";;
+        w) backoffBase="${OPTARG}";;
+        W) backoffMax="${OPTARG}";;
+        C) connectTimeout="${OPTARG}";;
+        S) stallTimeout="${OPTARG}";;
+        L) maxRate="${OPTARG}";;
+        Q) maxRequests="${OPTARG}";;
+        k) conflicts=true;;
+        n) stubs=true;;
         c) createDBsOnDemand=true;;
         q) verboseMode=false;;
         z) compress=true;;
@@ -182,6 +249,18 @@ if [ "x$file_name" = "x" ]; then
 fi
 file_name_orig=$file_name
 
+# The responses of CouchDB are kept in a private directory, removed on exit together with
+# the intermediate files of the restore
+workdir=$(mktemp -d "${TMPDIR:-/tmp}/couch-dump-restore.XXXXXX")
+if [ ! $? = 0 ]; then
+    echo "... ERROR: Unable to create a temporary directory"
+    exit 1
+fi
+response_file="${workdir}/tmp.out"
+trap cleanup EXIT
+trap 'interrupted 130' INT
+trap 'interrupted 143' TERM
+
 # Get OS TYPE (Linux for Linux, Darwin for MacOSX)
 os_type=`uname -s`
 
@@ -284,6 +363,12 @@ if [ ! "x${username}" = "x" ]&&[ ! "x${password}" = "x" ]; then
     curlopt="${curlopt} -u ${username}:${password}"
 fi
 
+# Fail fast on unreachable or stalled nodes instead of hanging forever
+curlopt="${curlopt} --connect-timeout ${connectTimeout} --speed-limit 1 --speed-time ${stallTimeout}"
+if [ ! "x${maxRate}" = "x" ]; then
+    curlopt="${curlopt} --limit-rate ${maxRate}"
+fi
+
 ## Check for curl
 curl --version >/dev/null 2>&1 || ( echo "... ERROR: This script requires 'curl' to be present."; exit 1 )
 
@@ -321,7 +406,19 @@ if [ $backup = true ]&&[ $restore = false ]; then
     fi
 
     # Grab our data from couchdb
-    curl ${curlSilentOpt} ${curlopt} -X GET "$url/$db_name/_all_docs?include_docs=true&attachments=true" -o ${file_name}
+    # curl retries transient errors itself, with exponential backoff and honouring Retry-After
+    query="include_docs=true"
+    if [ "$stubs" = false ]; then
+        query="${query}&attachments=true"
+    else
+        # The stubs say which digests are of the data CouchDB stores compressed
+        query="${query}&att_encoding_info=true"
+    fi
+    if [ "$conflicts" = true ]; then
+        query="${query}&conflicts=true"
+    fi
+    throttle
+    interruptible curl ${curlSilentOpt} ${curlopt} --retry $(( attempts - 1 )) --retry-connrefused -X GET "$url/$db_name/_all_docs?${query}" -o ${file_name}
     # Check for curl errors
     if [ ! $? = 0 ]; then
         echo "... ERROR: Curl encountered an issue whilst dumping the database."
@@ -491,6 +588,7 @@ elif [ $restore = true ]&&[ $backup = false ]; then
     A=0
     until [ $A = 1 ]; do
         (( attemptcount++ ))
+        throttle
         existing_dbs=$(curl $curlSilentOpt $curlopt -X GET "${url}/_all_dbs")
         if [ ! $? = 0 ]; then
             if [ $attemptcount = $attempts ]; then
@@ -498,7 +596,7 @@ elif [ $restore = true ]&&[ $backup = false ]; then
                 exit 1
             else
                 echo "... WARN: Curl failed to get the list of databases - Attempt ${attemptcount}/${attempts}. Retrying..."
-                sleep 1
+                backoff $attemptcount
             fi
         else
             A=1
@@ -516,34 +614,35 @@ elif [ $restore = true ]&&[ $backup = false ]; then
             A=0
             until [ $A = 1 ]; do
                 (( attemptcount++ ))
-                curl $curlSilentOpt $curlopt -X PUT "${url}/${db_name}" -o tmp.out
+                throttle
+                interruptible curl $curlSilentOpt $curlopt -X PUT "${url}/${db_name}" -o ${response_file}
                 # If curl threw an error:
                 if [ ! $? = 0 ]; then
                     if [ $attemptcount = $attempts ]; then
                         echo "... ERROR: Curl failed to create the database ${db_name} - Stopping"
-                        if [ -f tmp.out ]; then
+                        if [ -f ${response_file} ]; then
                             echo -n "... ERROR: Error message was:   "
-                            cat tmp.out
+                            cat ${response_file}
                         else
                             echo ".. ERROR: See above for any errors"
                         fi
                         exit 1
                     else
                         echo "... WARN: Curl failed to create the database ${db_name} - Attempt ${attemptcount}/${attempts}. Retrying..."
-                        sleep 1
+                        backoff $attemptcount
                     fi
                 # If curl was happy, but CouchDB returned an error in the return JSON:
-                elif [ ! "`head -n 1 tmp.out | grep -c '^{"error":'`" = 0 ]; then
+                elif [ ! "`head -n 1 ${response_file} | grep -c '^{"error":'`" = 0 ]; then
                     if [ $attemptcount = $attempts ]; then
-                        echo "... ERROR: CouchDB Reported: `head -n 1 tmp.out`"
+                        echo "... ERROR: CouchDB Reported: `head -n 1 ${response_file}`"
                         exit 1
                     else
                         echo "... WARN: CouchDB Reported an error during db creation - Attempt ${attemptcount}/${attempts} - Retrying..."
-                        sleep 1
+                        backoff $attemptcount
                     fi
                 # Otherwise, if everything went well, delete our temp files.
                 else
-                    rm tmp.out
+                    rm ${response_file}
                     A=1
                 fi
             done
@@ -622,7 +721,8 @@ elif [ $restore = true ]&&[ $backup = false ]; then
             attemptcount=0
             until [ $A = 1 ]; do
                 (( attemptcount++ ))
-                curl $curlSilentOpt ${curlopt} -T ${design_file_name}.${designcount} -X PUT "${url}/${db_name}/${URLPATH}" -H 'Content-Type: application/json' -o ${design_file_name}.out.${designcount}
+                throttle
+                interruptible curl $curlSilentOpt ${curlopt} -T ${design_file_name}.${designcount} -X PUT "${url}/${db_name}/${URLPATH}" -H 'Content-Type: application/json' -o ${response_file}
                 # If curl threw an error:
                 if [ ! $? = 0 ]; then
                      if [ $attemptcount = $attempts ]; then
@@ -630,21 +730,21 @@ elif [ $restore = true ]&&[ $backup = false ]; then
                          exit 1
                      else
                          echo "... WARN: Import of ${design_file_name}.${designcount} failed - Attempt ${attemptcount}/${attempts}. Retrying..."
-                         sleep 1
+                         backoff $attemptcount
                      fi
                 # If curl was happy, but CouchDB returned an error in the return JSON:
-                elif [ ! "`head -n 1 ${design_file_name}.out.${designcount} | grep -c '^{"error":'`" = 0 ]; then
+                elif [ ! "`head -n 1 ${response_file} | grep -c '^{"error":'`" = 0 ]; then
                      if [ $attemptcount = $attempts ]; then
-                         echo "... ERROR: CouchDB Reported: `head -n 1 ${design_file_name}.out.${designcount}`"
+                         echo "... ERROR: CouchDB Reported: `head -n 1 ${response_file}`"
                          exit 1
                      else
                          echo "... WARN: CouchDB Reported an error during import - Attempt ${attemptcount}/${attempts} - Retrying..."
-                         sleep 1
+                         backoff $attemptcount
                      fi
                 # Otherwise, if everything went well, delete our temp files.
                 else
                      A=1
-                     rm -f ${design_file_name}.out.${designcount}
+                     rm -f ${response_file}
                      rm -f ${design_file_name}.${designcount}
                 fi
             done
@@ -663,27 +763,28 @@ elif [ $restore = true ]&&[ $backup = false ]; then
         attemptcount=0
         until [ $A = 1 ]; do
             (( attemptcount++ ))
-            curl $curlSilentOpt $curlopt -T $file_name -X POST "$url/$db_name/_bulk_docs" -H 'Content-Type: application/json' -o tmp.out
-            if [ "`head -n 1 tmp.out | grep -c '^{"error":'`" -eq 0 ]; then
+            throttle
+            interruptible curl $curlSilentOpt $curlopt -T $file_name -X POST "$url/$db_name/_bulk_docs" -H 'Content-Type: application/json' -o ${response_file}
+            if [ "`head -n 1 ${response_file} | grep -c '^{"error":'`" -eq 0 ]; then
                 $echoVerbose && echo "... INFO: Imported ${file_name_orig} Successfully."
-                rm -f tmp.out
+                rm -f ${response_file}
                 rm -f ${file_name_orig}-design
                 rm -f ${file_name_orig}-nodesign
                 exit 0
             else
                 if [ $attemptcount = $attempts ]; then
                     echo "... ERROR: Import of ${file_name_orig} failed."
-                    if [ -f tmp.out ]; then
+                    if [ -f ${response_file} ]; then
                         echo -n "... ERROR: Error message was:   "
-                        cat tmp.out
+                        cat ${response_file}
                     else
                         echo ".. ERROR: See above for any errors"
                     fi
-                    rm -f tmp.out
+                    rm -f ${response_file}
                     exit 1
                 else
                     echo "... WARN: Import of ${file_name_orig} failed - Attempt ${attemptcount}/${attempts} - Retrying..."
-                    sleep 1
+                    backoff $attemptcount
                 fi
             fi
         done
@@ -746,27 +847,28 @@ elif [ $restore = true ]&&[ $backup = false ]; then
             attemptcount=0
             until [ $A = 1 ]; do
                 (( attemptcount++ ))
-                curl $curlSilentOpt $curlopt -T ${PADNAME} -X POST "$url/$db_name/_bulk_docs" -H 'Content-Type: application/json' -o tmp.out
+                throttle
+                interruptible curl $curlSilentOpt $curlopt -T ${PADNAME} -X POST "$url/$db_name/_bulk_docs" -H 'Content-Type: application/json' -o ${response_file}
                 if [ ! $? = 0 ]; then
                     if [ $attemptcount = $attempts ]; then
                         echo "... ERROR: Curl failed trying to restore ${PADNAME} - Stopping"
                         exit 1
                     else
                         echo "... WARN: Failed to import ${PADNAME} - Attempt ${attemptcount}/${attempts} - Retrying..."
-                        sleep 1
+                        backoff $attemptcount
                     fi
-                elif [ ! "`head -n 1 tmp.out | grep -c '^{"error":'`" = 0 ]; then
+                elif [ ! "`head -n 1 ${response_file} | grep -c '^{"error":'`" = 0 ]; then
                     if [ $attemptcount = $attempts ]; then
-                        echo "... ERROR: CouchDB Reported: `head -n 1 tmp.out`"
+                        echo "... ERROR: CouchDB Reported: `head -n 1 ${response_file}`"
                         exit 1
                     else
                         echo "... WARN: CouchDB Reported and error during import - Attempt ${attemptcount}/${attempts} - Retrying..."
-                        sleep 1
+                        backoff $attemptcount
                     fi
                 else
                     A=1
                     rm -f ${PADNAME}
-                    rm -f tmp.out
+                    rm -f ${response_file}
                     (( count++ ))
                 fi
             done
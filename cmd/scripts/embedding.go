@@ -8,27 +8,29 @@ import (
 	"embed"
 	"fmt"
 	"os"
-	"path/filepath"
 )
 
 //go:embed *.sh
 
 var embeddedScripts embed.FS
 
+// GetEmbeddedScripts writes the backup script to a new temp file, so that concurrent
+// runs do not overwrite each other's script. The caller removes it.
 func GetEmbeddedScripts() (string, error) {
-	var tmpFile string
-	var scriptFile string
-
-	tmpFile = filepath.Join(os.TempDir(), "couch-script.sh")
-	scriptFile = "couch-dump-restore.sh"
+	scriptFile := "couch-dump-restore.sh"
 
 	scriptContent, err := embeddedScripts.ReadFile(scriptFile)
 	if err != nil {
 		return "", fmt.Errorf("error reading embedded script: %s", err)
 	}
-	err = os.WriteFile(tmpFile, scriptContent, 0755)
+	tmpFile, err := os.CreateTemp("", "couch-script-*.sh")
 	if err != nil {
+		return "", fmt.Errorf("error creating the temp file of the embedded script: %s", err)
+	}
+	defer tmpFile.Close()
+	if _, err = tmpFile.Write(scriptContent); err != nil {
+		os.Remove(tmpFile.Name())
 		return "", fmt.Errorf("error writing embedded script into temp file: %s", err)
 	}
-	return tmpFile, nil
+	return tmpFile.Name(), nil
 }
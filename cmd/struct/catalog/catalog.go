@@ -0,0 +1,40 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package catalog
+
+import (
+	"dbackupcli/cmd/struct/manifest"
+	"time"
+)
+
+// Entry is a backup run recorded in the catalog, one JSON line each.
+type Entry struct {
+	ID         string    `json:"id" yaml:"id"`
+	Command    string    `json:"command" yaml:"command"`
+	Status     string    `json:"status" yaml:"status"`
+	Host       string    `json:"host" yaml:"host"`
+	Tags       []string  `json:"tags,omitempty" yaml:"tags,omitempty"`
+	StartedAt  time.Time `json:"started_at" yaml:"started_at"`
+	FinishedAt time.Time `json:"finished_at" yaml:"finished_at"`
+	Duration   float64   `json:"duration_seconds" yaml:"duration_seconds"`
+	// Args are the arguments of the command line, with the passwords redacted
+	Args      []string   `json:"args" yaml:"args"`
+	Location  string     `json:"location" yaml:"location"`
+	Databases []Database `json:"databases" yaml:"databases"`
+}
+
+// Database is a dump written by a backup run.
+type Database struct {
+	Database    string             `json:"database" yaml:"database"`
+	File        string             `json:"file" yaml:"file"`
+	Documents   int                `json:"documents" yaml:"documents"`
+	Deleted     int                `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+	Conflicts   int                `json:"conflicts,omitempty" yaml:"conflicts,omitempty"`
+	Attachments int                `json:"attachments,omitempty" yaml:"attachments,omitempty"`
+	Bytes       int64              `json:"bytes" yaml:"bytes"`
+	SHA256      string             `json:"sha256" yaml:"sha256"`
+	UpdateSeq   string             `json:"update_seq,omitempty" yaml:"update_seq,omitempty"`
+	Manifest    *manifest.Manifest `json:"manifest,omitempty" yaml:"manifest,omitempty"`
+}
@@ -0,0 +1,38 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package couchdb
+
+type DocRef struct {
+	ID      string `json:"_id"`
+	Rev     string `json:"_rev"`
+	Deleted bool   `json:"_deleted,omitempty"`
+}
+
+type AllDocs struct {
+	TotalRows int          `json:"total_rows"`
+	Offset    int          `json:"offset"`
+	Rows      []AllDocsRow `json:"rows"`
+}
+
+type AllDocsRow struct {
+	ID    string       `json:"id"`
+	Key   string       `json:"key"`
+	Value AllDocsValue `json:"value"`
+}
+
+type AllDocsValue struct {
+	Rev string `json:"rev"`
+}
+
+type Changes struct {
+	Results []ChangesRow `json:"results"`
+	LastSeq any          `json:"last_seq"`
+}
+
+type ChangesRow struct {
+	ID      string         `json:"id"`
+	Changes []AllDocsValue `json:"changes"`
+	Deleted bool           `json:"deleted"`
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package instance
+
+import (
+	"time"
+)
+
+// Version of the instance file format, increased when a field changes meaning.
+const Version = 1
+
+// Instance describes a snapshot of a whole CouchDB node, it is written last
+// in the snapshot directory, so a directory without it is incomplete.
+type Instance struct {
+	Version            int        `json:"version"`
+	Host               string     `json:"host"`
+	CreatedAt          time.Time  `json:"created_at"`
+	CouchDBVersion     string     `json:"couchdb_version"`
+	Membership         Membership `json:"membership"`
+	Databases          []string   `json:"databases"`
+	ReplicatorRedacted bool       `json:"replicator_redacted"`
+}
+
+// Membership is the response of /_membership.
+type Membership struct {
+	AllNodes     []string `json:"all_nodes"`
+	ClusterNodes []string `json:"cluster_nodes"`
+}
+
+// Config is the response of /_node/_local/_config, section -> key -> value.
+type Config map[string]map[string]string
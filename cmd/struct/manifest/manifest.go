@@ -0,0 +1,42 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package manifest
+
+import (
+	"dbackupcli/cmd/struct/couchdb"
+	"encoding/json"
+	"time"
+)
+
+// Version of the manifest format, increased when a field changes meaning.
+const Version = 1
+
+// Manifest records the settings of a database that are not part of its documents,
+// it is saved next to the dump and applied back on restore.
+type Manifest struct {
+	Version   int             `json:"version"`
+	Database  string          `json:"database"`
+	CreatedAt time.Time       `json:"created_at"`
+	DocCount  int             `json:"doc_count"`
+	UpdateSeq string          `json:"update_seq,omitempty"`
+	Props     couchdb.Props   `json:"props"`
+	Cluster   couchdb.Cluster `json:"cluster"`
+	RevsLimit int             `json:"revs_limit"`
+	Security  json.RawMessage `json:"security,omitempty"`
+	// Attachments is the directory of the attachments saved apart from the dump,
+	// relative to the directory of the dump
+	Attachments string `json:"attachments,omitempty"`
+	// Selection is the filter of the documents, the dump holds only a part of the
+	// database when it is set
+	Selection *Selection `json:"selection,omitempty"`
+}
+
+// Selection chooses the documents of a partial backup, a document is dumped when it
+// matches all the fields that are set.
+type Selection struct {
+	Selector  json.RawMessage `json:"selector,omitempty"`
+	IDPrefix  string          `json:"id_prefix,omitempty"`
+	Partition string          `json:"partition,omitempty"`
+}
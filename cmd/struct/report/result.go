@@ -0,0 +1,53 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package report
+
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+type DatabaseResult struct {
+	Operation   string         `json:"operation" yaml:"operation"`
+	Host        string         `json:"host" yaml:"host"`
+	Database    string         `json:"database" yaml:"database"`
+	File        string         `json:"file,omitempty" yaml:"file,omitempty"`
+	Status      string         `json:"status" yaml:"status"`
+	Documents   int            `json:"documents" yaml:"documents"`
+	Conflicts   int            `json:"conflicts,omitempty" yaml:"conflicts,omitempty"`
+	Deleted     int            `json:"deleted,omitempty" yaml:"deleted,omitempty"`
+	Attachments int            `json:"attachments,omitempty" yaml:"attachments,omitempty"`
+	Bytes       int64          `json:"bytes" yaml:"bytes"`
+	Duration    float64        `json:"duration_seconds" yaml:"duration_seconds"`
+	Error       string         `json:"error,omitempty" yaml:"error,omitempty"`
+	Stats       *DatabaseStats `json:"stats,omitempty" yaml:"stats,omitempty"`
+}
+
+// DatabaseStats are the figures of the CouchDB database info at the time of the operation.
+type DatabaseStats struct {
+	DocCount     int `json:"doc_count" yaml:"doc_count"`
+	DocDelCount  int `json:"doc_del_count" yaml:"doc_del_count"`
+	SizeFile     int `json:"size_file" yaml:"size_file"`
+	SizeExternal int `json:"size_external" yaml:"size_external"`
+	SizeActive   int `json:"size_active" yaml:"size_active"`
+}
+
+type DatabaseList struct {
+	Host      string   `json:"host" yaml:"host"`
+	Count     int      `json:"count" yaml:"count"`
+	Databases []string `json:"databases" yaml:"databases"`
+}
+
+// PruneResult is the outcome of the retention and of the garbage collection of a repository.
+type PruneResult struct {
+	Repository     string   `json:"repository" yaml:"repository"`
+	DryRun         bool     `json:"dry_run" yaml:"dry_run"`
+	RemovedBackups []string `json:"removed_backups" yaml:"removed_backups"`
+	KeptBackups    int      `json:"kept_backups" yaml:"kept_backups"`
+	RemovedBlobs   int      `json:"removed_blobs" yaml:"removed_blobs"`
+	FreedBytes     int64    `json:"freed_bytes" yaml:"freed_bytes"`
+	KeptBlobs      int      `json:"kept_blobs" yaml:"kept_blobs"`
+}
@@ -0,0 +1,25 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package report
+
+import "time"
+
+const (
+	RunOK      = "ok"
+	RunFailed  = "failed"
+	RunPartial = "partial"
+	RunAborted = "aborted"
+)
+
+type RunReport struct {
+	Command    string           `json:"command" yaml:"command"`
+	Status     string           `json:"status" yaml:"status"`
+	ExitCode   int              `json:"exit_code" yaml:"exit_code"`
+	Error      string           `json:"error,omitempty" yaml:"error,omitempty"`
+	StartedAt  time.Time        `json:"started_at" yaml:"started_at"`
+	FinishedAt time.Time        `json:"finished_at" yaml:"finished_at"`
+	Duration   float64          `json:"duration_seconds" yaml:"duration_seconds"`
+	Databases  []DatabaseResult `json:"databases" yaml:"databases"`
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+
+package repository
+
+import (
+	"time"
+)
+
+// Version of the repository format, increased when a file changes meaning.
+const Version = 1
+
+// Config is the config.json of a repository, written once by init. The chunker
+// parameters cannot change afterwards or the new chunks would not match the old ones.
+type Config struct {
+	Version     int       `json:"version"`
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	ChunkerSeed string    `json:"chunker_seed"`
+	MinChunk    int       `json:"min_chunk"`
+	AvgChunk    int       `json:"avg_chunk"`
+	MaxChunk    int       `json:"max_chunk"`
+	Compression string    `json:"compression"`
+}
+
+// Snapshot is a backup stored in the repository: the files of a dump or of a backup
+// directory, each one as the list of the chunks that make it up.
+type Snapshot struct {
+	ID        string    `json:"id" yaml:"id"`
+	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+	Hostname  string    `json:"hostname" yaml:"hostname"`
+	Source    string    `json:"source" yaml:"source"`
+	Tags      []string  `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Size      int64     `json:"size" yaml:"size"`
+	// Added is the size of the chunks stored by this snapshot, compressed
+	Added int64  `json:"added" yaml:"added"`
+	Files []File `json:"files,omitempty" yaml:"-"`
+}
+
+// File is a file of a snapshot, its path relative to the source with forward slashes.
+type File struct {
+	Path   string   `json:"path"`
+	Mode   uint32   `json:"mode"`
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// Index lists the chunks a snapshot added to the repository.
+type Index struct {
+	Snapshot string       `json:"snapshot"`
+	Chunks   []IndexEntry `json:"chunks"`
+}
+
+// IndexEntry is a chunk with its size before and after the compression.
+type IndexEntry struct {
+	ID     string `json:"id"`
+	Length int64  `json:"length"`
+	Stored int64  `json:"stored"`
+}
+
+// CheckResult is the outcome of the check of a repository.
+type CheckResult struct {
+	Repository string   `json:"repository" yaml:"repository"`
+	Snapshots  int      `json:"snapshots" yaml:"snapshots"`
+	Chunks     int      `json:"chunks" yaml:"chunks"`
+	ReadData   bool     `json:"read_data" yaml:"read_data"`
+	Unused     int      `json:"unused_chunks" yaml:"unused_chunks"`
+	Errors     []string `json:"errors" yaml:"errors"`
+}
@@ -0,0 +1,151 @@
+/*
+Copyright © 2025 Nicolò Piovan <nicopiovan@gmail.com>
+*/
+package cmd
+
+import (
+	"bufio"
+	"dbackupcli/cmd/commons"
+	"dbackupcli/cmd/scripts"
+	"dbackupcli/cmd/struct/report"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// undoRestoreCmd represents the undo-restore command
+var undoRestoreCmd = &cobra.Command{
+	Use:   "undo-restore <id>",
+	Short: "Puts back a safety snapshot taken before a restore",
+	Long:  `Puts back the safety snapshot taken by restore before overwriting a database.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tmpFile, err := scripts.GetEmbeddedScripts()
+		defer os.Remove(tmpFile)
+		if err != nil {
+			slog.Error("error preparing the restore script", "error", err)
+			return err
+		}
+
+		user, host, password, port := commons.GetAuthFlagValues(cmd)
+		safetyDir := commons.GetSafetyDir(cmd)
+		if commons.CheckFlags(append([]string{}, safetyDir, user, password)) {
+			return commons.MissingFlags("undo-restore")
+		}
+
+		snapshot, err := commons.LoadSafetySnapshot(safetyDir, args[0])
+		if err != nil {
+			slog.Error("error loading the safety snapshot", "snapshot", args[0], "error", err)
+			return err
+		}
+		settings, hasSettings, err := commons.LoadManifest(snapshot.File)
+		if err != nil {
+			slog.Error("error reading the database settings", "snapshot", args[0], "error", err)
+			return err
+		}
+		if host == "" {
+			host = snapshot.Host
+		}
+		if !cmd.Flags().Changed("port") {
+			port = snapshot.Port
+		}
+
+		lock, err := commons.LockDatabase(host, port, snapshot.Database)
+		if err != nil {
+			slog.Error("error locking the database", "db", snapshot.Database, "host", host, "error", err)
+			return err
+		}
+		defer lock.Release()
+
+		statusCode, Database, err := commons.GetDB(host, port, user, password, snapshot.Database)
+		if err != nil && statusCode != 404 {
+			slog.Error("error reading the database info", "db", snapshot.Database, "host", host, "error", err)
+			return err
+		}
+
+		protected := commons.GetPolicy(cmd).IsProtected(host, snapshot.Database)
+		if protected {
+			acknowledged, _ := cmd.Flags().GetStringSlice("i-know-what-im-doing")
+			if err := commons.ConfirmTypedName(snapshot.Database, acknowledged); err != nil {
+				slog.Error("undo-restore not confirmed", "db", snapshot.Database, "host", host, "error", err)
+				return err
+			}
+		}
+
+		if statusCode == 200 {
+			if !protected {
+				fmt.Fprintf(commons.Out, "Database %s currently contains %d documents. Do you want to replace it with snapshot %s (%d documents)? (y/n): ",
+					Database.DbName, Database.DocCount, snapshot.ID, snapshot.DocCount)
+				reader := bufio.NewReader(os.Stdin)
+				input, _ := reader.ReadString('\n')
+				input = strings.TrimSpace(input)
+
+				if input != "y" && input != "Y" {
+					return commons.UserAbort("operation canceled. The database will not be overwritten")
+				}
+			}
+			if err := commons.DeleteDatabase(host, port, user, password, snapshot.Database); err != nil {
+				slog.Error("error deleting the database", "db", snapshot.Database, "host", host, "phase", "delete", "error", err)
+				return err
+			}
+		}
+
+		result := report.DatabaseResult{Operation: "undo-restore", Host: host, Database: snapshot.Database, File: snapshot.File, Documents: snapshot.DocCount}
+		started := time.Now()
+		cmdArgs := commons.PrepareCmdAuthArgs([]string{"-r", "-d", snapshot.Database, "-f", snapshot.File, "-c"}, user, password, host, port)
+		if hasSettings {
+			err = createFromManifest(settings, host, port, user, password, snapshot.Database)
+		}
+		if err == nil {
+			err = commons.RunScript(cmd.Context(), tmpFile, cmdArgs)
+		}
+		if err == nil && hasSettings {
+			err = commons.ApplyManifest(host, port, user, password, snapshot.Database, settings)
+		}
+		if err == nil {
+			err = verifyRestore(&result, snapshot.File, host, port, user, password)
+		}
+		commons.FinishResult(&result, started, err)
+		commons.PrintResult(result, func() {
+			if err != nil {
+				fmt.Fprintln(commons.Out, "Error: ", err)
+			} else {
+				fmt.Fprintf(commons.Out, "Snapshot %s restored successfully!\n", snapshot.ID)
+			}
+		})
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(undoRestoreCmd)
+	undoRestoreCmd.SetUsageTemplate(`
+Usage: dbackupcli undo-restore <id> [flags]
+
+Flags:
+ -h, --help		Show this help message
+ --safety-dir		The directory containing the safety snapshots,
+				can also be set with the DBACKUPCLI_SAFETY_DIR environment variable
+ --i-know-what-im-doing	Confirm the replacement of a protected database without typing its name
+ -u, --user		The CouchDB username for the auth
+ -p, --password		The CouchDB password for the auth
+ --host			The host of the remote CouchDB, default is the one recorded in the snapshot
+ --port			The port of the remote CouchDB, default is the one recorded in the snapshot
+
+The id of the snapshot is printed by restore when the snapshot is taken.
+
+Examples:
+ dbackupcli undo-restore my-db-20250101-101500-3fa2c1 --safety-dir /var/backups/safety -u admin -p root
+`)
+	undoRestoreCmd.Flags().BoolP("help", "h", false, "Help message")
+	undoRestoreCmd.Flags().String("host", "", "The remote CouchDB host (Default: the one recorded in the snapshot)")
+	undoRestoreCmd.Flags().Int("port", 5984, "The remote CouchDB port (Default: the one recorded in the snapshot)")
+	undoRestoreCmd.Flags().String("safety-dir", "", "The directory containing the safety snapshots (Default: $DBACKUPCLI_SAFETY_DIR)")
+	undoRestoreCmd.Flags().StringSlice("i-know-what-im-doing", nil, "The name of the protected database to replace without prompting (Default: empty)")
+	undoRestoreCmd.Flags().StringP("user", "u", "", "The user to authenticate to the CouchDB (Default: empty)")
+	undoRestoreCmd.Flags().StringP("password", "p", "", "The password to authenticate to the CouchDB (Default: empty)")
+}